@@ -0,0 +1,327 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command eco-fixups manages the manual corrections of missions used by
+// eco-ingest and eco-mig: the transport modes of missions of the "Autres"
+// kind and the destinations of missions.
+//
+// Usage: eco-fixups [options] list|check|set|rm|edit
+//
+//	list   lists the unresolved missions of the source database
+//	check  validates the fixups files
+//	set    adds or updates the fixups of a mission (-id, -tid, -dest, -lat, -lng, -km, -comment)
+//	rm     removes the fixups of a mission (-id)
+//	edit   interactively fixes the unresolved missions of the source database
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-fixups"
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+var (
+	srcFlag  = flag.String("src", "", "path to a CSV, XLSX or JSON Lines file of missions (default: LPC MySQL database)")
+	mapFlag  = flag.String("mapping", "", "path to a JSON file mapping the columns of the source to the fields of missions")
+	credFlag = flag.String("passwd", "passwd", "path to the credentials of the source MySQL database")
+	pageFlag = flag.Int("page", 1000, "number of missions read per query from the source database")
+
+	fixupsTIDFlag  = flag.String("fixups-tid", "fixups.tid.json", "path to transport IDs fixups")
+	fixupsDestFlag = flag.String("fixups-dest", "fixups.dest.json", "path to destination fixups")
+	rulesFlag      = flag.String("rules", "", "path to the rules inferring the transport mode of \"Autres\" missions")
+
+	idFlag      = flag.Int("id", 0, "mission ID of the fixup to set or remove")
+	tidFlag     = flag.String("tid", "", "transport mode of the mission (e.g. train, car)")
+	destFlag    = flag.String("dest", "", "destination of the mission, as country///city///country")
+	latFlag     = flag.Float64("lat", 0, "latitude of the destination of the mission")
+	lngFlag     = flag.Float64("lng", 0, "longitude of the destination of the mission")
+	kmFlag      = flag.Float64("km", 0, "round-trip distance of the mission, in kilometers")
+	commentFlag = flag.String("comment", "", "comment of the fixup")
+)
+
+func main() {
+	log.SetPrefix("eco-fixups: ")
+	log.SetFlags(0)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: eco-fixups [options] list|check|set|rm|edit
+
+  list   lists the unresolved missions of the source database
+  check  validates the fixups files
+  set    adds or updates the fixups of a mission (-id, -tid, -dest, -lat, -lng, -km, -comment)
+  rm     removes the fixups of a mission (-id)
+  edit   interactively fixes the unresolved missions of the source database
+
+Options:
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		log.Fatalf("missing command")
+	}
+
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "list":
+		err = list(os.Stdout)
+	case "check":
+		err = check(os.Stdout)
+	case "set":
+		err = set()
+	case "rm":
+		err = rm()
+	case "edit":
+		err = edit(os.Stdin, os.Stdout)
+	default:
+		flag.Usage()
+		log.Fatalf("unknown command %q", cmd)
+	}
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+}
+
+// load loads the fixups files.
+// Missing files are created if create is true.
+func load(create bool) (ingest.Fixups, error) {
+	if create {
+		for _, name := range []string{*fixupsTIDFlag, *fixupsDestFlag} {
+			_, err := os.Stat(name)
+			if !errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			err = os.WriteFile(name, []byte("[]\n"), 0644)
+			if err != nil {
+				return ingest.Fixups{}, fmt.Errorf("could not create fixups file: %w", err)
+			}
+		}
+	}
+	return ingest.LoadFixups(*fixupsTIDFlag, *fixupsDestFlag)
+}
+
+func save(fx ingest.Fixups) error {
+	return fx.Save(*fixupsTIDFlag, *fixupsDestFlag)
+}
+
+func check(w io.Writer) error {
+	fx, err := load(false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "fixups: %d transport, %d destination\n", len(fx.TIDs), len(fx.Dests))
+	return nil
+}
+
+// unresolved returns the errors of the missions of the source database
+// that can be fixed: unknown transport modes and malformed destinations.
+// Missions of the "Autres" kind matched by a transport rule are resolved.
+func unresolved(fx ingest.Fixups) ([]*ingest.Error, error) {
+	src, err := ingest.OpenSource(*srcFlag, *mapFlag, *credFlag, *pageFlag)
+	if err != nil {
+		return nil, fmt.Errorf("could not open source database: %w", err)
+	}
+	defer src.Close()
+
+	opts := ingest.Options{Fixups: fx}
+	if *rulesFlag != "" {
+		opts.Rules, err = ingest.LoadRules(*rulesFlag)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pipe := ingest.NewPipeline(nil, opts)
+	ms, err := pipe.Read(src)
+	if err != nil {
+		return nil, fmt.Errorf("could not read source database: %w", err)
+	}
+
+	var errs []*ingest.Error
+	for _, e := range pipe.Report().Errors {
+		switch e.Kind {
+		case ingest.BadTransport, ingest.BadDestination:
+			errs = append(errs, e)
+		}
+	}
+
+	for id, legs := range ms.Legs {
+		if ms.Failed[id] || len(legs) == 0 {
+			continue
+		}
+		if f, ok := fx.Dest(id); ok && f.Lat != nil {
+			continue
+		}
+		_, err := pipe.Destination(pipe.Choose(legs))
+		var e *ingest.Error
+		if errors.As(err, &e) {
+			errs = append(errs, e)
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].ID < errs[j].ID
+	})
+	return errs, nil
+}
+
+func list(w io.Writer) error {
+	fx, err := load(false)
+	if err != nil {
+		return err
+	}
+
+	errs, err := unresolved(fx)
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		fmt.Fprintf(w, "%v\n", e)
+	}
+	fmt.Fprintf(w, "unresolved: %d\n", len(errs))
+	return nil
+}
+
+func set() error {
+	if *idFlag <= 0 {
+		return fmt.Errorf("invalid mission ID %d", *idFlag)
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	fx, err := load(true)
+	if err != nil {
+		return err
+	}
+
+	id := int32(*idFlag)
+	n := 0
+	if given["tid"] {
+		fx.SetTID(ingest.TIDFixup{ID: id, TID: *tidFlag, Comment: *commentFlag})
+		n++
+	}
+	if given["dest"] || given["lat"] || given["lng"] || given["km"] {
+		f, ok := fx.Dest(id)
+		if !ok {
+			f = ingest.DestFixup{ID: id}
+		}
+		if given["dest"] {
+			f.Dest = strings.Split(*destFlag, "///")
+		}
+		if given["lat"] {
+			f.Lat = float64p(*latFlag)
+		}
+		if given["lng"] {
+			f.Lng = float64p(*lngFlag)
+		}
+		if given["km"] {
+			f.Km = *kmFlag
+		}
+		if given["comment"] {
+			f.Comment = *commentFlag
+		}
+		fx.SetDest(f)
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no fixup to set for mission %d (use -tid, -dest, -lat, -lng or -km)", id)
+	}
+	return save(fx)
+}
+
+func rm() error {
+	fx, err := load(false)
+	if err != nil {
+		return err
+	}
+	if !fx.Remove(int32(*idFlag)) {
+		return fmt.Errorf("no fixup for mission %d", *idFlag)
+	}
+	return save(fx)
+}
+
+// edit prompts for the fixups of the unresolved missions.
+// Empty answers skip missions.
+func edit(r io.Reader, w io.Writer) error {
+	fx, err := load(true)
+	if err != nil {
+		return err
+	}
+
+	errs, err := unresolved(fx)
+	if err != nil {
+		return err
+	}
+
+	sc := bufio.NewScanner(r)
+	ask := func(prompt string) (string, bool) {
+		fmt.Fprint(w, prompt)
+		if !sc.Scan() {
+			return "", false
+		}
+		return strings.TrimSpace(sc.Text()), true
+	}
+
+loop:
+	for _, e := range errs {
+		fmt.Fprintf(w, "%v\n", e)
+		for {
+			switch e.Kind {
+			case ingest.BadTransport:
+				v, ok := ask("transport mode (e.g. train, car; empty to skip)? ")
+				if !ok {
+					break loop
+				}
+				if v == "" {
+					continue loop
+				}
+				if tid, err := eco.ParseTransID(v); err != nil || tid == eco.Unknown {
+					fmt.Fprintf(w, "invalid transport mode %q\n", v)
+					continue
+				}
+				fx.SetTID(ingest.TIDFixup{ID: e.ID, TID: v})
+
+			case ingest.BadDestination:
+				v, ok := ask("destination (country///city///country; empty to skip)? ")
+				if !ok {
+					break loop
+				}
+				if v == "" {
+					continue loop
+				}
+				f, ok := fx.Dest(e.ID)
+				if !ok {
+					f = ingest.DestFixup{ID: e.ID}
+				}
+				f.Dest = strings.Split(v, "///")
+				if err := (ingest.Fixups{Dests: []ingest.DestFixup{f}}).Validate(); err != nil {
+					fmt.Fprintf(w, "%v\n", err)
+					continue
+				}
+				fx.SetDest(f)
+			}
+			continue loop
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("could not read answers: %w", err)
+	}
+
+	return save(fx)
+}
+
+func float64p(v float64) *float64 { return &v }
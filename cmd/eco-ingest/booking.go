@@ -0,0 +1,63 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+// readBookings reads the bookings of a comma-separated list of
+// travel-agency statements (or glob patterns of statements).
+func readBookings(names, mapping string) ([]ingest.Booking, error) {
+	var m ingest.Mapping
+	if mapping != "" {
+		var err error
+		m, err = ingest.LoadMapping(mapping)
+		if err != nil {
+			return nil, fmt.Errorf("could not load bookings mapping: %w", err)
+		}
+	}
+
+	var bks []ingest.Booking
+	for _, pattern := range strings.Split(names, ",") {
+		fnames, err := filepath.Glob(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid statements pattern %q: %w", pattern, err)
+		}
+		if len(fnames) == 0 {
+			return nil, fmt.Errorf("no statement matching %q", pattern)
+		}
+		for _, fname := range fnames {
+			vs, err := ingest.ReadBookings(fname, m)
+			if err != nil {
+				return nil, fmt.Errorf("could not read statement: %w", err)
+			}
+			bks = append(bks, vs...)
+		}
+	}
+	return bks, nil
+}
+
+// reportBookings writes a human readable report of the bookings that could
+// not be matched with a mission, for review.
+func reportBookings(w io.Writer, unmatched []ingest.Unmatched) {
+	for _, u := range unmatched {
+		switch len(u.Missions) {
+		case 0:
+			fmt.Fprintf(w, "booking %v: unmatched\n", u.Booking)
+		default:
+			ids := make([]string, len(u.Missions))
+			for i, id := range u.Missions {
+				ids[i] = fmt.Sprintf("%d", id)
+			}
+			fmt.Fprintf(w, "booking %v: ambiguous (missions %s)\n", u.Booking, strings.Join(ids, ", "))
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+func TestReportBookings(t *testing.T) {
+	date := func(v string) time.Time { t, _ := time.Parse(timefmtJourney, v); return t }
+	var (
+		t1 = ingest.Booking{Ref: "T1", Date: date("2019-11-02"), Origin: "Clermont-Ferrand", Dest: "Lyon Part-Dieu", Mode: eco.Train, Fare: -1}
+		t2 = ingest.Booking{Ref: "T2", Date: date("2020-01-02"), Origin: "Clermont-Ferrand", Dest: "Lyon Part-Dieu", Mode: eco.Train, Fare: -1}
+	)
+
+	out := new(strings.Builder)
+	reportBookings(out, []ingest.Unmatched{
+		{Booking: t1, Missions: []int32{2, 3}},
+		{Booking: t2},
+	})
+	if got, want := out.String(), strings.Join([]string{
+		`booking 2019-11-02 train Clermont-Ferrand -> Lyon Part-Dieu (ref="T1", traveller="", class=""): ambiguous (missions 2, 3)`,
+		`booking 2020-01-02 train Clermont-Ferrand -> Lyon Part-Dieu (ref="T2", traveller="", class=""): unmatched`,
+		"",
+	}, "\n"); got != want {
+		t.Fatalf("invalid report:\ngot= %q\nwant=%q", got, want)
+	}
+}
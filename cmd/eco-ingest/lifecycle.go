@@ -0,0 +1,77 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
+
+import (
+	"sort"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+// change is a change of a mission in the source database.
+type change struct {
+	rev    eco.Revision
+	legs   []ingest.Record // legs of the mission in the source database
+	update bool            // whether the content of the mission must be (re)processed
+}
+
+// changes returns the changes of the missions of the source database
+// with respect to the missions known to eco-srv, sorted by mission ID.
+//
+//   - missions unknown to eco-srv are registered,
+//   - known missions with a different hash are modified,
+//   - known missions without a hash have their hash recorded,
+//   - known missions whose rows are all rejected are rejected,
+//   - known missions absent from the source database are cancelled,
+//   - missions with errors are left untouched.
+//
+// Cancelled or rejected missions that reappear in the source database are
+// modified.
+func changes(known map[int32]eco.Lifecycle, src *ingest.Missions) []change {
+	var chs []change
+	for id, ds := range src.Digests {
+		var (
+			hash   = ingest.Hash(ds)
+			lc, ok = known[id]
+			ch     = change{
+				rev:  eco.Revision{ID: id, Hash: hash},
+				legs: src.Legs[id],
+			}
+		)
+		switch {
+		case src.Failed[id]:
+			continue
+		case !src.Accepted[id]:
+			if !ok || !lc.Status.Active() {
+				continue
+			}
+			ch.rev.Status = eco.Rejected
+		case !ok:
+			ch.rev.Status = eco.Registered
+			ch.update = true
+		case !lc.Status.Active() || (lc.Hash != "" && lc.Hash != hash):
+			ch.rev.Status = eco.Modified
+			ch.update = true
+		case lc.Hash == "":
+			ch.rev.Status = eco.Registered
+		default:
+			continue
+		}
+		chs = append(chs, ch)
+	}
+
+	for id, lc := range known {
+		if _, ok := src.Digests[id]; ok || src.Failed[id] || !lc.Status.Active() {
+			continue
+		}
+		chs = append(chs, change{rev: eco.Revision{ID: id, Status: eco.Cancelled}})
+	}
+
+	sort.Slice(chs, func(i, j int) bool {
+		return chs[i].rev.ID < chs[j].rev.ID
+	})
+	return chs
+}
@@ -5,41 +5,51 @@
 package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
 
 import (
-	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"reflect"
-	"sort"
-	"strconv"
-	"strings"
-	"time"
 
 	"github.com/sbinet-lpc/eco"
-	"github.com/sbinet-lpc/eco/geo"
-	"github.com/sbinet-lpc/eco/osm"
+	"github.com/sbinet-lpc/eco/ingest"
 )
 
 const (
-	timefmtMission = "2006-01-02 15:04:05"
 	timefmtJourney = "2006-01-02"
 )
 
 var (
-	clermont = geo.Point{Lat: 45.7774551, Lng: 3.0819427}
-
-	addrFlag = flag.String("addr", ":80", "address to eco-srv")
+	addrFlag = flag.String("addr", ":80", "[scheme://]host[:port] address of eco-srv")
 	idFlag   = flag.Int("id", 0, "enable verbose mode for a specific mission ID")
 	dbgFlag  = flag.Bool("v", false, "enable verbose mode")
-	dryFlag  = flag.Bool("dry", false, "enable dry mode (do not commit to eco-DB)")
+	dryFlag  = flag.Bool("dry", false, "enable dry mode (do not commit to eco-DB, print the plan of the changes)")
+	planFlag = flag.String("plan", "", "path to the JSON plan of the changes, in dry mode")
+	pageFlag = flag.Int("page", 1000, "number of missions read per query from the source database")
+	srcFlag  = flag.String("src", "", "path to a CSV, XLSX or JSON Lines file of missions (default: LPC MySQL database)")
+	mapFlag  = flag.String("mapping", "", "path to a JSON file mapping the columns of the source to the fields of missions")
+	credFlag = flag.String("passwd", "passwd", "path to the credentials of the source MySQL database")
+
+	bookFlag    = flag.String("bookings", "", "comma-separated list of travel-agency statements (CSV or XLSX files, glob patterns allowed)")
+	bookMapFlag = flag.String("bookings-mapping", "", "path to a JSON file mapping the columns of the statements to the fields of bookings")
+
+	reconcileFlag = flag.Bool("reconcile", false, "enable reconcile mode (report differences between the source database and eco-DB)")
+	applyFlag     = flag.Bool("apply", false, "apply the fixes found in reconcile mode")
+
+	tokenFlag   = flag.String("token-file", "", "path to file holding the eco-srv API token (default: $ECO_TOKEN)")
+	batchFlag   = flag.Int("batch", 500, "maximum number of revisions per upload batch")
+	retriesFlag = flag.Int("retries", 3, "number of retries of a failed upload batch")
 
 	fixupsTIDFlag  = flag.String("fixups-tid", "fixups.tid.json", "path to transport IDs fixups")
 	fixupsDestFlag = flag.String("fixups-dest", "fixups.dest.json", "path to destination fixups")
+	othersFlag     = flag.String("others", "car", "transport mode of \"Autres\" missions without a TID fixup nor a matching rule (empty: reject them)")
+	rulesFlag      = flag.String("rules", "", "path to the rules inferring the transport mode of \"Autres\" missions")
 
-	fixupTIDs map[int32]eco.TransID
+	reportFlag    = flag.String("report", "", "path to the JSON report of the errors of missions")
+	maxFailedFlag = flag.Int("max-failed", 0, "maximum number of failed missions before exiting with an error (negative: no limit)")
+	maxRateFlag   = flag.Float64("max-failed-rate", 0, "maximum fraction of failed missions before exiting with an error (0: no limit)")
 )
 
 func main() {
@@ -48,507 +58,257 @@ func main() {
 
 	flag.Parse()
 
-	lastID, err := getLastID(*addrFlag)
+	tok, err := ingest.APIToken(*tokenFlag)
 	if err != nil {
-		log.Fatalf("could not retrieve last mission id: %+v", err)
+		log.Fatalf("could not read API token: %+v", err)
 	}
 
-	fixupTIDs, err = loadTIDs(*fixupsTIDFlag)
+	known, err := getLifecycles(*addrFlag, tok)
 	if err != nil {
-		log.Fatalf("could not load TIDs db: %+v", err)
+		log.Fatalf("could not retrieve lifecycle of missions: %+v", err)
 	}
 
-	c, err := readCredentials()
+	opts, err := options()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("could not configure pipeline: %+v", err)
 	}
-
-	db, err := sql.Open("mysql", c.Conn())
-	if err != nil {
-		log.Fatal(err)
+	sink := ingest.HTTPSink{
+		Addr:         *addrFlag,
+		Token:        tok,
+		MaxRevisions: *batchFlag,
+		Retries:      *retriesFlag,
+		// the fixes of reconcile mode are applied all at once, or not at all.
+		Single: *reconcileFlag,
 	}
-	defer db.Close()
+	pipe := ingest.NewPipeline(sink, opts)
 
-	err = db.Ping()
+	ms, err := ingest.OpenSource(*srcFlag, *mapFlag, *credFlag, *pageFlag)
 	if err != nil {
-		log.Fatalf("could not ping db: %+v", err)
+		log.Fatalf("could not open source database: %+v", err)
 	}
+	defer ms.Close()
 
-	// FIXME(sbinet): use a WHERE clause with ID_MISSION > lastID
-	rows, err := db.Query("select * from view_mission order by ID_MISSION")
+	// scan all the missions: changes to already stored missions are
+	// detected from the hash of their content.
+	src, err := pipe.Read(ms)
 	if err != nil {
-		log.Fatalf("could not select: %+v", err)
+		log.Fatalf("could not read source database: %+v", err)
 	}
-	defer rows.Close()
-
-	var (
-		invalid  int64
-		missions = make(map[int32][]Mission)
-		allgood  = true
-	)
-	for rows.Next() {
-		if rows.Err() != nil {
-			break
-		}
-		var m RawMission
-		err = rows.Scan(
-			&m.ID, &m.Date, &m.Org, &m.Group,
-			&m.Departure,
-			&m.Destination,
-			&m.Object,
-			&m.Type,
-			&m.Transport.Name,
-			&m.Outbound.Date,
-			&m.Outbound.Start,
-			&m.Outbound.Stop,
-			&m.Inbound.Date,
-			&m.Inbound.Start,
-			&m.Inbound.Stop,
-			&m.Comment,
-			&m.Valid,
-			&m.Cost,
-			&m.Residence.Familiale,
-			&m.Residence.Return,
-			&m.Housing,
-			&m.Transport.ID,
-			&m.Transport.Label,
-		)
-		if err != nil {
-			log.Fatalf("could not scan row: %+v", err)
-		}
+	if len(src.Digests) == 0 {
+		// do not cancel all the known missions.
+		log.Fatalf("no mission in source database")
+	}
+	log.Printf("missions:   %d", len(src.Legs))
+	log.Printf("invalid:    %d", src.Invalid)
 
-		if *idFlag == int(m.ID) {
-			log.Printf(
-				"id=%d, org=%q, grp=%q mission:%q transport:%d|%s valid=%d comment=%q",
-				m.ID, m.Org, m.Group, m.Destination, m.Transport.ID, m.Transport.Label,
-				m.Valid, m.Comment,
-			)
+	dups := 0
+	for id := range src.Legs {
+		if len(src.Legs[id]) > 1 {
+			dups++
 		}
+	}
+	log.Printf("multi-legs: %d", dups)
 
-		if m.ID <= lastID {
-			continue
+	if *bookFlag != "" {
+		bks, err := readBookings(*bookFlag, *bookMapFlag)
+		if err != nil {
+			log.Fatalf("could not read bookings: %+v", err)
 		}
+		unmatched := src.Book(bks)
+		reportBookings(os.Stdout, unmatched)
+		log.Printf("bookings:   %d (unmatched: %d)", len(bks), len(unmatched))
+	}
 
-		mm, ok := m.ToMission()
-		if !ok {
-			allgood = false
-			invalid++
-			log.Printf(
-				"INVALID mission: id=%d, org=%q, grp=%q mission:%q transport:%d|%s valid=%d comment=%q (date=%v -> %v)",
-				m.ID, m.Org, m.Group, m.Destination, m.Transport.ID, m.Transport.Label,
-				m.Valid, m.Comment,
-				string(m.Outbound.Date),
-				string(m.Inbound.Date),
-			)
-			continue
+	var chs []change
+	switch {
+	case *reconcileFlag:
+		stored, err := getMissions(*addrFlag, tok)
+		if err != nil {
+			log.Fatalf("could not retrieve stored missions: %+v", err)
 		}
-
-		if !mm.isValid() {
-			invalid++
-			continue
+		ds := diffs(pipe, src, stored, known)
+		report(os.Stdout, ds)
+		if !*applyFlag {
+			return
 		}
-
-		missions[mm.ID] = append(missions[mm.ID], mm)
+		chs = fixes(src, ds)
+	default:
+		chs = changes(known, src)
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Fatalf("could not iterate over select result: %+v", err)
-	}
-	log.Printf("missions:   %d", len(missions))
-	log.Printf("invalid:    %d", invalid)
-	if !allgood {
-		log.Fatalf("could not handle at least one mission. check TIDs")
+	cnt := make(map[eco.Status]int)
+	for _, ch := range chs {
+		cnt[ch.rev.Status]++
 	}
+	log.Printf("new:        %d", cnt[eco.Registered])
+	log.Printf("modified:   %d", cnt[eco.Modified])
+	log.Printf("cancelled:  %d", cnt[eco.Cancelled])
+	log.Printf("rejected:   %d", cnt[eco.Rejected])
+	log.Printf("failed:     %d", len(src.Failed))
 
-	dups := 0
-	mids := make([]int32, 0, len(missions))
-	for id := range missions {
-		mids = append(mids, id)
-		if len(missions[id]) > 1 {
-			dups++
+	for _, ch := range chs {
+		if !ch.update {
+			pipe.Add(ch.rev)
+			continue
 		}
-	}
-
-	sort.Slice(mids, func(i, j int) bool {
-		return mids[i] < mids[j]
-	})
-	log.Printf("multi-legs: %d", dups)
-
-	if len(mids) == 0 {
-		log.Printf("no new mission to process")
-		return
-	}
 
-	proc, err := newProcessor(*fixupsDestFlag)
-	if err != nil {
-		log.Fatalf("could not create processor: %+v", err)
+		// errors are reported: carry on with the other missions.
+		_ = pipe.Revise(ch.rev, ch.legs, src.Bookings[ch.rev.ID])
 	}
 
-	for _, id := range mids {
-		m := chooseMission(missions[id])
-		if *dbgFlag {
-			log.Printf(
-				"id=%d transport=%v, date=%s dest=%v",
-				m.ID,
-				m.Transport.Label,
-				m.Outbound.Date.Format(timefmtJourney),
-				m.Destination,
-			)
+	switch {
+	case *dryFlag:
+		log.Printf("dry mode enabled: no upload to %q eco-srv", *addrFlag)
+		err = dryRun(pipe, tok)
+		if err != nil {
+			log.Fatalf("could not plan changes: %+v", err)
 		}
-
-		err := proc.Process(m)
+	case len(pipe.Revisions()) == 0:
+		log.Printf("no mission to update")
+	default:
+		err = pipe.Flush()
 		if err != nil {
-			log.Printf("could not process id=%d: %+v", id, err)
-			allgood = false
-			break
+			log.Fatalf("could not upload missions: %+v", err)
 		}
 	}
 
-	if *dryFlag {
-		log.Printf("dry mode enabled: no upload to %q eco-srv", *addrFlag)
-		return
-	}
-
-	err = proc.upload(*addrFlag)
+	err = checkReport(pipe.Report())
 	if err != nil {
-		log.Fatalf("could not upload new missions: %+v", err)
-	}
-
-	if !allgood {
-		log.Fatalf("an error occurred during processing")
+		log.Fatalf("%+v", err)
 	}
 }
 
-const (
-	idAvion int32 = iota + 1
-	idBus
-	idPassager
-	idTrain
-	idVoitureAdm
-	idVoitureLoc
-	idVoiturePers
-	idAutres
-)
-
-type RawMission struct {
-	ID          int32
-	Date        []byte       // when was the mission drafted
-	Org         sql.RawBytes // funding organization
-	Group       sql.RawBytes // group funding the mission
-	Departure   sql.RawBytes
-	Destination sql.RawBytes
-	Object      sql.RawBytes
-	Type        int16
-	Transport   struct {
-		Name  sql.RawBytes
-		ID    int32
-		Label sql.RawBytes
-	}
-	Outbound  RawJourney
-	Inbound   RawJourney
-	Comment   sql.RawBytes
-	Valid     int16
-	Cost      sql.NullFloat64
-	Residence struct {
-		Familiale int8
-		Return    sql.NullInt64
-	}
-	Housing sql.RawBytes
-}
-
-func (raw RawMission) ToMission() (Mission, bool) {
-	date, err := time.Parse(timefmtMission, string(raw.Date))
+// dryRun prints the plan of the changes that would be written to eco-srv
+// and writes it as JSON, if requested.
+func dryRun(pipe *ingest.Pipeline, tok string) error {
+	stored, err := getMissions(*addrFlag, tok)
 	if err != nil {
-		panic(err)
-	}
-	out := Mission{
-		ID:          raw.ID,
-		Date:        date.UTC(),
-		Org:         string(raw.Org),
-		Group:       string(raw.Group),
-		Departure:   string(raw.Departure),
-		Destination: string(raw.Destination),
-		Object:      string(raw.Object),
-		Type:        raw.Type,
-		Outbound:    raw.Outbound.ToJourney(),
-		Inbound:     raw.Inbound.ToJourney(),
-		Comment:     string(raw.Comment),
-		Valid:       raw.Valid,
-		Cost:        -1,
-		Housing:     string(raw.Housing),
-	}
-	out.Transport.Name = string(raw.Transport.Name)
-	out.Transport.ID = raw.Transport.ID
-	out.Transport.Label = string(raw.Transport.Label)
-	if raw.Cost.Valid {
-		out.Cost = raw.Cost.Float64
-	}
-	out.Residence.Familiale = raw.Residence.Familiale
-	out.Residence.Return = -1
-	if raw.Residence.Return.Valid {
-		out.Residence.Return = raw.Residence.Return.Int64
-	}
-
-	if ok := out.checkTID(); !ok {
-		return Mission{}, ok
+		return fmt.Errorf("could not retrieve stored missions: %w", err)
 	}
 
-	return out, true
-}
+	p := newPlan(pipe.Revisions(), stored, pipe.Report())
+	p.print(os.Stdout)
 
-type Mission struct {
-	ID          int32
-	Date        time.Time // when was the mission drafted
-	Org         string    // funding organization
-	Group       string    // group funding the mission
-	Departure   string
-	Destination string
-	Object      string
-	Type        int16
-	Transport   struct {
-		Name  string
-		ID    int32
-		Label string
+	if *planFlag == "" {
+		return nil
 	}
-	Outbound  Journey
-	Inbound   Journey
-	Comment   string
-	Valid     int16
-	Cost      float64
-	Residence struct {
-		Familiale int8
-		Return    int64
-	}
-	Housing string
-}
 
-func (m Mission) isValid() bool {
-	switch m.Valid {
-	case 4:
-		// rejected by manager
-		return false
-	case 5:
-		// rejected by funder
-		return false
-	case 6:
-		// accepted by funder, rejected by manager
-		return false
-	case 7:
-		// accepted by manager, rejected by funder
-		return false
-	case 8:
-		// rejected by manager & funder
-		return false
+	f, err := os.Create(*planFlag)
+	if err != nil {
+		return fmt.Errorf("could not create plan file: %w", err)
 	}
-	return true
-}
+	defer f.Close()
 
-func (m Mission) TransID() eco.TransID {
-	var id eco.TransID
-	switch tid := m.Transport.ID; tid {
-	case idAvion:
-		id = eco.Plane
-	case idBus:
-		id = eco.Bus
-	case idPassager:
-		// free. cost already reported on somebody else
-		id = eco.Passenger
-	case idTrain:
-		id = eco.Train
-	case idVoitureAdm, idVoitureLoc, idVoiturePers:
-		id = eco.Car
-	case idAutres:
-		id = fixupTID(m)
+	err = p.writeJSON(f)
+	if err != nil {
+		return fmt.Errorf("could not write plan: %w", err)
 	}
 
-	return id
-}
-
-func (m Mission) checkTID() bool {
-	switch tid := m.Transport.ID; tid {
-	default:
-		return true
-	case idAutres:
-		_, ok := fixupTIDs[m.ID]
-		return ok
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not save plan: %w", err)
 	}
+	return nil
 }
 
-func chooseMission(ms []Mission) Mission {
-	if len(ms) == 1 {
-		return ms[0]
-	}
-
-	if *dbgFlag {
-		log.Printf("=== missions %d === (n=%d)", ms[0].ID, len(ms))
-		for _, m := range ms {
-			log.Printf("transport=%s, destination=%s", m.Transport.Label, m.Destination)
+// checkReport writes the report of the errors of the missions and checks
+// it against the configured thresholds.
+func checkReport(r *ingest.Report) error {
+	if *reportFlag != "" {
+		f, err := os.Create(*reportFlag)
+		if err != nil {
+			return fmt.Errorf("could not create report file: %w", err)
 		}
-	}
+		defer f.Close()
 
-	costs := make([]eco.TransID, len(ms))
-	for i, m := range ms {
-		costs[i] = m.TransID()
-	}
-	switch {
-	case reflect.DeepEqual(costs, []eco.TransID{eco.Train, eco.Bus}):
-		return ms[0]
-	case reflect.DeepEqual(costs, []eco.TransID{eco.Bus, eco.Train}):
-		return ms[1]
-	}
+		err = r.WriteJSON(f)
+		if err != nil {
+			return fmt.Errorf("could not write report: %w", err)
+		}
 
-	var (
-		cost = ms[0].TransID()
-		j    = 0
-	)
-	for i := range costs {
-		if !eco.CostLess(costs[i], cost) {
-			cost = costs[i]
-			j = i
+		err = f.Close()
+		if err != nil {
+			return fmt.Errorf("could not save report: %w", err)
 		}
 	}
-	return ms[j]
-}
 
-type RawJourney struct {
-	Date  []byte
-	Start sql.RawBytes // starting point of the journey
-	Stop  sql.RawBytes // destination of the journey
+	r.Summary(log.Writer())
+	return r.Check(ingest.Thresholds{
+		MaxFailed: *maxFailedFlag,
+		MaxRate:   *maxRateFlag,
+	})
 }
 
-func (raw RawJourney) ToJourney() Journey {
-	date, err := time.Parse(timefmtJourney, string(raw.Date))
-	if err != nil {
-		panic(err)
-	}
-
-	return Journey{
-		Date:  date.UTC(),
-		Start: string(raw.Start),
-		Stop:  string(raw.Stop),
+// options returns the options of the pipeline, from the command line flags.
+func options() (ingest.Options, error) {
+	opts := ingest.Options{
+		Trace:   int32(*idFlag),
+		Verbose: *dbgFlag,
 	}
-}
 
-type Journey struct {
-	Date  time.Time
-	Start string // Hour of departure
-	Stop  string // Hour of arrival
-}
-
-type cred struct {
-	User  string `json:"user"`
-	Pwd   string `json:"password"`
-	Host  string `json:"host"`
-	DB    string `json:"db"`
-	Table string `json:"table"`
-}
-
-type OSMReq struct {
-	Mission Mission     `json:"mission"`
-	Places  []osm.Place `json:"places"`
-}
-
-func (req OSMReq) LatLng() (float64, float64) {
-	loc := req.Places[0]
-
-	lat, err := strconv.ParseFloat(loc.Lat, 64)
+	var err error
+	opts.Fixups, err = ingest.LoadFixups(*fixupsTIDFlag, *fixupsDestFlag)
 	if err != nil {
-		panic(fmt.Errorf("could not convert latitude: %w", err))
+		return opts, err
 	}
-	lng, err := strconv.ParseFloat(loc.Lng, 64)
-	if err != nil {
-		panic(fmt.Errorf("could not convert longitude: %w", err))
-	}
-	return lat, lng
-}
 
-func readCredentials() (cred, error) {
-	var v cred
-	f, err := os.Open("passwd")
-	if err != nil {
-		return v, fmt.Errorf("could not open credentials file: %w", err)
+	if *rulesFlag != "" {
+		opts.Rules, err = ingest.LoadRules(*rulesFlag)
+		if err != nil {
+			return opts, err
+		}
 	}
-	defer f.Close()
 
-	err = json.NewDecoder(f).Decode(&v)
-	if err != nil {
-		return v, fmt.Errorf("could not decode credentials file content: %w", err)
+	if *othersFlag != "" {
+		opts.Others, err = eco.ParseTransID(*othersFlag)
+		if err != nil {
+			return opts, fmt.Errorf("invalid transport mode for \"Autres\" missions: %w", err)
+		}
 	}
-
-	return v, nil
-}
-
-func (c cred) Conn() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:3306)/%s", c.User, c.Pwd, c.Host, c.DB)
+	return opts, nil
 }
 
-func getLastID(addr string) (int32, error) {
-	if strings.HasPrefix(addr, ":") {
-		addr = "localhost" + addr
-	}
-	url := fmt.Sprintf("http://%s/api/last-id", addr)
-	resp, err := http.Get(url)
+// getLifecycles returns the lifecycle of all the missions known to eco-srv.
+func getLifecycles(addr, tok string) (map[int32]eco.Lifecycle, error) {
+	req, err := newRequest(http.MethodGet, ingest.URL(addr, "/api/lifecycle"), tok, nil)
 	if err != nil {
-		return 0, fmt.Errorf("could not GET last-id: %w", err)
+		return nil, fmt.Errorf("could not create GET request to eco-srv: %w", err)
 	}
-	defer resp.Body.Close()
 
-	var raw struct {
-		ID int32 `json:"id"`
-	}
-	err = json.NewDecoder(resp.Body).Decode(&raw)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("could not decode last-id response: %w", err)
+		return nil, fmt.Errorf("could not GET lifecycle: %w", err)
 	}
+	defer resp.Body.Close()
 
-	return raw.ID, nil
-}
-
-func fixupTID(m Mission) eco.TransID {
-	tid, ok := fixupTIDs[m.ID]
-	if !ok {
-		panic(fmt.Errorf("invalid mission-id=%d, (tid=%d|%v) comment=%q", m.ID, m.Transport.ID, m.Transport.Label, m.Comment))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received an invalid status from eco-srv: %s (code=%d)",
+			resp.Status, resp.StatusCode,
+		)
 	}
-	return tid
-}
 
-func loadTIDs(name string) (map[int32]eco.TransID, error) {
-	f, err := os.Open(name)
+	var lcs []eco.Lifecycle
+	err = json.NewDecoder(resp.Body).Decode(&lcs)
 	if err != nil {
-		return nil, fmt.Errorf("could not open tid db file: %w", err)
+		return nil, fmt.Errorf("could not decode lifecycle response: %w", err)
 	}
-	defer f.Close()
 
-	var raw []struct {
-		ID  int32  `json:"id"`
-		TID string `json:"tid"`
-	}
-	err = json.NewDecoder(f).Decode(&raw)
-	if err != nil {
-		return nil, fmt.Errorf("could not decode tid db file: %w", err)
+	db := make(map[int32]eco.Lifecycle, len(lcs))
+	for _, lc := range lcs {
+		db[lc.ID] = lc
 	}
+	return db, nil
+}
 
-	db := make(map[int32]eco.TransID, len(raw))
-	tids := make(map[string]eco.TransID)
-	for _, tid := range []eco.TransID{
-		eco.Bike,
-		eco.Tramway,
-		eco.Train,
-		eco.Bus,
-		eco.Passenger,
-		eco.Car,
-		eco.Plane,
-	} {
-		tids[tid.String()] = tid
+// newRequest creates a new HTTP request to eco-srv, authenticated with
+// the provided API token, if any.
+func newRequest(method, url, tok string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
 	}
-
-	for _, v := range raw {
-		tid, ok := tids[v.TID]
-		if !ok {
-			return nil, fmt.Errorf("could not find eco.TransID corresponding to %q", v.TID)
-		}
-		db[v.ID] = tid
+	if tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
 	}
-
-	return db, nil
+	return req, nil
 }
@@ -0,0 +1,190 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+// Kinds of planned changes.
+const (
+	planNew       = "new"       // mission registered in eco-srv
+	planChanged   = "changed"   // stored mission modified
+	planCancelled = "cancelled" // stored mission cancelled
+	planRejected  = "rejected"  // stored mission rejected
+	planHash      = "hash"      // hash of a stored mission recorded
+)
+
+// plan is what a run would write to eco-srv: the revisions of missions,
+// the missions skipped because of errors and the resulting change of the
+// CO2e emissions per transport mode.
+type plan struct {
+	Missions []planned          `json:"missions"`
+	Skipped  []*ingest.Error    `json:"skipped"`
+	Delta    map[string]float64 `json:"co2e_delta"` // kgCO2e per transport mode
+}
+
+// planned is the planned change of a mission.
+type planned struct {
+	ID      int32        `json:"id"`
+	Kind    string       `json:"kind"`
+	Fields  []string     `json:"fields,omitempty"`  // changed fields, as "name: stored -> new"
+	Mission *eco.Mission `json:"mission,omitempty"` // new content of the mission
+	Stored  *eco.Mission `json:"stored,omitempty"`  // stored content of the mission
+	CO2e    float64      `json:"co2e_delta"`        // in kgCO2e
+}
+
+// newPlan returns the plan of the revisions of missions, with respect to
+// the missions stored in eco-srv.
+func newPlan(revs []eco.Revision, stored map[int32]eco.Mission, r *ingest.Report) plan {
+	p := plan{
+		Missions: make([]planned, 0, len(revs)),
+		Skipped:  append([]*ingest.Error{}, r.Errors...),
+		Delta:    make(map[string]float64),
+	}
+	cost := func(m eco.Mission, sign float64) float64 {
+		v := sign * eco.CostOf(m.Trans, m.Dist)
+		p.Delta[m.Trans.String()] += v
+		return v
+	}
+
+	for _, rev := range revs {
+		pm := planned{ID: rev.ID, Mission: rev.Mission}
+		if s, ok := stored[rev.ID]; ok {
+			s := s
+			pm.Stored = &s
+		}
+
+		switch rev.Status {
+		case eco.Registered:
+			pm.Kind = planNew
+			if rev.Mission == nil {
+				pm.Kind = planHash
+			}
+		case eco.Modified:
+			pm.Kind = planChanged
+		case eco.Cancelled:
+			pm.Kind = planCancelled
+		case eco.Rejected:
+			pm.Kind = planRejected
+		}
+
+		if pm.Stored != nil && (rev.Mission != nil || !rev.Status.Active()) {
+			pm.CO2e += cost(*pm.Stored, -1)
+		}
+		if rev.Mission != nil {
+			pm.CO2e += cost(*rev.Mission, +1)
+			if pm.Stored != nil {
+				pm.Fields = fields(*pm.Stored, *rev.Mission)
+			}
+		}
+		p.Missions = append(p.Missions, pm)
+	}
+
+	sort.Slice(p.Missions, func(i, j int) bool {
+		return p.Missions[i].ID < p.Missions[j].ID
+	})
+	sort.SliceStable(p.Skipped, func(i, j int) bool {
+		return p.Skipped[i].ID < p.Skipped[j].ID
+	})
+	return p
+}
+
+// fields returns the fields of a stored mission changed by its new content.
+func fields(old, cur eco.Mission) []string {
+	var fs []string
+	cmp := func(name string, got, want interface{}) {
+		if got != want {
+			fs = append(fs, fmt.Sprintf("%s: %v -> %v", name, got, want))
+		}
+	}
+	cmp("date", old.Date.Format(timefmtJourney), cur.Date.Format(timefmtJourney))
+	cmp("inbound", old.Inbound.Format(timefmtJourney), cur.Inbound.Format(timefmtJourney))
+	cmp("dest", old.Dest.Name, cur.Dest.Name)
+	cmp("dist", km(old.Dist), km(cur.Dist))
+	cmp("transport", old.Trans, cur.Trans)
+	cmp("group", old.Group, cur.Group)
+	cmp("legs", len(old.Legs), len(cur.Legs))
+	return fs
+}
+
+func km(dist float64) string {
+	return fmt.Sprintf("%.0fkm", dist/1000)
+}
+
+// writeJSON writes the plan as JSON.
+func (p plan) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// print writes a human readable version of the plan.
+func (p plan) print(w io.Writer) {
+	cnt := make(map[string]int)
+	for _, pm := range p.Missions {
+		cnt[pm.Kind]++
+		switch {
+		case pm.Mission != nil:
+			m := pm.Mission
+			fmt.Fprintf(w, "mission %d: %s %s -> %s (%s), %s, %v",
+				pm.ID, pm.Kind, m.Date.Format(timefmtJourney),
+				m.Dest.Name, place(m.Dest), km(m.Dist), m.Trans,
+			)
+			if m.TransReason != "" {
+				fmt.Fprintf(w, " [%s]", m.TransReason)
+			}
+			fmt.Fprintf(w, ", %+.1f kgCO2e\n", pm.CO2e)
+			for _, leg := range m.Legs {
+				fmt.Fprintf(w, "\tleg: %s -> %s, %s, %v\n", leg.Start.Name, leg.Dest.Name, km(leg.Dist), leg.Trans)
+			}
+			if len(pm.Fields) > 0 {
+				fmt.Fprintf(w, "\tchanged: %s\n", strings.Join(pm.Fields, ", "))
+			}
+		case pm.Kind == planHash:
+			fmt.Fprintf(w, "mission %d: %s\n", pm.ID, pm.Kind)
+		default:
+			fmt.Fprintf(w, "mission %d: %s, %+.1f kgCO2e\n", pm.ID, pm.Kind, pm.CO2e)
+		}
+	}
+	for _, e := range p.Skipped {
+		fmt.Fprintf(w, "skipped %v\n", e)
+	}
+
+	fmt.Fprintf(w, "plan: %d new, %d changed, %d cancelled, %d rejected, %d skipped\n",
+		cnt[planNew], cnt[planChanged], cnt[planCancelled], cnt[planRejected], len(p.Skipped),
+	)
+
+	modes := make([]string, 0, len(p.Delta))
+	for k := range p.Delta {
+		modes = append(modes, k)
+	}
+	sort.Strings(modes)
+	total := 0.0
+	for _, k := range modes {
+		fmt.Fprintf(w, "  %-12s %+.1f kgCO2e\n", k+":", p.Delta[k])
+		total += p.Delta[k]
+	}
+	fmt.Fprintf(w, "  %-12s %+.1f kgCO2e\n", "total:", total)
+}
+
+// place returns the geocoded place of a location, as
+// "city, country (lat, lng)".
+func place(loc eco.Location) string {
+	var parts []string
+	for _, v := range []string{loc.Addr.City, loc.Addr.Country} {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s (%.4f, %.4f)", strings.Join(parts, ", "), loc.Lat, loc.Lng))
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+func TestPlan(t *testing.T) {
+	pipe := ingest.NewPipeline(nil, ingest.Options{})
+	readSource(t, pipe, "plan.jsonl") // unknown transport.
+
+	var (
+		date = time.Date(2019, 10, 2, 0, 0, 0, 0, time.UTC)
+		lyon = eco.Location{
+			Name: "Lyon", Lat: 45.7578, Lng: 4.8320,
+			Addr: eco.Address{City: "Lyon", Country: "France", CountryCode: "FR"},
+		}
+		m1 = eco.Mission{ID: 1, Date: date, Dest: lyon, Dist: 300e3, Trans: eco.Train, Group: "ATLAS"}
+		m2 = eco.Mission{ID: 2, Date: date, Dest: lyon, Dist: 300e3, Trans: eco.Car, Group: "ATLAS", TransReason: `rule "car"`}
+		s2 = eco.Mission{ID: 2, Date: date, Dest: lyon, Dist: 300e3, Trans: eco.Plane, Group: "ATLAS"}
+		s3 = eco.Mission{ID: 3, Date: date, Dest: lyon, Dist: 100e3, Trans: eco.Car, Group: "LHCb"}
+		s4 = eco.Mission{ID: 4, Date: date, Dest: lyon, Dist: 100e3, Trans: eco.Car, Group: "LHCb"}
+	)
+
+	p := newPlan([]eco.Revision{
+		{ID: 4, Status: eco.Registered, Hash: "h4"},
+		{ID: 3, Status: eco.Cancelled},
+		{ID: 2, Status: eco.Modified, Hash: "h2", Mission: &m2},
+		{ID: 1, Status: eco.Registered, Hash: "h1", Mission: &m1},
+	}, map[int32]eco.Mission{2: s2, 3: s3, 4: s4}, pipe.Report())
+
+	kinds := make([]string, len(p.Missions))
+	for i, pm := range p.Missions {
+		kinds[i] = pm.Kind
+	}
+	if got, want := kinds, []string{planNew, planChanged, planCancelled, planHash}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid kinds: got=%v, want=%v", got, want)
+	}
+	if got, want := p.Missions[1].Fields, []string{"transport: plane -> car"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid changed fields: got=%v, want=%v", got, want)
+	}
+	if got, want := len(p.Skipped), 1; got != want {
+		t.Fatalf("invalid number of skipped missions: got=%d, want=%d", got, want)
+	}
+
+	want := map[string]float64{
+		"train": eco.CostOf(eco.Train, 300e3),
+		"car":   eco.CostOf(eco.Car, 300e3) - eco.CostOf(eco.Car, 100e3),
+		"plane": -eco.CostOf(eco.Plane, 300e3),
+	}
+	if len(p.Delta) != len(want) {
+		t.Fatalf("invalid delta: got=%v, want=%v", p.Delta, want)
+	}
+	for k, v := range want {
+		if math.Abs(p.Delta[k]-v) > 1e-9 {
+			t.Fatalf("invalid delta for %s: got=%v, want=%v", k, p.Delta[k], v)
+		}
+	}
+
+	out := new(strings.Builder)
+	p.print(out)
+	for _, line := range []string{
+		"mission 1: new 2019-10-02 -> Lyon (Lyon, France (45.7578, 4.8320)), 300km, train, +1.1 kgCO2e",
+		`mission 2: changed 2019-10-02 -> Lyon (Lyon, France (45.7578, 4.8320)), 300km, car [rule "car"], +14.7 kgCO2e`,
+		"\tchanged: transport: plane -> car",
+		"mission 3: cancelled, -25.9 kgCO2e",
+		"mission 4: hash",
+		`skipped mission 5: transport transport_id="99": unknown transport mode ""`,
+		"plan: 1 new, 1 changed, 1 cancelled, 0 rejected, 1 skipped",
+		"  total:       -10.1 kgCO2e",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("missing line %q in plan:\n%s", line, out)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err := p.writeJSON(buf)
+	if err != nil {
+		t.Fatalf("could not write plan: %+v", err)
+	}
+	var raw struct {
+		Missions []struct {
+			ID   int32  `json:"id"`
+			Kind string `json:"kind"`
+		} `json:"missions"`
+		Skipped []struct {
+			ID   int32  `json:"id"`
+			Kind string `json:"kind"`
+		} `json:"skipped"`
+		Delta map[string]float64 `json:"co2e_delta"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &raw)
+	if err != nil {
+		t.Fatalf("could not decode plan: %+v", err)
+	}
+	if len(raw.Missions) != 4 || raw.Skipped[0].ID != 5 || raw.Skipped[0].Kind != "transport" || len(raw.Delta) != 3 {
+		t.Fatalf("invalid JSON plan: %+v", raw)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+// Kinds of differences between the source database and eco-srv.
+const (
+	diffMissing = "missing" // mission of the source database not stored
+	diffExtra   = "extra"   // stored mission absent or rejected in the source database
+	diffChanged = "changed" // stored mission with different fields
+)
+
+// diff is a difference between a mission of the source database and the
+// mission stored in eco-srv.
+type diff struct {
+	ID     int32
+	Kind   string
+	Fields []string // changed fields, as "name: stored -> source"
+}
+
+// diffs compares the missions of the source database with the stored ones.
+//
+// Only the fields that do not need to be geocoded are compared: changes
+// of destination are detected from the hash of the missions.
+// Missions with errors are not compared.
+// Corrections made in eco-srv, as listed in the lifecycle of the missions,
+// take precedence over the source database: corrected fields and deleted
+// missions are not compared.
+func diffs(p *ingest.Pipeline, src *ingest.Missions, stored map[int32]eco.Mission, known map[int32]eco.Lifecycle) []diff {
+	var ds []diff
+	for id, legs := range src.Legs {
+		if !src.Accepted[id] || src.Failed[id] || len(legs) == 0 {
+			continue
+		}
+		lc := known[id]
+		if lc.Deleted {
+			continue
+		}
+		var (
+			m         = p.Choose(legs)
+			s, ok     = stored[id]
+			fields    []string
+			corrected = make(map[string]bool, len(lc.Corrected))
+			cmp       = func(name, field string, got, want interface{}) {
+				if got != want && !corrected[field] {
+					fields = append(fields, fmt.Sprintf("%s: %v -> %v", name, got, want))
+				}
+			}
+		)
+		if !ok {
+			ds = append(ds, diff{ID: id, Kind: diffMissing})
+			continue
+		}
+		for _, field := range lc.Corrected {
+			corrected[field] = true
+		}
+		cmp("date", "date", s.Date.Format(timefmtJourney), m.Outbound.Date.Format(timefmtJourney))
+		cmp("inbound", "inbound", s.Inbound.Format(timefmtJourney), m.Inbound.Date.Format(timefmtJourney))
+		tid, _ := p.Decide(m, s.Dist/1000)
+		cmp("transport", "transport_id", s.Trans, tid)
+		cmp("group", "group", s.Group, m.Group)
+		if len(fields) > 0 {
+			ds = append(ds, diff{ID: id, Kind: diffChanged, Fields: fields})
+		}
+	}
+
+	for id := range stored {
+		if len(src.Legs[id]) > 0 && src.Accepted[id] {
+			continue
+		}
+		if src.Failed[id] {
+			continue
+		}
+		ds = append(ds, diff{ID: id, Kind: diffExtra})
+	}
+
+	sort.Slice(ds, func(i, j int) bool {
+		return ds[i].ID < ds[j].ID
+	})
+	return ds
+}
+
+// fixes returns the changes that reconcile eco-srv with the source database.
+//
+// Missing missions are registered, changed missions are modified and extra
+// missions are rejected (if rejected in the source database) or cancelled.
+func fixes(src *ingest.Missions, ds []diff) []change {
+	chs := make([]change, 0, len(ds))
+	for _, d := range ds {
+		ch := change{
+			rev:  eco.Revision{ID: d.ID},
+			legs: src.Legs[d.ID],
+		}
+		if digests, ok := src.Digests[d.ID]; ok {
+			ch.rev.Hash = ingest.Hash(digests)
+		}
+		switch d.Kind {
+		case diffMissing:
+			ch.rev.Status = eco.Registered
+			ch.update = true
+		case diffChanged:
+			ch.rev.Status = eco.Modified
+			ch.update = true
+		case diffExtra:
+			ch.rev.Status = eco.Cancelled
+			if _, ok := src.Digests[d.ID]; ok {
+				ch.rev.Status = eco.Rejected
+			}
+		}
+		chs = append(chs, ch)
+	}
+	return chs
+}
+
+// report writes a human readable report of the differences.
+func report(w io.Writer, ds []diff) {
+	cnt := make(map[string]int)
+	for _, d := range ds {
+		cnt[d.Kind]++
+		switch len(d.Fields) {
+		case 0:
+			fmt.Fprintf(w, "mission %d: %s\n", d.ID, d.Kind)
+		default:
+			fmt.Fprintf(w, "mission %d: %s (%s)\n", d.ID, d.Kind, strings.Join(d.Fields, ", "))
+		}
+	}
+	fmt.Fprintf(w, "reconcile: %d missing, %d extra, %d changed\n",
+		cnt[diffMissing], cnt[diffExtra], cnt[diffChanged],
+	)
+}
+
+// getMissions returns all the missions stored in eco-srv.
+func getMissions(addr, tok string) (map[int32]eco.Mission, error) {
+	req, err := newRequest(http.MethodGet, ingest.URL(addr, "/api/export?format=json"), tok, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GET request to eco-srv: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not GET missions: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received an invalid status from eco-srv: %s (code=%d)",
+			resp.Status, resp.StatusCode,
+		)
+	}
+
+	var ms []eco.Mission
+	err = json.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode missions: %w", err)
+	}
+
+	db := make(map[int32]eco.Mission, len(ms))
+	for _, m := range ms {
+		db[m.ID] = m
+	}
+	return db, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-ingest"
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
+)
+
+// readSource reads the missions of a JSON Lines file of testdata.
+func readSource(t *testing.T, pipe *ingest.Pipeline, name string) *ingest.Missions {
+	t.Helper()
+
+	rs, err := ingest.Open(filepath.Join("testdata", name), ingest.Mapping{DateLayout: timefmtJourney})
+	if err != nil {
+		t.Fatalf("could not open source: %+v", err)
+	}
+	defer rs.Close()
+
+	src, err := pipe.Read(rs)
+	if err != nil {
+		t.Fatalf("could not read source: %+v", err)
+	}
+	return src
+}
+
+func TestReconcile(t *testing.T) {
+	pipe := ingest.NewPipeline(nil, ingest.Options{})
+	src := readSource(t, pipe, "reconcile.jsonl")
+
+	if got, want := len(src.Digests), 7; got != want {
+		t.Fatalf("invalid number of source missions: got=%d, want=%d", got, want)
+	}
+	for id, n := range map[int32]int{1: 2, 2: 1, 3: 1, 4: 0, 6: 2, 7: 1, 8: 1} {
+		if got := len(src.Legs[id]); got != n {
+			t.Fatalf("invalid number of legs for mission %d: got=%d, want=%d", id, got, n)
+		}
+	}
+	if src.Accepted[4] {
+		t.Fatalf("rejected mission 4 was accepted")
+	}
+
+	var (
+		date   = func(v string) time.Time { t, _ := time.Parse(timefmtJourney, v); return t }
+		stored = map[int32]eco.Mission{
+			1: {ID: 1, Date: date("2019-10-02"), Inbound: date("2019-10-04"), Trans: eco.Train, Group: "ATLAS"},
+			2: {ID: 2, Date: date("2019-11-01"), Inbound: date("2019-11-03"), Trans: eco.Plane, Group: "ATLAS"},
+			4: {ID: 4, Date: date("2020-01-02"), Inbound: date("2020-01-10"), Trans: eco.Plane, Group: "ATLAS"},
+			5: {ID: 5, Date: date("2020-01-05"), Inbound: date("2020-01-06"), Trans: eco.Car, Group: "ATLAS"},
+			6: {ID: 6, Date: date("2020-02-02"), Inbound: date("2020-02-03"), Trans: eco.Train, Group: "ATLAS"},
+			7: {ID: 7, Date: date("2020-03-02"), Inbound: date("2020-03-05"), Trans: eco.Car, Group: "CMS"},
+		}
+		known = map[int32]eco.Lifecycle{
+			// transport corrected in eco-srv: only the group changed.
+			7: {ID: 7, Corrected: []string{"dist", "transport_id"}},
+			// deleted in eco-srv: not missing.
+			8: {ID: 8, Deleted: true},
+		}
+	)
+
+	ds := diffs(pipe, src, stored, known)
+	want := []diff{
+		{ID: 2, Kind: diffChanged, Fields: []string{"date: 2019-11-01 -> 2019-11-02", "transport: plane -> car"}},
+		{ID: 3, Kind: diffMissing},
+		{ID: 4, Kind: diffExtra},
+		{ID: 5, Kind: diffExtra},
+		{ID: 7, Kind: diffChanged, Fields: []string{"group: CMS -> ATLAS"}},
+	}
+	if !reflect.DeepEqual(ds, want) {
+		t.Fatalf("invalid diffs:\ngot= %+v\nwant=%+v", ds, want)
+	}
+
+	out := new(strings.Builder)
+	report(out, ds)
+	if got, want := out.String(), strings.Join([]string{
+		"mission 2: changed (date: 2019-11-01 -> 2019-11-02, transport: plane -> car)",
+		"mission 3: missing",
+		"mission 4: extra",
+		"mission 5: extra",
+		"mission 7: changed (group: CMS -> ATLAS)",
+		"reconcile: 1 missing, 2 extra, 2 changed",
+		"",
+	}, "\n"); got != want {
+		t.Fatalf("invalid report:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	chs := fixes(src, ds)
+	for i, want := range []struct {
+		status eco.Status
+		update bool
+		hash   bool
+	}{
+		{eco.Modified, true, true},
+		{eco.Registered, true, true},
+		{eco.Rejected, false, true},
+		{eco.Cancelled, false, false},
+		{eco.Modified, true, true},
+	} {
+		ch := chs[i]
+		if ch.rev.Status != want.status || ch.update != want.update || (ch.rev.Hash != "") != want.hash {
+			t.Fatalf("invalid fix for mission %d: got=%+v", ch.rev.ID, ch)
+		}
+	}
+}
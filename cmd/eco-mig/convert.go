@@ -0,0 +1,89 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-mig"
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// convert writes the stored missions to a CSV file.
+// Missions without a transport ID in the source database are skipped.
+func convert(db *bbolt.DB, tids map[int32]int32) error {
+	f, err := os.Create("eco.csv")
+	if err != nil {
+		return fmt.Errorf("could not create output CSV file: %w", err)
+	}
+	defer f.Close()
+
+	const layout = "02/01/2006"
+
+	w := csv.NewWriter(f)
+	w.Comma = '\t'
+
+	var ms []eco.Mission
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		var err error
+		ms, err = store.Missions(tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not scan db: %+v", err)
+	}
+
+	for _, m := range ms {
+		dest := strings.Split(m.Dest.Name, ",")
+		tid, ok := tids[m.ID]
+		if !ok {
+			continue
+		}
+		if int(m.ID) == *idFlag {
+			log.Printf("csv> %+v", m)
+		}
+		rec := []string{
+			strconv.Itoa(int(m.ID)),
+			m.Date.Format(layout),
+			"Clermont-Ferrand", "France",
+			strings.TrimSpace(dest[0]),
+			strings.TrimSpace(dest[len(dest)-1]),
+			m.Trans.String(),
+			strconv.Itoa(int(tid)),
+			"OUI",
+			"N/A",
+			"N/A",
+		}
+		err = w.Write(rec)
+		if err != nil {
+			return fmt.Errorf("could not write mission ID=%d: %w", m.ID, err)
+		}
+	}
+
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return fmt.Errorf("could not flush CSV file: %w", err)
+	}
+
+	/*
+		# mission	Date de départ	Ville de départ	Pays de départ	Ville de destination	Pays de destination	Mode de déplacement	Nb de personnes dans la voiture	Aller Retour (OUI si identiques, NON si différents)	Motif du déplacement (optionnel)	Statut de l'agent (optionnel)
+		1	24/01/2019	Grenoble	France	Lyon Saint-Exupéry	France	bus		OUI	Colloque-congrès	ITA
+
+	*/
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not save output CSV file: %w", err)
+	}
+
+	return nil
+}
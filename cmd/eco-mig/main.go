@@ -5,49 +5,37 @@
 package main // import "github.com/sbinet-lpc/eco/cmd/eco-mig"
 
 import (
-	"database/sql"
-	"encoding/binary"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"reflect"
 	"sort"
-	"strconv"
 	"time"
 
 	"github.com/sbinet-lpc/eco"
-	"github.com/sbinet-lpc/eco/geo"
-	"github.com/sbinet-lpc/eco/osm"
+	"github.com/sbinet-lpc/eco/ingest"
 	"go.etcd.io/bbolt"
-	"golang.org/x/xerrors"
-)
-
-const (
-	timefmtMission = "2006-01-02 15:04:05"
-	timefmtJourney = "2006-01-02"
-)
-
-var (
-	bucketUpdate = []byte("last-update")
-	bucketEco    = []byte("eco")
-	bucketOSM    = []byte("osm")
 )
 
 var (
-	clermont = geo.Point{Lat: 45.7774551, Lng: 3.0819427}
+	dbFlag   = flag.String("db", "eco.db", "path to lpc-eco database")
+	idFlag   = flag.Int("id", 0, "enable verbose mode for a specific mission ID")
+	dbgFlag  = flag.Bool("v", false, "enable verbose mode")
+	dryFlag  = flag.Bool("dry", false, "enable dry mode (do not commit to eco-DB)")
+	srcFlag  = flag.String("src", "", "path to a CSV, XLSX or JSON Lines file of missions (default: LPC MySQL database)")
+	mapFlag  = flag.String("mapping", "", "path to a JSON file mapping the columns of the source to the fields of missions")
+	credFlag = flag.String("passwd", "passwd", "path to the credentials of the source MySQL database")
 
-	idFlag  = flag.Int("id", 0, "enable verbose mode for a specific mission ID")
-	dbgFlag = flag.Bool("v", false, "enable verbose mode")
-	dryFlag = flag.Bool("dry", false, "enable dry mode (do not commit to eco-DB)")
+	pageFlag = flag.Int("page", 1000, "number of missions read per query from the source database")
 
 	fixupsTIDFlag  = flag.String("fixups-tid", "fixups.tid.json", "path to transport IDs fixups")
 	fixupsDestFlag = flag.String("fixups-dest", "fixups.dest.json", "path to destination fixups")
+	othersFlag     = flag.String("others", "car", "transport mode of \"Autres\" missions without a TID fixup nor a matching rule (empty: reject them)")
+	rulesFlag      = flag.String("rules", "", "path to the rules inferring the transport mode of \"Autres\" missions")
 
-	fixupTIDs map[int32]eco.TransID
-
-	bdb *bbolt.DB
+	reportFlag    = flag.String("report", "", "path to the JSON report of the errors of missions")
+	maxFailedFlag = flag.Int("max-failed", 0, "maximum number of failed missions before exiting with an error (negative: no limit)")
+	maxRateFlag   = flag.Float64("max-failed-rate", 0, "maximum fraction of failed missions before exiting with an error (0: no limit)")
 )
 
 func main() {
@@ -56,132 +44,56 @@ func main() {
 
 	flag.Parse()
 
-	bdb, err := bbolt.Open("eco.db", 0644, &bbolt.Options{Timeout: 1 * time.Second})
+	bdb, err := bbolt.Open(*dbFlag, 0644, &bbolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		log.Fatalf("could not open eco db: %w", err)
+		log.Fatalf("could not open eco db: %+v", err)
 	}
+	defer bdb.Close()
 
-	lastID, err := getLastID(bdb)
+	sink, err := ingest.NewBoltSink(bdb, "eco-mig")
 	if err != nil {
-		log.Fatalf("could not retrieve last mission id: %+v", err)
+		log.Fatalf("could not create eco db sink: %+v", err)
 	}
 
-	fixupTIDs, err = loadTIDs(*fixupsTIDFlag)
+	lastID, err := sink.LastID()
 	if err != nil {
-		log.Fatalf("could not load TIDs db: %+v", err)
-	}
-
-	c, err := readCredentials()
-	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("could not retrieve last mission id: %+v", err)
 	}
 
-	db, err := sql.Open("mysql", c.Conn())
+	opts, err := options()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("could not configure pipeline: %+v", err)
 	}
-	defer db.Close()
+	opts.After = lastID
+	pipe := ingest.NewPipeline(sink, opts)
 
-	err = db.Ping()
+	ms, err := ingest.OpenSource(*srcFlag, *mapFlag, *credFlag, *pageFlag)
 	if err != nil {
-		log.Fatalf("could not ping db: %+v", err)
+		log.Fatalf("could not open source database: %+v", err)
 	}
+	defer ms.Close()
 
-	// FIXME(sbinet): use a WHERE clause with ID_MISSION > lastID
-	rows, err := db.Query("select * from view_mission order by ID_MISSION")
+	src, err := pipe.Read(ms)
 	if err != nil {
-		log.Fatalf("could not select: %+v", err)
+		log.Fatalf("could not read source database: %+v", err)
 	}
-	defer rows.Close()
-
-	var (
-		invalid  int64
-		missions = make(map[int32][]Mission)
-		allgood  = true
-	)
-	for rows.Next() {
-		if rows.Err() != nil {
-			break
-		}
-		var m RawMission
-		err = rows.Scan(
-			&m.ID, &m.Date, &m.Org, &m.Group,
-			&m.Departure,
-			&m.Destination,
-			&m.Object,
-			&m.Type,
-			&m.Transport.Name,
-			&m.Outbound.Date,
-			&m.Outbound.Start,
-			&m.Outbound.Stop,
-			&m.Inbound.Date,
-			&m.Inbound.Start,
-			&m.Inbound.Stop,
-			&m.Comment,
-			&m.Valid,
-			&m.Cost,
-			&m.Residence.Familiale,
-			&m.Residence.Return,
-			&m.Housing,
-			&m.Transport.ID,
-			&m.Transport.Label,
-		)
-		if err != nil {
-			log.Fatalf("could not scan row: %+v", err)
-		}
-
-		if *idFlag == int(m.ID) {
-			log.Printf(
-				"id=%d, org=%q, grp=%q mission:%q transport:%d|%s valid=%d comment=%q",
-				m.ID, m.Org, m.Group, m.Destination, m.Transport.ID, m.Transport.Label,
-				m.Valid, m.Comment,
-			)
-		}
-
-		if m.ID <= lastID {
-			continue
-		}
-
-		mm, ok := m.ToMission()
-		if !ok {
-			allgood = false
-			invalid++
-			log.Printf(
-				"INVALID mission: id=%d, org=%q, grp=%q mission:%q transport:%d|%s valid=%d comment=%q (date=%v -> %v)",
-				m.ID, m.Org, m.Group, m.Destination, m.Transport.ID, m.Transport.Label,
-				m.Valid, m.Comment,
-				string(m.Outbound.Date),
-				string(m.Inbound.Date),
-			)
-			continue
-		}
 
-		if !mm.isValid() {
-			invalid++
+	dups := 0
+	mids := make([]int32, 0, len(src.Legs))
+	for id, legs := range src.Legs {
+		if src.Failed[id] {
 			continue
 		}
-
-		missions[mm.ID] = append(missions[mm.ID], mm)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Fatalf("could not iterate over select result: %+v", err)
-	}
-	log.Printf("missions:   %d", len(missions))
-	log.Printf("invalid:    %d", invalid)
-	if !allgood {
-		log.Fatalf("could not handle at least one mission. check TIDs")
-	}
-
-	dups := 0
-	mids := make([]int32, 0, len(missions))
-	for id := range missions {
 		mids = append(mids, id)
-		if len(missions[id]) > 1 {
+		if len(legs) > 1 {
 			dups++
 		}
 	}
 
+	log.Printf("missions:   %d", len(mids))
+	log.Printf("invalid:    %d", src.Invalid)
+	log.Printf("failed:     %d", len(src.Failed))
+
 	sort.Slice(mids, func(i, j int) bool {
 		return mids[i] < mids[j]
 	})
@@ -189,422 +101,106 @@ func main() {
 
 	if len(mids) == 0 {
 		log.Printf("no new mission to process")
-		err = convert(bdb, db)
+		err = convert(bdb, src.Transports)
 		if err != nil {
 			log.Fatalf("could not convert to CSV: %+v", err)
 		}
+		err = checkReport(pipe.Report())
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
 		return
 	}
 
-	proc, err := newProcessor(*fixupsDestFlag)
-	if err != nil {
-		log.Fatalf("could not create processor: %+v", err)
-	}
-
 	for _, id := range mids {
-		m := chooseMission(missions[id])
-		if *dbgFlag {
-			log.Printf(
-				"id=%d transport=%v, date=%s dest=%v",
-				m.ID,
-				m.Transport.Label,
-				m.Outbound.Date.Format(timefmtJourney),
-				m.Destination,
-			)
-		}
-
-		err := proc.Process(m)
-		if err != nil {
-			log.Printf("could not process id=%d: %+v", id, err)
-			allgood = false
-			break
-		}
+		// errors are reported: carry on with the other missions.
+		rev := eco.Revision{ID: id, Status: eco.Registered}
+		_ = pipe.Revise(rev, src.Legs[id], nil)
 	}
 
 	if *dryFlag {
 		log.Printf("dry mode enabled: no upload to db")
+		err = checkReport(pipe.Report())
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
 		return
 	}
 
-	err = proc.upload(bdb)
+	err = pipe.Flush()
 	if err != nil {
 		log.Fatalf("could not save new missions: %+v", err)
 	}
 
-	err = convert(bdb, db)
+	err = convert(bdb, src.Transports)
 	if err != nil {
 		log.Fatalf("could not convert to CSV: %+v", err)
 	}
 
-	if !allgood {
-		log.Fatalf("an error occurred during processing")
-	}
-}
-
-const (
-	idAvion int32 = iota + 1
-	idBus
-	idPassager
-	idTrain
-	idVoitureAdm
-	idVoitureLoc
-	idVoiturePers
-	idAutres
-)
-
-type RawMission struct {
-	ID          int32
-	Date        []byte       // when was the mission drafted
-	Org         sql.RawBytes // funding organization
-	Group       sql.RawBytes // group funding the mission
-	Departure   sql.RawBytes
-	Destination sql.RawBytes
-	Object      sql.RawBytes
-	Type        int16
-	Transport   struct {
-		Name  sql.RawBytes
-		ID    int32
-		Label sql.RawBytes
-	}
-	Outbound  RawJourney
-	Inbound   RawJourney
-	Comment   sql.RawBytes
-	Valid     int16
-	Cost      sql.NullFloat64
-	Residence struct {
-		Familiale int8
-		Return    sql.NullInt64
-	}
-	Housing sql.RawBytes
-}
-
-func (raw RawMission) ToMission() (Mission, bool) {
-	date, err := time.Parse(timefmtMission, string(raw.Date))
+	err = bdb.Close()
 	if err != nil {
-		panic(err)
+		log.Fatalf("could not close eco db: %+v", err)
 	}
-	out := Mission{
-		ID:          raw.ID,
-		Date:        date.UTC(),
-		Org:         string(raw.Org),
-		Group:       string(raw.Group),
-		Departure:   string(raw.Departure),
-		Destination: string(raw.Destination),
-		Object:      string(raw.Object),
-		Type:        raw.Type,
-		Outbound:    raw.Outbound.ToJourney(),
-		Inbound:     raw.Inbound.ToJourney(),
-		Comment:     string(raw.Comment),
-		Valid:       raw.Valid,
-		Cost:        -1,
-		Housing:     string(raw.Housing),
-	}
-	out.Transport.Name = string(raw.Transport.Name)
-	out.Transport.ID = raw.Transport.ID
-	out.Transport.Label = string(raw.Transport.Label)
-	if raw.Cost.Valid {
-		out.Cost = raw.Cost.Float64
-	}
-	out.Residence.Familiale = raw.Residence.Familiale
-	out.Residence.Return = -1
-	if raw.Residence.Return.Valid {
-		out.Residence.Return = raw.Residence.Return.Int64
-	}
-
-	if ok := out.checkTID(); !ok {
-		return Mission{}, ok
-	}
-
-	return out, true
-}
-
-type Mission struct {
-	ID          int32
-	Date        time.Time // when was the mission drafted
-	Org         string    // funding organization
-	Group       string    // group funding the mission
-	Departure   string
-	Destination string
-	Object      string
-	Type        int16
-	Transport   struct {
-		Name  string
-		ID    int32
-		Label string
-	}
-	Outbound  Journey
-	Inbound   Journey
-	Comment   string
-	Valid     int16
-	Cost      float64
-	Residence struct {
-		Familiale int8
-		Return    int64
-	}
-	Housing string
-}
 
-func (m Mission) isValid() bool {
-	switch m.Valid {
-	case 4:
-		// rejected by manager
-		return false
-	case 5:
-		// rejected by funder
-		return false
-	case 6:
-		// accepted by funder, rejected by manager
-		return false
-	case 7:
-		// accepted by manager, rejected by funder
-		return false
-	case 8:
-		// rejected by manager & funder
-		return false
+	err = checkReport(pipe.Report())
+	if err != nil {
+		log.Fatalf("%+v", err)
 	}
-	return true
 }
 
-func (m Mission) TransID() eco.TransID {
-	var id eco.TransID
-	switch tid := m.Transport.ID; tid {
-	case idAvion:
-		id = eco.Plane
-	case idBus:
-		id = eco.Bus
-	case idPassager:
-		// free. cost already reported on somebody else
-		id = eco.Passenger
-	case idTrain:
-		id = eco.Train
-	case idVoitureAdm, idVoitureLoc, idVoiturePers:
-		id = eco.Car
-	case idAutres:
-		id = fixupTID(m)
+// options returns the options of the pipeline, from the command line flags.
+func options() (ingest.Options, error) {
+	opts := ingest.Options{
+		Trace:   int32(*idFlag),
+		Verbose: *dbgFlag,
 	}
 
-	return id
-}
-
-func (m *Mission) checkTID() bool {
-	tid := m.Transport.ID
-	if tid != idAutres {
-		return true
-	}
-	_, ok := fixupTIDs[m.ID]
-	if ok {
-		return ok
-	}
-
-	m.Transport.ID = idVoitureAdm // FIXME
-	return true
-}
-
-func chooseMission(ms []Mission) Mission {
-	if len(ms) == 1 {
-		return ms[0]
+	var err error
+	opts.Fixups, err = ingest.LoadFixups(*fixupsTIDFlag, *fixupsDestFlag)
+	if err != nil {
+		return opts, err
 	}
 
-	if *dbgFlag {
-		log.Printf("=== missions %d === (n=%d)", ms[0].ID, len(ms))
-		for _, m := range ms {
-			log.Printf("transport=%s, destination=%s", m.Transport.Label, m.Destination)
+	if *rulesFlag != "" {
+		opts.Rules, err = ingest.LoadRules(*rulesFlag)
+		if err != nil {
+			return opts, err
 		}
 	}
 
-	costs := make([]eco.TransID, len(ms))
-	for i, m := range ms {
-		costs[i] = m.TransID()
-	}
-	switch {
-	case reflect.DeepEqual(costs, []eco.TransID{eco.Train, eco.Bus}):
-		return ms[0]
-	case reflect.DeepEqual(costs, []eco.TransID{eco.Bus, eco.Train}):
-		return ms[1]
-	}
-
-	var (
-		cost = ms[0].TransID()
-		j    = 0
-	)
-	for i := range costs {
-		if !eco.CostLess(costs[i], cost) {
-			cost = costs[i]
-			j = i
+	if *othersFlag != "" {
+		opts.Others, err = eco.ParseTransID(*othersFlag)
+		if err != nil {
+			return opts, fmt.Errorf("invalid transport mode for \"Autres\" missions: %w", err)
 		}
 	}
-	return ms[j]
-}
-
-type RawJourney struct {
-	Date  []byte
-	Start sql.RawBytes // starting point of the journey
-	Stop  sql.RawBytes // destination of the journey
-}
-
-func (raw RawJourney) ToJourney() Journey {
-	date, err := time.Parse(timefmtJourney, string(raw.Date))
-	if err != nil {
-		panic(err)
-	}
-
-	return Journey{
-		Date:  date.UTC(),
-		Start: string(raw.Start),
-		Stop:  string(raw.Stop),
-	}
-}
-
-type Journey struct {
-	Date  time.Time
-	Start string // Hour of departure
-	Stop  string // Hour of arrival
-}
-
-type cred struct {
-	User  string `json:"user"`
-	Pwd   string `json:"password"`
-	Host  string `json:"host"`
-	DB    string `json:"db"`
-	Table string `json:"table"`
-}
-
-type OSMReq struct {
-	Mission Mission     `json:"mission"`
-	Places  []osm.Place `json:"places"`
-}
-
-func (req OSMReq) LatLng() (float64, float64) {
-	loc := req.Places[0]
-
-	lat, err := strconv.ParseFloat(loc.Lat, 64)
-	if err != nil {
-		panic(xerrors.Errorf("could not convert latitude: %w", err))
-	}
-	lng, err := strconv.ParseFloat(loc.Lng, 64)
-	if err != nil {
-		panic(xerrors.Errorf("could not convert longitude: %w", err))
-	}
-	return lat, lng
-}
-
-func readCredentials() (cred, error) {
-	var v cred
-	f, err := os.Open("passwd")
-	if err != nil {
-		return v, xerrors.Errorf("could not open credentials file: %w", err)
-	}
-	defer f.Close()
-
-	err = json.NewDecoder(f).Decode(&v)
-	if err != nil {
-		return v, xerrors.Errorf("could not decode credentials file content: %w", err)
-	}
-
-	return v, nil
+	return opts, nil
 }
 
-func (c cred) Conn() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:3306)/%s", c.User, c.Pwd, c.Host, c.DB)
-}
-
-func getLastID(db *bbolt.DB) (int32, error) {
-	err := db.Update(func(tx *bbolt.Tx) error {
-		upd, err := tx.CreateBucketIfNotExists(bucketUpdate)
+// checkReport writes the report of the errors of the missions and checks
+// it against the configured thresholds.
+func checkReport(r *ingest.Report) error {
+	if *reportFlag != "" {
+		f, err := os.Create(*reportFlag)
 		if err != nil {
-			return xerrors.Errorf("could not create %q bucket: %w", bucketUpdate, err)
-		}
-		if upd == nil {
-			return xerrors.Errorf("could not create %q bucket", bucketUpdate)
+			return fmt.Errorf("could not create report file: %w", err)
 		}
+		defer f.Close()
 
-		eco, err := tx.CreateBucketIfNotExists(bucketEco)
+		err = r.WriteJSON(f)
 		if err != nil {
-			return xerrors.Errorf("could not create %q bucket: %w", bucketEco, err)
-		}
-		if eco == nil {
-			return xerrors.Errorf("could not create %q bucket", bucketEco)
+			return fmt.Errorf("could not write report: %w", err)
 		}
 
-		osm, err := tx.CreateBucketIfNotExists(bucketOSM)
+		err = f.Close()
 		if err != nil {
-			return xerrors.Errorf("could not create %q bucket: %w", bucketOSM, err)
+			return fmt.Errorf("could not save report: %w", err)
 		}
-		if osm == nil {
-			return xerrors.Errorf("could not create %q bucket", bucketOSM)
-		}
-
-		return nil
-	})
-	if err != nil {
-		return 0, xerrors.Errorf("could not setup eco db buckets: %w", err)
 	}
 
-	var lastID int32
-	err = db.View(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketEco)
-		if bkt == nil {
-			return xerrors.Errorf("could not find %q bucket", bucketEco)
-		}
-		return bkt.ForEach(func(k, v []byte) error {
-			id := int32(binary.LittleEndian.Uint32(k))
-			if id > lastID {
-				lastID = id
-			}
-			return nil
-		})
+	r.Summary(log.Writer())
+	return r.Check(ingest.Thresholds{
+		MaxFailed: *maxFailedFlag,
+		MaxRate:   *maxRateFlag,
 	})
-	if err != nil {
-		return 0, xerrors.Errorf("could not find last mission id: %w", err)
-	}
-	return lastID, nil
-}
-
-func fixupTID(m Mission) eco.TransID {
-	tid, ok := fixupTIDs[m.ID]
-	if !ok {
-		panic(xerrors.Errorf("invalid mission-id=%d, (tid=%d|%v) comment=%q", m.ID, m.Transport.ID, m.Transport.Label, m.Comment))
-	}
-	return tid
-}
-
-func loadTIDs(name string) (map[int32]eco.TransID, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, xerrors.Errorf("could not open tid db file: %w", err)
-	}
-	defer f.Close()
-
-	var raw []struct {
-		ID  int32  `json:"id"`
-		TID string `json:"tid"`
-	}
-	err = json.NewDecoder(f).Decode(&raw)
-	if err != nil {
-		return nil, xerrors.Errorf("could not decode tid db file: %w", err)
-	}
-
-	db := make(map[int32]eco.TransID, len(raw))
-	tids := make(map[string]eco.TransID)
-	for _, tid := range []eco.TransID{
-		eco.Bike,
-		eco.Tramway,
-		eco.Train,
-		eco.Bus,
-		eco.Passenger,
-		eco.Car,
-		eco.Plane,
-	} {
-		tids[tid.String()] = tid
-	}
-
-	for _, v := range raw {
-		tid, ok := tids[v.TID]
-		if !ok {
-			return nil, xerrors.Errorf("could not find eco.TransID corresponding to %q", v.TID)
-		}
-		db[v.ID] = tid
-	}
-
-	return db, nil
 }
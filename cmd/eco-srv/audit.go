@@ -0,0 +1,347 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// merge merges the JSON merge-patch p into dst.
+func merge(dst, p map[string]interface{}) {
+	for k, v := range p {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			sub, ok := dst[k].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{}, len(v))
+			}
+			merge(sub, v)
+			dst[k] = sub
+		default:
+			dst[k] = v
+		}
+	}
+}
+
+// apiMissions handles requests for missions:
+//   - GET    /api/missions/: list all missions,
+//   - GET    /api/missions/{id}: retrieve a mission,
+//   - PATCH  /api/missions/{id}: correct a mission,
+//   - DELETE /api/missions/{id}: delete a mission,
+//   - GET    /api/missions/{id}/audit: retrieve the audit trail of a mission.
+func (srv *server) apiMissions(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/missions/"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+			return
+		}
+		srv.apiMissionList(w, r)
+		return
+	}
+
+	toks := strings.Split(path, "/")
+	if len(toks) > 2 || (len(toks) == 2 && toks[1] != "audit") {
+		http.NotFound(w, r)
+		return
+	}
+
+	v, err := strconv.ParseInt(toks[0], 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid mission id %q", toks[0]), http.StatusBadRequest)
+		return
+	}
+	id := int32(v)
+
+	switch {
+	case len(toks) == 2 && r.Method == http.MethodGet:
+		srv.apiMissionAudit(w, r, id)
+	case len(toks) == 2:
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+	case r.Method == http.MethodGet:
+		srv.apiMissionGet(w, r, id)
+	case r.Method == http.MethodPatch:
+		srv.apiMissionPatch(w, r, id)
+	case r.Method == http.MethodDelete:
+		srv.apiMissionDelete(w, r, id)
+	default:
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+	}
+}
+
+// missionEntry is a mission together with its CO2 equivalent emission.
+type missionEntry struct {
+	eco.Mission
+	CO2e float64 `json:"co2e"` // in kg
+}
+
+func (srv *server) apiMissionList(w http.ResponseWriter, r *http.Request) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	now := srv.now()
+	etag, body, err := srv.cached("missions", now, func(tx *bbolt.Tx) ([]byte, error) {
+		ms, err := store.Missions(tx)
+		if err != nil {
+			return nil, err
+		}
+		vs := make([]missionEntry, len(ms))
+		for i, m := range ms {
+			vs[i] = missionEntry{Mission: m, CO2e: eco.CostOf(m.Trans, m.Dist)}
+		}
+		return json.Marshal(vs)
+	})
+	if err != nil {
+		err = fmt.Errorf("could not list missions: %w", err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func (srv *server) apiMissionGet(w http.ResponseWriter, r *http.Request, id int32) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	var m eco.Mission
+	err := srv.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		m, err = store.LoadMission(tx, id)
+		return err
+	})
+	if err != nil {
+		srv.missionError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(m)
+	if err != nil {
+		log.Printf("could not encode mission %d: %+v", id, err)
+		return
+	}
+}
+
+// missionRequest is the payload of a mission correction or deletion.
+type missionRequest struct {
+	User    string                 `json:"user"`
+	Reason  string                 `json:"reason"`
+	Mission map[string]interface{} `json:"mission"`
+}
+
+func (srv *server) apiMissionPatch(w http.ResponseWriter, r *http.Request, id int32) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	defer r.Body.Close()
+
+	var req missionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w,
+			fmt.Sprintf("could not decode mission patch payload: %+v", err),
+			http.StatusBadRequest,
+		)
+		return
+	}
+	if user := userFrom(r); user != "" {
+		req.User = user
+	}
+	if req.Reason == "" {
+		http.Error(w, "missing reason for mission correction", http.StatusBadRequest)
+		return
+	}
+	if len(req.Mission) == 0 {
+		http.Error(w, "missing mission correction", http.StatusBadRequest)
+		return
+	}
+	delete(req.Mission, "id")
+	if _, err := (store.Correction{Patch: req.Mission}).Apply(eco.Mission{}); err != nil {
+		http.Error(w, fmt.Sprintf("invalid mission correction: %+v", err), http.StatusBadRequest)
+		return
+	}
+
+	var next eco.Mission
+	err = srv.db.Update(func(tx *bbolt.Tx) error {
+		prev, err := store.LoadMission(tx, id)
+		if err != nil {
+			return err
+		}
+
+		next, err = store.Correction{Patch: req.Mission}.Apply(prev)
+		if err != nil {
+			return err
+		}
+		err = next.Validate()
+		if err != nil {
+			return err
+		}
+
+		c, _, err := store.LoadCorrection(tx, id)
+		if err != nil {
+			return err
+		}
+		if c.Patch == nil {
+			c.Patch = make(map[string]interface{}, len(req.Mission))
+		}
+		merge(c.Patch, req.Mission)
+
+		err = store.SaveCorrection(tx, id, c)
+		if err != nil {
+			return err
+		}
+
+		err = store.SaveMission(tx, next)
+		if err != nil {
+			return err
+		}
+
+		return store.AddAudit(tx, store.Audit{
+			ID:     id,
+			Action: "patch",
+			User:   req.User,
+			Date:   srv.now(),
+			Reason: req.Reason,
+			Prev:   &prev,
+			Next:   &next,
+		})
+	})
+	if err != nil {
+		srv.missionError(w, id, err)
+		return
+	}
+
+	log.Printf("mission %d corrected by %q: %s", id, req.User, req.Reason)
+	srv.checkBudgets(srv.now())
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(next)
+	if err != nil {
+		log.Printf("could not encode mission %d: %+v", id, err)
+		return
+	}
+}
+
+func (srv *server) apiMissionDelete(w http.ResponseWriter, r *http.Request, id int32) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	defer r.Body.Close()
+
+	req := missionRequest{
+		User:   r.URL.Query().Get("user"),
+		Reason: r.URL.Query().Get("reason"),
+	}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("could not decode mission deletion payload: %+v", err),
+				http.StatusBadRequest,
+			)
+			return
+		}
+	}
+	if user := userFrom(r); user != "" {
+		req.User = user
+	}
+	if req.Reason == "" {
+		http.Error(w, "missing reason for mission deletion", http.StatusBadRequest)
+		return
+	}
+
+	err := srv.db.Update(func(tx *bbolt.Tx) error {
+		prev, err := store.LoadMission(tx, id)
+		if err != nil {
+			return err
+		}
+
+		c, _, err := store.LoadCorrection(tx, id)
+		if err != nil {
+			return err
+		}
+		c.Deleted = true
+		err = store.SaveCorrection(tx, id, c)
+		if err != nil {
+			return err
+		}
+
+		err = store.DeleteMission(tx, id)
+		if err != nil {
+			return err
+		}
+
+		return store.AddAudit(tx, store.Audit{
+			ID:     id,
+			Action: "delete",
+			User:   req.User,
+			Date:   srv.now(),
+			Reason: req.Reason,
+			Prev:   &prev,
+		})
+	})
+	if err != nil {
+		srv.missionError(w, id, err)
+		return
+	}
+
+	log.Printf("mission %d deleted by %q: %s", id, req.User, req.Reason)
+	srv.checkBudgets(srv.now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) apiMissionAudit(w http.ResponseWriter, r *http.Request, id int32) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	var as []store.Audit
+	err := srv.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		as, err = store.LoadAudit(tx, id)
+		return err
+	})
+	if err != nil {
+		srv.missionError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(as)
+	if err != nil {
+		log.Printf("could not encode audit trail of mission %d: %+v", id, err)
+		return
+	}
+}
+
+func (srv *server) missionError(w http.ResponseWriter, id int32, err error) {
+	if errors.Is(err, store.ErrNoMission) {
+		http.Error(w, fmt.Sprintf("could not find mission %d", id), http.StatusNotFound)
+		return
+	}
+	var verr *eco.ValidationError
+	if errors.As(err, &verr) {
+		invalidMissions(w, []*eco.ValidationError{verr})
+		return
+	}
+	err = fmt.Errorf("could not process mission %d: %w", id, err)
+	log.Printf("%+v", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Token scopes.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// Token is an API token, as stored in the tokens file.
+// Only the SHA-256 hash of the token is stored.
+type Token struct {
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash"` // hex-encoded SHA-256 of the token
+	Scopes []string `json:"scopes"`
+}
+
+// validScope returns whether scope is a known token scope.
+func validScope(scope string) bool {
+	switch scope {
+	case scopeRead, scopeWrite:
+		return true
+	}
+	return false
+}
+
+func (tok Token) allows(scope string) bool {
+	for _, v := range tok.Scopes {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authz enforces token-based authentication and authorization.
+type authz struct {
+	tokens []Token
+	read   bool // whether read endpoints are protected
+}
+
+func newAuthz(name string, protectRead bool) (*authz, error) {
+	if name == "" {
+		return &authz{}, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open tokens file: %w", err)
+	}
+	defer f.Close()
+
+	var toks []Token
+	err = json.NewDecoder(f).Decode(&toks)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode tokens file: %w", err)
+	}
+
+	for _, tok := range toks {
+		raw, err := hex.DecodeString(tok.Hash)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid hash for token %q", tok.Name)
+		}
+		for _, scope := range tok.Scopes {
+			if !validScope(scope) {
+				return nil, fmt.Errorf("invalid scope %q for token %q", scope, tok.Name)
+			}
+		}
+	}
+
+	return &authz{tokens: toks, read: protectRead}, nil
+}
+
+// enabled returns whether tokens have been configured.
+func (az *authz) enabled() bool {
+	return len(az.tokens) > 0
+}
+
+// lookup returns the token matching the provided secret.
+func (az *authz) lookup(secret string) (Token, bool) {
+	sum := sha256.Sum256([]byte(secret))
+	hash := hex.EncodeToString(sum[:])
+	for _, tok := range az.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(tok.Hash)) == 1 {
+			return tok, true
+		}
+	}
+	return Token{}, false
+}
+
+type userKey struct{}
+
+// userFrom returns the name of the token used to authenticate the request.
+func userFrom(r *http.Request) string {
+	v, _ := r.Context().Value(userKey{}).(string)
+	return v
+}
+
+// wrap protects the handler h.
+// Safe HTTP methods require the read scope (if read protection is enabled),
+// all the others require the write scope.
+func (az *authz) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !az.enabled() {
+			h(w, r)
+			return
+		}
+
+		scope := scopeWrite
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			scope = scopeRead
+		}
+
+		secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if c, err := r.Cookie(cookieName); err == nil && secret == "" && scope == scopeRead {
+			// only read requests are authenticated by the cookie of the
+			// dashboard, so other sites can not make write requests on
+			// behalf of its users.
+			secret = c.Value
+		}
+		tok, ok := az.lookup(secret)
+		switch {
+		case scope == scopeRead && !az.read:
+			// read endpoints are public.
+		case secret == "" || !ok:
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				uri := r.RequestURI
+				if uri == "" {
+					uri = r.URL.RequestURI()
+				}
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(uri), http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="eco-srv"`)
+			http.Error(w, "missing or invalid API token", http.StatusUnauthorized)
+			return
+		case !tok.allows(scope):
+			http.Error(w, fmt.Sprintf("API token %q lacks %q scope", tok.Name, scope), http.StatusForbidden)
+			return
+		}
+
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, tok.Name))
+		}
+		h(w, r)
+	}
+}
+
+// cookieName is the name of the cookie holding the API token of the
+// users of the dashboard.
+const cookieName = "eco-token"
+
+// login logs users of the dashboard in with an API token: GET /login
+// serves the login form, POST /login stores the token in a cookie and
+// redirects to the page given by the next query parameter.
+func (az *authz) login(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	var msg string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		secret := r.PostFormValue("token")
+		tok, ok := az.lookup(secret)
+		if ok && tok.allows(scopeRead) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieName,
+				Value:    secret,
+				Path:     "/",
+				Secure:   r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		msg = "invalid API token"
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := loginTmpl.Execute(w, map[string]interface{}{
+		"Next":  next,
+		"Error": msg,
+	})
+	if err != nil {
+		log.Printf("could not execute login template: %+v", err)
+	}
+}
+
+// logout removes the cookie holding the API token of a dashboard user.
+func (az *authz) logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// genToken generates a new random API token and its tokens file entry.
+func genToken(name string, scopes []string) (string, Token, error) {
+	if len(scopes) == 0 {
+		return "", Token{}, fmt.Errorf("no scope for token %q", name)
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", Token{}, fmt.Errorf("invalid scope %q for token %q (valid scopes: %s, %s)", scope, name, scopeRead, scopeWrite)
+		}
+	}
+
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", Token{}, fmt.Errorf("could not generate random token: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(secret))
+	return secret, Token{
+		Name:   name,
+		Hash:   hex.EncodeToString(sum[:]),
+		Scopes: scopes,
+	}, nil
+}
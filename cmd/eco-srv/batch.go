@@ -0,0 +1,129 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// bucketBatches stores the result of the applied batches of revisions,
+// keyed by batch ID.
+var bucketBatches = []byte("batches")
+
+const (
+	maxBatchSize = 8 << 20 // maximum size of a batch request, in bytes
+	maxBatchID   = 128     // maximum length of a batch ID
+)
+
+// apiBatch handles the upload of a batch of revisions from the source
+// database: POST /api/batch.
+//
+// The valid revisions of a batch are applied, and the batch recorded, in
+// a single transaction. Invalid revisions are rejected and reported in
+// the result of the batch.
+// Uploading an already applied batch does not modify the db and returns
+// the result of its first upload.
+func (srv *server) apiBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+
+	var b eco.Batch
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&b)
+	if err != nil {
+		code := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("could not decode batch request payload: %+v", err), code)
+		return
+	}
+	if b.ID == "" || len(b.ID) > maxBatchID {
+		http.Error(w, fmt.Sprintf("invalid batch ID %q", b.ID), http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var (
+		user = userFrom(r)
+		now  = srv.now()
+		mid  = srv.mid
+		res  eco.BatchResult
+	)
+	err = srv.db.Update(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket(bucketBatches)
+		if raw := bkt.Get([]byte(b.ID)); raw != nil {
+			err := json.Unmarshal(raw, &res)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal result of batch %q: %w", b.ID, err)
+			}
+			res.Replayed = true
+			return nil
+		}
+
+		res = eco.BatchResult{ID: b.ID, Date: now}
+		var err error
+		res.Accepted, res.Rejected, err = store.Apply(tx, b.Revisions, user, now)
+		if err != nil {
+			return err
+		}
+		rejected := make(map[int32]bool, len(res.Rejected))
+		for _, rej := range res.Rejected {
+			rejected[rej.ID] = true
+		}
+		for _, rev := range b.Revisions {
+			if rev.Mission != nil && rev.ID > mid && !rejected[rev.ID] {
+				mid = rev.ID
+			}
+		}
+
+		raw, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("could not marshal result of batch %q: %w", b.ID, err)
+		}
+		err = bkt.Put([]byte(b.ID), raw)
+		if err != nil {
+			return fmt.Errorf("could not store result of batch %q: %w", b.ID, err)
+		}
+		return store.Touch(tx, now)
+	})
+	if err != nil {
+		err = fmt.Errorf("could not apply batch %q: %w", b.ID, err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case res.Replayed:
+		log.Printf("batch %q already applied on %v", res.ID, res.Date.Format("2006-01-02 15:04:05"))
+	default:
+		srv.mid = mid
+		srv.last = now
+		log.Printf("applied batch %q (accepted=%d, rejected=%d)", res.ID, len(res.Accepted), len(res.Rejected))
+		srv.checkBudgets(now)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Printf("could not encode batch result: %+v", err)
+		return
+	}
+}
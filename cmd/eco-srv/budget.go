@@ -0,0 +1,490 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	bucketBudgets = []byte("budgets")
+	bucketAlerts  = []byte("budget-alerts")
+)
+
+// Budget is a yearly CO2e emissions budget.
+type Budget struct {
+	Year       int       `json:"year"`
+	Group      string    `json:"group,omitempty"`      // funding group, or all groups if empty
+	Mode       string    `json:"mode,omitempty"`       // transport mode, or all modes if empty
+	Limit      float64   `json:"limit"`                // in tCO2e
+	Thresholds []float64 `json:"thresholds,omitempty"` // fractions of the limit triggering alerts
+}
+
+// defaultThresholds are the alert thresholds of budgets that do not
+// declare any.
+var defaultThresholds = []float64{0.8, 1}
+
+func (b Budget) key() []byte {
+	return []byte(fmt.Sprintf("%04d/%s/%s", b.Year, b.Group, b.Mode))
+}
+
+func (b Budget) String() string {
+	o := fmt.Sprintf("%d", b.Year)
+	if b.Group != "" {
+		o += " group=" + b.Group
+	}
+	if b.Mode != "" {
+		o += " mode=" + b.Mode
+	}
+	return o
+}
+
+func (b Budget) validate() error {
+	if b.Year < 1900 || b.Year > 9999 {
+		return fmt.Errorf("invalid budget year %d", b.Year)
+	}
+	if b.Limit <= 0 || math.IsInf(b.Limit, 0) || math.IsNaN(b.Limit) {
+		return fmt.Errorf("invalid budget limit %v", b.Limit)
+	}
+	if b.Mode != "" {
+		_, err := eco.ParseTransID(b.Mode)
+		if err != nil {
+			return fmt.Errorf("invalid budget mode: %w", err)
+		}
+	}
+	for _, v := range b.Thresholds {
+		if v <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Errorf("invalid budget threshold %v", v)
+		}
+	}
+	return nil
+}
+
+func (b Budget) thresholds() []float64 {
+	if len(b.Thresholds) == 0 {
+		return defaultThresholds
+	}
+	vs := append([]float64(nil), b.Thresholds...)
+	sort.Float64s(vs)
+	return vs
+}
+
+// matches returns whether a mission of any year has the group and the
+// transport mode of the budget.
+func (b Budget) matches(m eco.Mission) bool {
+	if b.Group != "" && m.Group != b.Group {
+		return false
+	}
+	if b.Mode != "" && m.Trans.String() != b.Mode {
+		return false
+	}
+	return true
+}
+
+// BudgetProgress describes the consumption of a budget.
+//
+// Executed missions consume the budget, planned missions are part of the
+// committed emissions. The projected year-end emissions are the forecast
+// of the emissions of the missions of the budget (see eco.NewForecast),
+// and at least the committed ones.
+type BudgetProgress struct {
+	Budget
+	Executed  float64  `json:"executed"`  // in tCO2e
+	Planned   float64  `json:"planned"`   // in tCO2e
+	Projected float64  `json:"projected"` // projected year-end emissions, in tCO2e
+	Fraction  float64  `json:"fraction"`  // fraction of the budget committed
+	Level     float64  `json:"level"`     // highest threshold crossed by the committed emissions
+	Status    string   `json:"status"`    // ok, warning or over
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+func progress(b Budget, ms []eco.Mission, now time.Time) BudgetProgress {
+	var (
+		p   = BudgetProgress{Budget: b}
+		beg = time.Date(b.Year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		end = beg.AddDate(1, 0, 0)
+		sel = make([]eco.Mission, 0, len(ms))
+	)
+	for _, m := range ms {
+		if !b.matches(m) {
+			continue
+		}
+		// missions of the previous years are the reference of the
+		// seasonal model of the forecast.
+		sel = append(sel, m)
+		if m.Date.UTC().Year() != b.Year {
+			continue
+		}
+		v := eco.CostOf(m.Trans, m.Dist) / 1000
+		switch {
+		case m.Planned(now):
+			p.Planned += v
+		default:
+			p.Executed += v
+		}
+	}
+
+	committed := p.Executed + p.Planned
+	fc := eco.NewForecast(sel, beg, end, now)
+	p.Projected = math.Max(committed, fc.Total.Projected/1000)
+	p.Fraction = committed / b.Limit
+
+	for _, v := range b.thresholds() {
+		if p.Fraction >= v {
+			p.Level = v
+		}
+	}
+
+	p.Status = "ok"
+	if p.Level > 0 {
+		p.Status = "warning"
+		p.Warnings = append(p.Warnings, fmt.Sprintf(
+			"%.0f%% of the budget is committed (threshold: %.0f%%)",
+			100*p.Fraction, 100*p.Level,
+		))
+	}
+	if p.Projected > b.Limit && committed <= b.Limit {
+		p.Status = "warning"
+		p.Warnings = append(p.Warnings, fmt.Sprintf(
+			"projected year-end emissions (%.2f tCO2e) exceed the budget (%.2f tCO2e)",
+			p.Projected, b.Limit,
+		))
+	}
+	if committed > b.Limit {
+		p.Status = "over"
+		p.Warnings = append(p.Warnings, fmt.Sprintf(
+			"committed emissions (%.2f tCO2e) exceed the budget (%.2f tCO2e)",
+			committed, b.Limit,
+		))
+	}
+
+	return p
+}
+
+func dbBudgets(tx *bbolt.Tx) ([]Budget, error) {
+	bkt := tx.Bucket(bucketBudgets)
+	if bkt == nil {
+		return nil, fmt.Errorf("could not find %q bucket", bucketBudgets)
+	}
+
+	var bs []Budget
+	err := bkt.ForEach(func(k, v []byte) error {
+		var b Budget
+		err := json.Unmarshal(v, &b)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal budget %q: %w", k, err)
+		}
+		bs = append(bs, b)
+		return nil
+	})
+	return bs, err
+}
+
+func saveBudget(tx *bbolt.Tx, b Budget) error {
+	raw, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("could not marshal budget %v: %w", b, err)
+	}
+	err = tx.Bucket(bucketBudgets).Put(b.key(), raw)
+	if err != nil {
+		return fmt.Errorf("could not store budget %v: %w", b, err)
+	}
+	return store.BumpVersion(tx)
+}
+
+// setBudgets stores the provided budgets, replacing the budgets with the
+// same year, group and mode.
+func (srv *server) setBudgets(bs []Budget) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.db.Update(func(tx *bbolt.Tx) error {
+		for _, b := range bs {
+			err := b.validate()
+			if err != nil {
+				return err
+			}
+			err = saveBudget(tx, b)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// apiBudget serves the progress of budgets (GET) and declares (PUT, POST)
+// or removes (DELETE) a budget.
+func (srv *server) apiBudget(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		srv.apiBudgetGet(w, r)
+	case http.MethodPut, http.MethodPost:
+		srv.apiBudgetPut(w, r)
+	case http.MethodDelete:
+		srv.apiBudgetDelete(w, r)
+	default:
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+	}
+}
+
+func (srv *server) apiBudgetGet(w http.ResponseWriter, r *http.Request) {
+	now, err := srv.asof(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	year := now.Year()
+	if v := r.URL.Query().Get("year"); v != "" {
+		year, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid year %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	key := fmt.Sprintf("budget?year=%d&asof=%s", year, asofKey(r, now))
+	etag, body, err := srv.cached(key, srv.now(), func(tx *bbolt.Tx) ([]byte, error) {
+		bs, err := dbBudgets(tx)
+		if err != nil {
+			return nil, err
+		}
+		ms, err := store.TripMissions(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		ps := make([]BudgetProgress, 0, len(bs))
+		for _, b := range bs {
+			if b.Year != year {
+				continue
+			}
+			ps = append(ps, progress(b, ms, now))
+		}
+		return json.Marshal(ps)
+	})
+	if err != nil {
+		err = fmt.Errorf("could not compute budgets: %w", err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func (srv *server) apiBudgetPut(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var b Budget
+	err := json.NewDecoder(r.Body).Decode(&b)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode budget: %+v", err), http.StatusBadRequest)
+		return
+	}
+	err = b.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = srv.setBudgets([]Budget{b})
+	if err != nil {
+		err = fmt.Errorf("could not store budget: %w", err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("budget %v set to %v tCO2e by %q", b, b.Limit, userFrom(r))
+
+	srv.checkBudgets(srv.now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) apiBudgetDelete(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	year, err := strconv.Atoi(q.Get("year"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid year %q", q.Get("year")), http.StatusBadRequest)
+		return
+	}
+	b := Budget{Year: year, Group: q.Get("group"), Mode: q.Get("mode")}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	found := false
+	err = srv.db.Update(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket(bucketBudgets)
+		if bkt.Get(b.key()) == nil {
+			return nil
+		}
+		found = true
+		err := bkt.Delete(b.key())
+		if err != nil {
+			return fmt.Errorf("could not delete budget %v: %w", b, err)
+		}
+		err = tx.Bucket(bucketAlerts).Delete(b.key())
+		if err != nil {
+			return fmt.Errorf("could not delete budget %v alerts: %w", b, err)
+		}
+		return store.BumpVersion(tx)
+	})
+	if err != nil {
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("no budget %v", b), http.StatusNotFound)
+		return
+	}
+	log.Printf("budget %v deleted by %q", b, userFrom(r))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Alert is sent when the committed emissions of a budget cross one of
+// its thresholds.
+type Alert struct {
+	Dataset   string         `json:"dataset"`
+	Date      time.Time      `json:"date"`
+	Threshold float64        `json:"threshold"`
+	Progress  BudgetProgress `json:"progress"`
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf(
+		"dataset %q: budget %v: %.0f%% threshold crossed (%.2f/%.2f tCO2e committed, %.2f tCO2e projected)",
+		a.Dataset, a.Progress.Budget, 100*a.Threshold,
+		a.Progress.Executed+a.Progress.Planned, a.Progress.Limit,
+		a.Progress.Projected,
+	)
+}
+
+// checkBudgets sends an alert for each budget whose committed emissions
+// crossed a new threshold since the last check.
+//
+// checkBudgets is a no-op when no notifier is configured.
+func (srv *server) checkBudgets(now time.Time) {
+	if srv.notifier == nil {
+		return
+	}
+
+	var alerts []Alert
+	err := srv.db.Update(func(tx *bbolt.Tx) error {
+		bs, err := dbBudgets(tx)
+		if err != nil {
+			return err
+		}
+		ms, err := store.TripMissions(tx)
+		if err != nil {
+			return err
+		}
+
+		bkt := tx.Bucket(bucketAlerts)
+		for _, b := range bs {
+			p := progress(b, ms, now)
+			prev := 0.0
+			if raw := bkt.Get(b.key()); len(raw) == 8 {
+				prev = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+			}
+			if p.Level == prev {
+				continue
+			}
+			if p.Level > prev {
+				alerts = append(alerts, Alert{
+					Dataset:   srv.name,
+					Date:      now,
+					Threshold: p.Level,
+					Progress:  p,
+				})
+			}
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(p.Level))
+			err = bkt.Put(b.key(), buf)
+			if err != nil {
+				return fmt.Errorf("could not store budget %v alert level: %w", b, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("could not check budgets: %+v", err)
+		return
+	}
+
+	for _, a := range alerts {
+		log.Printf("budget alert: %v", a)
+		srv.alerts.Add(1)
+		go func(a Alert) {
+			defer srv.alerts.Done()
+			err := srv.notifier.notify(a)
+			if err != nil {
+				log.Printf("could not send budget alert: %+v", err)
+			}
+		}(a)
+	}
+}
+
+// budgetConfig is an entry of the budgets configuration file.
+type budgetConfig struct {
+	Dataset string `json:"dataset,omitempty"` // dataset of the budget, or all datasets if empty
+	Budget
+}
+
+// readBudgets reads the budgets configuration file and assigns the budgets
+// to their datasets.
+func readBudgets(fname string, dss []dataset) error {
+	raw, err := os.ReadFile(fname)
+	if err != nil {
+		return fmt.Errorf("could not read budgets file: %w", err)
+	}
+
+	var cfg []budgetConfig
+	err = json.Unmarshal(raw, &cfg)
+	if err != nil {
+		return fmt.Errorf("could not decode budgets file %q: %w", fname, err)
+	}
+
+	for _, v := range cfg {
+		err := v.validate()
+		if err != nil {
+			return fmt.Errorf("invalid budget %v: %w", v.Budget, err)
+		}
+		found := false
+		for i := range dss {
+			if v.Dataset == "" || v.Dataset == dss[i].Name {
+				dss[i].Budgets = append(dss[i].Budgets, v.Budget)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid budget %v: unknown dataset %q", v.Budget, v.Dataset)
+		}
+	}
+
+	return nil
+}
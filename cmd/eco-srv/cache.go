@@ -0,0 +1,107 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// dayfmt is the layout of the dates in cache keys.
+const dayfmt = "20060102"
+
+// etag returns the entity tag of the responses derived from the dataset.
+//
+// As the planned/executed classification depends on the current time,
+// the ETag changes when the dataset is modified and every hour.
+func (srv *server) etag(tx *bbolt.Tx, now time.Time) string {
+	return fmt.Sprintf(`"%s-%d-%s"`, srv.name, store.Version(tx), now.Format("2006010215"))
+}
+
+// notModified sets the ETag header of the response and reports whether
+// the client already has an up-to-date copy of the resource.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimSpace(v)
+		if v == etag || v == "*" || v == "W/"+etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// maxCacheEntries is the maximum number of responses held in cache.
+const maxCacheEntries = 256
+
+// cache holds responses computed from a given version of the dataset.
+//
+// Keys are derived from the validated parameters of the requests, and
+// an arbitrary entry is evicted when the cache is full.
+type cache struct {
+	mu   sync.Mutex
+	etag string
+	vs   map[string][]byte
+}
+
+func (c *cache) get(key, etag string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.etag != etag {
+		return nil, false
+	}
+	v, ok := c.vs[key]
+	return v, ok
+}
+
+func (c *cache) put(key, etag string, v []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.etag != etag {
+		c.etag = etag
+		c.vs = make(map[string][]byte)
+	}
+	if _, ok := c.vs[key]; !ok && len(c.vs) >= maxCacheEntries {
+		for k := range c.vs {
+			delete(c.vs, k)
+			break
+		}
+	}
+	c.vs[key] = v
+}
+
+// cached returns the ETag and the body of the response identified by key.
+// The body is computed from the dataset, unless a response computed from
+// the same version of the dataset is already in cache.
+func (srv *server) cached(key string, now time.Time, compute func(tx *bbolt.Tx) ([]byte, error)) (string, []byte, error) {
+	var (
+		etag string
+		body []byte
+	)
+	err := srv.db.View(func(tx *bbolt.Tx) error {
+		etag = srv.etag(tx, now)
+		if v, ok := srv.cache.get(key, etag); ok {
+			body = v
+			return nil
+		}
+
+		var err error
+		body, err = compute(tx)
+		if err != nil {
+			return err
+		}
+		srv.cache.put(key, etag, body)
+		return nil
+	})
+	return etag, body, err
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// dataset associates a dataset name with the path to its eco db.
+type dataset struct {
+	Name    string
+	Path    string
+	Budgets []Budget // budgets declared in the configuration
+}
+
+// parseDatasets parses a comma-separated list of [name=]path datasets.
+// When the name is omitted, it is derived from the base name of the path.
+func parseDatasets(v string) ([]dataset, error) {
+	var (
+		dss  []dataset
+		seen = make(map[string]bool)
+	)
+	for _, tok := range strings.Split(v, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+		var ds dataset
+		switch i := strings.Index(tok, "="); {
+		case i >= 0:
+			ds.Name = tok[:i]
+			ds.Path = tok[i+1:]
+		default:
+			ds.Path = tok
+			ds.Name = strings.TrimSuffix(filepath.Base(tok), filepath.Ext(tok))
+		}
+		if ds.Name == "" || ds.Path == "" || strings.Contains(ds.Name, "/") {
+			return nil, fmt.Errorf("invalid dataset %q", tok)
+		}
+		if seen[ds.Name] {
+			return nil, fmt.Errorf("duplicate dataset %q", ds.Name)
+		}
+		seen[ds.Name] = true
+		dss = append(dss, ds)
+	}
+	if len(dss) == 0 {
+		return nil, fmt.Errorf("no dataset")
+	}
+	return dss, nil
+}
+
+// datasets serves a set of named datasets.
+//
+// A dataset is selected with a "/d/{name}" path prefix or with a
+// "dataset={name}" query parameter.
+// Requests that do not select a dataset are served by the first one.
+type datasets struct {
+	names []string
+	srvs  map[string]*server
+	muxs  map[string]http.Handler
+	list  http.HandlerFunc // list of the datasets, protected like the datasets
+	az    *authz
+}
+
+func newDatasets(dss []dataset, az *authz, n notifier) (*datasets, error) {
+	o := &datasets{
+		names: make([]string, 0, len(dss)),
+		srvs:  make(map[string]*server, len(dss)),
+		muxs:  make(map[string]http.Handler, len(dss)),
+		az:    az,
+	}
+	o.list = az.wrap(o.apiDatasets)
+	for _, ds := range dss {
+		srv, err := newServer(ds.Name, ds.Path)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("could not create dataset %q: %w", ds.Name, err)
+		}
+		o.names = append(o.names, ds.Name)
+		o.srvs[ds.Name] = srv
+		o.muxs[ds.Name] = srv.routes(az)
+
+		srv.notifier = n
+		err = srv.setBudgets(ds.Budgets)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("could not set budgets of dataset %q: %w", ds.Name, err)
+		}
+		srv.checkBudgets(srv.now())
+	}
+	return o, nil
+}
+
+func (o *datasets) Close() error {
+	var err error
+	for _, name := range o.names {
+		e := o.srvs[name].Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (o *datasets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		o.healthz(w, r)
+		return
+	case "/readyz":
+		o.readyz(w, r)
+		return
+	case "/api/datasets":
+		o.list(w, r)
+		return
+	case "/login":
+		o.az.login(w, r)
+		return
+	case "/logout":
+		o.az.logout(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("dataset")
+	if strings.HasPrefix(r.URL.Path, "/d/") {
+		path := strings.TrimPrefix(r.URL.Path, "/d/")
+		i := strings.Index(path, "/")
+		if i < 0 {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		name = path[:i]
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = path[i:]
+		r2.URL.RawPath = ""
+		r = r2
+	}
+	if name == "" {
+		name = o.names[0]
+	}
+
+	mux, ok := o.muxs[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown dataset %q", name), http.StatusNotFound)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// healthz reports whether the eco-srv process is alive.
+func (o *datasets) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "ok\n")
+}
+
+// readyz reports whether all the datasets are ready to serve requests.
+func (o *datasets) readyz(w http.ResponseWriter, r *http.Request) {
+	for _, name := range o.names {
+		err := o.srvs[name].check()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %+v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "ok\n")
+}
+
+func (o *datasets) apiDatasets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(o.names)
+	if err != nil {
+		log.Printf("could not encode datasets: %+v", err)
+		return
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// forecastPeriod returns the [beg, end) period of a forecast, from the
+// inclusive from and to query dates.
+// The default period is the calendar year of now.
+func forecastPeriod(q url.Values, now time.Time) (beg, end time.Time, err error) {
+	beg = time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	end = beg.AddDate(1, 0, 0)
+
+	if v := q.Get("from"); v != "" {
+		beg, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return beg, end, fmt.Errorf("invalid forecast start date %q: %w", v, err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		end, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return beg, end, fmt.Errorf("invalid forecast end date %q: %w", v, err)
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	if !beg.Before(end) {
+		return beg, end, fmt.Errorf("invalid forecast period (%s > %s)",
+			beg.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02"),
+		)
+	}
+	return beg, end, nil
+}
+
+// apiForecast serves the projection of the emissions up to the end of a
+// period.
+func (srv *server) apiForecast(w http.ResponseWriter, r *http.Request) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
+
+	now, err := srv.asof(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	beg, end, err := forecastPeriod(r.URL.Query(), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := fmt.Sprintf("forecast?from=%s&to=%s&asof=%s",
+		beg.Format(dayfmt), end.Format(dayfmt), asofKey(r, now),
+	)
+	etag, body, err := srv.cached(key, srv.now(), func(tx *bbolt.Tx) ([]byte, error) {
+		ms, err := store.TripMissions(tx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(eco.NewForecast(ms, beg, end, now))
+	})
+	if err != nil {
+		err = fmt.Errorf("could not compute forecast: %w", err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
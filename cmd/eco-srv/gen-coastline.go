@@ -0,0 +1,83 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+
+// Command gen-coastline generates the coastline embedded in eco-srv from
+// the Natural Earth 1:110m coastline dataset.
+//
+// Natural Earth data is in the public domain:
+// https://www.naturalearthdata.com/about/terms-of-use/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+const (
+	version = "v5.1.2"
+	source  = "https://raw.githubusercontent.com/nvkelso/natural-earth-vector/" + version + "/geojson/ne_110m_coastline.geojson"
+)
+
+func main() {
+	log.SetPrefix("gen-coastline: ")
+	log.SetFlags(0)
+
+	oname := flag.String("o", "web/coastline.geojson", "path to the output GeoJSON file")
+	flag.Parse()
+
+	resp, err := http.Get(source)
+	if err != nil {
+		log.Fatalf("could not download coastline: %+v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("could not download coastline: %s", resp.Status)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("could not read coastline: %+v", err)
+	}
+
+	var fc struct {
+		Features []struct {
+			Geometry json.RawMessage `json:"geometry"`
+		} `json:"features"`
+	}
+	err = json.Unmarshal(raw, &fc)
+	if err != nil {
+		log.Fatalf("could not decode coastline: %+v", err)
+	}
+	if len(fc.Features) == 0 {
+		log.Fatalf("empty coastline")
+	}
+
+	// only the geometries are kept, one feature per line.
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, `{"type":"FeatureCollection","features":[`)
+	for i, f := range fc.Features {
+		geom := new(bytes.Buffer)
+		err = json.Compact(geom, f.Geometry)
+		if err != nil {
+			log.Fatalf("could not compact geometry of feature %d: %+v", i, err)
+		}
+		if i > 0 {
+			o.WriteString(",")
+		}
+		fmt.Fprintf(o, "\n{\"type\":\"Feature\",\"properties\":{},\"geometry\":%s}", geom.Bytes())
+	}
+	o.WriteString("\n]}\n")
+
+	err = os.WriteFile(*oname, o.Bytes(), 0644)
+	if err != nil {
+		log.Fatalf("could not write coastline: %+v", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// apiLifecycle lists the lifecycle of all the known missions:
+// GET /api/lifecycle.
+//
+// Revisions from the source database are applied with POST /api/batch.
+func (srv *server) apiLifecycle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	var lcs []eco.Lifecycle
+	err := srv.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		lcs, err = store.Lifecycles(tx)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("could not list lifecycles: %w", err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(lcs)
+	if err != nil {
+		log.Printf("could not encode lifecycles: %+v", err)
+		return
+	}
+}
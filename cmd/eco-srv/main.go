@@ -5,9 +5,18 @@
 package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -15,25 +24,168 @@ func main() {
 	log.SetFlags(0)
 
 	var (
-		addrFlag = flag.String("addr", ":80", "[host]:port to serve")
-		dbFlag   = flag.String("db", "eco.db", "path to lpc-eco database")
+		addrFlag   = flag.String("addr", ":80", "[host]:port to serve")
+		dbFlag     = flag.String("db", "eco.db", "comma-separated list of [name=]path to lpc-eco databases")
+		tokensFlag = flag.String("tokens", "", "path to API tokens file (enables authentication)")
+		authRFlag  = flag.Bool("auth-read", false, "require an API token with read scope for read endpoints")
+		genFlag    = flag.String("gen-token", "", "generate a new API token with the provided name and exit")
+		scopesFlag = flag.String("scopes", "read", "comma-separated list of scopes for the generated API token")
+
+		budgetsFlag = flag.String("budgets", "", "path to budgets configuration file")
+		webhookFlag = flag.String("notify-webhook", "", "URL of a webhook receiving budget alerts")
+		mailFlag    = flag.String("notify-file", "", "path to a file receiving budget alerts as email messages")
+		mailToFlag  = flag.String("notify-to", "root@localhost", "recipient of budget alerts email messages")
+
+		coastFlag = flag.String("coastline", "", "path to a GeoJSON coastline file for world maps (default: embedded Natural Earth coastline)")
+
+		certFlag = flag.String("tls-cert", "", "path to TLS certificate file (enables HTTPS)")
+		keyFlag  = flag.String("tls-key", "", "path to TLS private key file")
+
+		rtimeoutFlag = flag.Duration("read-timeout", 30*time.Second, "maximum duration for reading a request")
+		wtimeoutFlag = flag.Duration("write-timeout", 60*time.Second, "maximum duration before timing out writes of a response")
+		itimeoutFlag = flag.Duration("idle-timeout", 120*time.Second, "maximum duration to wait for the next request on keep-alive connections")
+		stimeoutFlag = flag.Duration("shutdown-timeout", 30*time.Second, "maximum duration to wait for in-flight requests on shutdown")
 	)
 
 	flag.Parse()
 
-	srv, err := newServer(*dbFlag)
+	if *genFlag != "" {
+		secret, tok, err := genToken(*genFlag, strings.Split(*scopesFlag, ","))
+		if err != nil {
+			log.Fatalf("could not generate API token: %+v", err)
+		}
+		raw, err := json.Marshal(tok)
+		if err != nil {
+			log.Fatalf("could not marshal API token: %+v", err)
+		}
+		fmt.Fprintf(os.Stdout, "token: %s\nentry: %s\n", secret, raw)
+		return
+	}
+
+	if (*certFlag == "") != (*keyFlag == "") {
+		log.Fatalf("-tls-cert and -tls-key must be provided together")
+	}
+
+	az, err := newAuthz(*tokensFlag, *authRFlag)
+	if err != nil {
+		log.Fatalf("could not setup authentication: %+v", err)
+	}
+	if !az.enabled() {
+		log.Printf("no API tokens configured: write endpoints are NOT protected")
+	}
+
+	if *coastFlag != "" {
+		worldCoast, err = loadCoastline(*coastFlag)
+		if err != nil {
+			log.Fatalf("could not load coastline: %+v", err)
+		}
+	}
+
+	dss, err := parseDatasets(*dbFlag)
+	if err != nil {
+		log.Fatalf("could not parse datasets: %+v", err)
+	}
+
+	if *budgetsFlag != "" {
+		err = readBudgets(*budgetsFlag, dss)
+		if err != nil {
+			log.Fatalf("could not read budgets: %+v", err)
+		}
+	}
+
+	var ns notifiers
+	if *webhookFlag != "" {
+		ns = append(ns, newWebhook(*webhookFlag))
+	}
+	if *mailFlag != "" {
+		ns = append(ns, &mailFile{fname: *mailFlag, from: "eco-srv@localhost", to: *mailToFlag})
+	}
+	var n notifier
+	if len(ns) > 0 {
+		n = ns
+	}
+
+	err = run(*addrFlag, dss, az, n, *certFlag, *keyFlag, timeouts{
+		read:     *rtimeoutFlag,
+		write:    *wtimeoutFlag,
+		idle:     *itimeoutFlag,
+		shutdown: *stimeoutFlag,
+	})
 	if err != nil {
-		log.Fatalf("could not create eco server: %+v", err)
+		log.Fatalf("error serving eco-srv: %+v", err)
+	}
+}
+
+type timeouts struct {
+	read     time.Duration
+	write    time.Duration
+	idle     time.Duration
+	shutdown time.Duration
+}
+
+func run(addr string, dss []dataset, az *authz, n notifier, cert, key string, tmo timeouts) error {
+	srv, err := newDatasets(dss, az, n)
+	if err != nil {
+		return fmt.Errorf("could not create eco server: %w", err)
 	}
 	defer srv.Close()
 
-	log.Printf("serving %q...", *addrFlag)
+	for _, ds := range dss {
+		log.Printf("dataset %q: %s", ds.Name, ds.Path)
+	}
+
+	hsrv := &http.Server{
+		Addr:              addr,
+		Handler:           srv,
+		ReadHeaderTimeout: tmo.read,
+		ReadTimeout:       tmo.read,
+		WriteTimeout:      tmo.write,
+		IdleTimeout:       tmo.idle,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		switch {
+		case cert != "":
+			log.Printf("serving %q (TLS)...", addr)
+			errc <- hsrv.ListenAndServeTLS(cert, key)
+		default:
+			log.Printf("serving %q...", addr)
+			errc <- hsrv.ListenAndServe()
+		}
+	}()
 
-	http.HandleFunc("/", srv.rootHandle)
-	http.HandleFunc("/api/last-id", srv.apiLastID)
-	http.HandleFunc("/api/stats", srv.apiStats)
-	http.HandleFunc("/api/update-db", srv.apiUpdateDB)
-	http.HandleFunc("/plot/co2", srv.plotCO2)
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		stop()
+	}
+
+	log.Printf("shutting down...")
+	for _, ds := range srv.srvs {
+		ds.ready.Store(false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tmo.shutdown)
+	defer cancel()
+
+	err = hsrv.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("could not shutdown eco-srv: %w", err)
+	}
+	if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = srv.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("shutting down... [done]")
 
-	log.Fatalf("error serving eco-srv: %+v", http.ListenAndServe(*addrFlag, nil))
+	return nil
 }
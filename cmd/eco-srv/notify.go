@@ -0,0 +1,112 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifier sends budget alerts.
+type notifier interface {
+	notify(a Alert) error
+}
+
+// notifiers sends budget alerts to multiple notifiers.
+type notifiers []notifier
+
+func (ns notifiers) notify(a Alert) error {
+	var errs []string
+	for _, n := range ns {
+		err := n.notify(a)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not notify alert: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// webhook posts budget alerts as JSON to an HTTP endpoint.
+type webhook struct {
+	url string
+	cli *http.Client
+}
+
+func newWebhook(url string) *webhook {
+	return &webhook{
+		url: url,
+		cli: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (wh *webhook) notify(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("could not marshal alert: %w", err)
+	}
+
+	resp, err := wh.cli.Post(wh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not post alert to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("invalid webhook status: %s (code=%d)", resp.Status, resp.StatusCode)
+	}
+	return nil
+}
+
+// mailFile appends budget alerts, formatted as email messages, to a file.
+//
+// The file can be picked up by a local mail transfer agent.
+type mailFile struct {
+	mu    sync.Mutex
+	fname string
+	from  string
+	to    string
+}
+
+func (mf *mailFile) notify(a Alert) error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	f, err := os.OpenFile(mf.fname, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open alerts file: %w", err)
+	}
+	defer f.Close()
+
+	msg := new(strings.Builder)
+	fmt.Fprintf(msg, "From: %s\r\n", mf.from)
+	fmt.Fprintf(msg, "To: %s\r\n", mf.to)
+	fmt.Fprintf(msg, "Date: %s\r\n", a.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Subject: [eco] budget %v: %.0f%% threshold crossed\r\n", a.Progress.Budget, 100*a.Threshold)
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(msg, "\r\n")
+	fmt.Fprintf(msg, "%s\r\n", a)
+	for _, v := range a.Progress.Warnings {
+		fmt.Fprintf(msg, "- %s\r\n", v)
+	}
+	fmt.Fprintf(msg, "\r\n")
+
+	_, err = f.WriteString(msg.String())
+	if err != nil {
+		return fmt.Errorf("could not write alert: %w", err)
+	}
+
+	return f.Close()
+}
@@ -5,15 +5,20 @@
 package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
 
 import (
+	"bytes"
 	"fmt"
 	"image/color"
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go-hep.org/x/hep/hbook"
 	"go-hep.org/x/hep/hplot"
 	"go.etcd.io/bbolt"
 	"gonum.org/v1/plot"
@@ -27,111 +32,758 @@ func (srv *server) plotCO2(w http.ResponseWriter, r *http.Request) {
 	srv.mu.RLock()
 	defer srv.mu.RUnlock()
 
-	var ms []eco.Mission
-	err := srv.db.View(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketEco)
-		if bkt == nil {
-			return fmt.Errorf("could not find bucket %q", bucketEco)
-		}
-		return bkt.ForEach(func(k, v []byte) error {
-			var m eco.Mission
-			err := m.UnmarshalBinary(v)
-			if err != nil {
-				return fmt.Errorf("could not unmarshal mission: %w", err)
+	now := srv.now()
+	etag, img, err := srv.cached("plot/co2", now, func(tx *bbolt.Tx) ([]byte, error) {
+		var (
+			xmin time.Time
+			data = make(map[eco.TransID][]daily)
+		)
+		err := store.Trips(tx, func(date, end time.Time, tid eco.TransID, cnt store.Counter) error {
+			if xmin.IsZero() {
+				xmin = date
+			}
+			if now.Before(end) {
+				return nil
 			}
-			ms = append(ms, m)
+			data[tid] = append(data[tid], daily{date, cnt})
 			return nil
 		})
+		if err != nil {
+			return nil, fmt.Errorf("could not process missions: %w", err)
+		}
+		if xmin.IsZero() || xmin.After(now) {
+			xmin = now.AddDate(-1, 0, 0)
+		}
+
+		ms, err := store.TripMissions(tx)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			beg = time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+			end = beg.AddDate(1, 0, 0)
+			fcs = make(map[eco.TransID]*eco.ModeForecast)
+			fc  = eco.NewForecast(ms, beg, end, now)
+		)
+		for i := range fc.Modes {
+			fcs[fc.Modes[i].Mode] = &fc.Modes[i]
+		}
+
+		tp := hplot.NewTiledPlot(draw.Tiles{
+			Cols: 2, Rows: 2,
+			PadX: 1 * vg.Centimeter,
+			PadY: 1 * vg.Centimeter,
+		})
+		for i, tid := range []eco.TransID{eco.Train, eco.Bus, eco.Car, eco.Plane} {
+			tp.Plots[i], err = makeTIDPlot(tid, xmin, end, data[tid], fcs[tid])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		c := &vgimg.PngCanvas{Canvas: vgimg.New(2*15*vg.Centimeter, 2*10*vg.Centimeter)}
+		tp.Draw(draw.New(c))
+
+		o := new(bytes.Buffer)
+		_, err = c.WriteTo(o)
+		if err != nil {
+			return nil, fmt.Errorf("could not write PNG canvas: %w", err)
+		}
+		return o.Bytes(), nil
 	})
 	if err != nil {
-		err = fmt.Errorf("could not process missions: %w", err)
 		log.Printf("%+v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	tp := hplot.NewTiledPlot(draw.Tiles{
-		Cols: 2, Rows: 2,
-		PadX: 1 * vg.Centimeter,
-		PadY: 1 * vg.Centimeter,
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, _ = w.Write(img)
+}
+
+// daily is the aggregate of all the missions of a given day.
+type daily struct {
+	Date time.Time
+	Cnt  store.Counter
+}
+
+// makeTIDPlot plots the cumulative distance of the executed missions of a
+// transport mode and, if any, its forecast as a dashed extension with its
+// uncertainty band.
+func makeTIDPlot(tid eco.TransID, xmin, xmax time.Time, data []daily, fc *eco.ModeForecast) (*hplot.Plot, error) {
+	p := hplot.New()
+
+	total := 0.0
+	pts := make(plotter.XYs, len(data))
+	for i, d := range data {
+		total += d.Cnt.Dist
+		pts[i].X = float64(d.Date.Unix())
+		pts[i].Y = total / 1000
+	}
+
+	cost := eco.EmissionsOf(map[eco.TransID]float64{tid: total}).Total
+	p.Title.Text = fmt.Sprintf("%s: %3.2f ± %3.2f tCO2e", strings.Title(tid.String()), cost.Value/1000, cost.Err/1000)
+	p.Y.Label.Text = "Cumulative distance [km]"
+
+	// xticks defines how we convert and display time.Time values.
+	xticks := plot.TimeTicks{Format: "2006-01-02"}
+	p.X.Tick.Marker = xticks
+	p.X.Min = float64(xmin.Unix())
+	p.X.Max = float64(xmax.Unix())
+
+	if fc != nil && len(fc.Curve) > 1 {
+		// the forecast starts from the distance executed during the
+		// forecast period, the plot from the first mission.
+		var (
+			offset = total/1000 - fc.Dist.Executed
+			mid    = make(plotter.XYs, len(fc.Curve))
+			lo     = make(plotter.XYs, len(fc.Curve))
+			hi     = make(plotter.XYs, len(fc.Curve))
+		)
+		for i, v := range fc.Curve {
+			x := float64(v.Date.Unix())
+			mid[i] = plotter.XY{X: x, Y: offset + v.Value}
+			lo[i] = plotter.XY{X: x, Y: offset + v.Low}
+			hi[i] = plotter.XY{X: x, Y: offset + v.High}
+		}
+
+		band := hplot.NewBand(color.RGBA{0, 0, 255, 48}, hi, lo)
+		p.Add(band)
+
+		line, err := hplot.NewLine(mid)
+		if err != nil {
+			return nil, fmt.Errorf("could not create forecast line plot for %v: %w", tid, err)
+		}
+		line.LineStyle.Color = color.RGBA{0, 0, 255, 255}
+		line.LineStyle.Dashes = []vg.Length{vg.Points(4), vg.Points(2)}
+		p.Add(line)
+
+		p.Title.Text += fmt.Sprintf(" (%d: %3.2f tCO2e projected)",
+			fc.Curve[0].Date.Year(), fc.CO2e.Projected/1000,
+		)
+	}
+
+	if len(pts) > 0 {
+		line, err := hplot.NewLine(pts)
+		if err != nil {
+			return nil, fmt.Errorf("could not create line plot for %v: %w", tid, err)
+		}
+		line.StepStyle = plotter.PreStep
+		line.LineStyle.Color = color.RGBA{0, 0, 255, 255}
+		p.Add(line)
+	}
+
+	p.Add(hplot.NewGrid())
+	return p, nil
+}
+
+// plotOptions configures the plots served under /plot/{kind}.
+type plotOptions struct {
+	kind   string
+	format string // png, svg or pdf
+	width  vg.Length
+	height vg.Length
+	from   time.Time // start of the date range (inclusive)
+	to     time.Time // end of the date range (inclusive)
+	modes  []eco.TransID
+	status string // planned, executed or empty for all missions
+	now    time.Time
+	bins   int    // number of bins of histograms
+	proj   string // projection of maps
+}
+
+var plotContentTypes = map[string]string{
+	"png": "image/png",
+	"svg": "image/svg+xml",
+	"pdf": "application/pdf",
+}
+
+// plotKinds lists all the available plots.
+var plotKinds = map[string]func(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error){
+	"cumdist": plotCumDist,
+	"cumco2":  plotCumCO2,
+	"monthly": plotMonthly,
+	"hist":    plotHist,
+	"groups":  plotGroups,
+	"modes":   plotModes,
+	"map":     plotMap,
+}
+
+func parsePlotOptions(kind string, q url.Values, now time.Time) (plotOptions, error) {
+	opts := plotOptions{
+		kind:   kind,
+		format: "png",
+		width:  20 * vg.Centimeter,
+		height: 12 * vg.Centimeter,
+		modes:  append([]eco.TransID{eco.Unknown}, eco.TransIDs...),
+		now:    now,
+		bins:   50,
+		proj:   "equirect",
+	}
+
+	if _, ok := plotKinds[kind]; !ok {
+		return opts, fmt.Errorf("unknown plot kind %q", kind)
+	}
+
+	if v := q.Get("format"); v != "" {
+		if _, ok := plotContentTypes[v]; !ok {
+			return opts, fmt.Errorf("invalid plot format %q", v)
+		}
+		opts.format = v
+	}
+
+	for _, v := range []struct {
+		name string
+		dst  *vg.Length
+	}{
+		{"width", &opts.width},
+		{"height", &opts.height},
+	} {
+		raw := q.Get(v.name)
+		if raw == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(raw, 64); err == nil {
+			raw += "cm"
+		}
+		l, err := vg.ParseLength(raw)
+		if err != nil || l <= 0 || l > 100*vg.Centimeter {
+			return opts, fmt.Errorf("invalid plot %s %q", v.name, q.Get(v.name))
+		}
+		*v.dst = l
+	}
+	if kind == "map" && q.Get("height") == "" {
+		opts.height = opts.width / 2
+	}
+
+	for _, v := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"from", &opts.from},
+		{"to", &opts.to},
+	} {
+		raw := q.Get(v.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return opts, fmt.Errorf("invalid plot %s date %q: %w", v.name, raw, err)
+		}
+		*v.dst = t.UTC()
+	}
+	if !opts.to.IsZero() {
+		// make the end of the date range inclusive.
+		opts.to = opts.to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	if !opts.from.IsZero() && !opts.to.IsZero() && opts.to.Before(opts.from) {
+		return opts, fmt.Errorf("invalid plot date range (%s > %s)",
+			opts.from.Format("2006-01-02"), opts.to.Format("2006-01-02"),
+		)
+	}
+
+	if v := q.Get("modes"); v != "" {
+		opts.modes = nil
+		for _, name := range strings.Split(v, ",") {
+			tid, err := eco.ParseTransID(strings.TrimSpace(name))
+			if err != nil {
+				return opts, fmt.Errorf("invalid plot mode: %w", err)
+			}
+			opts.modes = append(opts.modes, tid)
+		}
+	}
+
+	switch v := q.Get("status"); v {
+	case "", "planned", "executed":
+		opts.status = v
+	default:
+		return opts, fmt.Errorf("invalid mission status %q", v)
+	}
+
+	if v := q.Get("proj"); v != "" {
+		if _, ok := projections[v]; !ok {
+			return opts, fmt.Errorf("invalid map projection %q", v)
+		}
+		opts.proj = v
+	}
+
+	if v := q.Get("bins"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			return opts, fmt.Errorf("invalid number of bins %q", v)
+		}
+		opts.bins = n
+	}
+
+	return opts, nil
+}
+
+// key returns the normalised plot options, to be used in cache keys.
+func (opts plotOptions) key(asof string) string {
+	modes := make([]string, len(opts.modes))
+	for i, tid := range opts.modes {
+		modes[i] = strconv.Itoa(int(tid))
+	}
+	day := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(dayfmt)
+	}
+	return fmt.Sprintf(
+		"format=%s&width=%g&height=%g&from=%s&to=%s&modes=%s&status=%s&bins=%d&proj=%s&asof=%s",
+		opts.format, float64(opts.width), float64(opts.height),
+		day(opts.from), day(opts.to), strings.Join(modes, ","),
+		opts.status, opts.bins, opts.proj, asof,
+	)
+}
+
+// selected returns the missions matching the plot options.
+func (opts plotOptions) selected(ms []eco.Mission) []eco.Mission {
+	modes := make(map[eco.TransID]bool, len(opts.modes))
+	for _, tid := range opts.modes {
+		modes[tid] = true
+	}
+
+	o := make([]eco.Mission, 0, len(ms))
+	for _, m := range ms {
+		if !modes[m.Trans] {
+			continue
+		}
+		if !opts.from.IsZero() && m.Date.Before(opts.from) {
+			continue
+		}
+		if !opts.to.IsZero() && m.Date.After(opts.to) {
+			continue
+		}
+		switch opts.status {
+		case "planned":
+			if !m.Planned(opts.now) {
+				continue
+			}
+		case "executed":
+			if m.Planned(opts.now) {
+				continue
+			}
+		}
+		o = append(o, m)
+	}
+
+	sort.SliceStable(o, func(i, j int) bool {
+		return o[i].Date.Before(o[j].Date)
 	})
-	tp.Plots[0] = makeTIDPlot(eco.Train, ms)
-	tp.Plots[1] = makeTIDPlot(eco.Bus, ms)
-	tp.Plots[2] = makeTIDPlot(eco.Car, ms)
-	tp.Plots[3] = makeTIDPlot(eco.Plane, ms)
+	return o
+}
 
-	c := &vgimg.PngCanvas{vgimg.New(2*15*vg.Centimeter, 2*10*vg.Centimeter)}
-	tp.Draw(draw.New(c))
+// plotHandle serves the /plot/{kind} family of plots.
+func (srv *server) plotHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
 
-	w.Header().Set("Content-Type", "image/png")
-	_, err = c.WriteTo(w)
+	now, err := srv.asof(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind := strings.Trim(strings.TrimPrefix(r.URL.Path, "/plot/"), "/")
+	opts, err := parsePlotOptions(kind, r.URL.Query(), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	key := "plot/" + kind + "?" + opts.key(asofKey(r, now))
+	etag, img, err := srv.cached(key, srv.now(), func(tx *bbolt.Tx) ([]byte, error) {
+		// maps need the destinations of the missions, the other plots
+		// are computed from the aggregates.
+		load := store.TripMissions
+		if kind == "map" {
+			load = store.Missions
+		}
+		ms, err := load(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := plotKinds[kind](opts.selected(ms), opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not create %q plot: %w", kind, err)
+		}
+
+		wt, err := p.WriterTo(opts.width, opts.height, opts.format)
+		if err != nil {
+			return nil, fmt.Errorf("could not create %q plot canvas: %w", kind, err)
+		}
+
+		o := new(bytes.Buffer)
+		_, err = wt.WriteTo(o)
+		if err != nil {
+			return nil, fmt.Errorf("could not render %q plot: %w", kind, err)
+		}
+		return o.Bytes(), nil
+	})
 	if err != nil {
-		err = fmt.Errorf("could not write PNG canvas: %w", err)
 		log.Printf("%+v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", plotContentTypes[opts.format])
+	_, _ = w.Write(img)
 }
 
-func makeTIDPlot(tid eco.TransID, ms []eco.Mission) *hplot.Plot {
-	var (
-		now  = time.Now().UTC()
-		xmin = ms[0].Date
-		xmax = now
-	)
+// modeColors associates a color to each transport mode.
+var modeColors = map[eco.TransID]color.Color{
+	eco.Unknown:   color.RGBA{0x99, 0x99, 0x99, 0xff},
+	eco.Bike:      color.RGBA{0x1b, 0x9e, 0x77, 0xff},
+	eco.Tramway:   color.RGBA{0x66, 0xa6, 0x1e, 0xff},
+	eco.Train:     color.RGBA{0x75, 0x70, 0xb3, 0xff},
+	eco.Bus:       color.RGBA{0xe6, 0xab, 0x02, 0xff},
+	eco.Passenger: color.RGBA{0xa6, 0x76, 0x1d, 0xff},
+	eco.Car:       color.RGBA{0xd9, 0x5f, 0x02, 0xff},
+	eco.Plane:     color.RGBA{0xe7, 0x29, 0x8a, 0xff},
+}
 
+func newPlot(title string) *hplot.Plot {
 	p := hplot.New()
-	sort.Slice(ms, func(i, j int) bool {
-		mi := ms[i]
-		mj := ms[j]
-		switch {
-		case mi.Date.Equal(mj.Date):
-			return mi.ID < mj.ID
-		default:
-			return mi.Date.Before(mj.Date)
+	p.Title.Text = title
+	p.Legend.Top = true
+	p.Legend.Left = true
+	p.Add(hplot.NewGrid())
+	return p
+}
+
+// timeAxis configures the X-axis of p to display the time range of the plot.
+func timeAxis(p *hplot.Plot, ms []eco.Mission, opts plotOptions) {
+	xmax := opts.to
+	if xmax.IsZero() {
+		xmax = opts.now
+		if n := len(ms); n > 0 && ms[n-1].Date.After(xmax) {
+			xmax = ms[n-1].Date
 		}
+	}
+	xmin := opts.from
+	if xmin.IsZero() && len(ms) > 0 {
+		xmin = ms[0].Date
+	}
+	if xmin.IsZero() || !xmin.Before(xmax) {
+		xmin = xmax.AddDate(-1, 0, 0)
+	}
+	p.X.Tick.Marker = plot.TimeTicks{Format: "2006-01-02"}
+	p.X.Min = float64(xmin.Unix())
+	p.X.Max = float64(xmax.Unix())
+}
+
+// plotCumulative plots, for each transport mode, the cumulative sum of
+// the value of each mission.
+func plotCumulative(ms []eco.Mission, opts plotOptions, value func(m eco.Mission) float64) (*hplot.Plot, error) {
+	p := newPlot("")
+	timeAxis(p, ms, opts)
+
+	for _, tid := range opts.modes {
+		var (
+			total = 0.0
+			pts   = make(plotter.XYs, 0)
+		)
+		for _, m := range ms {
+			if m.Trans != tid {
+				continue
+			}
+			total += value(m)
+			pts = append(pts, plotter.XY{X: float64(m.Date.Unix()), Y: total})
+		}
+		if len(pts) == 0 {
+			continue
+		}
+		// extend the curve up to the end of the time range.
+		pts = append(pts, plotter.XY{X: p.X.Max, Y: total})
+
+		line, err := hplot.NewLine(pts)
+		if err != nil {
+			return nil, fmt.Errorf("could not create line plot for %v: %w", tid, err)
+		}
+		line.StepStyle = plotter.PreStep
+		line.LineStyle.Color = modeColors[tid]
+		line.LineStyle.Width = vg.Points(1.5)
+		p.Add(line)
+		p.Legend.Add(tid.String(), line)
+	}
+
+	return p, nil
+}
+
+func plotCumDist(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error) {
+	p, err := plotCumulative(ms, opts, func(m eco.Mission) float64 {
+		return m.Dist / 1000
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.Title.Text = "Cumulative distance"
+	p.Y.Label.Text = "Cumulative distance [km]"
+	return p, nil
+}
+
+func plotCumCO2(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error) {
+	p, err := plotCumulative(ms, opts, func(m eco.Mission) float64 {
+		return eco.CostOf(m.Trans, m.Dist) / 1000
 	})
+	if err != nil {
+		return nil, err
+	}
+	p.Title.Text = "Cumulative CO2e"
+	p.Y.Label.Text = "Cumulative CO2e [tCO2e]"
+	return p, nil
+}
+
+// plotMonthly plots the CO2e emissions per month, stacked by transport mode.
+func plotMonthly(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error) {
+	p := newPlot("Monthly CO2e")
+	p.Y.Label.Text = "CO2e [tCO2e]"
+
+	var (
+		months []string
+		index  = make(map[string]int)
+	)
+	if len(ms) > 0 {
+		beg := time.Date(ms[0].Date.Year(), ms[0].Date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		end := ms[len(ms)-1].Date
+		for t := beg; !t.After(end); t = t.AddDate(0, 1, 0) {
+			index[t.Format("2006-01")] = len(months)
+			months = append(months, t.Format("2006-01"))
+		}
+	}
+	if len(months) == 0 {
+		p.NominalX("N/A")
+		return p, nil
+	}
 
-	data := make([]eco.Mission, 0, len(ms))
+	var (
+		vals  = make(map[eco.TransID]plotter.Values, len(opts.modes))
+		dists = make([]map[eco.TransID]float64, len(months))
+	)
+	for _, tid := range opts.modes {
+		vals[tid] = make(plotter.Values, len(months))
+	}
+	for i := range dists {
+		dists[i] = make(map[eco.TransID]float64)
+	}
 	for _, m := range ms {
-		if m.Date.Before(xmin) {
-			xmin = m.Date
+		i := index[m.Date.Format("2006-01")]
+		vals[m.Trans][i] += eco.CostOf(m.Trans, m.Dist) / 1000
+		dists[i][m.Trans] += m.Dist
+	}
+
+	var (
+		prev  *plotter.BarChart
+		width = vg.Points(float64(opts.width) * 0.6 / float64(len(months)))
+	)
+	for _, tid := range opts.modes {
+		bars, err := plotter.NewBarChart(vals[tid], width)
+		if err != nil {
+			return nil, fmt.Errorf("could not create bar chart for %v: %w", tid, err)
 		}
-		if m.Trans != tid {
-			continue
+		bars.LineStyle.Width = 0
+		bars.Color = modeColors[tid]
+		if prev != nil {
+			bars.StackOn(prev)
 		}
-		if m.Date.After(now) {
-			continue
+		prev = bars
+		p.Add(bars)
+		p.Legend.Add(tid.String(), bars)
+	}
+
+	errs, err := errorBars(dists)
+	if err != nil {
+		return nil, err
+	}
+	p.Add(errs)
+
+	p.NominalX(months...)
+	p.X.Tick.Label.Rotation = 0.8
+	p.X.Tick.Label.XAlign = draw.XRight
+
+	return p, nil
+}
+
+// plotHist plots the distribution of the distance of missions.
+func plotHist(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error) {
+	p := newPlot("Distance distribution")
+	p.X.Label.Text = "Distance [km]"
+	p.Y.Label.Text = "Missions"
+
+	xmax := 0.0
+	for _, m := range ms {
+		if v := m.Dist / 1000; v > xmax {
+			xmax = v
 		}
-		data = append(data, m)
+	}
+	if xmax <= 0 {
+		xmax = 1
 	}
 
-	total := 0.0
-	pts := make(plotter.XYs, len(data))
-	for i, m := range data {
-		total += m.Dist
-		pts[i].X = float64(m.Date.Unix())
-		pts[i].Y = total / 1000
+	h := hbook.NewH1D(opts.bins, 0, xmax*1.001)
+	for _, m := range ms {
+		h.Fill(m.Dist/1000, 1)
 	}
 
-	cost := eco.CostOf(tid, total)
-	p.Title.Text = fmt.Sprintf("%s: %3.2f tCO2e", strings.Title(tid.String()), cost/1000)
-	p.Y.Label.Text = "Cumulative distance [km]"
+	hh := hplot.NewH1D(h)
+	hh.Infos.Style = hplot.HInfoNone
+	hh.FillColor = color.RGBA{0x75, 0x70, 0xb3, 0xaa}
+	p.Add(hh)
 
-	// xticks defines how we convert and display time.Time values.
-	xticks := plot.TimeTicks{Format: "2006-01-02"}
-	p.X.Tick.Marker = xticks
-	p.X.Min = float64(xmin.Unix())
-	p.X.Max = float64(xmax.Unix())
+	return p, nil
+}
+
+// plotGroups plots the CO2e emissions per funding group.
+func plotGroups(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error) {
+	p := newPlot("CO2e per group")
+	p.Y.Label.Text = "CO2e [tCO2e]"
+
+	var (
+		sums  = make(map[string]float64)
+		dists = make(map[string]map[eco.TransID]float64)
+	)
+	for _, m := range ms {
+		grp := m.Group
+		if grp == "" {
+			grp = "N/A"
+		}
+		sums[grp] += eco.CostOf(m.Trans, m.Dist) / 1000
+		if dists[grp] == nil {
+			dists[grp] = make(map[eco.TransID]float64)
+		}
+		dists[grp][m.Trans] += m.Dist
+	}
+	if len(sums) == 0 {
+		p.NominalX("N/A")
+		return p, nil
+	}
+
+	grps := make([]string, 0, len(sums))
+	for grp := range sums {
+		grps = append(grps, grp)
+	}
+	sort.Slice(grps, func(i, j int) bool {
+		if sums[grps[i]] == sums[grps[j]] {
+			return grps[i] < grps[j]
+		}
+		return sums[grps[i]] > sums[grps[j]]
+	})
 
-	line, err := hplot.NewLine(pts)
+	vals := make(plotter.Values, len(grps))
+	for i, grp := range grps {
+		vals[i] = sums[grp]
+	}
+
+	bars, err := plotter.NewBarChart(vals, vg.Points(float64(opts.width)*0.6/float64(len(grps))))
 	if err != nil {
-		panic(fmt.Errorf("could not create line plot for %v: %w", tid, err))
+		return nil, fmt.Errorf("could not create bar chart: %w", err)
 	}
-	line.StepStyle = plotter.PreStep
-	line.LineStyle.Color = color.RGBA{0, 0, 255, 255}
+	bars.LineStyle.Width = 0
+	bars.Color = color.RGBA{0x2e, 0x5d, 0x34, 0xff}
+	p.Add(bars)
 
-	p.Add(line)
-	p.Add(hplot.NewGrid())
-	return p
+	ds := make([]map[eco.TransID]float64, len(grps))
+	for i, grp := range grps {
+		ds[i] = dists[grp]
+	}
+	errs, err := errorBars(ds)
+	if err != nil {
+		return nil, err
+	}
+	p.Add(errs)
+
+	p.NominalX(grps...)
+	p.X.Tick.Label.Rotation = 0.8
+	p.X.Tick.Label.XAlign = draw.XRight
+
+	return p, nil
+}
+
+// plotModes plots the CO2e emissions per transport mode.
+func plotModes(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error) {
+	p := newPlot("CO2e per transport mode")
+	p.Y.Label.Text = "CO2e [tCO2e]"
+
+	var (
+		names = make([]string, len(opts.modes))
+		vals  = make(plotter.Values, len(opts.modes))
+		dists = make([]map[eco.TransID]float64, len(opts.modes))
+	)
+	for i, tid := range opts.modes {
+		names[i] = tid.String()
+		dists[i] = make(map[eco.TransID]float64)
+		for _, m := range ms {
+			if m.Trans != tid {
+				continue
+			}
+			vals[i] += eco.CostOf(m.Trans, m.Dist) / 1000
+			dists[i][tid] += m.Dist
+		}
+	}
+	if len(names) == 0 {
+		p.NominalX("N/A")
+		return p, nil
+	}
+
+	width := vg.Points(float64(opts.width) * 0.6 / float64(len(names)))
+	for i, tid := range opts.modes {
+		v := make(plotter.Values, len(names))
+		v[i] = vals[i]
+		bars, err := plotter.NewBarChart(v, width)
+		if err != nil {
+			return nil, fmt.Errorf("could not create bar chart for %v: %w", tid, err)
+		}
+		bars.LineStyle.Width = 0
+		bars.Color = modeColors[tid]
+		p.Add(bars)
+	}
+
+	errs, err := errorBars(dists)
+	if err != nil {
+		return nil, err
+	}
+	p.Add(errs)
+
+	p.NominalX(names...)
+	return p, nil
+}
+
+// errorBars returns the error bars of the 95% confidence intervals of the
+// CO2e emissions (in tCO2e) of the provided distances per transport mode,
+// at the positions of the bars of a bar chart.
+func errorBars(dists []map[eco.TransID]float64) (*plotter.YErrorBars, error) {
+	pts := struct {
+		plotter.XYs
+		plotter.YErrors
+	}{
+		XYs:     make(plotter.XYs, len(dists)),
+		YErrors: make(plotter.YErrors, len(dists)),
+	}
+	for i, ds := range dists {
+		v := eco.EmissionsOf(ds).Total
+		pts.XYs[i] = plotter.XY{X: float64(i), Y: v.Value / 1000}
+		pts.YErrors[i].Low = (v.Value - v.Low) / 1000
+		pts.YErrors[i].High = (v.High - v.Value) / 1000
+	}
+
+	errs, err := plotter.NewYErrorBars(pts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create error bars: %w", err)
+	}
+	errs.LineStyle.Width = vg.Points(1)
+	return errs, nil
 }
@@ -5,147 +5,215 @@
 package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
 
 import (
-	"encoding/binary"
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
-	"text/template"
+	"sync/atomic"
 	"time"
 
 	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
 	"go.etcd.io/bbolt"
 )
 
-var (
-	bucketUpdate = []byte("last-update")
-	bucketEco    = []byte("eco")
-	bucketOSM    = []byte("osm")
-)
-
 type server struct {
+	name string // name of the dataset
+
 	mu   sync.RWMutex
 	db   *bbolt.DB
 	mid  int32     // last mission id
 	last time.Time // last updated
+
+	ready  atomic.Bool // whether the server is ready to serve requests
+	closed atomic.Bool // whether the eco db has been closed
+
+	cache cache // responses computed from the current dataset version
+
+	notifier notifier       // budget alerts notifier, if any
+	alerts   sync.WaitGroup // in-flight budget alerts
+
+	clock func() time.Time // reference clock, or time.Now if nil
 }
 
-func newServer(name string) (*server, error) {
-	db, err := bbolt.Open("eco.db", 0644, &bbolt.Options{Timeout: 1 * time.Second})
+func newServer(name, fname string) (*server, error) {
+	db, err := bbolt.Open(fname, 0644, &bbolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		return nil, fmt.Errorf("could not open eco db: %w", err)
+		return nil, fmt.Errorf("could not open eco db %q: %w", fname, err)
 	}
 
-	srv := &server{db: db, last: time.Now().UTC()}
+	srv := &server{name: name, db: db, last: time.Now().UTC()}
 	err = srv.init()
 	if err != nil {
 		return nil, fmt.Errorf("could not initialize eco server: %w", err)
 	}
+	srv.ready.Store(true)
 
 	return srv, nil
 }
 
 func (srv *server) init() error {
-	err := srv.db.Update(func(tx *bbolt.Tx) error {
-		upd, err := tx.CreateBucketIfNotExists(bucketUpdate)
+	return srv.db.Update(func(tx *bbolt.Tx) error {
+		err := store.Setup(tx)
 		if err != nil {
-			return fmt.Errorf("could not create %q bucket: %w", bucketUpdate, err)
+			return fmt.Errorf("could not setup eco db: %w", err)
 		}
-		if upd == nil {
-			return fmt.Errorf("could not create %q bucket", bucketUpdate)
+
+		for _, name := range [][]byte{
+			bucketBudgets,
+			bucketAlerts,
+			bucketBatches,
+		} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("could not create %q bucket: %w", name, err)
+			}
 		}
 
-		eco, err := tx.CreateBucketIfNotExists(bucketEco)
+		srv.mid, err = store.LastID(tx)
 		if err != nil {
-			return fmt.Errorf("could not create %q bucket: %w", bucketEco, err)
-		}
-		if eco == nil {
-			return fmt.Errorf("could not create %q bucket", bucketEco)
+			return fmt.Errorf("could not find last mission id: %w", err)
 		}
 
-		osm, err := tx.CreateBucketIfNotExists(bucketOSM)
+		last, ok, err := store.LastUpdate(tx)
 		if err != nil {
-			return fmt.Errorf("could not create %q bucket: %w", bucketOSM, err)
+			return fmt.Errorf("could not find last-update: %w", err)
 		}
-		if osm == nil {
-			return fmt.Errorf("could not create %q bucket", bucketOSM)
+		if ok {
+			srv.last = last
 		}
-
 		return nil
 	})
-	if err != nil {
-		return fmt.Errorf("could not setup eco db buckets: %w", err)
-	}
+}
 
-	err = srv.db.View(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketEco)
-		if bkt == nil {
-			return fmt.Errorf("could not find %q bucket", bucketEco)
-		}
-		return bkt.ForEach(func(k, v []byte) error {
-			id := int32(binary.LittleEndian.Uint32(k))
-			if id > srv.mid {
-				srv.mid = id
-			}
-			return nil
-		})
-	})
-	if err != nil {
-		return fmt.Errorf("could not find last mission id: %w", err)
+// routes returns the HTTP handler serving all the endpoints of a dataset.
+func (srv *server) routes(az *authz) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", az.wrap(srv.rootHandle))
+	mux.HandleFunc("/api/last-id", az.wrap(srv.apiLastID))
+	mux.HandleFunc("/api/stats", az.wrap(srv.apiStats))
+	mux.HandleFunc("/api/export", az.wrap(srv.apiExport))
+	mux.HandleFunc("/api/missions/", az.wrap(srv.apiMissions))
+	mux.HandleFunc("/api/lifecycle", az.wrap(srv.apiLifecycle))
+	mux.HandleFunc("/api/batch", az.wrap(srv.apiBatch))
+	mux.HandleFunc("/api/budget", az.wrap(srv.apiBudget))
+	mux.HandleFunc("/api/forecast", az.wrap(srv.apiForecast))
+	mux.HandleFunc("/api/map", az.wrap(srv.apiMap))
+	mux.HandleFunc("/api/coastline", az.wrap(srv.apiCoastline))
+	mux.HandleFunc("/plot/co2", az.wrap(srv.plotCO2))
+	mux.HandleFunc("/plot/", az.wrap(srv.plotHandle))
+	mux.Handle("/static/", http.FileServer(http.FS(webFS)))
+	return mux
+}
+
+func (srv *server) Close() error {
+	srv.ready.Store(false)
+	if srv.closed.Swap(true) {
+		return nil
 	}
 
-	err = srv.db.View(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketUpdate)
-		if bkt == nil {
-			return fmt.Errorf("could not find %q bucket", bucketUpdate)
-		}
-		raw := bkt.Get(bucketUpdate)
-		if raw == nil {
-			return nil
-		}
+	srv.alerts.Wait()
 
-		return srv.last.UnmarshalBinary(raw)
-	})
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	err := srv.db.Close()
 	if err != nil {
-		return fmt.Errorf("could not find last-update: %w", err)
+		return fmt.Errorf("could not close eco db: %w", err)
 	}
 
 	return nil
 }
 
-func (srv *server) Close() error {
-	err := srv.db.Close()
-	if err != nil {
-		return fmt.Errorf("could not close eco db: %w", err)
+// check reports whether the dataset is ready to serve requests.
+func (srv *server) check() error {
+	if !srv.ready.Load() {
+		return fmt.Errorf("dataset %q is not ready", srv.name)
 	}
 
-	return nil
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	return srv.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(store.BucketEco) == nil {
+			return fmt.Errorf("could not find %q bucket", store.BucketEco)
+		}
+		return nil
+	})
 }
 
 func (srv *server) rootHandle(w http.ResponseWriter, r *http.Request) {
-	stats, err := srv.stats()
-	if err != nil {
-		err = fmt.Errorf("could not compute eco stats: %w", err)
-		log.Printf("%+v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
 		return
 	}
+
 	srv.mu.RLock()
-	last := srv.last.Format("2006-01-02 15:04:05")
-	srv.mu.RUnlock()
+	defer srv.mu.RUnlock()
 
-	err = rootTmpl.Execute(w, map[string]interface{}{
-		"Stats":   stats,
-		"Updated": last,
+	now := srv.now()
+	etag, page, err := srv.cached("root", now, func(tx *bbolt.Tx) ([]byte, error) {
+		o := new(bytes.Buffer)
+		err := rootTmpl.Execute(o, map[string]interface{}{
+			"Dataset": srv.name,
+			"Updated": srv.last.Format("2006-01-02 15:04:05"),
+			"Prefix":  "/d/" + srv.name,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not execute html template: %w", err)
+		}
+		return o.Bytes(), nil
 	})
 	if err != nil {
-		err = fmt.Errorf("could not execute html template: %w", err)
 		log.Printf("%+v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(page)
+}
+
+// now returns the current time of the server clock.
+func (srv *server) now() time.Time {
+	if srv.clock != nil {
+		return srv.clock().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// asof returns the reference time of a request: the time given by its
+// asof query parameter (YYYY-MM-DD or RFC 3339), or the current time.
+func (srv *server) asof(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get("asof")
+	if v == "" {
+		return srv.now(), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, v)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid reference time %q", v)
+}
+
+// asofKey returns the normalised reference time of a request, to be used
+// in cache keys.
+func asofKey(r *http.Request, asof time.Time) string {
+	if r.URL.Query().Get("asof") == "" {
+		return ""
+	}
+	return asof.Format(time.RFC3339Nano)
 }
 
 func (srv *server) apiLastID(w http.ResponseWriter, r *http.Request) {
@@ -173,6 +241,9 @@ func (srv *server) apiLastID(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// maxMCSamples is the maximum number of Monte Carlo samples of a request.
+const maxMCSamples = 100000
+
 func (srv *server) apiStats(w http.ResponseWriter, r *http.Request) {
 	srv.mu.RLock()
 	defer srv.mu.RUnlock()
@@ -182,270 +253,145 @@ func (srv *server) apiStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	summ := eco.NewSummary()
-	err := srv.db.View(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketEco)
-		if bkt == nil {
-			return fmt.Errorf("could not find bucket %q", bucketEco)
+	// number of Monte Carlo samples used to propagate the uncertainties
+	// of the emissions, or analytical propagation if zero.
+	mc := 0
+	if v := r.URL.Query().Get("mc"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxMCSamples {
+			http.Error(w, fmt.Sprintf("invalid number of Monte Carlo samples %q", v), http.StatusBadRequest)
+			return
 		}
-		return bkt.ForEach(func(k, v []byte) error {
-			var m eco.Mission
-			err := m.UnmarshalBinary(v)
-			if err != nil {
-				return fmt.Errorf("could not unmarshal mission: %w", err)
-			}
+		mc = n
+	}
 
-			summ.Add(m)
+	asof, err := srv.asof(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			return nil
-		})
+	key := fmt.Sprintf("stats?mc=%d&asof=%s", mc, asofKey(r, asof))
+	etag, body, err := srv.cached(key, srv.now(), func(tx *bbolt.Tx) ([]byte, error) {
+		summ, err := store.Summary(tx, asof)
+		if err != nil {
+			return nil, fmt.Errorf("could not process missions: %w", err)
+		}
+		if mc > 0 {
+			// use a fixed seed so that responses can be cached.
+			rnd := rand.New(rand.NewSource(1))
+			for _, st := range []*eco.Stats{&summ.All, &summ.Planned, &summ.Executed, &summ.Avoided} {
+				st.CO2e = st.Simulate(mc, rnd)
+			}
+		}
+		return json.Marshal(summ)
 	})
 	if err != nil {
-		err = fmt.Errorf("could not process missions: %w", err)
+		err = fmt.Errorf("could not compute eco stats: %w", err)
 		log.Printf("%+v", err)
-		http.Error(
-			w,
-			fmt.Errorf("could not encode last-mission ID: %w", err).Error(),
-			http.StatusInternalServerError,
-		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	err = json.NewEncoder(w).Encode(summ)
-	if err != nil {
-		log.Printf("could not encode last-mission ID: %+v", err)
-		http.Error(
-			w,
-			fmt.Errorf("could not encode last-mission ID: %w", err).Error(),
-			http.StatusInternalServerError,
-		)
+	if notModified(w, r, etag) {
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
 }
 
-func (srv *server) apiUpdateDB(w http.ResponseWriter, r *http.Request) {
-	srv.mu.Lock()
-	defer srv.mu.Unlock()
+// apiExport exports all the missions of the dataset, as JSON or CSV.
+func (srv *server) apiExport(w http.ResponseWriter, r *http.Request) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
 
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodGet {
 		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
 		return
 	}
 
-	defer r.Body.Close()
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json", "csv":
+	default:
+		http.Error(w, fmt.Sprintf("invalid export format %q", format), http.StatusBadRequest)
+		return
+	}
 
 	var ms []eco.Mission
-	err := json.NewDecoder(r.Body).Decode(&ms)
+	err := srv.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		ms, err = store.Missions(tx)
+		return err
+	})
 	if err != nil {
-		log.Printf("could not decode update-db request payload: %+v", err)
-		http.Error(w,
-			fmt.Sprintf("could not decode update-db request payload: %+v", err),
-			http.StatusInternalServerError,
-		)
+		err = fmt.Errorf("could not process missions: %w", err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if len(ms) == 0 {
-		log.Printf("received an empty mission list")
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", srv.name+".csv"))
+		err = writeCSV(w, ms)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(ms)
+	}
+	if err != nil {
+		log.Printf("could not export missions: %+v", err)
 		return
 	}
+}
 
-	err = srv.db.Update(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketEco)
-		if bkt == nil {
-			return fmt.Errorf("could not access %q bucket", bucketEco)
-		}
-
-		id := make([]byte, 4)
-		for _, m := range ms {
-			binary.LittleEndian.PutUint32(id, uint32(m.ID))
-			buf, err := m.MarshalBinary()
-			if err != nil {
-				return fmt.Errorf("could not marshal mission %v: %w", m, err)
-			}
-
-			err = bkt.Put(id, buf)
-			if err != nil {
-				return fmt.Errorf("could not store mission %v: %w", m, err)
-			}
-			if m.ID > srv.mid {
-				srv.mid = m.ID
-			}
-		}
-		return nil
+func writeCSV(w io.Writer, ms []eco.Mission) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{
+		"id", "date", "dest", "lat", "lng", "dist_km", "transport",
 	})
-
 	if err != nil {
-		err = fmt.Errorf("could not update eco db buckets: %w", err)
-		log.Printf("%+v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return fmt.Errorf("could not write CSV header: %w", err)
 	}
 
-	srv.last = time.Now().UTC()
-	err = srv.db.Update(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketUpdate)
-		if bkt == nil {
-			return fmt.Errorf("could not access %q bucket", bucketUpdate)
-		}
-
-		raw, err := srv.last.MarshalBinary()
+	for _, m := range ms {
+		err = cw.Write([]string{
+			strconv.Itoa(int(m.ID)),
+			m.Date.Format("2006-01-02"),
+			m.Dest.Name,
+			strconv.FormatFloat(m.Dest.Lat, 'f', -1, 64),
+			strconv.FormatFloat(m.Dest.Lng, 'f', -1, 64),
+			strconv.FormatFloat(m.Dist/1000, 'f', 3, 64),
+			m.Trans.String(),
+		})
 		if err != nil {
-			return fmt.Errorf("could not marshal last-update: %w", err)
+			return fmt.Errorf("could not write mission %d: %w", m.ID, err)
 		}
+	}
 
-		return bkt.Put(bucketUpdate, raw)
-	})
-
-	log.Printf("updated eco db with %d missions (%d -> %d)", len(ms),
-		ms[0].ID,
-		ms[len(ms)-1].ID,
-	)
+	cw.Flush()
+	return cw.Error()
 }
 
-func (srv *server) stats() (string, error) {
-	srv.mu.RLock()
-	defer srv.mu.RUnlock()
-
-	summ := eco.NewSummary()
-	err := srv.db.View(func(tx *bbolt.Tx) error {
-		bkt := tx.Bucket(bucketEco)
-		if bkt == nil {
-			return fmt.Errorf("could not find bucket %q", bucketEco)
-		}
-		return bkt.ForEach(func(k, v []byte) error {
-			var m eco.Mission
-			err := m.UnmarshalBinary(v)
-			if err != nil {
-				return fmt.Errorf("could not unmarshal mission: %w", err)
-			}
-
-			summ.Add(m)
+// invalidMissions replies to a request with the validation errors of its
+// missions, with a 422 status.
+func invalidMissions(w http.ResponseWriter, errs []*eco.ValidationError) {
+	for _, err := range errs {
+		log.Printf("%+v", err)
+	}
 
-			return nil
-		})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	err := json.NewEncoder(w).Encode(struct {
+		Error    string                 `json:"error"`
+		Missions []*eco.ValidationError `json:"missions"`
+	}{
+		Error:    fmt.Sprintf("%d invalid mission(s)", len(errs)),
+		Missions: errs,
 	})
 	if err != nil {
-		return "", fmt.Errorf("could not process missions: %w", err)
-	}
-
-	o := new(strings.Builder)
-	fmt.Fprintf(o, "\n<h3>Stats</h3>\n")
-	fmt.Fprintf(o, "\n<pre>\n")
-	fmt.Fprintf(o, "missions:    %4d (executed)\n", summ.Executed.N)
-	fmt.Fprintf(o, "missions:    %4d (planned)\n", summ.Planned.N)
-	fmt.Fprintf(o, "missions:    %4d (all)\n", summ.All.N)
-	fmt.Fprintf(o, "time period: %v -> %s\n",
-		summ.Start.Format("2006-01-02"),
-		summ.Stop.Format("2006-01-02"),
-	)
-	fmt.Fprintf(o, "\n</pre>\n")
-
-	//	type entry struct {
-	//		name  string
-	//		count int
-	//	}
-	//
-	//	sort := func(m map[string]int) []entry {
-	//		vs := make([]entry, 0, len(m))
-	//		for k := range m {
-	//			vs = append(vs, entry{k, m[k]})
-	//		}
-	//		sort.Slice(vs, func(i, j int) bool {
-	//			ii := vs[i]
-	//			jj := vs[j]
-	//			if ii.name == jj.name {
-	//				return ii.count < jj.count
-	//			}
-	//			return ii.name < jj.name
-	//		})
-	//		return vs
-	//	}
-	//
-	//	cities := sort(summ.Cities)
-	//	fmt.Fprintf(o, "=== cities ===\n")
-	//	for _, v := range cities {
-	//		fmt.Fprintf(o, "%-10s %d\n", v.name, v.count)
-	//	}
-	//
-	//	countries := sort(summ.Countries)
-	//	fmt.Fprintf(o, "=== countries ===\n")
-	//	for _, v := range countries {
-	//		fmt.Fprintf(o, "%-10s %d\n", v.name, v.count)
-	//	}
-
-	tids := []eco.TransID{
-		eco.Bike,
-		eco.Tramway,
-		eco.Train,
-		eco.Bus,
-		eco.Passenger,
-		eco.Car,
-		eco.Plane,
-	}
-
-	fmt.Fprintf(o, "<h3>Transport (executed, planned, all)</h3>\n")
-	fmt.Fprintf(o, "\n<pre>\n")
-	for _, k := range tids {
-		v1 := summ.Executed.TransIDs[k]
-		v2 := summ.Planned.TransIDs[k]
-		v3 := summ.All.TransIDs[k]
-		fmt.Fprintf(o, "%-10s %5d %5d %5d\n", k, v1, v2, v3)
-	}
-	fmt.Fprintf(o, "\n</pre>\n")
-
-	fmt.Fprintf(o, "<h3>Distances (executed, planned, all)</h3>\n")
-	fmt.Fprintf(o, "\n<pre>\n")
-	for _, k := range tids {
-		v1 := summ.Executed.Dists[k]
-		v2 := summ.Planned.Dists[k]
-		v3 := summ.All.Dists[k]
-		fmt.Fprintf(o, "%-10s %8d km %8d km %8d km\n", k, v1, v2, v3)
-	}
-	fmt.Fprintf(o, "\n</pre>\n")
-
-	fmt.Fprintf(o, "<h3>Summary (multiplicity, distance, CO2e -- only for executed)</h3>\n")
-	fmt.Fprintf(o, "\n<pre>\n")
-	for _, k := range tids {
-		n := summ.Executed.TransIDs[k]
-		dist := summ.Executed.Dists[k]
-		co2 := eco.CostOf(k, float64(dist))
-		fmt.Fprintf(o, "%-10s %8d %8d km %8.2f tCO2\n", k, n, dist, co2)
+		log.Printf("could not encode validation errors: %+v", err)
+		return
 	}
-	fmt.Fprintf(o, "\n</pre>\n")
-
-	return o.String(), nil
 }
-
-const rootPage = `
-<html>
-        <head>
-                <title>ecoLPC</title>
-                <style>
-                </style>
-        </head>
-
-        <body>
-                <div id="header">
-                        <h2>CO2 Evolution</h2>
-                </div>
-				<pre>Last Updated: {{.Updated}} (UTC)</pre>
-				<div id="stats">
-					{{.Stats}}
-				</div>
-                <div id="content">
-					<img id="co2-plot" src="/plot/co2" alt="N/A"></img>
-                </div>
-				<br>
-				<hr>
-				<div>
-					Source code is <a href="https://github.com/sbinet-lpc/eco">there</a>.
-				</div>
-        </body>
-</html>
-
-`
-
-var rootTmpl = template.Must(template.New("eco-LPC").Parse(rootPage))
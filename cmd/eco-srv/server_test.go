@@ -0,0 +1,1633 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "eco.db"), 0644, nil)
+	if err != nil {
+		t.Fatalf("could not open eco db: %+v", err)
+	}
+
+	srv := &server{name: "test", db: db}
+	err = srv.init()
+	if err != nil {
+		t.Fatalf("could not initialize eco server: %+v", err)
+	}
+	srv.ready.Store(true)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv
+}
+
+func do(t *testing.T, h http.HandlerFunc, method, url string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if body != nil {
+		err := json.NewEncoder(buf).Encode(body)
+		if err != nil {
+			t.Fatalf("could not encode request body: %+v", err)
+		}
+	}
+	req := httptest.NewRequest(method, url, buf)
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+// nbatches is the number of batches uploaded by the tests.
+var nbatches int
+
+// upload applies revisions through the batch API, in a new batch, and
+// returns the result of the batch.
+func upload(t *testing.T, srv *server, revs []eco.Revision) eco.BatchResult {
+	t.Helper()
+	nbatches++
+	rec := do(t, srv.apiBatch, http.MethodPost, "/api/batch", eco.Batch{
+		ID:        fmt.Sprintf("%s-%d", t.Name(), nbatches),
+		Revisions: revs,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not upload batch: %v", rec.Body.String())
+	}
+	var res eco.BatchResult
+	err := json.NewDecoder(rec.Body).Decode(&res)
+	if err != nil {
+		t.Fatalf("could not decode batch result: %+v", err)
+	}
+	return res
+}
+
+// register uploads missions as registered revisions, through the batch
+// API.
+func register(t *testing.T, srv *server, ms []eco.Mission) {
+	t.Helper()
+	revs := make([]eco.Revision, len(ms))
+	for i := range ms {
+		m := ms[i]
+		revs[i] = eco.Revision{ID: m.ID, Status: eco.Registered, Mission: &m}
+	}
+	res := upload(t, srv, revs)
+	if len(res.Rejected) != 0 {
+		t.Fatalf("could not register missions: %+v", res.Rejected)
+	}
+}
+
+func testMissions() []eco.Mission {
+	date := time.Date(2019, 10, 2, 0, 0, 0, 0, time.UTC)
+	return []eco.Mission{
+		{
+			ID: 1, Date: date,
+			Dest:  eco.Location{Name: "Paris, France", Lat: 48.8566101, Lng: 2.3514992},
+			Dist:  692000,
+			Trans: eco.Train,
+		},
+		{
+			ID: 2, Date: date.AddDate(0, 1, 0),
+			Dest:  eco.Location{Name: "Genève, Suisse", Lat: 46.2334715, Lng: 6.0555674},
+			Dist:  470000,
+			Trans: eco.Car,
+		},
+	}
+}
+
+func TestMissionCorrections(t *testing.T) {
+	srv := newTestServer(t)
+
+	register(t, srv, testMissions())
+
+	rec := do(t, srv.apiMissions, http.MethodPatch, "/api/missions/1", missionRequest{
+		User:    "bob",
+		Mission: map[string]interface{}{"transport_id": eco.Plane},
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid status for patch w/o reason: got=%d, want=%d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodPatch, "/api/missions/1", missionRequest{
+		User:    "bob",
+		Reason:  "mission was by plane",
+		Mission: map[string]interface{}{"transport_id": "plane"},
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid status for malformed patch: got=%d, want=%d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodPatch, "/api/missions/1", missionRequest{
+		User:   "bob",
+		Reason: "mission was by plane",
+		Mission: map[string]interface{}{
+			"id":           42,
+			"transport_id": eco.Plane,
+			"dest":         map[string]interface{}{"name": "Paris"},
+		},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not patch mission: %v", rec.Body.String())
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodDelete, "/api/missions/2?user=alice&reason=cancelled", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("could not delete mission: %v", rec.Body.String())
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodGet, "/api/missions/2", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("invalid status for deleted mission: got=%d, want=%d", rec.Code, http.StatusNotFound)
+	}
+
+	rec = do(t, srv.apiLifecycle, http.MethodGet, "/api/lifecycle", nil)
+	var lcs []eco.Lifecycle
+	err := json.NewDecoder(rec.Body).Decode(&lcs)
+	if err != nil {
+		t.Fatalf("could not decode lifecycles: %+v", err)
+	}
+	for i := range lcs {
+		lcs[i].Date = time.Time{}
+		lcs[i].History = nil
+	}
+	if got, want := lcs, []eco.Lifecycle{
+		{ID: 1, Status: eco.Registered, Corrected: []string{"dest", "transport_id"}},
+		{ID: 2, Status: eco.Registered, Deleted: true},
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid lifecycles:\ngot= %+v\nwant=%+v", got, want)
+	}
+
+	// re-ingest: corrections should survive.
+	register(t, srv, testMissions())
+
+	rec = do(t, srv.apiMissions, http.MethodGet, "/api/missions/1", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get mission: %v", rec.Body.String())
+	}
+	var m eco.Mission
+	err = json.NewDecoder(rec.Body).Decode(&m)
+	if err != nil {
+		t.Fatalf("could not decode mission: %+v", err)
+	}
+	if got, want := m.ID, int32(1); got != want {
+		t.Fatalf("invalid mission id: got=%d, want=%d", got, want)
+	}
+	if got, want := m.Trans, eco.Plane; got != want {
+		t.Fatalf("invalid transport: got=%v, want=%v", got, want)
+	}
+	if got, want := m.Dest.Name, "Paris"; got != want {
+		t.Fatalf("invalid destination: got=%q, want=%q", got, want)
+	}
+	if got, want := m.Dest.Lat, 48.8566101; got != want {
+		t.Fatalf("invalid destination latitude: got=%v, want=%v", got, want)
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodGet, "/api/missions/2", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("deleted mission was re-ingested: %v", rec.Body.String())
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodGet, "/api/missions/1/audit", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get audit trail: %v", rec.Body.String())
+	}
+	var as []store.Audit
+	err = json.NewDecoder(rec.Body).Decode(&as)
+	if err != nil {
+		t.Fatalf("could not decode audit trail: %+v", err)
+	}
+	if len(as) != 2 {
+		t.Fatalf("invalid audit trail length: got=%d, want=2", len(as))
+	}
+	if a := as[1]; a.Action != "registered" || a.Next == nil || a.Next.Trans != eco.Plane {
+		t.Fatalf("invalid audit entry of re-ingested mission: %+v", a)
+	}
+	if got, want := as[0].Prev.Trans, eco.Train; got != want {
+		t.Fatalf("invalid previous value: got=%v, want=%v", got, want)
+	}
+	if got, want := as[0].User, "bob"; got != want {
+		t.Fatalf("invalid audit user: got=%q, want=%q", got, want)
+	}
+
+	// revisions from the source database: deleted missions stay deleted,
+	// corrected missions are validated.
+	ms := testMissions()
+	res := upload(t, srv, []eco.Revision{
+		{ID: 2, Status: eco.Modified, Hash: "h2", Mission: &ms[1]},
+	})
+	if len(res.Rejected) != 0 {
+		t.Fatalf("could not revise mission 2: %+v", res.Rejected)
+	}
+	rec = do(t, srv.apiMissions, http.MethodGet, "/api/missions/2", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("deleted mission was revised: %v", rec.Body.String())
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodGet, "/api/missions/2/audit", nil)
+	if !strings.Contains(rec.Body.String(), `"action":"delete"`) {
+		t.Fatalf("missing deletion audit entry: %v", rec.Body.String())
+	}
+	as = nil
+	err = json.NewDecoder(rec.Body).Decode(&as)
+	if err != nil {
+		t.Fatalf("could not decode audit trail: %+v", err)
+	}
+	if len(as) != 1 {
+		t.Fatalf("invalid audit trail of deleted mission: %+v", as)
+	}
+
+	err = srv.db.Update(func(tx *bbolt.Tx) error {
+		return store.SaveCorrection(tx, 1, store.Correction{Patch: map[string]interface{}{"dist": -1}})
+	})
+	if err != nil {
+		t.Fatalf("could not store correction: %+v", err)
+	}
+	res = upload(t, srv, []eco.Revision{
+		{ID: 1, Status: eco.Modified, Hash: "h1", Mission: &ms[0]},
+	})
+	if len(res.Rejected) != 1 || res.Rejected[0].ID != 1 || len(res.Rejected[0].Fields) == 0 {
+		t.Fatalf("invalid rejection of invalid corrected mission: %+v", res.Rejected)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	srv := newTestServer(t)
+
+	type response struct {
+		Error    string                `json:"error"`
+		Missions []eco.ValidationError `json:"missions"`
+	}
+	invalid := func(rec *httptest.ResponseRecorder, ids ...int32) response {
+		t.Helper()
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("invalid status: got=%d, want=%d (%s)", rec.Code, http.StatusUnprocessableEntity, rec.Body.String())
+		}
+		var resp response
+		err := json.NewDecoder(rec.Body).Decode(&resp)
+		if err != nil {
+			t.Fatalf("could not decode validation errors: %+v", err)
+		}
+		if len(resp.Missions) != len(ids) {
+			t.Fatalf("invalid number of invalid missions: got=%d, want=%d", len(resp.Missions), len(ids))
+		}
+		for i, id := range ids {
+			if resp.Missions[i].ID != id || len(resp.Missions[i].Fields) == 0 {
+				t.Fatalf("invalid validation error %d: %+v", i, resp.Missions[i])
+			}
+		}
+		return resp
+	}
+
+	ms := testMissions()
+	bad := ms[1]
+	bad.Trans = 42
+	bad.Dest.Lat = 91
+	res := upload(t, srv, []eco.Revision{
+		{ID: 1, Status: eco.Registered, Hash: "h1", Mission: &ms[0]},
+		{ID: 2, Status: eco.Registered, Hash: "h2", Mission: &bad},
+	})
+	if len(res.Rejected) != 1 || res.Rejected[0].ID != 2 {
+		t.Fatalf("invalid rejections: %+v", res.Rejected)
+	}
+	fields := res.Rejected[0].Fields
+	if len(fields) != 2 || fields[0].Field != "dest.lat" || fields[1].Field != "transport_id" {
+		t.Fatalf("invalid fields: %+v", fields)
+	}
+
+	// invalid revisions are not stored.
+	rec := do(t, srv.apiMissions, http.MethodGet, "/api/missions/2", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("invalid revision stored mission 2: %v", rec.Body.String())
+	}
+
+	invalid(do(t, srv.apiMissions, http.MethodPatch, "/api/missions/1", missionRequest{
+		User:    "bob",
+		Reason:  "longer trip",
+		Mission: map[string]interface{}{"dist": -1},
+	}), 1)
+
+	zero := eco.Mission{ID: 3}
+	res = upload(t, srv, []eco.Revision{{ID: 3, Status: eco.Registered, Hash: "h3", Mission: &zero}})
+	if len(res.Rejected) != 1 || res.Rejected[0].ID != 3 || len(res.Rejected[0].Fields) == 0 {
+		t.Fatalf("invalid batch result: %+v", res)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	srv.clock = func() time.Time { return now }
+
+	ms := testMissions()
+	ms = append(ms, eco.Mission{
+		ID: 3, Date: now.AddDate(0, 3, 0),
+		Dest:  eco.Location{Name: "Tokyo, Japon", Lat: 35.6828387, Lng: 139.7594549},
+		Dist:  19430000,
+		Trans: eco.Plane,
+	})
+
+	// mission 1 is stored before lifecycles are tracked.
+	err := srv.db.Update(func(tx *bbolt.Tx) error {
+		return store.SaveMission(tx, ms[0])
+	})
+	if err != nil {
+		t.Fatalf("could not store mission 1: %+v", err)
+	}
+
+	revs := []eco.Revision{{ID: 1, Status: eco.Registered, Hash: "h1"}}
+	for i := range ms[1:] {
+		revs = append(revs, eco.Revision{
+			ID: ms[i+1].ID, Status: eco.Registered, Hash: fmt.Sprintf("h%d", ms[i+1].ID), Mission: &ms[i+1],
+		})
+	}
+	res := upload(t, srv, revs)
+	if len(res.Rejected) != 0 {
+		t.Fatalf("could not register missions: %+v", res.Rejected)
+	}
+
+	lifecycles := func() []eco.Lifecycle {
+		t.Helper()
+		rec := do(t, srv.apiLifecycle, http.MethodGet, "/api/lifecycle", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("could not list lifecycles: %v", rec.Body.String())
+		}
+		var lcs []eco.Lifecycle
+		err := json.NewDecoder(rec.Body).Decode(&lcs)
+		if err != nil {
+			t.Fatalf("could not decode lifecycles: %+v", err)
+		}
+		return lcs
+	}
+	stats := func(asof string) eco.Summary {
+		t.Helper()
+		rec := do(t, srv.apiStats, http.MethodGet, "/api/stats?asof="+asof, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("could not get stats: %v", rec.Body.String())
+		}
+		var summ eco.Summary
+		err := json.NewDecoder(rec.Body).Decode(&summ)
+		if err != nil {
+			t.Fatalf("could not decode stats: %+v", err)
+		}
+		return summ
+	}
+
+	lcs := lifecycles()
+	if got, want := len(lcs), 3; got != want {
+		t.Fatalf("invalid number of lifecycles: got=%d, want=%d", got, want)
+	}
+	for i, lc := range lcs {
+		if got, want := lc.Hash, fmt.Sprintf("h%d", i+1); got != want {
+			t.Fatalf("invalid hash for mission %d: got=%q, want=%q", lc.ID, got, want)
+		}
+		if got, want := lc.Status, eco.Registered; got != want {
+			t.Fatalf("invalid status for mission %d: got=%v, want=%v", lc.ID, got, want)
+		}
+	}
+	if got, want := len(lcs[0].History), 0; got != want {
+		t.Fatalf("invalid history for mission 1: got=%d, want=%d", got, want)
+	}
+
+	now = now.AddDate(0, 0, 1)
+	m2 := ms[1]
+	m2.Dist *= 2
+	res = upload(t, srv, []eco.Revision{
+		{ID: 1, Status: eco.Rejected, Hash: "h1-rejected"},
+		{ID: 2, Status: eco.Modified, Hash: "h2-modified", Mission: &m2},
+		{ID: 3, Status: eco.Cancelled},
+	})
+	if len(res.Rejected) != 0 {
+		t.Fatalf("could not revise missions: %+v", res.Rejected)
+	}
+
+	lcs = lifecycles()
+	for i, want := range []eco.Status{eco.Rejected, eco.Modified, eco.Cancelled} {
+		lc := lcs[i]
+		if lc.Status != want {
+			t.Fatalf("invalid status for mission %d: got=%v, want=%v", lc.ID, lc.Status, want)
+		}
+		if got := lc.History[len(lc.History)-1]; got.To != want || !got.Date.Equal(now) {
+			t.Fatalf("invalid transition for mission %d: got=%+v", lc.ID, got)
+		}
+	}
+	if got, want := lcs[2].Hash, "h3"; got != want {
+		t.Fatalf("invalid hash for cancelled mission: got=%q, want=%q", got, want)
+	}
+	if lcs[2].Mission == nil || lcs[2].Mission.Trans != eco.Plane {
+		t.Fatalf("invalid tombstone for cancelled mission: %+v", lcs[2].Mission)
+	}
+
+	summ := stats("")
+	if got, want := summ.All.N, 1; got != want {
+		t.Fatalf("invalid number of missions: got=%d, want=%d", got, want)
+	}
+	if got, want := summ.All.Dists[eco.Car], int64(940); got != want {
+		t.Fatalf("invalid distance of modified mission: got=%d, want=%d", got, want)
+	}
+	// mission 1 was already executed when rejected: no avoided emissions.
+	if got, want := summ.Avoided.N, 1; got != want {
+		t.Fatalf("invalid number of avoided missions: got=%d, want=%d", got, want)
+	}
+	if got, want := summ.Avoided.Dists[eco.Plane], int64(19430); got != want {
+		t.Fatalf("invalid avoided distance: got=%d, want=%d", got, want)
+	}
+	if got, want := stats("2020-06-15").Avoided.N, 0; got != want {
+		t.Fatalf("invalid number of avoided missions before cancellation: got=%d, want=%d", got, want)
+	}
+
+	rec := do(t, srv.apiMissions, http.MethodGet, "/api/missions/3/audit", nil)
+	var as []store.Audit
+	err = json.NewDecoder(rec.Body).Decode(&as)
+	if err != nil {
+		t.Fatalf("could not decode audit trail: %+v", err)
+	}
+	if len(as) != 1 || as[0].Action != "cancelled" || as[0].Prev == nil || as[0].Next != nil {
+		t.Fatalf("invalid audit trail: %+v", as)
+	}
+
+	res = upload(t, srv, []eco.Revision{
+		{ID: 3, Status: eco.Modified, Hash: "h3-restored"},
+	})
+	if len(res.Rejected) != 1 {
+		t.Fatalf("restored a cancelled mission without its content")
+	}
+
+	res = upload(t, srv, []eco.Revision{
+		{ID: 3, Status: eco.Modified, Hash: "h3-restored", Mission: &ms[2]},
+	})
+	if len(res.Rejected) != 0 {
+		t.Fatalf("could not restore mission: %+v", res.Rejected)
+	}
+	summ = stats("")
+	if summ.All.N != 2 || summ.Planned.N != 1 || summ.Avoided.N != 0 {
+		t.Fatalf("invalid stats after restoration: all=%d, planned=%d, avoided=%d", summ.All.N, summ.Planned.N, summ.Avoided.N)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	srv.clock = func() time.Time { return now }
+
+	ms := testMissions()
+	batch := eco.Batch{
+		ID: "b1",
+		Revisions: []eco.Revision{
+			{ID: 1, Status: eco.Registered, Hash: "h1", Mission: &ms[0]},
+			{ID: 2, Status: eco.Registered, Hash: "h2", Mission: &ms[1]},
+			{ID: 3, Status: eco.Registered, Hash: "h3", Mission: &ms[0]},
+			{ID: 4, Status: eco.Modified, Hash: "h4"},
+		},
+	}
+
+	upload := func(b eco.Batch) eco.BatchResult {
+		t.Helper()
+		rec := do(t, srv.apiBatch, http.MethodPost, "/api/batch", b)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("could not upload batch %q: %v", b.ID, rec.Body.String())
+		}
+		var res eco.BatchResult
+		err := json.NewDecoder(rec.Body).Decode(&res)
+		if err != nil {
+			t.Fatalf("could not decode batch result: %+v", err)
+		}
+		return res
+	}
+
+	res := upload(batch)
+	if res.ID != "b1" || res.Replayed || !res.Date.Equal(now) {
+		t.Fatalf("invalid batch result: %+v", res)
+	}
+	if got, want := res.Accepted, []int32{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid accepted revisions: got=%v, want=%v", got, want)
+	}
+	if got, want := len(res.Rejected), 2; got != want {
+		t.Fatalf("invalid number of rejected revisions: got=%d, want=%d", got, want)
+	}
+	for i, id := range []int32{3, 4} {
+		if r := res.Rejected[i]; r.ID != id || r.Reason == "" {
+			t.Fatalf("invalid rejection %d: %+v", i, r)
+		}
+	}
+	if !srv.last.Equal(now) || srv.mid != 2 {
+		t.Fatalf("invalid server state: last=%v, mid=%d", srv.last, srv.mid)
+	}
+
+	// replaying a batch does not modify the db.
+	srv.clock = func() time.Time { return now.Add(time.Hour) }
+	batch.Revisions[0].Status = eco.Cancelled
+	batch.Revisions[0].Mission = nil
+	res = upload(batch)
+	if !res.Replayed || !res.Date.Equal(now) || len(res.Accepted) != 2 || len(res.Rejected) != 2 {
+		t.Fatalf("invalid replayed batch result: %+v", res)
+	}
+	if !srv.last.Equal(now) {
+		t.Fatalf("replayed batch modified last-update: %v", srv.last)
+	}
+
+	err := srv.db.View(func(tx *bbolt.Tx) error {
+		var last time.Time
+		err := last.UnmarshalBinary(tx.Bucket(store.BucketUpdate).Get(store.BucketUpdate))
+		if err != nil {
+			return err
+		}
+		if !last.Equal(now) {
+			t.Fatalf("invalid stored last-update: %v", last)
+		}
+		if tx.Bucket(store.BucketEco).Get(store.MissionKey(1)) == nil {
+			t.Fatalf("replayed batch cancelled mission 1")
+		}
+		if tx.Bucket(store.BucketEco).Get(store.MissionKey(3)) != nil {
+			t.Fatalf("rejected revision was stored")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not read db: %+v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		body interface{}
+		code int
+	}{
+		{"no-id", eco.Batch{Revisions: batch.Revisions}, http.StatusBadRequest},
+		{"long-id", eco.Batch{ID: strings.Repeat("x", maxBatchID+1)}, http.StatusBadRequest},
+		{"too-large", eco.Batch{ID: "b2", Revisions: make([]eco.Revision, maxBatchSize/32)}, http.StatusRequestEntityTooLarge},
+	} {
+		rec := do(t, srv.apiBatch, http.MethodPost, "/api/batch", tc.body)
+		if rec.Code != tc.code {
+			t.Fatalf("%s: invalid status: got=%d, want=%d", tc.name, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestAuthz(t *testing.T) {
+	rsecret, rtok, err := genToken("reader", []string{scopeRead})
+	if err != nil {
+		t.Fatalf("could not generate token: %+v", err)
+	}
+	wsecret, wtok, err := genToken("writer", []string{scopeRead, scopeWrite})
+	if err != nil {
+		t.Fatalf("could not generate token: %+v", err)
+	}
+
+	fname := filepath.Join(t.TempDir(), "tokens.json")
+	raw, err := json.Marshal([]Token{rtok, wtok})
+	if err != nil {
+		t.Fatalf("could not marshal tokens: %+v", err)
+	}
+	err = os.WriteFile(fname, raw, 0600)
+	if err != nil {
+		t.Fatalf("could not write tokens file: %+v", err)
+	}
+
+	var user string
+	h := func(w http.ResponseWriter, r *http.Request) {
+		user = userFrom(r)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		read   bool
+		method string
+		secret string
+		cookie string
+		accept string
+		want   int
+		user   string
+	}{
+		{name: "public-read", method: http.MethodGet, want: http.StatusOK},
+		{name: "public-read-auth", method: http.MethodGet, secret: rsecret, want: http.StatusOK, user: "reader"},
+		{name: "protected-read", read: true, method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "protected-read-bad", read: true, method: http.MethodGet, secret: "xxx", want: http.StatusUnauthorized},
+		{name: "protected-read-ok", read: true, method: http.MethodGet, secret: rsecret, want: http.StatusOK, user: "reader"},
+		{name: "write-anon", method: http.MethodPost, want: http.StatusUnauthorized},
+		{name: "write-reader", method: http.MethodPost, secret: rsecret, want: http.StatusForbidden},
+		{name: "write-writer", method: http.MethodPost, secret: wsecret, want: http.StatusOK, user: "writer"},
+		{name: "delete-writer", method: http.MethodDelete, secret: wsecret, want: http.StatusOK, user: "writer"},
+		{name: "protected-read-cookie", read: true, method: http.MethodGet, cookie: rsecret, want: http.StatusOK, user: "reader"},
+		{name: "protected-read-cookie-bad", read: true, method: http.MethodGet, cookie: "xxx", want: http.StatusUnauthorized},
+		{name: "protected-read-html", read: true, method: http.MethodGet, accept: "text/html", want: http.StatusSeeOther},
+		{name: "write-cookie", method: http.MethodPost, cookie: wsecret, want: http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			az, err := newAuthz(fname, tt.read)
+			if err != nil {
+				t.Fatalf("could not create authz: %+v", err)
+			}
+
+			user = ""
+			req := httptest.NewRequest(tt.method, "/api/batch", nil)
+			if tt.secret != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.secret)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: cookieName, Value: tt.cookie})
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			az.wrap(h)(rec, req)
+
+			if got, want := rec.Code, tt.want; got != want {
+				t.Fatalf("invalid status: got=%d, want=%d", got, want)
+			}
+			if got, want := user, tt.user; got != want {
+				t.Fatalf("invalid user: got=%q, want=%q", got, want)
+			}
+		})
+	}
+
+	_, _, err = genToken("bad", []string{scopeRead, "admin"})
+	if err == nil {
+		t.Fatalf("expected an error for an unknown scope")
+	}
+
+	// the list of datasets is protected like the datasets.
+	az, err := newAuthz(fname, true)
+	if err != nil {
+		t.Fatalf("could not create authz: %+v", err)
+	}
+	dss, err := newDatasets([]dataset{{Name: "test", Path: filepath.Join(t.TempDir(), "eco.db")}}, az, nil)
+	if err != nil {
+		t.Fatalf("could not create datasets: %+v", err)
+	}
+	defer dss.Close()
+
+	rec := do(t, dss.ServeHTTP, http.MethodGet, "/api/datasets", nil)
+	if got, want := rec.Code, http.StatusUnauthorized; got != want {
+		t.Fatalf("invalid status for anonymous datasets list: got=%d, want=%d", got, want)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/datasets", nil)
+	req.Header.Set("Authorization", "Bearer "+rsecret)
+	rec = httptest.NewRecorder()
+	dss.ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("invalid status for datasets list: got=%d, want=%d", got, want)
+	}
+
+	// users of the dashboard log in with a token, stored in a cookie.
+	rec = do(t, dss.ServeHTTP, http.MethodGet, "/login?next=/d/test/", nil)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("invalid status for login form: got=%d, want=%d", got, want)
+	}
+	login := func(secret, next string) *httptest.ResponseRecorder {
+		t.Helper()
+		form := url.Values{"token": {secret}}
+		req := httptest.NewRequest(http.MethodPost, "/login?next="+url.QueryEscape(next), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		dss.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = login("xxx", "/d/test/")
+	if got, want := rec.Code, http.StatusUnauthorized; got != want {
+		t.Fatalf("invalid status for invalid login: got=%d, want=%d", got, want)
+	}
+	if got := rec.Result().Cookies(); len(got) != 0 {
+		t.Fatalf("invalid cookies for invalid login: %v", got)
+	}
+	rec = login(rsecret, "//evil.example.org")
+	if got, want := rec.Header().Get("Location"), "/"; got != want {
+		t.Fatalf("invalid redirection to another site: got=%q, want=%q", got, want)
+	}
+	rec = login(rsecret, "/d/test/")
+	if got, want := rec.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("invalid status for login: got=%d, want=%d", got, want)
+	}
+	if got, want := rec.Header().Get("Location"), "/d/test/"; got != want {
+		t.Fatalf("invalid redirection after login: got=%q, want=%q", got, want)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieName || !cookies[0].HttpOnly {
+		t.Fatalf("invalid login cookies: %v", cookies)
+	}
+	for _, path := range []string{"/api/datasets", "/d/test/api/stats", "/d/test/"} {
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(cookies[0])
+		rec = httptest.NewRecorder()
+		dss.ServeHTTP(rec, req)
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("invalid status for %s with login cookie: got=%d, want=%d", path, got, want)
+		}
+	}
+
+	rec = do(t, dss.ServeHTTP, http.MethodGet, "/logout", nil)
+	if got, want := rec.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("invalid status for logout: got=%d, want=%d", got, want)
+	}
+	cookies = rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieName || cookies[0].MaxAge >= 0 {
+		t.Fatalf("invalid logout cookies: %v", cookies)
+	}
+}
+
+func TestDatasets(t *testing.T) {
+	dir := t.TempDir()
+	dss, err := parseDatasets(filepath.Join(dir, "prod.db") + ",test=" + filepath.Join(dir, "eco-test.db"))
+	if err != nil {
+		t.Fatalf("could not parse datasets: %+v", err)
+	}
+	if got, want := []string{dss[0].Name, dss[1].Name}, []string{"prod", "test"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid dataset names: got=%q, want=%q", got, want)
+	}
+
+	srv, err := newDatasets(dss, &authz{}, nil)
+	if err != nil {
+		t.Fatalf("could not create datasets: %+v", err)
+	}
+	defer srv.Close()
+
+	for _, name := range []string{"prod.db", "eco-test.db"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("could not find dataset db: %+v", err)
+		}
+	}
+
+	ms := testMissions()
+	rec := do(t, srv.ServeHTTP, http.MethodPost, "/d/test/api/batch", eco.Batch{
+		ID: "b1",
+		Revisions: []eco.Revision{
+			{ID: 1, Status: eco.Registered, Mission: &ms[0]},
+			{ID: 2, Status: eco.Registered, Mission: &ms[1]},
+		},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not upload missions: %v", rec.Body.String())
+	}
+
+	for _, tt := range []struct {
+		path string
+		code int
+		want string
+	}{
+		{"/healthz", http.StatusOK, "ok\n"},
+		{"/readyz", http.StatusOK, "ok\n"},
+		{"/api/datasets", http.StatusOK, `["prod","test"]` + "\n"},
+		{"/api/last-id", http.StatusOK, `{"id":0}` + "\n"},
+		{"/api/last-id?dataset=prod", http.StatusOK, `{"id":0}` + "\n"},
+		{"/api/last-id?dataset=test", http.StatusOK, `{"id":2}` + "\n"},
+		{"/d/test/api/last-id", http.StatusOK, `{"id":2}` + "\n"},
+		{"/d/prod/api/last-id", http.StatusOK, `{"id":0}` + "\n"},
+		{"/d/nope/api/last-id", http.StatusNotFound, "unknown dataset \"nope\"\n"},
+		{"/d/test/api/export?format=csv", http.StatusOK, "id,date,dest,lat,lng,dist_km,transport\n" +
+			"1,2019-10-02,\"Paris, France\",48.8566101,2.3514992,692.000,train\n" +
+			"2,2019-11-02,\"Genève, Suisse\",46.2334715,6.0555674,470.000,car\n",
+		},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := do(t, srv.ServeHTTP, http.MethodGet, tt.path, nil)
+			if got, want := rec.Code, tt.code; got != want {
+				t.Fatalf("invalid status: got=%d, want=%d", got, want)
+			}
+			if got, want := rec.Body.String(), tt.want; got != want {
+				t.Fatalf("invalid body:\ngot= %q\nwant=%q", got, want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		path  string
+		ctype string
+		want  string
+	}{
+		{"/d/test/", "text/html; charset=utf-8", `<body data-prefix="/d/test" data-dataset="test">`},
+		{"/?dataset=test", "text/html; charset=utf-8", `src="/d/test/static/dashboard.js"`},
+		{"/d/test/static/dashboard.js", "text/javascript; charset=utf-8", `"use strict";`},
+		{"/d/test/api/missions/", "application/json", `"co2e":`},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := do(t, srv.ServeHTTP, http.MethodGet, tt.path, nil)
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Fatalf("invalid status: got=%d, want=%d", got, want)
+			}
+			if got, want := rec.Header().Get("Content-Type"), tt.ctype; got != want {
+				t.Fatalf("invalid content-type: got=%q, want=%q", got, want)
+			}
+			if got, want := rec.Body.String(), tt.want; !strings.Contains(got, want) {
+				t.Fatalf("invalid body: %q not in:\n%s", want, got)
+			}
+		})
+	}
+
+	err = srv.Close()
+	if err != nil {
+		t.Fatalf("could not close datasets: %+v", err)
+	}
+
+	rec = do(t, srv.ServeHTTP, http.MethodGet, "/readyz", nil)
+	if got, want := rec.Code, http.StatusServiceUnavailable; got != want {
+		t.Fatalf("invalid status after close: got=%d, want=%d", got, want)
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	srv.clock = func() time.Time { return now }
+
+	ms := testMissions()
+	ms = append(ms, eco.Mission{
+		// mission in progress: still a planned mission.
+		ID: 3, Date: now.AddDate(0, 0, -2), Inbound: now.AddDate(0, 0, 3),
+		Dest: eco.Location{
+			Name: "東京都, 日本", Lat: 35.6828387, Lng: 139.7594549,
+			Addr: eco.Address{City: "Tokyo", Country: "Japon", CountryCode: "jp"},
+		},
+		Dist:  19430000,
+		Trans: eco.Plane,
+	})
+
+	register(t, srv, ms)
+
+	rec := do(t, srv.apiStats, http.MethodGet, "/api/stats", nil)
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("missing ETag")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	srv.apiStats(rec, req)
+	if got, want := rec.Code, http.StatusNotModified; got != want {
+		t.Fatalf("invalid status: got=%d, want=%d", got, want)
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodPatch, "/api/missions/1", missionRequest{
+		Reason:  "mission was by car",
+		Mission: map[string]interface{}{"transport_id": eco.Car, "dist": 700000},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not patch mission: %v", rec.Body.String())
+	}
+	rec = do(t, srv.apiMissions, http.MethodDelete, "/api/missions/2?reason=cancelled", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("could not delete mission: %v", rec.Body.String())
+	}
+	register(t, srv, ms)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	srv.apiStats(rec, req)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("invalid status after update: got=%d, want=%d", got, want)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Fatalf("ETag not updated")
+	}
+
+	var got eco.Summary
+	err := json.NewDecoder(rec.Body).Decode(&got)
+	if err != nil {
+		t.Fatalf("could not decode stats: %+v", err)
+	}
+
+	want := eco.NewSummary(srv.now())
+	err = srv.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(store.BucketEco).ForEach(func(k, v []byte) error {
+			var m eco.Mission
+			err := m.UnmarshalBinary(v)
+			if err != nil {
+				return err
+			}
+			want.Add(m)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("could not scan missions: %+v", err)
+	}
+
+	if !reflect.DeepEqual(&got, want) {
+		t.Fatalf("invalid aggregates:\ngot= %+v\nwant=%+v", got, *want)
+	}
+	if got, want := got.All.N, 2; got != want {
+		t.Fatalf("invalid number of missions: got=%d, want=%d", got, want)
+	}
+	if got, want := got.Executed.Dists[eco.Car], int64(700); got != want {
+		t.Fatalf("invalid car distance: got=%d, want=%d", got, want)
+	}
+	if got, want := got.Planned.N, 1; got != want {
+		t.Fatalf("invalid number of planned missions: got=%d, want=%d", got, want)
+	}
+
+	for _, tc := range []struct {
+		asof     string
+		planned  int
+		executed int
+	}{
+		{"2020-06-18", 1, 1},
+		{"2020-06-18T11:00:00Z", 1, 1},
+		{"2020-06-18T12:00:00Z", 0, 2},
+		{"2020-06-20", 0, 2},
+		{"2019-01-01", 0, 0}, // before the registration of the missions
+	} {
+		rec := do(t, srv.apiStats, http.MethodGet, "/api/stats?asof="+tc.asof, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("could not get stats as of %s: %v", tc.asof, rec.Body.String())
+		}
+		var summ eco.Summary
+		err := json.NewDecoder(rec.Body).Decode(&summ)
+		if err != nil {
+			t.Fatalf("could not decode stats: %+v", err)
+		}
+		if summ.Planned.N != tc.planned || summ.Executed.N != tc.executed {
+			t.Fatalf(
+				"invalid stats as of %s: got=(%d, %d), want=(%d, %d)",
+				tc.asof, summ.Planned.N, summ.Executed.N, tc.planned, tc.executed,
+			)
+		}
+	}
+	rec = do(t, srv.apiStats, http.MethodGet, "/api/stats?asof=yesterday", nil)
+	if got, want := rec.Code, http.StatusBadRequest; got != want {
+		t.Fatalf("invalid status: got=%d, want=%d", got, want)
+	}
+	if got, want := got.Countries["JP"], (eco.Tally{N: 1, Dist: 19430, CO2e: eco.CostOf(eco.Plane, 19430000)}); got != want {
+		t.Fatalf("invalid JP aggregates: got=%+v, want=%+v", got, want)
+	}
+
+	rec = do(t, srv.apiStats, http.MethodGet, "/api/stats?mc=2000", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get Monte Carlo stats: %v", rec.Body.String())
+	}
+	var mc eco.Summary
+	err = json.NewDecoder(rec.Body).Decode(&mc)
+	if err != nil {
+		t.Fatalf("could not decode stats: %+v", err)
+	}
+	if v, want := mc.All.CO2e.Total, got.All.CO2e.Total; v.Value != want.Value || v.Low >= v.Value || v.High <= v.Value {
+		t.Fatalf("invalid Monte Carlo estimate: got=%+v, want=%+v", v, want)
+	}
+	rec = do(t, srv.apiStats, http.MethodGet, "/api/stats?mc=-1", nil)
+	if got, want := rec.Code, http.StatusBadRequest; got != want {
+		t.Fatalf("invalid status: got=%d, want=%d", got, want)
+	}
+	if got, want := got.Continents, map[string]eco.Tally{eco.Asia: got.Countries["JP"]}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid continents aggregates: got=%+v, want=%+v", got, want)
+	}
+	if _, ok := got.Cities["Tokyo, JP"]; !ok {
+		t.Fatalf("missing Tokyo aggregates: %+v", got.Cities)
+	}
+
+	rec = do(t, srv.plotCO2, http.MethodGet, "/plot/co2", nil)
+	if got, want := rec.Header().Get("Content-Type"), "image/png"; got != want {
+		t.Fatalf("invalid plot content-type: got=%q, want=%q (%s)", got, want, rec.Body.String())
+	}
+}
+
+func TestTripMissions(t *testing.T) {
+	srv := newTestServer(t)
+
+	var (
+		date = time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+		ms   = []eco.Mission{
+			{ID: 1, Date: date, Dist: 692000, Trans: eco.Train, Group: "ATLAS"},
+			{ID: 2, Date: date, Dist: 692400, Trans: eco.Train, Group: "ATLAS"},
+			{ID: 3, Date: date, Dist: 470000, Trans: eco.Train, Group: "ATLAS"},
+			{ID: 4, Date: date, Dist: 692000, Trans: eco.Train, Group: "CMS"},
+			{ID: 5, Date: date, Inbound: date.AddDate(0, 0, 3), Dist: 9300000, Trans: eco.Plane, Group: "CMS"},
+			{ID: 6, Date: date.AddDate(0, 4, 0), Dist: 1200000, Trans: eco.Plane, Group: "ATLAS"},
+			{ID: 7, Date: date.AddDate(0, 5, 0), Dist: 300000, Trans: eco.Car},
+		}
+	)
+	for i := range ms {
+		ms[i].Dest = eco.Location{Name: "Paris, France", Lat: 48.8566101, Lng: 2.3514992}
+	}
+
+	register(t, srv, ms)
+
+	type key struct {
+		date  time.Time
+		end   time.Time
+		trans eco.TransID
+		group string
+	}
+	sum := func(ms []eco.Mission) map[key]float64 {
+		o := make(map[key]float64)
+		for _, m := range ms {
+			o[key{m.Date, m.End(), m.Trans, m.Group}] += m.Dist
+		}
+		return o
+	}
+
+	var all, trips []eco.Mission
+	err := srv.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		all, err = store.Missions(tx)
+		if err != nil {
+			return err
+		}
+		trips, err = store.TripMissions(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("could not load missions: %+v", err)
+	}
+	if got, want := len(trips), len(all); got != want {
+		t.Fatalf("invalid number of missions: got=%d, want=%d", got, want)
+	}
+
+	got, want := sum(trips), sum(all)
+	if len(got) != len(want) {
+		t.Fatalf("invalid distances:\ngot= %v\nwant=%v", got, want)
+	}
+	for k, w := range want {
+		if g := got[k]; math.Abs(g-w) > 1e-6*w {
+			t.Fatalf("invalid distance of %v: got=%v, want=%v", k, g, w)
+		}
+	}
+
+	var (
+		now    = time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+		approx = func(a, b float64) bool { return math.Abs(a-b) <= 1e-6*math.Max(1, math.Abs(b)) }
+	)
+	var (
+		beg = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		end = beg.AddDate(1, 0, 0)
+		fc  = eco.NewForecast(trips, beg, end, now)
+		exp = eco.NewForecast(all, beg, end, now)
+	)
+	if !approx(fc.Total.Projected, exp.Total.Projected) || !approx(fc.Total.Planned, exp.Total.Planned) {
+		t.Fatalf("invalid forecast:\ngot= %+v\nwant=%+v", fc.Total, exp.Total)
+	}
+	for i := range exp.Modes {
+		if g, w := fc.Modes[i].Dist, exp.Modes[i].Dist; !approx(g.Executed, w.Executed) || !approx(g.Planned, w.Planned) {
+			t.Fatalf("invalid %v forecast:\ngot= %+v\nwant=%+v", exp.Modes[i].Mode, g, w)
+		}
+	}
+
+	for _, b := range []Budget{
+		{Year: 2020, Limit: 1},
+		{Year: 2020, Group: "ATLAS", Limit: 1},
+		{Year: 2020, Group: "CMS", Mode: "train", Limit: 1},
+	} {
+		got := progress(b, trips, now)
+		exp := progress(b, all, now)
+		if !approx(got.Executed, exp.Executed) || !approx(got.Planned, exp.Planned) || got.Level != exp.Level {
+			t.Fatalf("invalid progress of %v:\ngot= %+v\nwant=%+v", b, got, exp)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	srv := newTestServer(t)
+
+	register(t, srv, testMissions())
+
+	for _, url := range []string{
+		"/plot/hist?bins=20&modes=train,car",
+		"/plot/hist?modes=train,car&bins=20",
+		"/plot/hist?modes=train,%20car&bins=20&foo=bar",
+		"/plot/hist?modes=train,car&bins=20&width=20cm",
+	} {
+		rec := do(t, srv.plotHandle, http.MethodGet, url, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("could not get plot %q: %v", url, rec.Body.String())
+		}
+	}
+	if got, want := len(srv.cache.vs), 1; got != want {
+		t.Fatalf("invalid number of cached responses: got=%d, want=%d", got, want)
+	}
+
+	for i := 0; i < maxCacheEntries+10; i++ {
+		url := fmt.Sprintf("/plot/hist?format=svg&bins=%d", i+1)
+		rec := do(t, srv.plotHandle, http.MethodGet, url, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("could not get plot %q: %v", url, rec.Body.String())
+		}
+	}
+	if got, want := len(srv.cache.vs), maxCacheEntries; got != want {
+		t.Fatalf("invalid number of cached responses: got=%d, want=%d", got, want)
+	}
+}
+
+func TestPlots(t *testing.T) {
+	empty := newTestServer(t)
+
+	srv := newTestServer(t)
+	ms := testMissions()
+	ms[0].Group = "ATLAS"
+	register(t, srv, ms)
+
+	for _, tc := range []struct {
+		url  string
+		code int
+		ct   string
+	}{
+		{"/plot/cumdist", http.StatusOK, "image/png"},
+		{"/plot/cumco2?format=svg", http.StatusOK, "image/svg+xml"},
+		{"/plot/monthly?format=pdf&modes=train,car", http.StatusOK, "application/pdf"},
+		{"/plot/hist?bins=10&width=10&height=8cm", http.StatusOK, "image/png"},
+		{"/plot/groups?from=2019-01-01&to=2019-12-31", http.StatusOK, "image/png"},
+		{"/plot/modes?format=svg", http.StatusOK, "image/svg+xml"},
+		{"/plot/modes?modes=plane,train", http.StatusOK, "image/png"},
+		{"/plot/monthly?from=2030-01-01&to=2030-12-31", http.StatusOK, "image/png"},
+		{"/plot/map?format=svg&proj=robinson", http.StatusOK, "image/svg+xml"},
+		{"/plot/map?status=planned", http.StatusOK, "image/png"},
+		{"/plot/pie", http.StatusBadRequest, ""},
+		{"/plot/map?proj=mercator", http.StatusBadRequest, ""},
+		{"/plot/map?status=done", http.StatusBadRequest, ""},
+		{"/plot/hist?format=gif", http.StatusBadRequest, ""},
+		{"/plot/hist?width=-2", http.StatusBadRequest, ""},
+		{"/plot/hist?modes=rocket", http.StatusBadRequest, ""},
+		{"/plot/hist?from=2019-12-31&to=2019-01-01", http.StatusBadRequest, ""},
+	} {
+		for _, srv := range []*server{empty, srv} {
+			rec := do(t, srv.plotHandle, http.MethodGet, tc.url, nil)
+			if got, want := rec.Code, tc.code; got != want {
+				t.Fatalf("%s: invalid status: got=%d, want=%d (%s)", tc.url, got, want, rec.Body.String())
+			}
+			if tc.ct == "" {
+				continue
+			}
+			if got, want := rec.Header().Get("Content-Type"), tc.ct; got != want {
+				t.Fatalf("%s: invalid content-type: got=%q, want=%q", tc.url, got, want)
+			}
+			if rec.Body.Len() == 0 {
+				t.Fatalf("%s: empty plot", tc.url)
+			}
+		}
+	}
+}
+
+func TestWorldMap(t *testing.T) {
+	srv := newTestServer(t)
+
+	clermont := eco.Location{Name: "Clermont-Ferrand", Lat: 45.7774551, Lng: 3.0819427}
+	ms := testMissions()
+	ms = append(ms,
+		eco.Mission{
+			ID: 3, Date: time.Now().UTC().AddDate(1, 0, 0),
+			Dest:  eco.Location{Name: "Tokyo, Japon", Lat: 35.6828387, Lng: 139.7594549},
+			Dist:  19430000,
+			Trans: eco.Plane,
+		},
+		eco.Mission{
+			ID: 4, Date: ms[0].Date.AddDate(0, 2, 0),
+			Dest:  ms[0].Dest,
+			Dist:  ms[0].Dist,
+			Trans: eco.Train,
+		},
+	)
+	for i := range ms {
+		ms[i].Start = clermont
+	}
+
+	register(t, srv, ms)
+
+	type feature struct {
+		Geometry struct {
+			Type string `json:"type"`
+		} `json:"geometry"`
+		Properties struct {
+			Kind     string `json:"kind"`
+			Name     string `json:"name"`
+			Missions int    `json:"missions"`
+			Mode     string `json:"mode"`
+		} `json:"properties"`
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  map[string]int // missions per destination
+	}{
+		{"", map[string]int{"Paris, France": 2, "Genève, Suisse": 1, "Tokyo, Japon": 1}},
+		{"status=executed", map[string]int{"Paris, France": 2, "Genève, Suisse": 1}},
+		{"status=planned&modes=plane", map[string]int{"Tokyo, Japon": 1}},
+		{"from=2019-11-01&to=2019-11-30", map[string]int{"Genève, Suisse": 1}},
+		{"modes=bike", map[string]int{}},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			rec := do(t, srv.apiMap, http.MethodGet, "/api/map?"+tc.query, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("could not get map: %v", rec.Body.String())
+			}
+			if got, want := rec.Header().Get("Content-Type"), "application/geo+json"; got != want {
+				t.Fatalf("invalid content-type: got=%q, want=%q", got, want)
+			}
+
+			var fc struct {
+				Type     string    `json:"type"`
+				Features []feature `json:"features"`
+			}
+			err := json.NewDecoder(rec.Body).Decode(&fc)
+			if err != nil {
+				t.Fatalf("could not decode map: %+v", err)
+			}
+
+			var (
+				dests = make(map[string]int)
+				arcs  = make(map[string]int)
+			)
+			for _, f := range fc.Features {
+				switch f.Properties.Kind {
+				case "destination":
+					if f.Geometry.Type != "Point" {
+						t.Fatalf("invalid destination geometry %q", f.Geometry.Type)
+					}
+					dests[f.Properties.Name] = f.Properties.Missions
+				case "arc":
+					if f.Geometry.Type != "MultiLineString" {
+						t.Fatalf("invalid arc geometry %q", f.Geometry.Type)
+					}
+					arcs[f.Properties.Name] = f.Properties.Missions
+				default:
+					t.Fatalf("invalid feature kind %q", f.Properties.Kind)
+				}
+			}
+			if !reflect.DeepEqual(dests, tc.want) {
+				t.Fatalf("invalid destinations:\ngot= %v\nwant=%v", dests, tc.want)
+			}
+			if !reflect.DeepEqual(arcs, tc.want) {
+				t.Fatalf("invalid arcs:\ngot= %v\nwant=%v", arcs, tc.want)
+			}
+		})
+	}
+
+	rec := do(t, srv.apiCoastline, http.MethodGet, "/api/coastline", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get coastline: %v", rec.Body.String())
+	}
+	coast, err := parseCoastline(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("could not parse coastline: %+v", err)
+	}
+	if len(coast.lines) == 0 {
+		t.Fatalf("empty coastline")
+	}
+}
+
+func TestParseCoastline(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want int
+		err  bool
+	}{
+		{raw: `{"type":"FeatureCollection","features":[]}`, want: 0},
+		{
+			raw: `{"type":"FeatureCollection","features":[
+				{"type":"Feature","geometry":{"type":"LineString","coordinates":[[0,0],[1,1]]}},
+				{"type":"Feature","geometry":{"type":"MultiLineString","coordinates":[[[0,0],[1,1]],[[2,2],[3,3]]]}},
+				{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,1],[0,1],[0,0]]]}},
+				{"type":"Feature","geometry":{"type":"MultiPolygon","coordinates":[[[[0,0],[1,1],[0,0]]],[[[2,2],[3,3],[2,2]]]]}}
+			]}`,
+			want: 6,
+		},
+		{raw: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]}}]}`, err: true},
+		{raw: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[0,0]}}]}`, err: true},
+		{raw: `not json`, err: true},
+	} {
+		t.Run("", func(t *testing.T) {
+			c, err := parseCoastline([]byte(tc.raw))
+			switch {
+			case tc.err && err == nil:
+				t.Fatalf("expected an error")
+			case !tc.err && err != nil:
+				t.Fatalf("could not parse coastline: %+v", err)
+			case tc.err:
+				return
+			}
+			if got, want := len(c.lines), tc.want; got != want {
+				t.Fatalf("invalid number of lines: got=%d, want=%d", got, want)
+			}
+		})
+	}
+}
+
+func TestForecast(t *testing.T) {
+	srv := newTestServer(t)
+
+	var (
+		now = time.Now().UTC()
+		ms  []eco.Mission
+	)
+	for i := 1; i <= 3; i++ {
+		ms = append(ms, eco.Mission{
+			ID: int32(i), Date: time.Date(now.Year()-i, time.June, 15, 0, 0, 0, 0, time.UTC),
+			Dist: 1000000, Trans: eco.Plane,
+		})
+	}
+	ms = append(ms, eco.Mission{ID: 4, Date: now.Add(-time.Hour), Dist: 100000, Trans: eco.Train})
+	register(t, srv, ms)
+
+	rec := do(t, srv.apiForecast, http.MethodGet, "/api/forecast", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get forecast: %v", rec.Body.String())
+	}
+	var fc eco.Forecast
+	err := json.NewDecoder(rec.Body).Decode(&fc)
+	if err != nil {
+		t.Fatalf("could not decode forecast: %+v", err)
+	}
+	if got, want := fc.Start.Year(), now.Year(); got != want {
+		t.Fatalf("invalid forecast period: got=%d, want=%d", got, want)
+	}
+
+	next := now.Year() + 1
+	rec = do(t, srv.apiForecast, http.MethodGet, fmt.Sprintf("/api/forecast?from=%d-01-01&to=%d-12-31", next, next), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get forecast: %v", rec.Body.String())
+	}
+	fc = eco.Forecast{}
+	err = json.NewDecoder(rec.Body).Decode(&fc)
+	if err != nil {
+		t.Fatalf("could not decode forecast: %+v", err)
+	}
+	// the year of the first mission is incomplete and the current one is
+	// not over yet.
+	if got, want := fc.Years, []int{now.Year() - 1, now.Year() - 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid reference years: got=%v, want=%v", got, want)
+	}
+	if len(fc.Modes) != 1 || fc.Modes[0].Mode != eco.Plane || fc.Modes[0].Dist.Projected != 1000 {
+		t.Fatalf("invalid forecast: %+v", fc)
+	}
+
+	rec = do(t, srv.apiForecast, http.MethodGet, "/api/forecast?from=2019-09-01&to=2020-08-31", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get forecast: %v", rec.Body.String())
+	}
+	fc = eco.Forecast{}
+	err = json.NewDecoder(rec.Body).Decode(&fc)
+	if err != nil {
+		t.Fatalf("could not decode forecast: %+v", err)
+	}
+	if got, want := fc.Stop, time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("invalid forecast end: got=%v, want=%v", got, want)
+	}
+
+	for _, url := range []string{
+		"/api/forecast?from=2019",
+		"/api/forecast?from=2019-09-01&to=2019-01-01",
+	} {
+		rec = do(t, srv.apiForecast, http.MethodGet, url, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("invalid status for %q: got=%d, want=%d", url, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	rec = do(t, srv.plotCO2, http.MethodGet, "/plot/co2", nil)
+	if got, want := rec.Header().Get("Content-Type"), "image/png"; got != want {
+		t.Fatalf("invalid plot content-type: got=%q, want=%q (%s)", got, want, rec.Body.String())
+	}
+}
+
+func TestBudgets(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		hooks []Alert
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		err := json.NewDecoder(r.Body).Decode(&a)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		hooks = append(hooks, a)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	mails := filepath.Join(t.TempDir(), "alerts.mbox")
+
+	srv := newTestServer(t)
+	srv.notifier = notifiers{
+		newWebhook(hook.URL),
+		&mailFile{fname: mails, from: "eco-srv@localhost", to: "admin@example.com"},
+	}
+
+	var (
+		now     = time.Now().UTC()
+		year    = now.Year()
+		beg     = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		end     = beg.AddDate(1, 0, 0)
+		planned = now.Add(end.Sub(now) / 2)
+	)
+
+	rec := do(t, srv.apiBudget, http.MethodPut, "/api/budget", Budget{Year: year, Limit: 0.42})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("could not set budget: %v", rec.Body.String())
+	}
+	rec = do(t, srv.apiBudget, http.MethodPut, "/api/budget", Budget{Year: year, Mode: "rocket", Limit: 1})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid status for invalid budget: got=%d, want=%d", rec.Code, http.StatusBadRequest)
+	}
+	rec = do(t, srv.apiBudget, http.MethodPut, "/api/budget", Budget{Year: year, Mode: "train", Limit: 1})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("could not set train budget: %v", rec.Body.String())
+	}
+
+	alerts := func() []Alert {
+		srv.alerts.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Alert(nil), hooks...)
+	}
+
+	register(t, srv, []eco.Mission{
+		{ID: 1, Date: beg.Add(time.Minute), Dist: 1000000, Trans: eco.Plane},
+	})
+	if got := alerts(); len(got) != 0 {
+		t.Fatalf("unexpected alerts: %+v", got)
+	}
+
+	register(t, srv, []eco.Mission{
+		{ID: 2, Date: planned, Dist: 800000, Trans: eco.Plane},
+	})
+	got := alerts()
+	if len(got) != 1 {
+		t.Fatalf("invalid number of alerts: got=%d, want=1 (%+v)", len(got), got)
+	}
+	if got, want := got[0].Threshold, 0.8; got != want {
+		t.Fatalf("invalid alert threshold: got=%v, want=%v", got, want)
+	}
+
+	// alerts are only sent when a new threshold is crossed.
+	register(t, srv, []eco.Mission{
+		{ID: 2, Date: planned, Dist: 800000, Trans: eco.Plane},
+	})
+	if got := alerts(); len(got) != 1 {
+		t.Fatalf("invalid number of alerts: got=%d, want=1 (%+v)", len(got), got)
+	}
+
+	rec = do(t, srv.apiMissions, http.MethodPatch, "/api/missions/2", missionRequest{
+		Reason:  "longer trip",
+		Mission: map[string]interface{}{"dist": 1500000},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not patch mission: %v", rec.Body.String())
+	}
+	got = alerts()
+	if len(got) != 2 {
+		t.Fatalf("invalid number of alerts: got=%d, want=2 (%+v)", len(got), got)
+	}
+	if got, want := got[1].Threshold, 1.0; got != want {
+		t.Fatalf("invalid alert threshold: got=%v, want=%v", got, want)
+	}
+
+	raw, err := os.ReadFile(mails)
+	if err != nil {
+		t.Fatalf("could not read alerts file: %+v", err)
+	}
+	if got, want := strings.Count(string(raw), "To: admin@example.com\r\n"), 2; got != want {
+		t.Fatalf("invalid number of alert emails: got=%d, want=%d\n%s", got, want, raw)
+	}
+
+	rec = do(t, srv.apiBudget, http.MethodGet, "/api/budget", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not get budgets: %v", rec.Body.String())
+	}
+	var ps []BudgetProgress
+	err = json.NewDecoder(rec.Body).Decode(&ps)
+	if err != nil {
+		t.Fatalf("could not decode budgets: %+v", err)
+	}
+	if got, want := len(ps), 2; got != want {
+		t.Fatalf("invalid number of budgets: got=%d, want=%d", got, want)
+	}
+	for _, p := range ps {
+		switch p.Mode {
+		case "":
+			if p.Status != "over" || len(p.Warnings) == 0 {
+				t.Fatalf("invalid global budget progress: %+v", p)
+			}
+		case "train":
+			if p.Status != "ok" || p.Executed != 0 || p.Planned != 0 {
+				t.Fatalf("invalid train budget progress: %+v", p)
+			}
+		}
+	}
+
+	rec = do(t, srv.apiBudget, http.MethodDelete, fmt.Sprintf("/api/budget?year=%d", year), nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("could not delete budget: %v", rec.Body.String())
+	}
+	rec = do(t, srv.apiBudget, http.MethodDelete, fmt.Sprintf("/api/budget?year=%d", year), nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("invalid status for missing budget: got=%d, want=%d", rec.Code, http.StatusNotFound)
+	}
+
+	rec = do(t, srv.apiBudget, http.MethodGet, fmt.Sprintf("/api/budget?year=%d", year), nil)
+	ps = nil
+	err = json.NewDecoder(rec.Body).Decode(&ps)
+	if err != nil {
+		t.Fatalf("could not decode budgets: %+v", err)
+	}
+	if len(ps) != 1 || ps[0].Mode != "train" {
+		t.Fatalf("invalid budgets after deletion: %+v", ps)
+	}
+}
+
+func TestBudgetProgress(t *testing.T) {
+	var (
+		b   = Budget{Year: 2019, Group: "ATLAS", Limit: 1}
+		now = time.Date(2019, time.July, 2, 12, 0, 0, 0, time.UTC) // mid-year
+		ms  = []eco.Mission{
+			{ID: 1, Date: time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), Group: "ATLAS", Dist: 2000000, Trans: eco.Plane},
+			{ID: 2, Date: time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC), Group: "ATLAS", Dist: 1000000, Trans: eco.Plane},
+			{ID: 3, Date: time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), Group: "CMS", Dist: 2000000, Trans: eco.Plane},
+			{ID: 4, Date: time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), Group: "ATLAS", Dist: 2000000, Trans: eco.Plane},
+		}
+		approx = func(a, b float64) bool { return math.Abs(a-b) < 1e-3 }
+	)
+
+	p := progress(b, ms, now)
+	if !approx(p.Executed, 0.42) || !approx(p.Planned, 0.21) {
+		t.Fatalf("invalid consumption: %+v", p)
+	}
+	// the executed emissions, extrapolated over the year, exceed the committed ones.
+	if !approx(p.Projected, 0.84) {
+		t.Fatalf("invalid projection: got=%v, want=%v", p.Projected, 0.84)
+	}
+	if p.Level != 0 || p.Status != "ok" {
+		t.Fatalf("invalid status: %+v", p)
+	}
+
+	b.Limit = 0.7
+	p = progress(b, ms, now)
+	if p.Level != 0.8 || p.Status != "warning" || len(p.Warnings) != 2 {
+		t.Fatalf("invalid status: %+v", p)
+	}
+
+	p = progress(b, ms, time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC))
+	if !approx(p.Executed, 0.63) || p.Planned != 0 || !approx(p.Projected, 0.63) {
+		t.Fatalf("invalid past year progress: %+v", p)
+	}
+
+	// with a reference year, the projection follows the seasonal model of
+	// the forecast: no more mission is expected in the second half.
+	ms = append(ms, eco.Mission{ID: 5, Date: time.Date(2018, 1, 15, 0, 0, 0, 0, time.UTC), Group: "ATLAS", Dist: 1000000, Trans: eco.Plane})
+	p = progress(b, ms, now)
+	fc := eco.NewForecast(
+		[]eco.Mission{ms[0], ms[1], ms[3], ms[4]},
+		time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), now,
+	)
+	if len(fc.Years) != 1 || !approx(p.Projected, fc.Total.Projected/1000) || !approx(p.Projected, 0.63) {
+		t.Fatalf("invalid seasonal projection: got=%v, want=%v (forecast=%+v)", p.Projected, 0.63, fc.Total)
+	}
+}
+
+func TestReadBudgets(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "budgets.json")
+	err := os.WriteFile(fname, []byte(`[
+		{"year": 2019, "limit": 10},
+		{"dataset": "lpc", "year": 2019, "group": "ATLAS", "mode": "plane", "limit": 2, "thresholds": [0.5, 1]}
+	]`), 0644)
+	if err != nil {
+		t.Fatalf("could not write budgets file: %+v", err)
+	}
+
+	dss := []dataset{{Name: "lpc"}, {Name: "test"}}
+	err = readBudgets(fname, dss)
+	if err != nil {
+		t.Fatalf("could not read budgets: %+v", err)
+	}
+	if got, want := len(dss[0].Budgets), 2; got != want {
+		t.Fatalf("invalid number of lpc budgets: got=%d, want=%d", got, want)
+	}
+	if got, want := len(dss[1].Budgets), 1; got != want {
+		t.Fatalf("invalid number of test budgets: got=%d, want=%d", got, want)
+	}
+
+	for _, tc := range []string{
+		`[{"year": 2019, "limit": -1}]`,
+		`[{"year": 2019, "limit": 1, "mode": "rocket"}]`,
+		`[{"dataset": "nope", "year": 2019, "limit": 1}]`,
+	} {
+		err := os.WriteFile(fname, []byte(tc), 0644)
+		if err != nil {
+			t.Fatalf("could not write budgets file: %+v", err)
+		}
+		err = readBudgets(fname, []dataset{{Name: "lpc"}})
+		if err == nil {
+			t.Fatalf("expected an error for %s", tc)
+		}
+	}
+}
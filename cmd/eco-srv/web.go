@@ -0,0 +1,28 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+)
+
+var (
+	//go:embed web
+	webRoot embed.FS
+
+	// webFS holds the static assets of the dashboard, served under /static/.
+	webFS = func() fs.FS {
+		sub, err := fs.Sub(webRoot, "web")
+		if err != nil {
+			panic(err)
+		}
+		return sub
+	}()
+
+	rootTmpl  = template.Must(template.ParseFS(webRoot, "web/index.html"))
+	loginTmpl = template.Must(template.ParseFS(webRoot, "web/login.html"))
+)
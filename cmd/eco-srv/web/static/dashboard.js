@@ -0,0 +1,503 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// eco-srv dashboard.
+//
+// All the data is retrieved from the eco-srv JSON API.
+// User-provided values are only ever inserted with textContent.
+
+"use strict";
+
+(function () {
+	const prefix = document.body.dataset.prefix;
+	const dataset = document.body.dataset.dataset;
+	const svgNS = "http://www.w3.org/2000/svg";
+
+	// transport modes, indexed by eco.TransID.
+	const modes = ["unknown", "bike", "tramway", "train", "bus", "passenger", "car", "plane"];
+	const colors = {
+		unknown: "#999999",
+		bike: "#1b9e77",
+		tramway: "#66a61e",
+		train: "#7570b3",
+		bus: "#e6ab02",
+		passenger: "#a6761d",
+		car: "#d95f02",
+		plane: "#e7298a",
+	};
+
+	const state = {
+		missions: [],
+		sort: { key: "date", asc: false },
+		coastline: null,
+		mapSeq: 0,
+	};
+
+	function $(id) {
+		return document.getElementById(id);
+	}
+
+	// get retrieves a JSON document from eco-srv.
+	// The API token of the user is sent by the browser, in the cookie set
+	// by the login form: users are sent to it when the token is missing.
+	function get(url) {
+		return fetch(url, { credentials: "same-origin" }).then(function (resp) {
+			if (resp.status === 401) {
+				window.location = "/login?next=" + encodeURIComponent(window.location.pathname + window.location.search);
+			}
+			if (!resp.ok) {
+				throw new Error(url + ": " + resp.status + " " + resp.statusText);
+			}
+			return resp.json();
+		});
+	}
+
+	// api retrieves a JSON document from the API of the dataset.
+	function api(path) {
+		return get(prefix + path);
+	}
+
+	function el(tag, attrs, parent) {
+		const e = document.createElementNS(svgNS, tag);
+		Object.keys(attrs || {}).forEach(function (k) {
+			e.setAttribute(k, attrs[k]);
+		});
+		if (parent) {
+			parent.appendChild(e);
+		}
+		return e;
+	}
+
+	function text(tag, txt, parent) {
+		const e = document.createElement(tag);
+		e.textContent = txt;
+		if (parent) {
+			parent.appendChild(e);
+		}
+		return e;
+	}
+
+	function clear(e) {
+		while (e.firstChild) {
+			e.removeChild(e.firstChild);
+		}
+	}
+
+	function fmt(v, digits) {
+		return v.toLocaleString("en-US", {
+			minimumFractionDigits: digits,
+			maximumFractionDigits: digits,
+		});
+	}
+
+	function mode(m) {
+		return modes[m.transport_id] || "unknown";
+	}
+
+	function day(m) {
+		return m.date.slice(0, 10);
+	}
+
+	// planned returns whether a mission is not over yet.
+	// Missions in progress are planned missions.
+	function planned(m) {
+		let end = new Date(m.date);
+		const inbound = new Date(m.inbound);
+		if (inbound > end) {
+			end = inbound;
+		}
+		return end > new Date();
+	}
+
+	function filtered() {
+		const from = $("filter-from").value;
+		const to = $("filter-to").value;
+		const tid = $("filter-mode").value;
+		const status = $("filter-status").value;
+		const dest = $("filter-dest").value.trim().toLowerCase();
+
+		return state.missions.filter(function (m) {
+			if (from && day(m) < from) {
+				return false;
+			}
+			if (to && day(m) > to) {
+				return false;
+			}
+			if (tid && mode(m) !== tid) {
+				return false;
+			}
+			if (status === "planned" && !planned(m)) {
+				return false;
+			}
+			if (status === "executed" && planned(m)) {
+				return false;
+			}
+			if (dest && m.dest.name.toLowerCase().indexOf(dest) < 0) {
+				return false;
+			}
+			return true;
+		});
+	}
+
+	function renderSummary(ms) {
+		const root = $("summary");
+		clear(root);
+
+		const exec = ms.filter(function (m) { return !planned(m); });
+		const plan = ms.filter(planned);
+		const co2 = function (vs) {
+			return vs.reduce(function (acc, m) { return acc + m.co2e; }, 0) / 1000;
+		};
+		const dist = function (vs) {
+			return vs.reduce(function (acc, m) { return acc + m.dist; }, 0) / 1000;
+		};
+
+		[
+			["missions (executed)", fmt(exec.length, 0)],
+			["missions (planned)", fmt(plan.length, 0)],
+			["distance (executed)", fmt(dist(exec), 0) + " km"],
+			["CO2e (executed)", fmt(co2(exec), 2) + " t"],
+			["CO2e (planned)", fmt(co2(plan), 2) + " t"],
+		].forEach(function (v) {
+			const card = document.createElement("div");
+			card.className = "card";
+			text("div", v[0], card);
+			text("div", v[1], card).className = "value";
+			root.appendChild(card);
+		});
+	}
+
+	// barChart draws a stacked bar chart.
+	// groups is a list of {label, parts: [{key, value, color, title}]}.
+	function barChart(svg, groups) {
+		clear(svg);
+		const W = 600, H = 300, L = 50, B = 40, T = 10;
+		const max = Math.max.apply(null, groups.map(function (g) {
+			return g.parts.reduce(function (acc, p) { return acc + p.value; }, 0);
+		}).concat([1e-9]));
+		const bw = (W - L) / Math.max(groups.length, 1);
+
+		el("line", { x1: L, y1: H - B, x2: W, y2: H - B, stroke: "#333" }, svg);
+		for (let i = 0; i <= 4; i++) {
+			const v = max * i / 4;
+			const y = H - B - (H - B - T) * i / 4;
+			el("line", { x1: L, y1: y, x2: W, y2: y, stroke: "#eee" }, svg);
+			const t = el("text", { x: L - 4, y: y + 3, "text-anchor": "end" }, svg);
+			t.textContent = fmt(v, 2);
+		}
+
+		groups.forEach(function (g, i) {
+			let y = H - B;
+			const x = L + i * bw + bw * 0.1;
+			g.parts.forEach(function (p) {
+				const h = (H - B - T) * p.value / max;
+				y -= h;
+				const r = el("rect", { x: x, y: y, width: bw * 0.8, height: h, fill: p.color }, svg);
+				el("title", {}, r).textContent = p.title;
+			});
+			const t = el("text", {
+				x: x + bw * 0.4, y: H - B + 12, "text-anchor": "middle",
+			}, svg);
+			t.textContent = g.label;
+		});
+	}
+
+	function renderModes(ms) {
+		const groups = modes.slice(1).map(function (name) {
+			const vs = ms.filter(function (m) { return mode(m) === name; });
+			const exec = vs.filter(function (m) { return !planned(m); })
+				.reduce(function (acc, m) { return acc + m.co2e; }, 0) / 1000;
+			const plan = vs.filter(planned)
+				.reduce(function (acc, m) { return acc + m.co2e; }, 0) / 1000;
+			return {
+				label: name,
+				parts: [
+					{ value: exec, color: colors[name], title: name + " (executed): " + fmt(exec, 2) + " tCO2e" },
+					{ value: plan, color: colors[name] + "66", title: name + " (planned): " + fmt(plan, 2) + " tCO2e" },
+				],
+			};
+		});
+		barChart($("chart-modes"), groups);
+	}
+
+	function renderMonths(ms) {
+		const months = {};
+		ms.forEach(function (m) {
+			const k = m.date.slice(0, 7);
+			months[k] = months[k] || {};
+			months[k][mode(m)] = (months[k][mode(m)] || 0) + m.co2e / 1000;
+		});
+		const groups = Object.keys(months).sort().map(function (k) {
+			return {
+				label: k.slice(2),
+				parts: modes.slice(1).map(function (name) {
+					const v = months[k][name] || 0;
+					return { value: v, color: colors[name], title: k + " " + name + ": " + fmt(v, 2) + " tCO2e" };
+				}),
+			};
+		});
+		barChart($("chart-months"), groups);
+	}
+
+	function project(lat, lng) {
+		return [(lng + 180) * 2, (90 - lat) * 2];
+	}
+
+	function path(coords) {
+		return coords.map(function (c, i) {
+			const p = project(c[1], c[0]);
+			return (i === 0 ? "M" : "L") + p[0].toFixed(1) + "," + p[1].toFixed(1);
+		}).join("");
+	}
+
+	function lines(geom) {
+		switch (geom.type) {
+		case "LineString":
+			return [geom.coordinates];
+		case "MultiLineString":
+		case "Polygon":
+			return geom.coordinates;
+		case "MultiPolygon":
+			return [].concat.apply([], geom.coordinates);
+		default:
+			return [];
+		}
+	}
+
+	// mapQuery returns the query parameters of the map feed matching
+	// the current filters.
+	function mapQuery() {
+		const q = new URLSearchParams();
+		[["from", "filter-from"], ["to", "filter-to"], ["modes", "filter-mode"], ["status", "filter-status"]]
+			.forEach(function (v) {
+				if ($(v[1]).value) {
+					q.set(v[0], $(v[1]).value);
+				}
+			});
+		return q.toString();
+	}
+
+	function renderMap() {
+		const seq = ++state.mapSeq;
+		const dest = $("filter-dest").value.trim().toLowerCase();
+
+		Promise.all([
+			state.coastline || api("/api/coastline"),
+			api("/api/map?" + mapQuery()),
+		]).then(function (vs) {
+			if (seq !== state.mapSeq) {
+				return; // a more recent map has been requested.
+			}
+			state.coastline = vs[0];
+
+			const svg = $("map");
+			clear(svg);
+
+			const grid = el("g", { class: "map-grid" }, svg);
+			for (let lng = -180; lng <= 180; lng += 30) {
+				el("path", { d: path([[lng, -90], [lng, 90]]) }, grid);
+			}
+			for (let lat = -90; lat <= 90; lat += 30) {
+				el("path", { d: path([[-180, lat], [180, lat]]) }, grid);
+			}
+
+			const land = el("g", { class: "map-land" }, svg);
+			state.coastline.features.forEach(function (f) {
+				lines(f.geometry).forEach(function (line) {
+					el("path", { d: path(line) }, land);
+				});
+			});
+
+			const feats = vs[1].features.filter(function (f) {
+				return !dest || f.properties.name.toLowerCase().indexOf(dest) >= 0;
+			});
+
+			const arcs = el("g", { class: "map-arcs" }, svg);
+			feats.filter(function (f) { return f.properties.kind === "arc"; })
+				.forEach(function (f) {
+					const g = el("g", {
+						stroke: colors[f.properties.mode],
+						"stroke-width": 0.5 + 0.5 * Math.log1p(f.properties.missions),
+					}, arcs);
+					lines(f.geometry).forEach(function (line) {
+						el("path", { d: path(line) }, g);
+					});
+				});
+
+			feats.filter(function (f) { return f.properties.kind === "destination"; })
+				.forEach(function (f) {
+					const p = project(f.geometry.coordinates[1], f.geometry.coordinates[0]);
+					const c = el("circle", {
+						cx: p[0], cy: p[1], r: 2 + Math.sqrt(f.properties.missions) * 1.5,
+						fill: colors[f.properties.mode], "fill-opacity": 0.7, stroke: "#fff", "stroke-width": 0.5,
+					}, svg);
+					el("title", {}, c).textContent = f.properties.name + ": " +
+						f.properties.missions + " mission(s), " + fmt(f.properties.co2e / 1000, 2) + " tCO2e";
+				});
+		}).catch(function (err) {
+			const svg = $("map");
+			clear(svg);
+			el("text", { x: 360, y: 180, "text-anchor": "middle" }, svg).textContent =
+				"could not retrieve map: " + err.message;
+		});
+	}
+
+	function renderTable(ms) {
+		const key = state.sort.key, asc = state.sort.asc ? 1 : -1;
+		const value = function (m) {
+			switch (key) {
+			case "dest":
+				return m.dest.name;
+			case "transport":
+				return mode(m);
+			default:
+				return m[key];
+			}
+		};
+		ms = ms.slice().sort(function (a, b) {
+			const va = value(a), vb = value(b);
+			return (va < vb ? -1 : va > vb ? 1 : 0) * asc;
+		});
+
+		$("count").textContent = ms.length;
+		const tbody = $("missions").querySelector("tbody");
+		clear(tbody);
+		ms.forEach(function (m) {
+			const tr = document.createElement("tr");
+			if (planned(m)) {
+				tr.className = "planned";
+			}
+			text("td", m.id, tr);
+			text("td", day(m), tr);
+			text("td", m.dest.name, tr);
+			text("td", mode(m), tr);
+			text("td", fmt(m.dist / 1000, 0), tr).className = "num";
+			text("td", fmt(m.co2e, 1), tr).className = "num";
+			tr.addEventListener("click", function () { showDetails(m.id); });
+			tbody.appendChild(tr);
+		});
+	}
+
+	function showDetails(id) {
+		Promise.all([api("/api/missions/" + id), api("/api/missions/" + id + "/audit")])
+			.then(function (vs) {
+				const m = vs[0], audit = vs[1];
+				$("details-id").textContent = m.id;
+
+				const dl = $("details-mission");
+				clear(dl);
+				[
+					["date", day(m)],
+					["start", m.start.name],
+					["destination", m.dest.name],
+					["country", m.dest.address.country_code || "n/a"],
+					["coordinates", m.dest.lat.toFixed(4) + ", " + m.dest.lng.toFixed(4)],
+					["transport", mode(m)],
+					["distance", fmt(m.dist / 1000, 1) + " km"],
+				].forEach(function (v) {
+					text("dt", v[0], dl);
+					text("dd", v[1], dl);
+				});
+
+				const ol = $("details-audit");
+				clear(ol);
+				if (audit.length === 0) {
+					text("li", "no modification", ol);
+				}
+				audit.forEach(function (a) {
+					text("li", a.date.slice(0, 19).replace("T", " ") + " " + a.action +
+						" by " + (a.user || "anonymous") + ": " + a.reason, ol);
+				});
+				$("details").hidden = false;
+			})
+			.catch(function (err) {
+				window.alert("could not retrieve mission " + id + ": " + err.message);
+			});
+	}
+
+	function renderBudgets() {
+		api("/api/budget").then(function (ps) {
+			const root = $("budgets-list");
+			clear(root);
+			$("budgets").hidden = ps.length === 0;
+			ps.forEach(function (p) {
+				const div = document.createElement("div");
+				div.className = "budget " + p.status;
+				const name = [String(p.year), p.group || "all groups", p.mode || "all modes"].join(" / ");
+				text("div", name + ": " + fmt(p.executed + p.planned, 2) + " / " + fmt(p.limit, 2) +
+					" tCO2e (projected: " + fmt(p.projected, 2) + " tCO2e)", div);
+
+				const bar = document.createElement("div");
+				bar.className = "budget-bar";
+				const exec = document.createElement("span");
+				exec.className = "executed";
+				exec.style.width = Math.min(100, 100 * p.executed / p.limit) + "%";
+				const plan = document.createElement("span");
+				plan.className = "planned";
+				plan.style.width = Math.min(100, 100 * p.planned / p.limit) + "%";
+				bar.appendChild(exec);
+				bar.appendChild(plan);
+				div.appendChild(bar);
+
+				(p.warnings || []).forEach(function (w) {
+					text("div", w, div).className = "warning";
+				});
+				root.appendChild(div);
+			});
+		}).catch(function (err) {
+			text("p", "could not retrieve budgets: " + err.message, $("budgets-list"));
+			$("budgets").hidden = false;
+		});
+	}
+
+	function render() {
+		const ms = filtered();
+		renderSummary(ms);
+		renderModes(ms);
+		renderMonths(ms);
+		renderMap();
+		renderTable(ms);
+	}
+
+	function init() {
+		modes.slice(1).forEach(function (name) {
+			const opt = text("option", name, $("filter-mode"));
+			opt.value = name;
+		});
+		["filter-from", "filter-to", "filter-mode", "filter-status", "filter-dest"].forEach(function (id) {
+			$(id).addEventListener("input", render);
+		});
+		$("missions").querySelectorAll("th").forEach(function (th) {
+			th.addEventListener("click", function () {
+				const key = th.dataset.key;
+				state.sort = { key: key, asc: state.sort.key === key ? !state.sort.asc : true };
+				render();
+			});
+		});
+		$("details-close").addEventListener("click", function () {
+			$("details").hidden = true;
+		});
+		$("dataset").addEventListener("change", function (evt) {
+			window.location = "/d/" + encodeURIComponent(evt.target.value) + "/";
+		});
+
+		get("/api/datasets").then(function (names) {
+			names.forEach(function (name) {
+				const opt = text("option", name, $("dataset"));
+				opt.value = name;
+				opt.selected = name === dataset;
+			});
+		});
+
+		renderBudgets();
+		api("/api/missions/").then(function (ms) {
+			state.missions = ms;
+			render();
+		}).catch(function (err) {
+			text("p", "could not retrieve missions: " + err.message, $("summary"));
+		});
+	}
+
+	init();
+})();
@@ -0,0 +1,520 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "github.com/sbinet-lpc/eco/cmd/eco-srv"
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/geo"
+	"github.com/sbinet-lpc/eco/store"
+	"go-hep.org/x/hep/hplot"
+	"go.etcd.io/bbolt"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// coastline holds the background of world maps.
+type coastline struct {
+	raw   []byte // GeoJSON document
+	lines [][]geo.Point
+}
+
+//go:generate go run ./gen-coastline.go -o web/coastline.geojson
+
+// worldCoast is the coastline used to draw world maps.
+//
+// The default coastline is embedded in the eco-srv binary. It is generated
+// by gen-coastline.go from the Natural Earth 1:110m coastline, which is in
+// the public domain, and can be replaced with another GeoJSON dataset with
+// the -coastline flag.
+var worldCoast = func() *coastline {
+	raw, err := webRoot.ReadFile("web/coastline.geojson")
+	if err != nil {
+		panic(err)
+	}
+	c, err := parseCoastline(raw)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}()
+
+func loadCoastline(fname string) (*coastline, error) {
+	raw, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not read coastline file: %w", err)
+	}
+	c, err := parseCoastline(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse coastline file %q: %w", fname, err)
+	}
+	return c, nil
+}
+
+// parseCoastline parses a GeoJSON feature collection of (multi) line
+// strings or (multi) polygons.
+func parseCoastline(raw []byte) (*coastline, error) {
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	err := json.Unmarshal(raw, &fc)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode GeoJSON: %w", err)
+	}
+
+	c := &coastline{raw: raw}
+	for i, f := range fc.Features {
+		var (
+			line  [][2]float64
+			lines [][][2]float64
+			polys [][][][2]float64
+		)
+		switch f.Geometry.Type {
+		case "LineString":
+			err = json.Unmarshal(f.Geometry.Coordinates, &line)
+			lines = append(lines, line)
+		case "MultiLineString", "Polygon":
+			err = json.Unmarshal(f.Geometry.Coordinates, &lines)
+		case "MultiPolygon":
+			err = json.Unmarshal(f.Geometry.Coordinates, &polys)
+			for _, poly := range polys {
+				lines = append(lines, poly...)
+			}
+		default:
+			return nil, fmt.Errorf("invalid geometry type %q for feature %d", f.Geometry.Type, i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode coordinates of feature %d: %w", i, err)
+		}
+
+		for _, line := range lines {
+			pts := make([]geo.Point, len(line))
+			for j, v := range line {
+				pts[j] = geo.Point{Lat: v[1], Lng: v[0]}
+			}
+			c.lines = append(c.lines, pts)
+		}
+	}
+
+	return c, nil
+}
+
+// apiCoastline serves the GeoJSON coastline used by world maps.
+func (srv *server) apiCoastline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	_, _ = w.Write(worldCoast.raw)
+}
+
+// destination aggregates the missions to a given location.
+type destination struct {
+	Name  string
+	Loc   geo.Point
+	N     int
+	Dist  float64 // in meters
+	CO2e  float64 // in kgCO2e
+	Modes map[eco.TransID]int
+}
+
+// dominant returns the most used transport mode.
+func dominant(modes map[eco.TransID]int) eco.TransID {
+	var (
+		tid eco.TransID
+		max = -1
+	)
+	for k, n := range modes {
+		if n > max || (n == max && k < tid) {
+			tid, max = k, n
+		}
+	}
+	return tid
+}
+
+// route aggregates the missions between two locations.
+type route struct {
+	Start geo.Point
+	Dest  *destination
+	N     int
+	Modes map[eco.TransID]int
+}
+
+// destinations aggregates missions per destination and per route.
+// Routes are sorted by decreasing number of missions.
+func destinations(ms []eco.Mission) ([]*destination, []*route) {
+	var (
+		dests  []*destination
+		routes []*route
+		dmap   = make(map[string]*destination)
+		rmap   = make(map[string]*route)
+		keyOf  = func(loc eco.Location) string {
+			return fmt.Sprintf("%.3f,%.3f", loc.Lat, loc.Lng)
+		}
+	)
+
+	for _, m := range ms {
+		dkey := keyOf(m.Dest)
+		d, ok := dmap[dkey]
+		if !ok {
+			d = &destination{
+				Name:  m.Dest.Name,
+				Loc:   geo.Point{Lat: m.Dest.Lat, Lng: m.Dest.Lng},
+				Modes: make(map[eco.TransID]int),
+			}
+			dmap[dkey] = d
+			dests = append(dests, d)
+		}
+		d.N++
+		d.Dist += m.Dist
+		d.CO2e += eco.CostOf(m.Trans, m.Dist)
+		d.Modes[m.Trans]++
+
+		if m.Start == (eco.Location{}) {
+			continue
+		}
+		rkey := keyOf(m.Start) + "-" + dkey
+		rt, ok := rmap[rkey]
+		if !ok {
+			rt = &route{
+				Start: geo.Point{Lat: m.Start.Lat, Lng: m.Start.Lng},
+				Dest:  d,
+				Modes: make(map[eco.TransID]int),
+			}
+			rmap[rkey] = rt
+			routes = append(routes, rt)
+		}
+		rt.N++
+		rt.Modes[m.Trans]++
+	}
+
+	sort.SliceStable(dests, func(i, j int) bool { return dests[i].N > dests[j].N })
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].N > routes[j].N })
+	return dests, routes
+}
+
+// arc returns the great-circle arc of a route, split at the antimeridian.
+func (rt *route) arc() [][]geo.Point {
+	pts := geo.GreatCircle(rt.Start, rt.Dest.Loc, 64)
+	return splitAntimeridian(pts)
+}
+
+// splitAntimeridian splits a polyline where it crosses the antimeridian.
+func splitAntimeridian(pts []geo.Point) [][]geo.Point {
+	var (
+		lines [][]geo.Point
+		beg   = 0
+	)
+	for i := 1; i < len(pts); i++ {
+		if math.Abs(pts[i].Lng-pts[i-1].Lng) > 180 {
+			lines = append(lines, pts[beg:i])
+			beg = i
+		}
+	}
+	return append(lines, pts[beg:])
+}
+
+func modeNames(modes map[eco.TransID]int) map[string]int {
+	o := make(map[string]int, len(modes))
+	for tid, n := range modes {
+		o[tid.String()] = n
+	}
+	return o
+}
+
+type geoFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoGeometry            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// mapFeatures returns the GeoJSON features of destinations and of the
+// great-circle arcs leading to them.
+func mapFeatures(ms []eco.Mission) []geoFeature {
+	dests, routes := destinations(ms)
+
+	fs := make([]geoFeature, 0, len(dests)+len(routes))
+	for _, rt := range routes {
+		var coords [][][2]float64
+		for _, line := range rt.arc() {
+			vs := make([][2]float64, len(line))
+			for i, pt := range line {
+				vs[i] = [2]float64{pt.Lng, pt.Lat}
+			}
+			coords = append(coords, vs)
+		}
+		fs = append(fs, geoFeature{
+			Type:     "Feature",
+			Geometry: geoGeometry{Type: "MultiLineString", Coordinates: coords},
+			Properties: map[string]interface{}{
+				"kind":     "arc",
+				"name":     rt.Dest.Name,
+				"missions": rt.N,
+				"mode":     dominant(rt.Modes).String(),
+				"modes":    modeNames(rt.Modes),
+			},
+		})
+	}
+
+	for _, d := range dests {
+		fs = append(fs, geoFeature{
+			Type:     "Feature",
+			Geometry: geoGeometry{Type: "Point", Coordinates: [2]float64{d.Loc.Lng, d.Loc.Lat}},
+			Properties: map[string]interface{}{
+				"kind":     "destination",
+				"name":     d.Name,
+				"missions": d.N,
+				"mode":     dominant(d.Modes).String(),
+				"modes":    modeNames(d.Modes),
+				"dist_km":  d.Dist / 1000,
+				"co2e":     d.CO2e,
+			},
+		})
+	}
+
+	return fs
+}
+
+// apiMap serves the destinations of missions as a GeoJSON feature collection.
+//
+// apiMap accepts the same date range, modes and status parameters as the
+// /plot/map endpoint.
+func (srv *server) apiMap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid HTTP method", http.StatusBadRequest)
+		return
+	}
+
+	now, err := srv.asof(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := parsePlotOptions("map", r.URL.Query(), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	etag, body, err := srv.cached("map?"+opts.key(asofKey(r, now)), srv.now(), func(tx *bbolt.Tx) ([]byte, error) {
+		ms, err := store.Missions(tx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(struct {
+			Type     string       `json:"type"`
+			Features []geoFeature `json:"features"`
+		}{"FeatureCollection", mapFeatures(opts.selected(ms))})
+	})
+	if err != nil {
+		err = fmt.Errorf("could not compute map: %w", err)
+		log.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	_, _ = w.Write(body)
+}
+
+// projection maps geographic coordinates onto the plane.
+type projection struct {
+	fwd        func(pt geo.Point) (x, y float64)
+	xmax, ymax float64 // extent of the projected world
+}
+
+var projections = map[string]projection{
+	"equirect": {
+		fwd:  func(pt geo.Point) (x, y float64) { return pt.Lng, pt.Lat },
+		xmax: 180,
+		ymax: 90,
+	},
+	"robinson": {
+		fwd:  robinson,
+		xmax: 0.8487 * math.Pi,
+		ymax: 1.3523,
+	},
+}
+
+// robinsonTable holds the Robinson projection parameters, every 5 degrees
+// of latitude.
+var robinsonTable = [...][2]float64{
+	{1.0000, 0.0000}, {0.9986, 0.0620}, {0.9954, 0.1240}, {0.9900, 0.1860},
+	{0.9822, 0.2480}, {0.9730, 0.3100}, {0.9600, 0.3720}, {0.9427, 0.4340},
+	{0.9216, 0.4958}, {0.8962, 0.5571}, {0.8679, 0.6176}, {0.8350, 0.6769},
+	{0.7986, 0.7346}, {0.7597, 0.7903}, {0.7186, 0.8435}, {0.6732, 0.8936},
+	{0.6213, 0.9394}, {0.5722, 0.9761}, {0.5322, 1.0000},
+}
+
+// robinson implements the Robinson projection, interpolating linearly
+// between the tabulated parameters.
+func robinson(pt geo.Point) (x, y float64) {
+	lat := math.Min(math.Abs(pt.Lat), 90)
+	i := int(lat / 5)
+	if i >= len(robinsonTable)-1 {
+		i = len(robinsonTable) - 2
+	}
+	var (
+		f  = (lat - float64(i)*5) / 5
+		px = robinsonTable[i][0] + f*(robinsonTable[i+1][0]-robinsonTable[i][0])
+		py = robinsonTable[i][1] + f*(robinsonTable[i+1][1]-robinsonTable[i][1])
+	)
+	x = 0.8487 * px * pt.Lng * math.Pi / 180
+	y = 1.3523 * py
+	if pt.Lat < 0 {
+		y = -y
+	}
+	return x, y
+}
+
+func (proj projection) xys(pts []geo.Point) plotter.XYs {
+	xys := make(plotter.XYs, len(pts))
+	for i, pt := range pts {
+		xys[i].X, xys[i].Y = proj.fwd(pt)
+	}
+	return xys
+}
+
+func withAlpha(c color.Color, alpha uint8) color.Color {
+	r, g, b, _ := c.RGBA()
+	return color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), alpha}
+}
+
+// plotMap plots the destinations of missions on a world map, sized by
+// number of missions and colored by the most used transport mode, with
+// great-circle arcs from the starting point of missions.
+func plotMap(ms []eco.Mission, opts plotOptions) (*hplot.Plot, error) {
+	proj := projections[opts.proj]
+
+	p := hplot.New()
+	p.Title.Text = "Mission destinations"
+	p.HideAxes()
+	p.X.Min, p.X.Max = -proj.xmax, +proj.xmax
+	p.Y.Min, p.Y.Max = -proj.ymax, +proj.ymax
+	p.Legend.Top = true
+	p.Legend.Left = true
+
+	addLine := func(pts []geo.Point, style draw.LineStyle) error {
+		line, err := plotter.NewLine(proj.xys(pts))
+		if err != nil {
+			return err
+		}
+		line.LineStyle = style
+		p.Add(line)
+		return nil
+	}
+
+	grid := draw.LineStyle{Color: color.Gray{0xdd}, Width: vg.Points(0.5)}
+	for lng := -180.0; lng <= 180; lng += 30 {
+		pts := make([]geo.Point, 0, 37)
+		for lat := -90.0; lat <= 90; lat += 5 {
+			pts = append(pts, geo.Point{Lat: lat, Lng: lng})
+		}
+		err := addLine(pts, grid)
+		if err != nil {
+			return nil, fmt.Errorf("could not create graticule: %w", err)
+		}
+	}
+	for lat := -60.0; lat <= 60; lat += 30 {
+		err := addLine([]geo.Point{{Lat: lat, Lng: -180}, {Lat: lat, Lng: 180}}, grid)
+		if err != nil {
+			return nil, fmt.Errorf("could not create graticule: %w", err)
+		}
+	}
+
+	coast := draw.LineStyle{Color: color.Gray{0x88}, Width: vg.Points(0.5)}
+	for _, line := range worldCoast.lines {
+		if len(line) < 2 {
+			continue
+		}
+		err := addLine(line, coast)
+		if err != nil {
+			return nil, fmt.Errorf("could not create coastline: %w", err)
+		}
+	}
+
+	dests, routes := destinations(ms)
+
+	// draw the least used routes first, so the most used ones are on top.
+	for i := len(routes) - 1; i >= 0; i-- {
+		rt := routes[i]
+		style := draw.LineStyle{
+			Color: withAlpha(modeColors[dominant(rt.Modes)], 0x80),
+			Width: vg.Points(0.5 + 0.5*math.Log1p(float64(rt.N))),
+		}
+		for _, line := range rt.arc() {
+			if len(line) < 2 {
+				continue
+			}
+			err := addLine(line, style)
+			if err != nil {
+				return nil, fmt.Errorf("could not create route arc: %w", err)
+			}
+		}
+	}
+
+	for _, tid := range append([]eco.TransID{eco.Unknown}, eco.TransIDs...) {
+		var vs []*destination
+		for i := len(dests) - 1; i >= 0; i-- {
+			if dominant(dests[i].Modes) == tid {
+				vs = append(vs, dests[i])
+			}
+		}
+		if len(vs) == 0 {
+			continue
+		}
+
+		xys := make(plotter.XYs, len(vs))
+		for i, d := range vs {
+			xys[i].X, xys[i].Y = proj.fwd(d.Loc)
+		}
+		sca, err := plotter.NewScatter(xys)
+		if err != nil {
+			return nil, fmt.Errorf("could not create scatter for %v: %w", tid, err)
+		}
+		sca.GlyphStyle = draw.GlyphStyle{
+			Color:  withAlpha(modeColors[tid], 0xb0),
+			Radius: vg.Points(3),
+			Shape:  draw.CircleGlyph{},
+		}
+		sca.GlyphStyleFunc = func(i int) draw.GlyphStyle {
+			sty := sca.GlyphStyle
+			sty.Radius = vg.Points(1.5 + 1.5*math.Sqrt(float64(vs[i].N)))
+			return sty
+		}
+		p.Add(sca)
+		p.Legend.Add(tid.String(), sca)
+	}
+
+	return p, nil
+}
@@ -11,9 +11,9 @@ import (
 	"log"
 	"net/http"
 	"sort"
-	"strings"
 
 	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/ingest"
 )
 
 func main() {
@@ -21,28 +21,52 @@ func main() {
 	log.SetFlags(0)
 
 	var (
-		addrFlag      = flag.String("addr", ":80", "[host]:port address of eco-srv")
+		addrFlag      = flag.String("addr", ":80", "[scheme://]host[:port] address of eco-srv")
 		citiesFlag    = flag.Bool("cities", false, "display cities stats")
 		countriesFlag = flag.Bool("countries", false, "display countries stats")
+		contsFlag     = flag.Bool("continents", false, "display continents stats")
+		sortFlag      = flag.String("sort", "name", "sort cities, countries and continents stats by name, missions, dist or co2e")
+		tokenFlag     = flag.String("token-file", "", "path to file holding the eco-srv API token (default: $ECO_TOKEN)")
+		mcFlag        = flag.Int("mc", 0, "number of Monte Carlo samples to propagate CO2e uncertainties (default: analytical propagation)")
 	)
 
 	flag.Parse()
 
-	addr := *addrFlag
-	if strings.HasPrefix(addr, ":") {
-		addr = "localhost" + addr
+	less, ok := tallyOrders[*sortFlag]
+	if !ok {
+		log.Fatalf("invalid sort order %q", *sortFlag)
 	}
 
-	log.Printf("querying %q...", addr)
+	url := ingest.URL(*addrFlag, fmt.Sprintf("/api/stats?mc=%d", *mcFlag))
+	log.Printf("querying %q...", url)
 
-	req, err := http.Get(fmt.Sprintf("http://%s/api/stats", addr))
+	tok, err := ingest.APIToken(*tokenFlag)
+	if err != nil {
+		log.Fatalf("could not read API token: %+v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		log.Fatalf("could not create stats request: %+v", err)
+	}
+	if tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Fatalf("could not query stats: %+v", err)
 	}
-	defer req.Body.Close()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("received an invalid status from eco-srv: %s (code=%d)",
+			resp.Status, resp.StatusCode,
+		)
+	}
 
 	var summ eco.Summary
-	err = json.NewDecoder(req.Body).Decode(&summ)
+	err = json.NewDecoder(resp.Body).Decode(&summ)
 	if err != nil {
 		log.Fatalf("could not decode JSON stats: %+v", err)
 	}
@@ -50,45 +74,28 @@ func main() {
 	log.Printf("missions:    %4d (executed)", summ.Executed.N)
 	log.Printf("missions:    %4d (planned)", summ.Planned.N)
 	log.Printf("missions:    %4d (all)", summ.All.N)
+	log.Printf("missions:    %4d (avoided: cancelled or rejected while planned)", summ.Avoided.N)
 	log.Printf("time period: %v -> %s",
 		summ.Start.Format("2006-01-02"),
 		summ.Stop.Format("2006-01-02"),
 	)
 
-	type entry struct {
+	for _, v := range []struct {
+		show  bool
 		name  string
-		count int
-	}
-
-	sort := func(m map[string]int) []entry {
-		vs := make([]entry, 0, len(m))
-		for k := range m {
-			vs = append(vs, entry{k, m[k]})
-		}
-		sort.Slice(vs, func(i, j int) bool {
-			ii := vs[i]
-			jj := vs[j]
-			if ii.name == jj.name {
-				return ii.count < jj.count
-			}
-			return ii.name < jj.name
-		})
-		return vs
-	}
-
-	cities := sort(summ.Cities)
-	if *citiesFlag {
-		log.Printf("=== cities ===")
-		for _, v := range cities {
-			log.Printf("%-10s %d", v.name, v.count)
+		stats map[string]eco.Tally
+	}{
+		{*citiesFlag, "cities", summ.Cities},
+		{*countriesFlag, "countries", summ.Countries},
+		{*contsFlag, "continents", summ.Continents},
+	} {
+		if !v.show {
+			continue
 		}
-	}
-
-	if *countriesFlag {
-		countries := sort(summ.Countries)
-		log.Printf("=== countries ===")
-		for _, v := range countries {
-			log.Printf("%-10s %d", v.name, v.count)
+		log.Printf("=== %s ===", v.name)
+		log.Printf("%-30s %8s %10s %11s", "", "missions", "dist", "co2e")
+		for _, e := range sortTallies(v.stats, less) {
+			log.Printf("%-30s %8d %7.0f km %8.1f kg", e.name, e.N, e.Dist, e.CO2e)
 		}
 	}
 
@@ -107,4 +114,57 @@ func main() {
 		v3 := summ.All.Dists[k]
 		log.Printf("%-10s %8d km %8d km %8d km\n", k, v1, v2, v3)
 	}
+
+	log.Printf("=== co2e (95%% CL) ===")
+	for _, k := range eco.TransIDs {
+		log.Printf("%-10s %s %s %s\n", k,
+			estimate(summ.Executed.CO2e.Modes[k]),
+			estimate(summ.Planned.CO2e.Modes[k]),
+			estimate(summ.All.CO2e.Modes[k]),
+		)
+	}
+	log.Printf("%-10s %s %s %s\n", "total",
+		estimate(summ.Executed.CO2e.Total),
+		estimate(summ.Planned.CO2e.Total),
+		estimate(summ.All.CO2e.Total),
+	)
+	log.Printf("%-10s %s\n", "avoided", estimate(summ.Avoided.CO2e.Total))
+}
+
+// estimate formats a CO2e estimate (in kgCO2e) in tCO2e, with its
+// confidence interval.
+func estimate(v eco.Estimate) string {
+	return fmt.Sprintf("%8.2f [%8.2f, %8.2f] t", v.Value/1000, v.Low/1000, v.High/1000)
+}
+
+type entry struct {
+	name string
+	eco.Tally
+}
+
+// tallyOrders lists the available orderings of places stats.
+// Places are sorted by name or by decreasing number of missions,
+// distance or CO2e emissions.
+var tallyOrders = map[string]func(a, b entry) bool{
+	"name":     func(a, b entry) bool { return a.name < b.name },
+	"missions": func(a, b entry) bool { return a.N > b.N },
+	"dist":     func(a, b entry) bool { return a.Dist > b.Dist },
+	"co2e":     func(a, b entry) bool { return a.CO2e > b.CO2e },
+}
+
+func sortTallies(m map[string]eco.Tally, less func(a, b entry) bool) []entry {
+	vs := make([]entry, 0, len(m))
+	for k, v := range m {
+		vs = append(vs, entry{k, v})
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if less(vs[i], vs[j]) {
+			return true
+		}
+		if less(vs[j], vs[i]) {
+			return false
+		}
+		return vs[i].name < vs[j].name
+	})
+	return vs
 }
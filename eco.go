@@ -4,21 +4,49 @@
 
 package eco // import "github.com/sbinet-lpc/eco"
 
-//go:generate brio-gen -p github.com/sbinet-lpc/eco -t Mission,Location -o gen_brio.go
+//go:generate brio-gen -p github.com/sbinet-lpc/eco -t Mission,Location,Address,Leg -o gen_brio.go
 
 import (
 	"fmt"
 	"time"
 )
 
+// BinaryVersion is the version of the binary layout of missions, as
+// encoded by Mission.MarshalBinary.
+// It is incremented each time the layout of Mission, Location, Address or
+// Leg changes.
+const BinaryVersion = 5
+
 type Mission struct {
 	ID int32 `json:"id"`
 
-	Date  time.Time `json:"date"`
-	Start Location  `json:"start"`
-	Dest  Location  `json:"dest"`
-	Dist  float64   `json:"dist"`
-	Trans TransID   `json:"transport_id"`
+	Date    time.Time `json:"date"`    // date of the outbound journey
+	Inbound time.Time `json:"inbound"` // date of the inbound journey, if known
+	Start   Location  `json:"start"`
+	Dest    Location  `json:"dest"`
+	Dist    float64   `json:"dist"`
+	Trans   TransID   `json:"transport_id"`
+	Group   string    `json:"group"` // group funding the mission
+
+	Legs []Leg `json:"legs,omitempty"` // booked journeys or itinerary between stops, if known
+
+	TransReason string `json:"transport_reason,omitempty"` // how the transport mode was inferred, if it was
+}
+
+// End returns the date of the end of the mission: the date of its
+// inbound journey, or the date of its outbound journey if unknown.
+func (m Mission) End() time.Time {
+	if m.Inbound.After(m.Date) {
+		return m.Inbound
+	}
+	return m.Date
+}
+
+// Planned returns whether the mission is not over yet at the provided
+// reference time.
+// Missions in progress are planned missions.
+func (m Mission) Planned(now time.Time) bool {
+	return now.Before(m.End())
 }
 
 func (m Mission) String() string {
@@ -33,6 +61,26 @@ type Location struct {
 	Name string  `json:"name"`
 	Lat  float64 `json:"lat"`
 	Lng  float64 `json:"lng"`
+	Addr Address `json:"address"`
+}
+
+// Leg is a journey of a mission, as booked through a travel agency or
+// between two stops of a multi-destination mission.
+type Leg struct {
+	Date  time.Time `json:"date"`
+	Start Location  `json:"start"` // airport or station of departure
+	Dest  Location  `json:"dest"`  // airport or station of arrival
+	Dist  float64   `json:"dist"`
+	Trans TransID   `json:"transport_id"`
+	Class string    `json:"class"` // cabin class (e.g. economy, business)
+}
+
+// Address is the structured postal address of a location.
+type Address struct {
+	City        string `json:"city"`
+	State       string `json:"state"`
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"` // ISO 3166-1 alpha-2 country code
 }
 
 type TransID byte
@@ -65,10 +113,25 @@ func (tid TransID) String() string {
 		return "passenger"
 	case Bike:
 		return "bike"
+	case Unknown:
+		return "unknown"
 	}
 	panic(fmt.Errorf("unknown transport ID %d", int(tid)))
 }
 
+// ParseTransID returns the transport ID corresponding to the provided name.
+func ParseTransID(name string) (TransID, error) {
+	if name == Unknown.String() {
+		return Unknown, nil
+	}
+	for _, tid := range TransIDs {
+		if tid.String() == name {
+			return tid, nil
+		}
+	}
+	return Unknown, fmt.Errorf("eco: unknown transport %q", name)
+}
+
 // List of all known TransIDs
 var TransIDs = []TransID{
 	Bike,
@@ -88,22 +151,31 @@ func CostLess(a, b TransID) bool {
 	return false
 }
 
-// CostOf returns the equivalent CO2 emission of a given distance (in meters),
-// for a given transportation mode.
+// Factor is an emission factor with its uncertainty.
+type Factor struct {
+	Value       float64 `json:"value"`       // in kgCO2e/km
+	Uncertainty float64 `json:"uncertainty"` // relative half-width of the 95% confidence interval
+}
+
+// Factors is the table of emission factors per transportation mode.
 //
 // Factors extracted from:
 //   - https://docs.google.com/spreadsheets/d/1WVemrYvkBv3hD_AbIOteL5uRa5cqfBWh/edit#gid=392963105
+//
+// Uncertainties extracted from the Base Carbone.
+var Factors = map[TransID]Factor{
+	Bike:      {0, 0},
+	Tramway:   {0.006, 0.2},
+	Train:     {3.69e-3, 0.2},
+	Bus:       {0.182, 0.2},
+	Passenger: {0, 0},
+	Car:       {0.259, 0.2}, // assume non-diesel cars
+	Plane:     {0.21, 0.6},  // assume long distance flights (eco-class)
+}
+
+// CostOf returns the equivalent CO2 emission of a given distance (in meters),
+// for a given transportation mode.
 func CostOf(tid TransID, dist float64) float64 {
 	dist = dist / 1000
-	fact := map[TransID]float64{
-		Bike:      0,
-		Tramway:   0.006,
-		Train:     3.69e-3,
-		Bus:       0.182,
-		Passenger: 0,
-		Car:       0.259, // assume non-diesel cars
-		Plane:     0.21,  // assume long distance flights (eco-class)
-	}[tid]
-
-	return dist * fact
+	return dist * Factors[tid].Value
 }
@@ -5,8 +5,13 @@
 package eco_test // import "github.com/sbinet-lpc/eco"
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sbinet-lpc/eco"
 )
@@ -65,3 +70,455 @@ func TestCost(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTransID(t *testing.T) {
+	for _, tid := range append([]eco.TransID{eco.Unknown}, eco.TransIDs...) {
+		got, err := eco.ParseTransID(tid.String())
+		if err != nil {
+			t.Fatalf("could not parse %q: %+v", tid, err)
+		}
+		if got != tid {
+			t.Fatalf("invalid transport: got=%v, want=%v", got, tid)
+		}
+	}
+
+	_, err := eco.ParseTransID("rocket")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestMissionPlanned(t *testing.T) {
+	var (
+		out = time.Date(2019, 10, 2, 8, 0, 0, 0, time.UTC)
+		in  = time.Date(2019, 10, 4, 18, 0, 0, 0, time.UTC)
+	)
+	for _, tc := range []struct {
+		name string
+		m    eco.Mission
+		now  time.Time
+		want bool
+	}{
+		{"before", eco.Mission{Date: out, Inbound: in}, out.Add(-time.Hour), true},
+		{"outbound", eco.Mission{Date: out, Inbound: in}, out, true},
+		{"in-progress", eco.Mission{Date: out, Inbound: in}, out.AddDate(0, 0, 1), true},
+		{"inbound", eco.Mission{Date: out, Inbound: in}, in, false},
+		{"after", eco.Mission{Date: out, Inbound: in}, in.Add(time.Hour), false},
+		{"no-inbound", eco.Mission{Date: out}, out, false},
+		{"inbound-before-outbound", eco.Mission{Date: out, Inbound: out.Add(-time.Hour)}, out, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, want := tc.m.Planned(tc.now), tc.want; got != want {
+				t.Fatalf("invalid planned status: got=%v, want=%v", got, want)
+			}
+		})
+	}
+
+	summ := eco.NewSummary(out.AddDate(0, 0, 1))
+	summ.Add(eco.Mission{ID: 1, Date: out, Inbound: in, Dist: 1000, Trans: eco.Train})
+	summ.Add(eco.Mission{ID: 2, Date: out.AddDate(0, 0, -7), Dist: 1000, Trans: eco.Train})
+	if got, want := summ.Planned.N, 1; got != want {
+		t.Fatalf("invalid number of planned missions: got=%d, want=%d", got, want)
+	}
+	if got, want := summ.Executed.N, 1; got != want {
+		t.Fatalf("invalid number of executed missions: got=%d, want=%d", got, want)
+	}
+	if got, want := summ.Stop, out.AddDate(0, 0, -7); !got.Equal(want) {
+		t.Fatalf("invalid stop: got=%v, want=%v", got, want)
+	}
+}
+
+func TestMissionLegs(t *testing.T) {
+	date := time.Date(2019, 10, 2, 0, 0, 0, 0, time.UTC)
+	want := eco.Mission{
+		ID: 1, Date: date, Inbound: date.AddDate(0, 0, 8),
+		Dest:  eco.Location{Name: "Tokyo", Lat: 35.68, Lng: 139.76},
+		Dist:  19430000,
+		Trans: eco.Plane,
+		Legs: []eco.Leg{
+			{
+				Date:  date,
+				Start: eco.Location{Name: "CDG", Addr: eco.Address{CountryCode: "FR"}},
+				Dest:  eco.Location{Name: "HND", Addr: eco.Address{CountryCode: "JP"}},
+				Dist:  9720000,
+				Trans: eco.Plane,
+				Class: "business",
+			},
+			{Date: date.AddDate(0, 0, 8), Dist: 9710000, Trans: eco.Plane, Class: "economy"},
+		},
+		TransReason: `rule "long-haul"`,
+	}
+
+	raw, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not marshal mission: %+v", err)
+	}
+	var got eco.Mission
+	err = got.UnmarshalBinary(raw)
+	if err != nil {
+		t.Fatalf("could not unmarshal mission: %+v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid round-trip:\ngot= %+v\nwant=%+v", got, want)
+	}
+}
+
+func TestMissionValidate(t *testing.T) {
+	date := time.Date(2019, 10, 2, 0, 0, 0, 0, time.UTC)
+	valid := func() eco.Mission {
+		return eco.Mission{
+			ID: 1, Date: date,
+			Dest:  eco.Location{Name: "Tokyo", Lat: 35.68, Lng: 139.76},
+			Dist:  19430000,
+			Trans: eco.Plane,
+			Legs:  []eco.Leg{{Dist: 9720000, Trans: eco.Plane}},
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(m *eco.Mission)
+		fields []string
+	}{
+		{"valid", func(m *eco.Mission) {}, nil},
+		{"id", func(m *eco.Mission) { m.ID = -1 }, []string{"id"}},
+		{"date", func(m *eco.Mission) { m.Date = time.Time{} }, []string{"date"}},
+		{"inbound", func(m *eco.Mission) { m.Inbound = date.AddDate(200, 0, 0) }, []string{"inbound"}},
+		{"dist", func(m *eco.Mission) { m.Dist = math.NaN() }, []string{"dist"}},
+		{"neg-dist", func(m *eco.Mission) { m.Dist = -1 }, []string{"dist"}},
+		{"trans", func(m *eco.Mission) { m.Trans = 42 }, []string{"transport_id"}},
+		{"unknown-trans", func(m *eco.Mission) { m.Trans = eco.Unknown }, []string{"transport_id"}},
+		{"unknown-leg-trans", func(m *eco.Mission) { m.Legs[0].Trans = eco.Unknown }, []string{"legs[0].transport_id"}},
+		{"coords", func(m *eco.Mission) { m.Dest.Lat, m.Start.Lng = 91, -181 }, []string{"start.lng", "dest.lat"}},
+		{"legs", func(m *eco.Mission) { m.Legs[0].Dist, m.Legs[0].Trans = math.Inf(+1), 8 }, []string{"legs[0].dist", "legs[0].transport_id"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := valid()
+			tc.modify(&m)
+			err := m.Validate()
+			if tc.fields == nil {
+				if err != nil {
+					t.Fatalf("invalid mission: %+v", err)
+				}
+				return
+			}
+			verr, ok := err.(*eco.ValidationError)
+			if !ok {
+				t.Fatalf("invalid error type %T: %+v", err, err)
+			}
+			var got []string
+			for _, f := range verr.Fields {
+				got = append(got, f.Field)
+			}
+			if !reflect.DeepEqual(got, tc.fields) {
+				t.Fatalf("invalid fields: got=%q, want=%q", got, tc.fields)
+			}
+		})
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	for _, st := range []eco.Status{eco.Registered, eco.Modified, eco.Cancelled, eco.Rejected} {
+		raw, err := json.Marshal(st)
+		if err != nil {
+			t.Fatalf("could not marshal %v: %+v", st, err)
+		}
+		var got eco.Status
+		err = json.Unmarshal(raw, &got)
+		if err != nil {
+			t.Fatalf("could not unmarshal %s: %+v", raw, err)
+		}
+		if got != st {
+			t.Fatalf("invalid status round-trip: got=%v, want=%v", got, st)
+		}
+	}
+	_, err := eco.ParseStatus("lost")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	var (
+		date = time.Date(2019, 10, 2, 0, 0, 0, 0, time.UTC)
+		m    = eco.Mission{ID: 1, Date: date, Dist: 1000, Trans: eco.Plane}
+	)
+	for _, tc := range []struct {
+		name string
+		lc   eco.Lifecycle
+		want bool
+	}{
+		{"registered", eco.Lifecycle{Status: eco.Registered, Date: date.AddDate(0, 0, -1)}, false},
+		{"cancelled-planned", eco.Lifecycle{Status: eco.Cancelled, Date: date.AddDate(0, 0, -1), Mission: &m}, true},
+		{"rejected-planned", eco.Lifecycle{Status: eco.Rejected, Date: date.AddDate(0, 0, -1), Mission: &m}, true},
+		{"cancelled-executed", eco.Lifecycle{Status: eco.Cancelled, Date: date.AddDate(0, 0, 1), Mission: &m}, false},
+		{"cancelled-unknown", eco.Lifecycle{Status: eco.Cancelled, Date: date.AddDate(0, 0, -1)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, want := tc.lc.Avoided(), tc.want; got != want {
+				t.Fatalf("invalid avoided status: got=%v, want=%v", got, want)
+			}
+		})
+	}
+}
+
+func TestPlace(t *testing.T) {
+	for _, tc := range []struct {
+		loc                      eco.Location
+		city, country, continent string
+	}{
+		{
+			loc:  eco.Location{Name: "Paris, Île-de-France, France métropolitaine, France"},
+			city: "Paris", country: "France",
+		},
+		{
+			loc: eco.Location{
+				Name: "Paris, Île-de-France, France métropolitaine, France",
+				Addr: eco.Address{City: "Paris", Country: "France", CountryCode: "fr"},
+			},
+			city: "Paris", country: "FR", continent: eco.Europe,
+		},
+		{
+			loc: eco.Location{
+				Name: "Meyrin, Genève, Suisse",
+				Addr: eco.Address{CountryCode: "CH"},
+			},
+			city: "Meyrin", country: "CH", continent: eco.Europe,
+		},
+		{
+			loc: eco.Location{
+				Name: "Chicago, Cook County, Illinois, États-Unis d'Amérique",
+				Addr: eco.Address{City: "Chicago", CountryCode: "us"},
+			},
+			city: "Chicago", country: "US", continent: eco.NorthAmerica,
+		},
+		{
+			loc: eco.Location{
+				Name: "Somewhere",
+				Addr: eco.Address{CountryCode: "zz"},
+			},
+			city: "Somewhere", country: "ZZ",
+		},
+	} {
+		t.Run(tc.loc.Name, func(t *testing.T) {
+			city, country, continent := tc.loc.Place()
+			if city != tc.city || country != tc.country || continent != tc.continent {
+				t.Fatalf("invalid place: got=(%q, %q, %q), want=(%q, %q, %q)",
+					city, country, continent,
+					tc.city, tc.country, tc.continent,
+				)
+			}
+		})
+	}
+}
+
+func TestSummaryPlaces(t *testing.T) {
+	var (
+		date  = time.Date(2019, 10, 2, 0, 0, 0, 0, time.UTC)
+		paris = eco.Location{
+			Name: "Paris, Île-de-France, France métropolitaine, France",
+			Addr: eco.Address{City: "Paris", CountryCode: "fr"},
+		}
+		lyon = eco.Location{
+			Name: "Lyon, Métropole de Lyon, France métropolitaine, France",
+			Addr: eco.Address{City: "Lyon", CountryCode: "fr"},
+		}
+		tokyo = eco.Location{
+			Name: "東京都, 日本",
+			Addr: eco.Address{City: "Tokyo", CountryCode: "jp"},
+		}
+		summ = eco.NewSummary(date.AddDate(0, 1, 0))
+	)
+
+	for _, m := range []eco.Mission{
+		{ID: 1, Date: date, Dest: paris, Dist: 700000, Trans: eco.Train},
+		{ID: 2, Date: date, Dest: paris, Dist: 700000, Trans: eco.Car},
+		{ID: 3, Date: date, Dest: lyon, Dist: 260000, Trans: eco.Car},
+		{ID: 4, Date: date, Dest: tokyo, Dist: 19430000, Trans: eco.Plane},
+	} {
+		summ.Add(m)
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  map[string]eco.Tally
+		want map[string]int
+	}{
+		{"cities", summ.Cities, map[string]int{"Paris, FR": 2, "Lyon, FR": 1, "Tokyo, JP": 1}},
+		{"countries", summ.Countries, map[string]int{"FR": 3, "JP": 1}},
+		{"continents", summ.Continents, map[string]int{eco.Europe: 3, eco.Asia: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, want := len(tc.got), len(tc.want); got != want {
+				t.Fatalf("invalid number of entries: got=%d, want=%d (%v)", got, want, tc.got)
+			}
+			for k, n := range tc.want {
+				if got, want := tc.got[k].N, n; got != want {
+					t.Fatalf("invalid number of missions for %q: got=%d, want=%d", k, got, want)
+				}
+			}
+		})
+	}
+
+	fr := summ.Countries["FR"]
+	if got, want := fr.Dist, 1660.0; got != want {
+		t.Fatalf("invalid FR distance: got=%v, want=%v", got, want)
+	}
+	want := eco.CostOf(eco.Train, 700000) + eco.CostOf(eco.Car, 700000) + eco.CostOf(eco.Car, 260000)
+	if got := fr.CO2e; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("invalid FR CO2e: got=%v, want=%v", got, want)
+	}
+}
+
+func TestForecast(t *testing.T) {
+	var (
+		ms  []eco.Mission
+		id  int32
+		add = func(date time.Time, dist float64, tid eco.TransID) {
+			id++
+			ms = append(ms, eco.Mission{ID: id, Date: date, Dist: dist, Trans: tid})
+		}
+		approx = func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+	)
+	for i, year := range []int{2016, 2017, 2018, 2019} {
+		for month := time.January; month <= time.December; month++ {
+			add(time.Date(year, month, 15, 0, 0, 0, 0, time.UTC), 100000, eco.Train)
+		}
+		if year < 2019 {
+			add(time.Date(year, time.July, 10, 0, 0, 0, 0, time.UTC), float64(i+1)*1000000, eco.Plane)
+		}
+	}
+	add(time.Date(2019, time.September, 20, 0, 0, 0, 0, time.UTC), 500000, eco.Plane)
+
+	var (
+		beg = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+		end = beg.AddDate(1, 0, 0)
+		now = time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+		fc  = eco.NewForecast(ms, beg, end, now)
+	)
+
+	if got, want := fc.Years, []int{2018, 2017, 2016}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid reference years: got=%v, want=%v", got, want)
+	}
+	if got, want := len(fc.Modes), 2; got != want {
+		t.Fatalf("invalid number of modes: got=%d, want=%d", got, want)
+	}
+
+	train := fc.Modes[0]
+	if got, want := train.Mode, eco.Train; got != want {
+		t.Fatalf("invalid mode: got=%v, want=%v", got, want)
+	}
+	if got, want := train.Dist, (eco.Projection{
+		Executed: 600, Planned: 600, Projected: 1200, Low: 1200, High: 1200,
+	}); got != want {
+		t.Fatalf("invalid train forecast:\ngot= %+v\nwant=%+v", got, want)
+	}
+	for _, v := range train.Curve {
+		if v.Date.Equal(time.Date(2019, time.October, 1, 0, 0, 0, 0, time.UTC)) {
+			if !approx(v.Value, 900) {
+				t.Fatalf("invalid train curve at %v: got=%v, want=%v", v.Date, v.Value, 900)
+			}
+		}
+	}
+	if got, want := len(train.Curve), 7; got != want {
+		t.Fatalf("invalid number of curve points: got=%d, want=%d", got, want)
+	}
+	if last := train.Curve[len(train.Curve)-1]; !last.Date.Equal(end) || !approx(last.Value, 1200) {
+		t.Fatalf("invalid last curve point: %+v", last)
+	}
+
+	plane := fc.Modes[1]
+	if got, want := plane.Dist, (eco.Projection{
+		Executed: 0, Planned: 500, Expected: 1500, Projected: 2000, Low: 1000, High: 3000,
+	}); got != want {
+		t.Fatalf("invalid plane forecast:\ngot= %+v\nwant=%+v", got, want)
+	}
+	if got, want := plane.CO2e.Projected, eco.CostOf(eco.Plane, 2000000); !approx(got, want) {
+		t.Fatalf("invalid plane CO2e: got=%v, want=%v", got, want)
+	}
+
+	want := eco.CostOf(eco.Train, 1200000) + eco.CostOf(eco.Plane, 2000000)
+	if got := fc.Total.Projected; !approx(got, want) {
+		t.Fatalf("invalid total projection: got=%v, want=%v", got, want)
+	}
+	if fc.Total.Low > fc.Total.Projected || fc.Total.High < fc.Total.Projected {
+		t.Fatalf("invalid total uncertainty band: %+v", fc.Total)
+	}
+
+	t.Run("no-history", func(t *testing.T) {
+		var (
+			beg = time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+			now = time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC)
+			fc  = eco.NewForecast(ms, beg, beg.AddDate(1, 0, 0), now)
+		)
+		if len(fc.Years) != 0 {
+			t.Fatalf("invalid reference years: %v", fc.Years)
+		}
+		train := fc.Modes[0]
+		if train.Dist.Executed != 600 || train.Dist.Projected <= 1100 || train.Dist.Low != 1200 {
+			t.Fatalf("invalid train forecast: %+v", train.Dist)
+		}
+	})
+}
+
+func TestEmissions(t *testing.T) {
+	dists := map[eco.TransID]float64{
+		eco.Plane: 1000000,
+		eco.Train: 2000000,
+		eco.Bike:  10000,
+	}
+	rel := func(tid eco.TransID) float64 {
+		const z95 = 1.959963984540054
+		f := eco.Factors[tid].Uncertainty / z95
+		d := eco.DistUncertainty / z95
+		return math.Sqrt(f*f + d*d)
+	}
+	approx := func(a, b, tol float64) bool { return math.Abs(a-b) <= tol*math.Abs(b) }
+
+	got := eco.EmissionsOf(dists)
+	plane := got.Modes[eco.Plane]
+	if want := 210.0; !approx(plane.Value, want, 1e-12) {
+		t.Fatalf("invalid plane emissions: got=%v, want=%v", plane.Value, want)
+	}
+	if want := 210 * rel(eco.Plane); !approx(plane.Err, want, 1e-12) {
+		t.Fatalf("invalid plane uncertainty: got=%v, want=%v", plane.Err, want)
+	}
+	if plane.Low <= 0 || plane.Low >= plane.Value || plane.High <= plane.Value {
+		t.Fatalf("invalid plane confidence interval: %+v", plane)
+	}
+	if bike := got.Modes[eco.Bike]; bike != (eco.Estimate{}) {
+		t.Fatalf("invalid bike emissions: %+v", bike)
+	}
+
+	train := got.Modes[eco.Train]
+	if want := math.Hypot(plane.Err, train.Err); !approx(got.Total.Err, want, 1e-12) {
+		t.Fatalf("invalid total uncertainty: got=%v, want=%v", got.Total.Err, want)
+	}
+	if want := plane.Value + train.Value; !approx(got.Total.Value, want, 1e-12) {
+		t.Fatalf("invalid total emissions: got=%v, want=%v", got.Total.Value, want)
+	}
+
+	mc := eco.SimulateEmissions(dists, 100000, rand.New(rand.NewSource(1)))
+	for _, tid := range []eco.TransID{eco.Plane, eco.Train} {
+		var (
+			v    = mc.Modes[tid]
+			want = got.Modes[tid]
+		)
+		if v.Value != want.Value {
+			t.Fatalf("invalid %v MC central value: got=%v, want=%v", tid, v.Value, want.Value)
+		}
+		if !approx(v.Err, want.Err, 0.05) {
+			t.Fatalf("invalid %v MC uncertainty: got=%v, want=%v", tid, v.Err, want.Err)
+		}
+		if v.Low <= 0 || v.Low >= v.Value || v.High <= v.Value {
+			t.Fatalf("invalid %v MC confidence interval: %+v", tid, v)
+		}
+	}
+	if !approx(mc.Total.Err, got.Total.Err, 0.05) {
+		t.Fatalf("invalid MC total uncertainty: got=%v, want=%v", mc.Total.Err, got.Total.Err)
+	}
+
+	stats := eco.NewStats()
+	stats.Add(eco.Mission{Dist: 1000000, Trans: eco.Plane})
+	if got, want := stats.CO2e, eco.EmissionsOf(map[eco.TransID]float64{eco.Plane: 1000000}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid stats emissions:\ngot= %+v\nwant=%+v", got, want)
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eco // import "github.com/sbinet-lpc/eco"
+
+import (
+	"math"
+	"time"
+)
+
+// Forecast is the projection of the emissions of missions up to the end
+// of a period.
+//
+// The projection combines the executed missions, the already planned ones
+// and a seasonal model of the missions not registered yet.
+// The seasonal model is the monthly profile, per transport mode, of the
+// distances travelled during the same period of the previous years.
+type Forecast struct {
+	Start time.Time      `json:"start"` // start of the period (inclusive)
+	Stop  time.Time      `json:"stop"`  // end of the period (exclusive)
+	Now   time.Time      `json:"now"`   // reference time of the forecast
+	Years []int          `json:"years"` // reference years of the seasonal model
+	Modes []ModeForecast `json:"modes"`
+	Total Projection     `json:"total"` // in kgCO2e
+}
+
+// ModeForecast is the forecast of the missions of a transport mode.
+type ModeForecast struct {
+	Mode  TransID         `json:"transport_id"`
+	Dist  Projection      `json:"dist"` // in kilometers
+	CO2e  Projection      `json:"co2e"` // in kgCO2e
+	Curve []ForecastPoint `json:"curve"`
+}
+
+// Projection is the projected end-of-period value of a quantity.
+type Projection struct {
+	Executed  float64 `json:"executed"`  // executed missions
+	Planned   float64 `json:"planned"`   // planned missions
+	Expected  float64 `json:"expected"`  // missions expected but not registered yet
+	Projected float64 `json:"projected"` // end-of-period value
+	Low       float64 `json:"low"`       // lower edge of the uncertainty band
+	High      float64 `json:"high"`      // upper edge of the uncertainty band
+}
+
+func (p Projection) scale(f float64) Projection {
+	return Projection{
+		Executed:  p.Executed * f,
+		Planned:   p.Planned * f,
+		Expected:  p.Expected * f,
+		Projected: p.Projected * f,
+		Low:       p.Low * f,
+		High:      p.High * f,
+	}
+}
+
+// ForecastPoint is a point of the projected cumulative distance of a
+// transport mode, in kilometers.
+type ForecastPoint struct {
+	Date  time.Time `json:"date"`
+	Value float64   `json:"value"`
+	Low   float64   `json:"low"`
+	High  float64   `json:"high"`
+}
+
+// NewForecast projects the emissions of the provided missions up to the
+// end of the [beg, end) period, as of now.
+//
+// Missions not completed as of now are planned missions.
+// The seasonal model is learned from the executed missions of the same
+// period of each previous year, back to the first executed mission.
+// The expected distance of each mode is the distance travelled during the
+// rest of the period in the reference years, scaled by the ratio of the
+// distances travelled so far this period and in the reference years.
+// That ratio is weighted by the fraction of the reference distance
+// already elapsed, so that early projections follow the seasonal model
+// and late ones the current trend.
+// Planned missions are part of the expected missions: the projection is
+// the executed distance plus the largest of the planned and expected ones.
+//
+// The uncertainty band is the standard deviation of the expected
+// distances over the reference years.
+// Without reference years, the executed missions are extrapolated
+// uniformly in time.
+// With fewer than two reference years, the uncertainty is 100% of the
+// expected distance.
+func NewForecast(ms []Mission, beg, end, now time.Time) Forecast {
+	fc := Forecast{
+		Start: beg,
+		Stop:  end,
+		Now:   now,
+		Years: make([]int, 0),
+		Modes: make([]ModeForecast, 0),
+	}
+
+	cut := now
+	if cut.Before(beg) {
+		cut = beg
+	}
+	if cut.After(end) {
+		cut = end
+	}
+
+	var (
+		first = -1
+		hist  = make(map[TransID]map[int]float64) // monthly distances of executed missions
+		exec  = make(map[TransID]float64)
+		plan  = make(map[TransID]float64)
+	)
+	for _, m := range ms {
+		var (
+			dist     = m.Dist / 1000
+			executed = !m.Planned(now)
+		)
+		if executed {
+			k := monthOf(m.Date)
+			if first < 0 || k < first {
+				first = k
+			}
+			if hist[m.Trans] == nil {
+				hist[m.Trans] = make(map[int]float64)
+			}
+			hist[m.Trans][k] += dist
+		}
+		if m.Date.Before(beg) || !m.Date.Before(end) {
+			continue
+		}
+		switch {
+		case executed:
+			exec[m.Trans] += dist
+		default:
+			plan[m.Trans] += dist
+		}
+	}
+
+	var shifts []int
+	for k := 1; first >= 0; k++ {
+		if monthOf(beg.AddDate(-k, 0, 0)) < first {
+			break
+		}
+		e := end.AddDate(-k, 0, 0)
+		if e.After(beg) || e.After(now) {
+			continue
+		}
+		shifts = append(shifts, k)
+		fc.Years = append(fc.Years, beg.AddDate(-k, 0, 0).Year())
+	}
+
+	var vlo, vhi float64
+	for _, tid := range TransIDs {
+		var (
+			h  = hist[tid]
+			n  = len(shifts)
+			es = make([]float64, n) // reference distances before the cut
+			rs = make([]float64, n) // reference distances after the cut
+		)
+		for i, k := range shifts {
+			es[i] = window(h, beg.AddDate(-k, 0, 0), cut.AddDate(-k, 0, 0))
+			rs[i] = window(h, cut.AddDate(-k, 0, 0), end.AddDate(-k, 0, 0))
+		}
+		if exec[tid] == 0 && plan[tid] == 0 && mean(rs) == 0 {
+			continue
+		}
+
+		var (
+			future float64
+			sigma  float64
+		)
+		switch n {
+		case 0:
+			if el := cut.Sub(beg); el > 0 {
+				future = exec[tid] * float64(end.Sub(cut)) / float64(el)
+			}
+			sigma = future
+		default:
+			me, mr := mean(es), mean(rs)
+			ratio := 1.0
+			if me > 0 {
+				frac := me / (me + mr)
+				ratio = frac*exec[tid]/me + (1 - frac)
+			}
+			fs := make([]float64, n)
+			for i, r := range rs {
+				fs[i] = ratio * r
+			}
+			future = mean(fs)
+			sigma = stddev(fs)
+			if n == 1 {
+				sigma = future
+			}
+		}
+
+		var (
+			committed = exec[tid] + plan[tid]
+			dist      = Projection{
+				Executed:  exec[tid],
+				Planned:   plan[tid],
+				Expected:  math.Max(0, future-plan[tid]),
+				Projected: exec[tid] + math.Max(plan[tid], future),
+			}
+		)
+		dist.Low = math.Max(committed, dist.Projected-sigma)
+		dist.High = dist.Projected + sigma
+
+		// shape of the cumulative distance after the cut, from the
+		// seasonal model or uniform in time.
+		shape := func(t time.Time) float64 {
+			if !end.After(cut) {
+				return 1
+			}
+			var num, den float64
+			for _, k := range shifts {
+				num += window(h, cut.AddDate(-k, 0, 0), t.AddDate(-k, 0, 0))
+				den += window(h, cut.AddDate(-k, 0, 0), end.AddDate(-k, 0, 0))
+			}
+			if den > 0 {
+				return num / den
+			}
+			return float64(t.Sub(cut)) / float64(end.Sub(cut))
+		}
+
+		var curve []ForecastPoint
+		for _, t := range monthEdges(cut, end) {
+			f := shape(t)
+			curve = append(curve, ForecastPoint{
+				Date:  t,
+				Value: dist.Executed + f*(dist.Projected-dist.Executed),
+				Low:   dist.Executed + f*(dist.Low-dist.Executed),
+				High:  dist.Executed + f*(dist.High-dist.Executed),
+			})
+		}
+
+		fact := CostOf(tid, 1000)
+		co2 := dist.scale(fact)
+		fc.Modes = append(fc.Modes, ModeForecast{
+			Mode:  tid,
+			Dist:  dist,
+			CO2e:  co2,
+			Curve: curve,
+		})
+
+		fc.Total.Executed += co2.Executed
+		fc.Total.Planned += co2.Planned
+		fc.Total.Expected += co2.Expected
+		fc.Total.Projected += co2.Projected
+		vlo += sq(co2.Projected - co2.Low)
+		vhi += sq(co2.High - co2.Projected)
+	}
+
+	fc.Total.Low = math.Max(fc.Total.Executed+fc.Total.Planned, fc.Total.Projected-math.Sqrt(vlo))
+	fc.Total.High = fc.Total.Projected + math.Sqrt(vhi)
+
+	return fc
+}
+
+// monthOf returns the index of the month of t, counted from year 0.
+func monthOf(t time.Time) int {
+	t = t.UTC()
+	return 12*t.Year() + int(t.Month()) - 1
+}
+
+func monthStart(k int) time.Time {
+	return time.Date(k/12, time.Month(k%12+1), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// window returns the sum of the monthly values in the [beg, end) range,
+// prorating partially covered months.
+func window(monthly map[int]float64, beg, end time.Time) float64 {
+	if len(monthly) == 0 || !end.After(beg) {
+		return 0
+	}
+	sum := 0.0
+	for k := monthOf(beg); k <= monthOf(end); k++ {
+		v, ok := monthly[k]
+		if !ok {
+			continue
+		}
+		var (
+			lo = monthStart(k)
+			hi = monthStart(k + 1)
+			a  = lo
+			b  = hi
+		)
+		if beg.After(a) {
+			a = beg
+		}
+		if end.Before(b) {
+			b = end
+		}
+		if !b.After(a) {
+			continue
+		}
+		sum += v * float64(b.Sub(a)) / float64(hi.Sub(lo))
+	}
+	return sum
+}
+
+// monthEdges returns the start of each month in the (beg, end) range,
+// surrounded by beg and end.
+func monthEdges(beg, end time.Time) []time.Time {
+	ts := []time.Time{beg}
+	for k := monthOf(beg) + 1; k <= monthOf(end); k++ {
+		t := monthStart(k)
+		if !t.Before(end) {
+			break
+		}
+		ts = append(ts, t)
+	}
+	if end.After(beg) {
+		ts = append(ts, end)
+	}
+	return ts
+}
+
+func mean(vs []float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range vs {
+		sum += v
+	}
+	return sum / float64(len(vs))
+}
+
+func stddev(vs []float64) float64 {
+	if len(vs) < 2 {
+		return 0
+	}
+	var (
+		m   = mean(vs)
+		sum = 0.0
+	)
+	for _, v := range vs {
+		sum += sq(v - m)
+	}
+	return math.Sqrt(sum / float64(len(vs)-1))
+}
+
+func sq(v float64) float64 { return v * v }
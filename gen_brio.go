@@ -1,4 +1,4 @@
-// DO NOT EDIT; automatically generated by brio-gen
+// Code generated by brio-gen; DO NOT EDIT.
 
 package eco
 
@@ -21,6 +21,15 @@ func (o *Mission) MarshalBinary() (data []byte, err error) {
 		data = append(data, buf[:8]...)
 		data = append(data, sub...)
 	}
+	{
+		sub, err := o.Inbound.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(buf[:8], uint64(len(sub)))
+		data = append(data, buf[:8]...)
+		data = append(data, sub...)
+	}
 	{
 		sub, err := o.Start.MarshalBinary()
 		if err != nil {
@@ -42,6 +51,26 @@ func (o *Mission) MarshalBinary() (data []byte, err error) {
 	binary.LittleEndian.PutUint64(buf[:8], math.Float64bits(o.Dist))
 	data = append(data, buf[:8]...)
 	data = append(data, byte(o.Trans))
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.Group)))
+	data = append(data, buf[:8]...)
+	data = append(data, []byte(o.Group)...)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.Legs)))
+	data = append(data, buf[:8]...)
+	for i := range o.Legs {
+		o := &o.Legs[i]
+		{
+			sub, err := o.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			binary.LittleEndian.PutUint64(buf[:8], uint64(len(sub)))
+			data = append(data, buf[:8]...)
+			data = append(data, sub...)
+		}
+	}
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.TransReason)))
+	data = append(data, buf[:8]...)
+	data = append(data, []byte(o.TransReason)...)
 	return data, err
 }
 
@@ -58,6 +87,15 @@ func (o *Mission) UnmarshalBinary(data []byte) (err error) {
 		}
 		data = data[n:]
 	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		err = o.Inbound.UnmarshalBinary(data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
 	{
 		n := int(binary.LittleEndian.Uint64(data[:8]))
 		data = data[8:]
@@ -80,6 +118,36 @@ func (o *Mission) UnmarshalBinary(data []byte) (err error) {
 	data = data[8:]
 	o.Trans = TransID(data[0])
 	data = data[1:]
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		o.Group = string(data[:n])
+		data = data[n:]
+	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		o.Legs = make([]Leg, n)
+		data = data[8:]
+		for i := range o.Legs {
+			oi := &o.Legs[i]
+			{
+				n := int(binary.LittleEndian.Uint64(data[:8]))
+				data = data[8:]
+				err = oi.UnmarshalBinary(data[:n])
+				if err != nil {
+					return err
+				}
+				data = data[n:]
+			}
+		}
+	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		o.TransReason = string(data[:n])
+		data = data[n:]
+	}
+	_ = data
 	return err
 }
 
@@ -93,6 +161,15 @@ func (o *Location) MarshalBinary() (data []byte, err error) {
 	data = append(data, buf[:8]...)
 	binary.LittleEndian.PutUint64(buf[:8], math.Float64bits(o.Lng))
 	data = append(data, buf[:8]...)
+	{
+		sub, err := o.Addr.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(buf[:8], uint64(len(sub)))
+		data = append(data, buf[:8]...)
+		data = append(data, sub...)
+	}
 	return data, err
 }
 
@@ -108,5 +185,145 @@ func (o *Location) UnmarshalBinary(data []byte) (err error) {
 	data = data[8:]
 	o.Lng = float64(math.Float64frombits(binary.LittleEndian.Uint64(data[:8])))
 	data = data[8:]
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		err = o.Addr.UnmarshalBinary(data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	_ = data
+	return err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (o *Address) MarshalBinary() (data []byte, err error) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.City)))
+	data = append(data, buf[:8]...)
+	data = append(data, []byte(o.City)...)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.State)))
+	data = append(data, buf[:8]...)
+	data = append(data, []byte(o.State)...)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.Country)))
+	data = append(data, buf[:8]...)
+	data = append(data, []byte(o.Country)...)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.CountryCode)))
+	data = append(data, buf[:8]...)
+	data = append(data, []byte(o.CountryCode)...)
+	return data, err
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (o *Address) UnmarshalBinary(data []byte) (err error) {
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		o.City = string(data[:n])
+		data = data[n:]
+	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		o.State = string(data[:n])
+		data = data[n:]
+	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		o.Country = string(data[:n])
+		data = data[n:]
+	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		o.CountryCode = string(data[:n])
+		data = data[n:]
+	}
+	_ = data
+	return err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (o *Leg) MarshalBinary() (data []byte, err error) {
+	var buf [8]byte
+	{
+		sub, err := o.Date.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(buf[:8], uint64(len(sub)))
+		data = append(data, buf[:8]...)
+		data = append(data, sub...)
+	}
+	{
+		sub, err := o.Start.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(buf[:8], uint64(len(sub)))
+		data = append(data, buf[:8]...)
+		data = append(data, sub...)
+	}
+	{
+		sub, err := o.Dest.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(buf[:8], uint64(len(sub)))
+		data = append(data, buf[:8]...)
+		data = append(data, sub...)
+	}
+	binary.LittleEndian.PutUint64(buf[:8], math.Float64bits(o.Dist))
+	data = append(data, buf[:8]...)
+	data = append(data, byte(o.Trans))
+	binary.LittleEndian.PutUint64(buf[:8], uint64(len(o.Class)))
+	data = append(data, buf[:8]...)
+	data = append(data, []byte(o.Class)...)
+	return data, err
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (o *Leg) UnmarshalBinary(data []byte) (err error) {
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		err = o.Date.UnmarshalBinary(data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		err = o.Start.UnmarshalBinary(data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		err = o.Dest.UnmarshalBinary(data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	o.Dist = float64(math.Float64frombits(binary.LittleEndian.Uint64(data[:8])))
+	data = data[8:]
+	o.Trans = TransID(data[0])
+	data = data[1:]
+	{
+		n := int(binary.LittleEndian.Uint64(data[:8]))
+		data = data[8:]
+		o.Class = string(data[:n])
+		data = data[n:]
+	}
+	_ = data
 	return err
 }
@@ -37,3 +37,48 @@ func hsin(theta float64) float64 {
 	sin := math.Sin(0.5 * theta)
 	return sin * sin
 }
+
+// GreatCircle returns n+1 points regularly spaced along the great circle
+// (the shortest path on the sphere) between pt1 and pt2, including both
+// end points.
+//
+// Input and output points coordinates are in degrees.
+func GreatCircle(pt1, pt2 Point, n int) []Point {
+	if n < 1 {
+		n = 1
+	}
+	var (
+		lat1 = pt1.Lat * deg2rad
+		lng1 = pt1.Lng * deg2rad
+		lat2 = pt2.Lat * deg2rad
+		lng2 = pt2.Lng * deg2rad
+		d    = 2 * math.Asin(math.Sqrt(hsin(lat2-lat1)+math.Cos(lat1)*math.Cos(lat2)*hsin(lng2-lng1)))
+		pts  = make([]Point, n+1)
+	)
+
+	if d == 0 {
+		for i := range pts {
+			pts[i] = pt1
+		}
+		return pts
+	}
+
+	for i := range pts {
+		var (
+			f = float64(i) / float64(n)
+			a = math.Sin((1-f)*d) / math.Sin(d)
+			b = math.Sin(f*d) / math.Sin(d)
+			x = a*math.Cos(lat1)*math.Cos(lng1) + b*math.Cos(lat2)*math.Cos(lng2)
+			y = a*math.Cos(lat1)*math.Sin(lng1) + b*math.Cos(lat2)*math.Sin(lng2)
+			z = a*math.Sin(lat1) + b*math.Sin(lat2)
+		)
+		pts[i] = Point{
+			Lat: math.Atan2(z, math.Sqrt(x*x+y*y)) / deg2rad,
+			Lng: math.Atan2(y, x) / deg2rad,
+		}
+	}
+	pts[0] = pt1
+	pts[n] = pt2
+
+	return pts
+}
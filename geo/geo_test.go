@@ -64,3 +64,46 @@ func approxEqual(a, b float64) bool {
 	// require only km-level precision.
 	return math.Abs(a-b) <= 1000
 }
+
+func TestGreatCircle(t *testing.T) {
+	var (
+		clermont = Point{45.7774551, 3.0819427}
+		tokyo    = Point{35.6828387, 139.7594549}
+	)
+
+	for _, tt := range []struct {
+		pt1, pt2 Point
+		n        int
+	}{
+		{clermont, clermont, 10},
+		{clermont, Point{48.8566101, 2.3514992}, 1},
+		{clermont, tokyo, 50},
+		{Point{0, 170}, Point{0, -170}, 4},
+	} {
+		t.Run("", func(t *testing.T) {
+			pts := GreatCircle(tt.pt1, tt.pt2, tt.n)
+			if got, want := len(pts), tt.n+1; got != want {
+				t.Fatalf("invalid number of points: got=%d, want=%d", got, want)
+			}
+			if pts[0] != tt.pt1 || pts[tt.n] != tt.pt2 {
+				t.Fatalf("invalid end points: got=(%v, %v), want=(%v, %v)", pts[0], pts[tt.n], tt.pt1, tt.pt2)
+			}
+
+			// all the steps along the great circle have the same length.
+			var (
+				want = Haversine(tt.pt1, tt.pt2) / float64(tt.n)
+				sum  = 0.0
+			)
+			for i := 1; i < len(pts); i++ {
+				got := Haversine(pts[i-1], pts[i])
+				if !approxEqual(got, want) {
+					t.Fatalf("invalid step %d: got=%v, want=%v", i, got, want)
+				}
+				sum += got
+			}
+			if got, want := sum, Haversine(tt.pt1, tt.pt2); !approxEqual(got, want) {
+				t.Fatalf("invalid great circle length: got=%v, want=%v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+)
+
+// Fields of a booking.
+var bookingFields = []string{
+	"ref", "traveller", "date",
+	"origin", "destination",
+	"mode", "class", "fare",
+}
+
+// bookingRequired lists the fields of a booking that must be provided by
+// a statement.
+var bookingRequired = map[string]bool{
+	"date":        true,
+	"origin":      true,
+	"destination": true,
+	"mode":        true,
+}
+
+// Booking is a journey booked through a travel agency, as listed in its
+// statements.
+type Booking struct {
+	Ref       string      // booking reference
+	Traveller string      // name of the traveller
+	Date      time.Time   // date of the journey
+	Origin    string      // airport or station of departure
+	Dest      string      // airport or station of arrival
+	Mode      eco.TransID // transport mode
+	Class     string      // cabin class (e.g. economy, business)
+	Fare      float64     // -1 if unknown
+}
+
+func (b Booking) String() string {
+	return fmt.Sprintf("%s %s %s -> %s (ref=%q, traveller=%q, class=%q)",
+		b.Date.Format(defaultJourneyLayout), b.Mode, b.Origin, b.Dest,
+		b.Ref, b.Traveller, b.Class,
+	)
+}
+
+// Digest returns the digest of the content of the booking.
+func (b Booking) Digest() []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "booking;")
+	for _, v := range []string{b.Ref, b.Traveller, b.Origin, b.Dest, b.Class} {
+		fmt.Fprintf(h, "%d:%s;", len(v), v)
+	}
+	fmt.Fprintf(h, "%d;%d;%v;", b.Date.Unix(), b.Mode, b.Fare)
+	return h.Sum(nil)
+}
+
+// ReadBookings reads the bookings of a travel-agency statement (a CSV or
+// XLSX file).
+// The fields of bookings are "ref", "traveller", "date", "origin",
+// "destination", "mode", "class" and "fare". Dates are parsed with the
+// journey layout of the mapping.
+func ReadBookings(fname string, m Mapping) ([]Booking, error) {
+	err := m.validate(bookingFields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping: %w", err)
+	}
+
+	src, err := openTable(fname, m, bookingFields, bookingRequired)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var bks []Booking
+	for {
+		row, err := src.line()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("could not read row %d of %q: %w", src.row, fname, err)
+		}
+		b, err := m.decodeBooking(src.idx, row)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode row %d of %q: %w", src.row, fname, err)
+		}
+		bks = append(bks, b)
+	}
+
+	err = src.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not close %q: %w", fname, err)
+	}
+	return bks, nil
+}
+
+func (m Mapping) decodeBooking(idx map[string]int, row []string) (Booking, error) {
+	var (
+		b    Booking
+		err  error
+		cell = func(f string) string {
+			i, ok := idx[f]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+		layout = m.JourneyLayout
+	)
+	if layout == "" {
+		layout = defaultJourneyLayout
+	}
+
+	b.Ref = cell("ref")
+	b.Traveller = cell("traveller")
+	b.Date, err = parseTime(layout, cell("date"))
+	if err != nil {
+		return b, fmt.Errorf("could not parse date: %w", err)
+	}
+	b.Origin = cell("origin")
+	b.Dest = cell("destination")
+	if b.Origin == "" || b.Dest == "" {
+		return b, fmt.Errorf("empty origin or destination")
+	}
+	b.Mode, err = parseMode(cell("mode"))
+	if err != nil {
+		return b, err
+	}
+	b.Class = cell("class")
+	b.Fare = -1
+	if v := cell("fare"); v != "" {
+		b.Fare, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return b, fmt.Errorf("could not parse fare: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// parseMode returns the transport mode of a booking.
+func parseMode(v string) (eco.TransID, error) {
+	switch fold(v) {
+	case "air", "flight", "avion", "vol", "aerien":
+		return eco.Plane, nil
+	case "rail", "sncf", "tgv", "ter", "intercites":
+		return eco.Train, nil
+	}
+	tid, err := eco.ParseTransID(fold(v))
+	if err != nil || tid == eco.Unknown {
+		return tid, fmt.Errorf("unknown transport mode %q", v)
+	}
+	return tid, nil
+}
+
+// Unmatched is a booking that could not be matched to a single mission.
+type Unmatched struct {
+	Booking  Booking
+	Missions []int32 // candidate missions, if ambiguous
+}
+
+// Match matches bookings with the missions of the provided records.
+//
+// A booking is a candidate for a mission if it takes place during the
+// mission (with one day of slack), if its traveller is the one of the
+// mission (when both are known) and if its traveller or its origin or
+// destination matches the mission.
+// Bookings are associated with their best candidate, if unique.
+func Match(bookings []Booking, recs []Record) (map[int32][]Booking, []Unmatched) {
+	var (
+		matched   = make(map[int32][]Booking)
+		unmatched []Unmatched
+	)
+
+	for _, b := range bookings {
+		var (
+			best = 0
+			ids  []int32
+		)
+		for _, rec := range recs {
+			v := score(b, rec)
+			switch {
+			case v <= 0 || v < best:
+				continue
+			case v > best:
+				best = v
+				ids = ids[:0]
+			}
+			ids = append(ids, rec.ID)
+		}
+		ids = uniq(ids) // missions with multiple legs.
+
+		switch len(ids) {
+		case 1:
+			matched[ids[0]] = append(matched[ids[0]], b)
+		case 0:
+			unmatched = append(unmatched, Unmatched{Booking: b})
+		default:
+			unmatched = append(unmatched, Unmatched{Booking: b, Missions: ids})
+		}
+	}
+
+	for _, bks := range matched {
+		sort.SliceStable(bks, func(i, j int) bool {
+			return bks[i].Date.Before(bks[j].Date)
+		})
+	}
+	return matched, unmatched
+}
+
+// score returns how well a booking matches a record, or zero if the
+// booking is not a candidate for the record.
+func score(b Booking, rec Record) int {
+	const slack = 24 * time.Hour
+
+	var (
+		beg = rec.Outbound.Date
+		end = rec.Inbound.Date
+	)
+	if end.Before(beg) {
+		end = beg
+	}
+	if b.Date.Before(beg.Add(-slack)) || b.Date.After(end.Add(slack)) {
+		return 0
+	}
+
+	v := 0
+	if b.Traveller != "" && rec.Traveller != "" {
+		if !sameName(b.Traveller, rec.Traveller) {
+			return 0
+		}
+		v += 2
+	}
+
+	place := rec.Destination
+	if toks := strings.Split(place, "///"); len(toks) > 1 {
+		place = toks[1] // city
+	}
+	place = fold(place)
+	if len(place) >= 3 && (strings.Contains(fold(b.Dest), place) || strings.Contains(fold(b.Origin), place)) {
+		v++
+	}
+	return v
+}
+
+// sameName returns whether two names refer to the same person, whatever
+// the order of first and last names.
+func sameName(a, b string) bool {
+	words := func(v string) string {
+		ws := strings.Fields(fold(v))
+		sort.Strings(ws)
+		return strings.Join(ws, " ")
+	}
+	return words(a) == words(b)
+}
+
+var folder = strings.NewReplacer(
+	"à", "a", "â", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"î", "i", "ï", "i",
+	"ô", "o", "ö", "o",
+	"ù", "u", "û", "u", "ü", "u",
+	"ç", "c",
+	"-", " ", ",", " ", ".", " ", "'", " ",
+)
+
+// fold returns a lower-case version of a name, without accents nor
+// punctuation.
+func fold(v string) string {
+	return strings.Join(strings.Fields(folder.Replace(strings.ToLower(v))), " ")
+}
+
+func uniq(ids []int32) []int32 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	out := ids[:0]
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
+}
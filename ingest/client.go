@@ -0,0 +1,59 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// URL returns the URL of a path (e.g. "/api/stats") of the eco-srv
+// server at the provided [scheme://]host[:port] address.
+//
+// Without a scheme, HTTPS is used, except for loopback hosts (e.g. ":80",
+// "localhost:8080") and port 80, served over plain HTTP.
+func URL(addr, path string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	addr = strings.TrimSuffix(addr, "/")
+	if strings.Contains(addr, "://") {
+		return addr + path
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	scheme := "https"
+	if port == "80" || loopback(host) {
+		scheme = "http"
+	}
+	return scheme + "://" + addr + path
+}
+
+// loopback returns whether host is a loopback host.
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// APIToken returns the eco-srv API token, read from the provided file
+// or from the $ECO_TOKEN environment variable.
+func APIToken(fname string) (string, error) {
+	if fname == "" {
+		return os.Getenv("ECO_TOKEN"), nil
+	}
+	raw, err := os.ReadFile(fname)
+	if err != nil {
+		return "", fmt.Errorf("could not read API token file: %w", err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIToken(t *testing.T) {
+	t.Setenv("ECO_TOKEN", "from-env")
+
+	tok, err := APIToken("")
+	if err != nil {
+		t.Fatalf("could not read token: %+v", err)
+	}
+	if got, want := tok, "from-env"; got != want {
+		t.Fatalf("invalid token: got=%q, want=%q", got, want)
+	}
+
+	fname := filepath.Join(t.TempDir(), "token")
+	err = os.WriteFile(fname, []byte("s3cr3t\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write token file: %+v", err)
+	}
+	tok, err = APIToken(fname)
+	if err != nil {
+		t.Fatalf("could not read token: %+v", err)
+	}
+	if got, want := tok, "s3cr3t"; got != want {
+		t.Fatalf("invalid token: got=%q, want=%q", got, want)
+	}
+
+	_, err = APIToken(fname + ".missing")
+	if err == nil {
+		t.Fatalf("expected an error for a missing token file")
+	}
+}
+
+func TestURL(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{":80", "http://localhost:80/api/stats"},
+		{":8443", "http://localhost:8443/api/stats"},
+		{"127.0.0.1:8080", "http://127.0.0.1:8080/api/stats"},
+		{"[::1]:8080", "http://[::1]:8080/api/stats"},
+		{"eco.example.org", "https://eco.example.org/api/stats"},
+		{"eco.example.org:8443", "https://eco.example.org:8443/api/stats"},
+		{"eco.example.org:80", "http://eco.example.org:80/api/stats"},
+		{"http://eco.example.org:8080", "http://eco.example.org:8080/api/stats"},
+		{"https://localhost:8443/", "https://localhost:8443/api/stats"},
+	} {
+		if got := URL(tc.addr, "/api/stats"); got != tc.want {
+			t.Fatalf("invalid URL for %q: got=%q, want=%q", tc.addr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stop is a city visited during a mission.
+type Stop struct {
+	City    string
+	Country string // empty if unknown
+}
+
+// query returns the geocoding query of the stop.
+func (s Stop) query() string {
+	if s.Country == "" {
+		return s.City
+	}
+	return s.City + "," + s.Country
+}
+
+func (s Stop) String() string { return s.query() }
+
+// ParseDestination parses the destination field of a mission into the
+// list of its stops, in visiting order.
+//
+// The destination field is a "///"-separated list of
+// "country///city///country" triplets, one per stop, where the first
+// country (often a region or a zone) is only used when the second one is
+// missing.
+// Shorter forms are also accepted for single-stop missions:
+// "city///country" and "city".
+// Several cities of the same country may be given in a single triplet,
+// separated by ";" or "+" (e.g. "Suisse///Genève; Zurich///Suisse"): commas
+// are part of city names (e.g. "Paris, 5e").
+//
+// Tokens are trimmed, their inner spaces collapsed and their case
+// normalized.
+func ParseDestination(dest string) ([]Stop, error) {
+	toks := strings.Split(dest, "///")
+	for i, tok := range toks {
+		toks[i] = normalize(tok)
+	}
+
+	var stops []Stop
+	add := func(cities, country string) error {
+		if cities == "" {
+			return fmt.Errorf("missing city (stop #%d)", len(stops)+1)
+		}
+		for _, city := range strings.FieldsFunc(cities, func(r rune) bool {
+			return r == ';' || r == '+'
+		}) {
+			city = normalize(city)
+			if city == "" {
+				continue
+			}
+			stops = append(stops, Stop{City: city, Country: country})
+		}
+		return nil
+	}
+
+	switch n := len(toks); {
+	case n == 1:
+		if err := add(toks[0], ""); err != nil {
+			return nil, err
+		}
+	case n == 2:
+		if err := add(toks[0], toks[1]); err != nil {
+			return nil, err
+		}
+	case n%3 == 0:
+		for i := 0; i < n; i += 3 {
+			country := toks[i+2]
+			if country == "" {
+				country = toks[i]
+			}
+			if err := add(toks[i+1], country); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("not a list of country///city///country triplets (n=%d)", n)
+	}
+
+	if len(stops) == 0 {
+		return nil, fmt.Errorf("no city")
+	}
+	return stops, nil
+}
+
+func normalize(tok string) string {
+	tok = strings.Join(strings.Fields(tok), " ")
+	return strings.Title(strings.ToLower(tok))
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/geo"
+)
+
+func TestParseDestination(t *testing.T) {
+	for _, tc := range []struct {
+		dest  string
+		want  []Stop
+		error bool
+	}{
+		{dest: "France///Lyon///France", want: []Stop{{"Lyon", "France"}}},
+		{dest: "  france /// LYON  ///france ", want: []Stop{{"Lyon", "France"}}},
+		{dest: "Europe///Genève///", want: []Stop{{"Genève", "Europe"}}},
+		{dest: "Lyon///France", want: []Stop{{"Lyon", "France"}}},
+		{dest: "Lyon", want: []Stop{{"Lyon", ""}}},
+		{dest: "Etats-Unis///new   york///Etats-Unis", want: []Stop{{"New York", "Etats-Unis"}}},
+		{
+			dest: "France///Lyon///France///Suisse///Genève///Suisse",
+			want: []Stop{{"Lyon", "France"}, {"Genève", "Suisse"}},
+		},
+		{
+			dest: "Suisse///Genève; Zurich + Bâle///Suisse",
+			want: []Stop{{"Genève", "Suisse"}, {"Zurich", "Suisse"}, {"Bâle", "Suisse"}},
+		},
+		{dest: "France///Paris, 5e///France", want: []Stop{{"Paris, 5e", "France"}}},
+		{dest: "", error: true},
+		{dest: "France/// ///France", error: true},
+		{dest: "France///Lyon///France///Suisse", error: true},
+		{dest: "France///;///France", error: true},
+	} {
+		t.Run(tc.dest, func(t *testing.T) {
+			got, err := ParseDestination(tc.dest)
+			switch {
+			case tc.error && err == nil:
+				t.Fatalf("expected an error, got %v", got)
+			case !tc.error && err != nil:
+				t.Fatalf("could not parse destination: %+v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("invalid stops:\ngot= %v\nwant=%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessStops(t *testing.T) {
+	var (
+		lyon   = eco.Location{Name: "Lyon", Lat: 45.7578137, Lng: 4.8320114}
+		geneve = eco.Location{Name: "Genève", Lat: 46.2017559, Lng: 6.1466014}
+		dist   = func(a, b eco.Location) float64 { return geo.Haversine(point(a), point(b)) }
+	)
+
+	p := newTestPipeline(nil, Options{})
+	p.places["Genève,Suisse"] = geneve
+
+	rec := record(1, idTrain, 1, "France///Lyon///France///Suisse///Genève///Suisse", "2019-10-02", "2019-10-04")
+	m, err := p.Process(rec, nil)
+	if err != nil {
+		t.Fatalf("could not process mission: %+v", err)
+	}
+
+	if m.Dest != geneve {
+		t.Fatalf("invalid destination: got=%v, want=%v", m.Dest, geneve)
+	}
+	want := dist(Clermont, lyon) + dist(lyon, geneve) + dist(geneve, Clermont)
+	if math.Abs(m.Dist-want) > 1e-6 {
+		t.Fatalf("invalid distance: got=%v, want=%v", m.Dist, want)
+	}
+
+	if got, want := len(m.Legs), 3; got != want {
+		t.Fatalf("invalid number of legs: got=%d, want=%d", got, want)
+	}
+	for i, stops := range [][2]eco.Location{{Clermont, lyon}, {lyon, geneve}, {geneve, Clermont}} {
+		leg := m.Legs[i]
+		if leg.Start != stops[0] || leg.Dest != stops[1] || leg.Trans != eco.Train {
+			t.Fatalf("invalid leg #%d: %+v", i, leg)
+		}
+	}
+	if !m.Legs[0].Date.Equal(m.Date) || !m.Legs[2].Date.Equal(m.Inbound) {
+		t.Fatalf("invalid legs dates: %v, %v", m.Legs[0].Date, m.Legs[2].Date)
+	}
+
+	rec = record(2, idTrain, 1, "France///Lyon///France", "2019-10-02", "2019-10-04")
+	m, err = p.Process(rec, nil)
+	if err != nil {
+		t.Fatalf("could not process mission: %+v", err)
+	}
+	if m.Dest != lyon || m.Legs != nil || m.Dist != 2*dist(Clermont, lyon) {
+		t.Fatalf("invalid single-stop mission: %v (legs=%d)", m, len(m.Legs))
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+)
+
+// TIDFixup fixes the transport mode of a mission of the "Autres" kind.
+type TIDFixup struct {
+	ID      int32  `json:"id"`
+	TID     string `json:"tid"` // transport mode (e.g. "train", "car")
+	Comment string `json:"comment,omitempty"`
+}
+
+// DestFixup fixes the destination of a mission.
+type DestFixup struct {
+	ID      int32    `json:"id"`
+	Dest    []string `json:"dest,omitempty"` // "country, city, country" triplets, see ParseDestination
+	Lat     *float64 `json:"lat,omitempty"`  // latitude of the destination
+	Lng     *float64 `json:"lng,omitempty"`  // longitude of the destination
+	Km      float64  `json:"km,omitempty"`   // round-trip distance, in kilometers
+	Comment string   `json:"comment,omitempty"`
+}
+
+// Fixups are the manual corrections of missions.
+type Fixups struct {
+	TIDs  []TIDFixup
+	Dests []DestFixup
+}
+
+// LoadFixups loads and validates the transport modes and destinations
+// fixups files.
+func LoadFixups(tids, dests string) (Fixups, error) {
+	var fx Fixups
+	err := load(tids, &fx.TIDs)
+	if err != nil {
+		return fx, fmt.Errorf("could not load transport fixups: %w", err)
+	}
+	err = load(dests, &fx.Dests)
+	if err != nil {
+		return fx, fmt.Errorf("could not load destination fixups: %w", err)
+	}
+
+	err = fx.Validate()
+	if err != nil {
+		return fx, err
+	}
+	return fx, nil
+}
+
+func load(name string, ptr interface{}) error {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(ptr)
+	if err != nil {
+		return fmt.Errorf("could not decode %q: %w", name, err)
+	}
+	return nil
+}
+
+// FixupErrors are the problems found in fixups.
+type FixupErrors []string
+
+func (errs FixupErrors) Error() string {
+	return fmt.Sprintf("invalid fixups:\n\t%s", strings.Join(errs, "\n\t"))
+}
+
+// Validate checks fixups:
+//   - mission IDs are positive and unique within each kind of fixups,
+//   - transport modes are known,
+//   - destinations are valid (see ParseDestination),
+//   - coordinates are given together and within range,
+//   - distances are positive,
+//   - destination fixups fix something.
+func (fx Fixups) Validate() error {
+	var errs FixupErrors
+	bad := func(kind string, id int32, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s fixup %d: %s", kind, id, fmt.Sprintf(format, args...)))
+	}
+
+	seen := make(map[int32]bool, len(fx.TIDs))
+	for _, f := range fx.TIDs {
+		if f.ID <= 0 {
+			bad("transport", f.ID, "invalid mission ID")
+		}
+		if seen[f.ID] {
+			bad("transport", f.ID, "duplicate mission ID")
+		}
+		seen[f.ID] = true
+		tid, err := eco.ParseTransID(f.TID)
+		if err != nil || tid == eco.Unknown {
+			bad("transport", f.ID, "invalid transport mode %q", f.TID)
+		}
+	}
+
+	seen = make(map[int32]bool, len(fx.Dests))
+	for _, f := range fx.Dests {
+		if f.ID <= 0 {
+			bad("destination", f.ID, "invalid mission ID")
+		}
+		if seen[f.ID] {
+			bad("destination", f.ID, "duplicate mission ID")
+		}
+		seen[f.ID] = true
+		if f.Dest != nil {
+			if _, err := ParseDestination(strings.Join(f.Dest, "///")); err != nil {
+				bad("destination", f.ID, "invalid destination %q: %v", f.Dest, err)
+			}
+		}
+		switch {
+		case (f.Lat == nil) != (f.Lng == nil):
+			bad("destination", f.ID, "latitude and longitude must be given together")
+		case f.Lat != nil && !(*f.Lat >= -90 && *f.Lat <= 90):
+			bad("destination", f.ID, "latitude %v out of range", *f.Lat)
+		case f.Lng != nil && !(*f.Lng >= -180 && *f.Lng <= 180):
+			bad("destination", f.ID, "longitude %v out of range", *f.Lng)
+		}
+		if math.IsNaN(f.Km) || math.IsInf(f.Km, 0) || f.Km < 0 {
+			bad("destination", f.ID, "invalid distance %v", f.Km)
+		}
+		if f.Dest == nil && f.Lat == nil && f.Lng == nil && f.Km == 0 {
+			bad("destination", f.ID, "no destination, coordinates nor distance")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SetTID adds or updates the transport fixup of a mission.
+func (fx *Fixups) SetTID(f TIDFixup) {
+	for i := range fx.TIDs {
+		if fx.TIDs[i].ID == f.ID {
+			fx.TIDs[i] = f
+			return
+		}
+	}
+	fx.TIDs = append(fx.TIDs, f)
+}
+
+// SetDest adds or updates the destination fixup of a mission.
+func (fx *Fixups) SetDest(f DestFixup) {
+	for i := range fx.Dests {
+		if fx.Dests[i].ID == f.ID {
+			fx.Dests[i] = f
+			return
+		}
+	}
+	fx.Dests = append(fx.Dests, f)
+}
+
+// Dest returns the destination fixup of a mission, if any.
+func (fx Fixups) Dest(id int32) (DestFixup, bool) {
+	for _, f := range fx.Dests {
+		if f.ID == id {
+			return f, true
+		}
+	}
+	return DestFixup{}, false
+}
+
+// Remove removes the transport and destination fixups of a mission.
+// It returns false if the mission had no fixup.
+func (fx *Fixups) Remove(id int32) bool {
+	n := len(fx.TIDs) + len(fx.Dests)
+	tids := fx.TIDs[:0]
+	for _, f := range fx.TIDs {
+		if f.ID != id {
+			tids = append(tids, f)
+		}
+	}
+	fx.TIDs = tids
+
+	dests := fx.Dests[:0]
+	for _, f := range fx.Dests {
+		if f.ID != id {
+			dests = append(dests, f)
+		}
+	}
+	fx.Dests = dests
+	return len(fx.TIDs)+len(fx.Dests) != n
+}
+
+// Save validates the fixups and writes them to the transport modes and
+// destinations fixups files, sorted by mission ID.
+func (fx Fixups) Save(tids, dests string) error {
+	err := fx.Validate()
+	if err != nil {
+		return err
+	}
+
+	if fx.TIDs == nil {
+		fx.TIDs = []TIDFixup{}
+	}
+	if fx.Dests == nil {
+		fx.Dests = []DestFixup{}
+	}
+	sort.Slice(fx.TIDs, func(i, j int) bool { return fx.TIDs[i].ID < fx.TIDs[j].ID })
+	sort.Slice(fx.Dests, func(i, j int) bool { return fx.Dests[i].ID < fx.Dests[j].ID })
+
+	for _, v := range []struct {
+		name string
+		data interface{}
+	}{
+		{tids, fx.TIDs},
+		{dests, fx.Dests},
+	} {
+		raw, err := json.MarshalIndent(v.data, "", "\t")
+		if err != nil {
+			return fmt.Errorf("could not encode fixups: %w", err)
+		}
+		err = os.WriteFile(v.name, append(raw, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("could not save fixups: %w", err)
+		}
+	}
+	return nil
+}
+
+func (fx Fixups) tids() map[int32]eco.TransID {
+	db := make(map[int32]eco.TransID, len(fx.TIDs))
+	for _, f := range fx.TIDs {
+		tid, err := eco.ParseTransID(f.TID)
+		if err != nil {
+			continue
+		}
+		db[f.ID] = tid
+	}
+	return db
+}
+
+func (fx Fixups) dests() map[int32]DestFixup {
+	db := make(map[int32]DestFixup, len(fx.Dests))
+	for _, f := range fx.Dests {
+		db[f.ID] = f
+	}
+	return db
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sbinet-lpc/eco"
+)
+
+func f64(v float64) *float64 { return &v }
+
+func TestFixupsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fx   Fixups
+		err  bool
+	}{
+		{
+			name: "ok",
+			fx: Fixups{
+				TIDs: []TIDFixup{{ID: 1, TID: "train"}},
+				Dests: []DestFixup{
+					{ID: 1, Dest: []string{"France", "Lyon", "France"}},
+					{ID: 2, Lat: f64(45.75), Lng: f64(4.83), Km: 300},
+				},
+			},
+		},
+		{name: "bad-id", fx: Fixups{TIDs: []TIDFixup{{ID: 0, TID: "train"}}}, err: true},
+		{name: "dup-id", fx: Fixups{TIDs: []TIDFixup{{ID: 1, TID: "train"}, {ID: 1, TID: "car"}}}, err: true},
+		{name: "bad-tid", fx: Fixups{TIDs: []TIDFixup{{ID: 1, TID: "rocket"}}}, err: true},
+		{name: "bad-dest", fx: Fixups{Dests: []DestFixup{{ID: 1, Dest: []string{"France", "Lyon", "France", "Suisse"}}}}, err: true},
+		{name: "empty-token", fx: Fixups{Dests: []DestFixup{{ID: 1, Dest: []string{"France", " ", "France"}}}}, err: true},
+		{name: "lat-only", fx: Fixups{Dests: []DestFixup{{ID: 1, Lat: f64(45)}}}, err: true},
+		{name: "bad-lat", fx: Fixups{Dests: []DestFixup{{ID: 1, Lat: f64(95), Lng: f64(4)}}}, err: true},
+		{name: "bad-km", fx: Fixups{Dests: []DestFixup{{ID: 1, Km: math.NaN()}}}, err: true},
+		{name: "no-op", fx: Fixups{Dests: []DestFixup{{ID: 1, Comment: "nothing"}}}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.fx.Validate()
+			if (err != nil) != tc.err {
+				t.Fatalf("invalid validation: err=%v", err)
+			}
+		})
+	}
+}
+
+func TestFixupsSave(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		tids  = filepath.Join(dir, "fixups.tid.json")
+		dests = filepath.Join(dir, "fixups.dest.json")
+	)
+
+	var fx Fixups
+	fx.SetTID(TIDFixup{ID: 3, TID: "car"})
+	fx.SetTID(TIDFixup{ID: 1, TID: "bus"})
+	fx.SetTID(TIDFixup{ID: 1, TID: "train", Comment: "TER"})
+	fx.SetDest(DestFixup{ID: 2, Dest: []string{"France", "Lyon", "France"}, Km: 320})
+
+	err := fx.Save(tids, dests)
+	if err != nil {
+		t.Fatalf("could not save fixups: %+v", err)
+	}
+
+	got, err := LoadFixups(tids, dests)
+	if err != nil {
+		t.Fatalf("could not load fixups: %+v", err)
+	}
+	want := Fixups{
+		TIDs: []TIDFixup{
+			{ID: 1, TID: "train", Comment: "TER"},
+			{ID: 3, TID: "car"},
+		},
+		Dests: []DestFixup{{ID: 2, Dest: []string{"France", "Lyon", "France"}, Km: 320}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid fixups:\ngot= %+v\nwant=%+v", got, want)
+	}
+
+	if !got.Remove(2) {
+		t.Fatalf("could not remove fixup of mission 2")
+	}
+	if got.Remove(2) {
+		t.Fatalf("removed fixup of mission 2 twice")
+	}
+	err = got.Save(tids, dests)
+	if err != nil {
+		t.Fatalf("could not save fixups: %+v", err)
+	}
+	got, err = LoadFixups(tids, dests)
+	if err != nil {
+		t.Fatalf("could not load fixups: %+v", err)
+	}
+	if len(got.TIDs) != 2 || len(got.Dests) != 0 {
+		t.Fatalf("invalid fixups: %+v", got)
+	}
+
+	bad := Fixups{TIDs: []TIDFixup{{ID: 1, TID: "rocket"}}}
+	if err := bad.Save(tids, dests); err == nil {
+		t.Fatalf("expected an error saving invalid fixups")
+	}
+}
+
+func TestFixupsProcess(t *testing.T) {
+	p := newTestPipeline(nil, Options{
+		Fixups: Fixups{
+			TIDs: []TIDFixup{{ID: 2, TID: "train"}, {ID: 9, TID: "car"}},
+			Dests: []DestFixup{
+				{ID: 1, Lat: f64(45.7578137), Lng: f64(4.8320114)},
+				{ID: 2, Km: 320},
+				{ID: 3, Lat: f64(45.7578137), Lng: f64(4.8320114)},
+				{ID: 4, Lat: f64(46.2017559), Lng: f64(6.1466014)},
+				{ID: 8, Dest: []string{"France", "Lyon", "France"}},
+			},
+		},
+	})
+	ms, err := p.Read(&records{
+		record(1, idTrain, 1, "France/// ///France", "2019-10-02", "2019-10-04"),
+		record(2, idAutres, 1, "France///Lyon///France", "2019-11-02", "2019-11-03"),
+		record(3, idTrain, 1, "France///Lyon///France", "2019-12-02", "2019-12-03"),
+		record(4, idTrain, 1, "Suisse///Genève///Suisse", "2019-12-02", "2019-12-03"),
+	})
+	if err != nil {
+		t.Fatalf("could not read source: %+v", err)
+	}
+
+	m, err := p.Process(p.Choose(ms.Legs[1]), nil)
+	if err != nil {
+		t.Fatalf("could not process mission 1: %+v", err)
+	}
+	if m.Dest.Lat != 45.7578137 || m.Dest.Lng != 4.8320114 {
+		t.Fatalf("invalid destination: %+v", m.Dest)
+	}
+
+	m, err = p.Process(p.Choose(ms.Legs[2]), nil)
+	if err != nil {
+		t.Fatalf("could not process mission 2: %+v", err)
+	}
+	if m.Trans != eco.Train || m.Dist != 320e3 {
+		t.Fatalf("invalid mission: trans=%v, dist=%v", m.Trans, m.Dist)
+	}
+
+	// overridden coordinates keep the city and country of the destination.
+	p.places["France"] = eco.Location{Name: "France", Addr: eco.Address{Country: "France", CountryCode: "FR"}}
+	p.places["Suisse"] = eco.Location{Name: "Suisse", Addr: eco.Address{Country: "Schweiz", CountryCode: "CH"}}
+	for _, tc := range []struct {
+		id                       int32
+		city, country, continent string
+	}{
+		{3, "Lyon", "FR", "Europe"},
+		{4, "Genève", "CH", "Europe"},
+	} {
+		m, err = p.Process(p.Choose(ms.Legs[tc.id]), nil)
+		if err != nil {
+			t.Fatalf("could not process mission %d: %+v", tc.id, err)
+		}
+		city, country, continent := m.Dest.Place()
+		if city != tc.city || country != tc.country || continent != tc.continent {
+			t.Fatalf("invalid place of mission %d: got=(%q, %q, %q), want=(%q, %q, %q)",
+				tc.id, city, country, continent, tc.city, tc.country, tc.continent,
+			)
+		}
+	}
+
+	r := p.Report()
+	if got, want := r.UnusedTIDs, []int32{9}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid unused transport fixups: got=%v, want=%v", got, want)
+	}
+	if got, want := r.UnusedDests, []int32{8}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid unused destination fixups: got=%v, want=%v", got, want)
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+)
+
+// fakeDB is an in-process stand-in for a SQL view of missions.
+// It only understands the queries used to stream the missions.
+type fakeDB struct {
+	cols    []string
+	rows    [][]driver.Value // sorted by mission ID, in the first column
+	queries []string
+}
+
+func (db *fakeDB) Open(name string) (driver.Conn, error) { return &fakeConn{db}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, fmt.Errorf("read-only") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return 2 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("read-only")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.queries = append(s.db.queries, s.query)
+	var (
+		a    = args[0].(int64)
+		b    = args[1].(int64)
+		rows = &fakeRows{}
+	)
+	switch {
+	case strings.HasPrefix(s.query, "select distinct "):
+		rows.cols = s.db.cols[:1]
+		for _, row := range s.db.rows {
+			id := row[0].(int64)
+			if id <= a || int64(len(rows.vals)) == b {
+				continue
+			}
+			if n := len(rows.vals); n > 0 && rows.vals[n-1][0] == id {
+				continue
+			}
+			rows.vals = append(rows.vals, []driver.Value{id})
+		}
+	case strings.HasPrefix(s.query, "select * "):
+		rows.cols = s.db.cols
+		for _, row := range s.db.rows {
+			if id := row[0].(int64); a < id && id <= b {
+				rows.vals = append(rows.vals, row)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown query %q", s.query)
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.vals[0])
+	r.vals = r.vals[1:]
+	return nil
+}
+
+// lpcCols are the names of the columns of the LPC view_mission view.
+var lpcCols = []string{
+	"ID_MISSION", "DATE_MISSION", "ORGANISME", "GROUPE",
+	"DEPART", "DESTINATION", "OBJET", "TYPE",
+	"TRANSPORT",
+	"DATE_ALLER", "DEBUT_ALLER", "FIN_ALLER",
+	"DATE_RETOUR", "DEBUT_RETOUR", "FIN_RETOUR",
+	"COMMENTAIRE", "VALIDE", "COUT",
+	"RESIDENCE_FAMILIALE", "RESIDENCE_RETOUR", "HEBERGEMENT",
+	"ID_TRANSPORT", "LIBELLE_TRANSPORT",
+}
+
+// fakeRow returns a row of the view_mission view.
+func fakeRow(id int64, tid int32, dest, out string) []driver.Value {
+	return []driver.Value{
+		id, []byte("2019-09-01 10:00:00"), []byte("CNRS"), []byte("ATLAS"),
+		[]byte("Clermont-Ferrand"), []byte(dest), []byte("meeting"), int64(1),
+		[]byte("transport"),
+		[]byte(out), []byte("08:00"), []byte("12:00"),
+		[]byte("2019-10-04"), []byte("14:00"), []byte("18:00"),
+		[]byte(""), int64(1), nil, int64(0), nil, []byte(""),
+		int64(tid), []byte("label"),
+	}
+}
+
+func date(v string) time.Time {
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestSQL(t *testing.T) {
+	db := &fakeDB{cols: lpcCols}
+	for i := int64(1); i <= 10; i++ {
+		for j := int64(0); j < i%3+1; j++ {
+			db.rows = append(db.rows, fakeRow(i, 1+int32(j), "France///Paris///France", "2019-10-02"))
+		}
+	}
+	sql.Register("eco-ingest-fake", db)
+
+	conn, err := sql.Open("eco-ingest-fake", "")
+	if err != nil {
+		t.Fatalf("could not open source: %+v", err)
+	}
+	defer conn.Close()
+
+	var (
+		named = Mapping{
+			Table: "missions",
+			Columns: map[string]string{
+				"id":                  "id_mission",
+				"date":                "DATE_MISSION",
+				"org":                 "ORGANISME",
+				"group":               "GROUPE",
+				"departure":           "DEPART",
+				"destination":         "DESTINATION",
+				"object":              "OBJET",
+				"type":                "TYPE",
+				"transport_name":      "TRANSPORT",
+				"outbound_date":       "DATE_ALLER",
+				"outbound_start":      "DEBUT_ALLER",
+				"outbound_stop":       "FIN_ALLER",
+				"inbound_date":        "DATE_RETOUR",
+				"inbound_start":       "DEBUT_RETOUR",
+				"inbound_stop":        "FIN_RETOUR",
+				"comment":             "COMMENTAIRE",
+				"valid":               "VALIDE",
+				"cost":                "COUT",
+				"residence_familiale": "RESIDENCE_FAMILIALE",
+				"residence_return":    "RESIDENCE_RETOUR",
+				"housing":             "HEBERGEMENT",
+				"transport_id":        "ID_TRANSPORT",
+				"transport_label":     "LIBELLE_TRANSPORT",
+			},
+		}
+		want []Record
+	)
+
+	for _, tc := range []struct {
+		m       Mapping
+		page    int
+		queries int
+	}{
+		{LPC, 1, 21},
+		{LPC, 3, 8},
+		{LPC, 100, 2},
+		{named, 10, 3},
+	} {
+		t.Run(fmt.Sprintf("%s-%d", tc.m.Table, tc.page), func(t *testing.T) {
+			db.queries = nil
+			src, err := NewSQL(conn, tc.m, tc.page)
+			if err != nil {
+				t.Fatalf("could not create source: %+v", err)
+			}
+			defer src.Close()
+
+			recs, err := ReadAll(src)
+			if err != nil {
+				t.Fatalf("could not read records: %+v", err)
+			}
+			if got, want := len(db.queries), tc.queries; got != want {
+				t.Fatalf("invalid number of queries: got=%d, want=%d", got, want)
+			}
+			if got, want := db.queries[0], "select distinct "+tc.m.Columns["id"]+" from "+tc.m.Table+" where "+tc.m.Columns["id"]+" > ? order by "+tc.m.Columns["id"]+" limit ?"; got != want {
+				t.Fatalf("invalid query:\ngot= %q\nwant=%q", got, want)
+			}
+			if got, want := len(recs), len(db.rows); got != want {
+				t.Fatalf("invalid number of records: got=%d, want=%d", got, want)
+			}
+			if want == nil {
+				want = recs
+			}
+			if !reflect.DeepEqual(recs, want) {
+				t.Fatalf("records depend on mapping and page size")
+			}
+		})
+	}
+
+	rec := want[0]
+	if rec.ID != 1 || rec.Transport.ID != 1 || rec.Group != "ATLAS" ||
+		rec.Destination != "France///Paris///France" ||
+		!rec.Outbound.Date.Equal(date("2019-10-02")) ||
+		!rec.Inbound.Date.Equal(date("2019-10-04")) ||
+		rec.Date != time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC) ||
+		rec.Cost != -1 || rec.Residence.Return != -1 || rec.Valid != 1 {
+		t.Fatalf("invalid record: %+v", rec)
+	}
+
+	for _, tc := range []struct {
+		m    Mapping
+		page int
+	}{
+		{LPC, 0},
+		{Mapping{}, 10},
+		{Mapping{Table: "view", Columns: map[string]string{"id": "#1"}}, 10},
+		{Mapping{Table: "view", Columns: map[string]string{"ident": "ID"}}, 10},
+	} {
+		_, err := NewSQL(conn, tc.m, tc.page)
+		if err == nil {
+			t.Fatalf("expected an error for mapping %+v (page=%d)", tc.m, tc.page)
+		}
+	}
+}
+
+const csvMissions = `id;date;group;destination;transport_id;outbound_date;inbound_date;valid;cost
+1;01/09/2019;ATLAS;France///Paris///France;4;02/10/2019;04/10/2019;1;120.5
+;;;;;;;;
+2;01/09/2019;LHCb;Japon///Tokyo///Japon;1;02/12/2019;10/12/2019;4;
+`
+
+func TestFiles(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "eco-ingest-")
+	if err != nil {
+		t.Fatalf("could not create tmp dir: %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	want := []Record{
+		{ID: 1, Date: date("2019-09-01"), Group: "ATLAS", Destination: "France///Paris///France", Valid: 1, Cost: 120.5},
+		{ID: 2, Date: date("2019-09-01"), Group: "LHCb", Destination: "Japon///Tokyo///Japon", Valid: 4, Cost: -1},
+	}
+	want[0].Transport.ID = 4
+	want[0].Outbound.Date = date("2019-10-02")
+	want[0].Inbound.Date = date("2019-10-04")
+	want[0].Residence.Return = -1
+	want[1].Transport.ID = 1
+	want[1].Outbound.Date = date("2019-12-02")
+	want[1].Inbound.Date = date("2019-12-10")
+	want[1].Residence.Return = -1
+
+	write := func(name string, data []byte) string {
+		fname := filepath.Join(tmp, name)
+		err := os.WriteFile(fname, data, 0644)
+		if err != nil {
+			t.Fatalf("could not create %q: %+v", name, err)
+		}
+		return fname
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		m    Mapping
+	}{
+		{
+			name: "missions.csv",
+			data: []byte(csvMissions),
+			m:    Mapping{Comma: ";", DateLayout: "02/01/2006", JourneyLayout: "02/01/2006"},
+		},
+		{
+			name: "missions.jsonl",
+			data: []byte(`{"ID": 1, "date": "2019-09-01", "group": "ATLAS", "dest": "France///Paris///France", "transport_id": 4, "outbound_date": "2019-10-02", "inbound_date": "2019-10-04", "valid": 1, "cost": 120.5}
+{"ID": 2, "date": "2019-09-01", "group": "LHCb", "dest": "Japon///Tokyo///Japon", "transport_id": "1", "outbound_date": "2019-12-02", "inbound_date": "2019-12-10", "valid": 4, "cost": null}
+`),
+			m: Mapping{Columns: map[string]string{"destination": "dest"}, DateLayout: "2006-01-02"},
+		},
+		{
+			name: "missions.xlsx",
+			data: xlsxMissions(t),
+			m: Mapping{
+				Columns: map[string]string{
+					"id": "Mission", "date": "Drafted", "group": "Group",
+					"destination": "Destination", "transport_id": "Mode",
+					"outbound_date": "Outbound", "inbound_date": "Inbound",
+					"valid": "Status", "cost": "Cost",
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, err := Open(write(tc.name, tc.data), tc.m)
+			if err != nil {
+				t.Fatalf("could not open source: %+v", err)
+			}
+			defer src.Close()
+
+			got, err := ReadAll(src)
+			if err != nil {
+				t.Fatalf("could not read records: %+v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("invalid records:\ngot= %+v\nwant=%+v", got, want)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name string
+		data string
+		m    Mapping
+	}{
+		{"missing.csv", "id,destination,outbound_date\n1,Paris,2019-10-02\n", Mapping{}},
+		{"invalid.csv", "id,destination,transport_id,outbound_date\n1,Paris,4,02/10/2019\n", Mapping{}},
+		{"unknown.csv", csvMissions, Mapping{Columns: map[string]string{"ident": "id"}}},
+		{"nested.jsonl", `{"id": 1, "destination": {"city": "Paris"}}`, Mapping{}},
+		{"missions.txt", csvMissions, Mapping{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, err := Open(write(tc.name, []byte(tc.data)), tc.m)
+			if err == nil {
+				defer src.Close()
+				_, err = ReadAll(src)
+			}
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+// xlsxMissions returns a minimal spreadsheet with shared and inline strings,
+// and serial dates.
+func xlsxMissions(t *testing.T) []byte {
+	t.Helper()
+
+	const (
+		rels = `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/data.xml"/>
+</Relationships>`
+		workbook = `<?xml version="1.0" encoding="UTF-8"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Missions" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+		strs = `<?xml version="1.0" encoding="UTF-8"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<si><t>Mission</t></si><si><t>Drafted</t></si><si><t>Group</t></si>
+<si><t>Destination</t></si><si><t>Mode</t></si><si><t>Outbound</t></si>
+<si><t>Inbound</t></si><si><t>Status</t></si><si><t>Cost</t></si>
+<si><r><t>France///</t></r><r><t>Paris///France</t></r></si>
+</sst>`
+		sheet = `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="s"><v>2</v></c><c r="D1" t="s"><v>3</v></c><c r="E1" t="s"><v>4</v></c><c r="F1" t="s"><v>5</v></c><c r="G1" t="s"><v>6</v></c><c r="H1" t="s"><v>7</v></c><c r="I1" t="s"><v>8</v></c></row>
+<row r="2"><c r="A2"><v>1</v></c><c r="B2"><v>43709</v></c><c r="C2" t="inlineStr"><is><t>ATLAS</t></is></c><c r="D2" t="s"><v>9</v></c><c r="E2"><v>4</v></c><c r="F2"><v>43740</v></c><c r="G2"><v>43742</v></c><c r="H2"><v>1</v></c><c r="I2"><v>120.5</v></c></row>
+<row r="4"><c r="A4"><v>2</v></c><c r="B4"><v>43709</v></c><c r="C4" t="str"><v>LHCb</v></c><c r="D4" t="inlineStr"><is><t>Japon///Tokyo///Japon</t></is></c><c r="E4"><v>1</v></c><c r="F4"><v>43801</v></c><c r="G4"><v>43809</v></c><c r="H4"><v>4</v></c></row>
+</sheetData></worksheet>`
+	)
+
+	buf := new(bytes.Buffer)
+	z := zip.NewWriter(buf)
+	for _, f := range []struct{ name, data string }{
+		{"xl/workbook.xml", workbook},
+		{"xl/_rels/workbook.xml.rels", rels},
+		{"xl/sharedStrings.xml", strs},
+		{"xl/worksheets/data.xml", sheet},
+	} {
+		w, err := z.Create(f.name)
+		if err != nil {
+			t.Fatalf("could not create %q: %+v", f.name, err)
+		}
+		_, err = io.WriteString(w, f.data)
+		if err != nil {
+			t.Fatalf("could not write %q: %+v", f.name, err)
+		}
+	}
+	err := z.Close()
+	if err != nil {
+		t.Fatalf("could not close spreadsheet: %+v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDigest(t *testing.T) {
+	var (
+		a = Record{ID: 1, Destination: "France///Paris///France", Cost: -1}
+		b = a
+	)
+	if !bytes.Equal(a.Digest(), b.Digest()) {
+		t.Fatalf("digests differ for identical records")
+	}
+	b.Destination = "France///Lyon///France"
+	if bytes.Equal(a.Digest(), b.Digest()) {
+		t.Fatalf("digests equal for different records")
+	}
+}
+
+func TestBookings(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "eco-ingest-")
+	if err != nil {
+		t.Fatalf("could not create tmp dir: %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	fname := filepath.Join(tmp, "statement.csv")
+	err = os.WriteFile(fname, []byte(`Ref;Voyageur;Date;De;Vers;Type;Classe;Montant
+A1;DOE John;02/10/2019;Paris CDG;Tokyo Haneda (HND);Avion;Business;4200.50
+A2;Doe John;10/10/2019;Tokyo Haneda (HND);Paris CDG;avion;Economy;
+T1;Martin Anne;02/11/2019;Clermont-Ferrand;Lyon Part-Dieu;Train;2nd;45
+T2;;03/12/2019;Clermont-Ferrand;Paris Gare de Lyon;TGV;1st;80
+T3;Smith Bob;05/12/2019;Clermont-Ferrand;Genève Cornavin;Train;2nd;120
+`), 0644)
+	if err != nil {
+		t.Fatalf("could not create statement: %+v", err)
+	}
+
+	m := Mapping{
+		Columns: map[string]string{
+			"ref": "Ref", "traveller": "Voyageur", "date": "Date",
+			"origin": "De", "destination": "Vers", "mode": "Type",
+			"class": "Classe", "fare": "Montant",
+		},
+		Comma:         ";",
+		JourneyLayout: "02/01/2006",
+	}
+	bks, err := ReadBookings(fname, m)
+	if err != nil {
+		t.Fatalf("could not read bookings: %+v", err)
+	}
+	if got, want := len(bks), 5; got != want {
+		t.Fatalf("invalid number of bookings: got=%d, want=%d", got, want)
+	}
+	if b := bks[0]; b.Ref != "A1" || b.Traveller != "DOE John" || !b.Date.Equal(date("2019-10-02")) ||
+		b.Mode != eco.Plane || b.Class != "Business" || b.Fare != 4200.50 {
+		t.Fatalf("invalid booking: %+v", b)
+	}
+	if b := bks[1]; b.Fare != -1 {
+		t.Fatalf("invalid booking fare: %+v", b)
+	}
+	if b := bks[3]; b.Mode != eco.Train {
+		t.Fatalf("invalid booking mode: %+v", b)
+	}
+
+	rec := func(id int32, traveller, dest, out, in string) Record {
+		r := Record{ID: id, Traveller: traveller, Destination: dest}
+		r.Outbound.Date = date(out)
+		r.Inbound.Date = date(in)
+		return r
+	}
+	recs := []Record{
+		rec(1, "John Doe", "Japon///Tokyo///Japon", "2019-10-02", "2019-10-09"),
+		rec(1, "John Doe", "Japon///Tokyo///Japon", "2019-10-02", "2019-10-09"),
+		rec(2, "Anne Martin", "France///Lyon///France", "2019-11-02", "2019-11-02"),
+		rec(3, "", "France///Paris///France", "2019-12-03", "2019-12-04"),
+		rec(4, "", "France///Paris///France", "2019-12-02", "2019-12-03"),
+		rec(5, "Bob Smith", "Suisse///Genève///Suisse", "2019-12-10", "2019-12-11"),
+	}
+
+	matched, unmatched := Match(bks, recs)
+	if got, want := len(matched[1]), 2; got != want {
+		t.Fatalf("invalid number of bookings for mission 1: got=%d, want=%d", got, want)
+	}
+	if got, want := matched[1][0].Ref, "A1"; got != want {
+		t.Fatalf("invalid first booking of mission 1: got=%q, want=%q", got, want)
+	}
+	if got, want := len(matched[2]), 1; got != want {
+		t.Fatalf("invalid number of bookings for mission 2: got=%d, want=%d", got, want)
+	}
+	if got, want := len(matched), 2; got != want {
+		t.Fatalf("invalid number of matched missions: got=%d, want=%d", got, want)
+	}
+
+	if got, want := len(unmatched), 2; got != want {
+		t.Fatalf("invalid number of unmatched bookings: got=%d, want=%d", got, want)
+	}
+	if u := unmatched[0]; u.Booking.Ref != "T2" || !reflect.DeepEqual(u.Missions, []int32{3, 4}) {
+		t.Fatalf("invalid ambiguous booking: %+v", u)
+	}
+	if u := unmatched[1]; u.Booking.Ref != "T3" || len(u.Missions) != 0 {
+		t.Fatalf("invalid unmatched booking: %+v", u)
+	}
+
+	_, err = ReadBookings(fname, Mapping{Comma: ";"})
+	if err == nil {
+		t.Fatalf("expected an error for a statement without the required columns")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// jsonlSource reads missions from a stream of JSON objects, one per
+// record. The keys of the objects are the names of the columns.
+type jsonlSource struct {
+	m     Mapping
+	dec   *json.Decoder
+	close func() error
+	n     int
+}
+
+func openJSONL(fname string, m Mapping) (MissionSource, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not open JSON Lines file: %w", err)
+	}
+	src := newJSONL(f, m)
+	src.close = f.Close
+	return src, nil
+}
+
+func newJSONL(r io.Reader, m Mapping) *jsonlSource {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &jsonlSource{m: m, dec: dec}
+}
+
+func (src *jsonlSource) Next() (Record, error) {
+	var obj map[string]interface{}
+	err := src.dec.Decode(&obj)
+	if err != nil {
+		if err == io.EOF {
+			return Record{}, err
+		}
+		return Record{}, fmt.Errorf("could not decode record %d: %w", src.n+1, err)
+	}
+	src.n++
+
+	var (
+		cols = make([]string, 0, len(obj))
+		row  = make([]string, 0, len(obj))
+	)
+	for k := range obj {
+		cols = append(cols, k)
+	}
+	sort.Strings(cols)
+	for _, k := range cols {
+		var v string
+		switch x := obj[k].(type) {
+		case nil:
+		case string:
+			v = x
+		case json.Number:
+			v = x.String()
+		case bool:
+			v = strconv.FormatBool(x)
+		default:
+			return Record{}, fmt.Errorf("record %d: invalid value for column %q: %v", src.n, k, x)
+		}
+		row = append(row, v)
+	}
+
+	idx, err := src.m.index(cols, fields, required)
+	if err != nil {
+		return Record{}, fmt.Errorf("record %d: could not map columns: %w", src.n, err)
+	}
+	rec, err := src.m.decode(idx, row)
+	if e, ok := err.(*Error); ok {
+		e.Row = src.n
+	}
+	return rec, err
+}
+
+func (src *jsonlSource) Close() error {
+	if src.close == nil {
+		return nil
+	}
+	return src.close()
+}
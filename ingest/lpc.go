@@ -0,0 +1,63 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/geo"
+)
+
+// Transport IDs of the LPC travel-management database.
+const (
+	idAvion int32 = iota + 1
+	idBus
+	idPassager
+	idTrain
+	idVoitureAdm
+	idVoitureLoc
+	idVoiturePers
+	idAutres
+)
+
+// Clermont is the default starting point of missions: LPC, in
+// Clermont-Ferrand.
+var Clermont = eco.Location{
+	Name: "Clermont-Ferrand",
+	Lat:  45.7774551,
+	Lng:  3.0819427,
+}
+
+func point(loc eco.Location) geo.Point {
+	return geo.Point{Lat: loc.Lat, Lng: loc.Lng}
+}
+
+// Accepted returns whether the mission was not rejected by its manager or
+// its funder.
+func (rec Record) Accepted() bool {
+	return ValidStatus(rec.Valid)
+}
+
+// ValidStatus returns whether a mission with the provided validation
+// status was not rejected.
+func ValidStatus(v int16) bool {
+	switch v {
+	case 4:
+		// rejected by manager
+		return false
+	case 5:
+		// rejected by funder
+		return false
+	case 6:
+		// accepted by funder, rejected by manager
+		return false
+	case 7:
+		// accepted by manager, rejected by funder
+		return false
+	case 8:
+		// rejected by manager & funder
+		return false
+	}
+	return true
+}
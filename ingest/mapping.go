@@ -0,0 +1,296 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields of a record, in the order of the columns of the LPC view_mission
+// view. The LPC view has no traveller column.
+var fields = []string{
+	"id", "date", "org", "group",
+	"departure", "destination", "object", "type",
+	"transport_name",
+	"outbound_date", "outbound_start", "outbound_stop",
+	"inbound_date", "inbound_start", "inbound_stop",
+	"comment", "valid", "cost",
+	"residence_familiale", "residence_return",
+	"housing",
+	"transport_id", "transport_label",
+	"traveller",
+}
+
+// required lists the fields of a record that must be provided by a source.
+var required = map[string]bool{
+	"id":            true,
+	"destination":   true,
+	"transport_id":  true,
+	"outbound_date": true,
+}
+
+const (
+	defaultDateLayout    = "2006-01-02 15:04:05"
+	defaultJourneyLayout = "2006-01-02"
+)
+
+// Mapping describes how the columns of a table, a spreadsheet or a JSON
+// object map to the fields of a record.
+//
+// Columns associates the name of a field of a record (e.g. "id",
+// "destination", "transport_id", "outbound_date") with the name of a
+// column, or with its 1-based position written as "#3".
+// Fields that are not listed are read from the column with the same name,
+// if any.
+type Mapping struct {
+	Table   string            `json:"table,omitempty"`   // name of the SQL table or view
+	Columns map[string]string `json:"columns,omitempty"` // field name -> column name or position
+	Comma   string            `json:"comma,omitempty"`   // field delimiter of CSV files (default: ",")
+
+	DateLayout    string `json:"date_layout,omitempty"`    // layout of the drafting date
+	JourneyLayout string `json:"journey_layout,omitempty"` // layout of the outbound and inbound dates
+}
+
+// LPC is the mapping of the view_mission view of the LPC travel-management
+// database.
+var LPC = func() Mapping {
+	m := Mapping{
+		Table:   "view_mission",
+		Columns: make(map[string]string, len(fields)),
+	}
+	for i, f := range fields {
+		if f == "traveller" {
+			continue
+		}
+		m.Columns[f] = "#" + strconv.Itoa(i+1)
+	}
+	m.Columns["id"] = "ID_MISSION"
+	return m
+}()
+
+// LoadMapping loads a mapping from a JSON file.
+func LoadMapping(fname string) (Mapping, error) {
+	var m Mapping
+	f, err := os.Open(fname)
+	if err != nil {
+		return m, fmt.Errorf("could not open mapping file: %w", err)
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&m)
+	if err != nil {
+		return m, fmt.Errorf("could not decode mapping file %q: %w", fname, err)
+	}
+	return m, nil
+}
+
+// validate checks the mapping describes the provided fields.
+func (m Mapping) validate(fields []string) error {
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f] = true
+	}
+	for f := range m.Columns {
+		if !known[f] {
+			return fmt.Errorf("unknown field %q", f)
+		}
+	}
+	if len([]rune(m.Comma)) > 1 {
+		return fmt.Errorf("invalid CSV delimiter %q", m.Comma)
+	}
+	return nil
+}
+
+// column returns the column reference of a field.
+func (m Mapping) column(field string) string {
+	if c, ok := m.Columns[field]; ok {
+		return c
+	}
+	return field
+}
+
+// index returns the index of the column of each of the provided fields,
+// given the names of the columns of a table.
+func (m Mapping) index(cols, fields []string, required map[string]bool) (map[string]int, error) {
+	idx := make(map[string]int, len(fields))
+	for _, f := range fields {
+		var (
+			ref = m.column(f)
+			i   = -1
+		)
+		switch {
+		case strings.HasPrefix(ref, "#"):
+			v, err := strconv.Atoi(ref[1:])
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("invalid column position %q for field %q", ref, f)
+			}
+			if v <= len(cols) {
+				i = v - 1
+			}
+		default:
+			for j, c := range cols {
+				if strings.EqualFold(strings.TrimSpace(c), ref) {
+					i = j
+					break
+				}
+			}
+		}
+		if i < 0 {
+			if required[f] {
+				return nil, fmt.Errorf("no column %q for field %q", ref, f)
+			}
+			continue
+		}
+		idx[f] = i
+	}
+	return idx, nil
+}
+
+// decode decodes a record from a row of cells.
+// Empty cells are handled as missing values.
+func (m Mapping) decode(idx map[string]int, row []string) (Record, error) {
+	var (
+		rec  Record
+		err  error
+		cell = func(f string) string {
+			i, ok := idx[f]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return row[i]
+		}
+		layout = func(v, def string) string {
+			if v == "" {
+				return def
+			}
+			return v
+		}
+		dates    = layout(m.DateLayout, defaultDateLayout)
+		journeys = layout(m.JourneyLayout, defaultJourneyLayout)
+	)
+
+	wrap := func(f string, err error) error {
+		return &Error{ID: rec.ID, Kind: BadRecord, Field: f, Value: cell(f), Err: err}
+	}
+
+	id, err := parseInt(cell("id"), 32)
+	if err != nil {
+		return rec, wrap("id", err)
+	}
+	rec.ID = int32(id)
+
+	if v := cell("date"); v != "" {
+		rec.Date, err = parseTime(dates, v)
+		if err != nil {
+			return rec, wrap("date", err)
+		}
+	}
+	rec.Org = cell("org")
+	rec.Group = cell("group")
+	rec.Departure = cell("departure")
+	rec.Destination = cell("destination")
+	if rec.Destination == "" {
+		return rec, &Error{ID: rec.ID, Kind: BadDestination, Field: "destination", Err: fmt.Errorf("empty destination")}
+	}
+	rec.Object = cell("object")
+	if v := cell("type"); v != "" {
+		t, err := parseInt(v, 16)
+		if err != nil {
+			return rec, wrap("type", err)
+		}
+		rec.Type = int16(t)
+	}
+
+	tid, err := parseInt(cell("transport_id"), 32)
+	if err != nil {
+		return rec, wrap("transport_id", err)
+	}
+	rec.Transport.ID = int32(tid)
+	rec.Transport.Name = cell("transport_name")
+	rec.Transport.Label = cell("transport_label")
+
+	for _, j := range []struct {
+		name string
+		ptr  *Journey
+	}{
+		{"outbound", &rec.Outbound},
+		{"inbound", &rec.Inbound},
+	} {
+		if v := cell(j.name + "_date"); v != "" {
+			j.ptr.Date, err = parseTime(journeys, v)
+			if err != nil {
+				return rec, wrap(j.name+"_date", err)
+			}
+		}
+		j.ptr.Start = cell(j.name + "_start")
+		j.ptr.Stop = cell(j.name + "_stop")
+	}
+	if rec.Outbound.Date.IsZero() {
+		return rec, wrap("outbound_date", fmt.Errorf("empty outbound date"))
+	}
+
+	rec.Comment = cell("comment")
+	if v := cell("valid"); v != "" {
+		valid, err := parseInt(v, 16)
+		if err != nil {
+			return rec, wrap("valid", err)
+		}
+		rec.Valid = int16(valid)
+	}
+
+	rec.Cost = -1
+	if v := cell("cost"); v != "" {
+		rec.Cost, err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return rec, wrap("cost", err)
+		}
+	}
+
+	if v := cell("residence_familiale"); v != "" {
+		fam, err := parseInt(v, 8)
+		if err != nil {
+			return rec, wrap("residence_familiale", err)
+		}
+		rec.Residence.Familiale = int8(fam)
+	}
+	rec.Residence.Return = -1
+	if v := cell("residence_return"); v != "" {
+		rec.Residence.Return, err = parseInt(v, 64)
+		if err != nil {
+			return rec, wrap("residence_return", err)
+		}
+	}
+	rec.Housing = cell("housing")
+	rec.Traveller = cell("traveller")
+
+	return rec, nil
+}
+
+func parseInt(v string, bits int) (int64, error) {
+	return strconv.ParseInt(strings.TrimSpace(v), 10, bits)
+}
+
+// excelEpoch is the origin of the serial dates of spreadsheets.
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// parseTime parses a date with the provided layout, or as a serial date of
+// a spreadsheet.
+func parseTime(layout, v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	t, err := time.Parse(layout, v)
+	if err == nil {
+		return t.UTC(), nil
+	}
+	if days, e := strconv.ParseFloat(v, 64); e == nil {
+		d := time.Duration(days * float64(24*time.Hour))
+		return excelEpoch.Add(d).Round(time.Second), nil
+	}
+	return t, err
+}
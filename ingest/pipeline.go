@@ -0,0 +1,700 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/geo"
+	"github.com/sbinet-lpc/eco/osm"
+)
+
+// Options configures a pipeline.
+type Options struct {
+	// Fixups are the manual corrections of missions.
+	Fixups Fixups
+
+	// Rules infer the transport mode of missions of the "Autres" kind
+	// without a fixup. Rules must be compiled (see LoadRules).
+	Rules Rules
+
+	// Others is the transport mode of missions of the "Autres" kind
+	// without a fixup nor a matching rule.
+	// Such missions can not be converted when Others is eco.Unknown.
+	Others eco.TransID
+
+	// Start is the starting point of missions (default: Clermont).
+	Start eco.Location
+
+	// After is the ID after which missions are converted: the missions
+	// with lower or equal IDs are only recorded in the digests and
+	// transports of the source.
+	After int32
+
+	Trace   int32 // mission ID to trace, if any
+	Verbose bool  // enable verbose mode
+}
+
+// Pipeline converts the missions of a source into eco missions and writes
+// their revisions to a sink.
+type Pipeline struct {
+	opts Options
+	osm  *osm.Client
+	sink Sink
+
+	tids  map[int32]eco.TransID // transport fixups
+	dests map[int32]DestFixup   // destination fixups
+	used  struct {
+		tids  map[int32]bool
+		dests map[int32]bool
+	}
+
+	places map[string]eco.Location // query -> location
+	revs   []eco.Revision
+	n      int // number of processed missions
+	report *Report
+}
+
+// NewPipeline returns a new pipeline writing to the provided sink.
+func NewPipeline(sink Sink, opts Options) *Pipeline {
+	if opts.Start == (eco.Location{}) {
+		opts.Start = Clermont
+	}
+	p := &Pipeline{
+		opts: opts,
+		osm: &osm.Client{
+			UserAgent:       osm.UserAgent,
+			AcceptLanguages: []string{"fr", "en"},
+			AddressDetails:  true,
+		},
+		sink:   sink,
+		tids:   opts.Fixups.tids(),
+		dests:  opts.Fixups.dests(),
+		places: make(map[string]eco.Location),
+		report: newReport(),
+	}
+	p.used.tids = make(map[int32]bool)
+	p.used.dests = make(map[int32]bool)
+	return p
+}
+
+// Missions are the missions of a source database.
+type Missions struct {
+	Legs       map[int32][]Record  // mission-id -> accepted legs
+	Digests    map[int32][][]byte  // mission-id -> digests of all its rows
+	Accepted   map[int32]bool      // missions with at least one non-rejected row
+	Failed     map[int32]bool      // missions with errors, left untouched
+	Transports map[int32]int32     // mission-id -> transport ID of its first row
+	Bookings   map[int32][]Booking // mission-id -> matched bookings
+	Invalid    int64               // number of rejected or failed rows
+}
+
+func newMissions() *Missions {
+	return &Missions{
+		Legs:       make(map[int32][]Record),
+		Digests:    make(map[int32][][]byte),
+		Accepted:   make(map[int32]bool),
+		Failed:     make(map[int32]bool),
+		Transports: make(map[int32]int32),
+		Bookings:   make(map[int32][]Booking),
+	}
+}
+
+// Read reads all the missions of a source.
+// Rows that can not be decoded or converted are reported, and their
+// missions marked as failed.
+func (p *Pipeline) Read(src MissionSource) (*Missions, error) {
+	ms := newMissions()
+	for {
+		rec, err := src.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			var e *Error
+			if !errors.As(err, &e) {
+				return nil, err
+			}
+			if e.ID != 0 && e.ID <= p.opts.After {
+				continue
+			}
+			ms.Invalid++
+			p.fail(e)
+			if e.ID != 0 {
+				ms.Failed[e.ID] = true
+			}
+			continue
+		}
+		p.add(ms, rec)
+	}
+
+	n := 0
+	for id := range ms.Digests {
+		if id > p.opts.After {
+			n++
+		}
+	}
+	for id := range ms.Failed {
+		if _, ok := ms.Digests[id]; !ok {
+			n++
+		}
+	}
+	p.report.Missions = n
+
+	var tids, dests []int32
+	for id := range p.tids {
+		tids = append(tids, id)
+	}
+	for id := range p.dests {
+		dests = append(dests, id)
+	}
+	p.report.UnusedTIDs = unused(tids, p.used.tids)
+	p.report.UnusedDests = unused(dests, p.used.dests)
+	if n := len(p.report.UnusedTIDs); n > 0 {
+		log.Printf("unused transport fixups: %v", p.report.UnusedTIDs)
+	}
+	if n := len(p.report.UnusedDests); n > 0 {
+		log.Printf("unused destination fixups: %v", p.report.UnusedDests)
+	}
+	return ms, nil
+}
+
+// unused returns the sorted IDs of the fixups that were not used.
+func unused(fixups []int32, used map[int32]bool) []int32 {
+	var ids []int32
+	for _, id := range fixups {
+		if !used[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// add adds a row of the source database.
+func (p *Pipeline) add(ms *Missions, m Record) {
+	if p.opts.Trace != 0 && p.opts.Trace == m.ID {
+		log.Printf(
+			"id=%d, org=%q, grp=%q mission:%q transport:%d|%s valid=%d comment=%q",
+			m.ID, m.Org, m.Group, m.Destination, m.Transport.ID, m.Transport.Label,
+			m.Valid, m.Comment,
+		)
+	}
+
+	if _, ok := ms.Transports[m.ID]; !ok {
+		ms.Transports[m.ID] = m.Transport.ID
+	}
+	ms.Digests[m.ID] = append(ms.Digests[m.ID], m.Digest())
+	if _, ok := p.tids[m.ID]; ok && m.Transport.ID == idAutres {
+		p.used.tids[m.ID] = true
+	}
+	if _, ok := p.dests[m.ID]; ok {
+		p.used.dests[m.ID] = true
+	}
+	if m.ID <= p.opts.After {
+		return
+	}
+
+	if !m.Accepted() {
+		ms.Invalid++
+		return
+	}
+	ms.Accepted[m.ID] = true
+
+	if err := p.transport(m); err != nil {
+		ms.Failed[m.ID] = true
+		ms.Invalid++
+		p.fail(err)
+		return
+	}
+
+	ms.Legs[m.ID] = append(ms.Legs[m.ID], m)
+}
+
+// Hash returns the hash of a mission, from the digests of its rows and
+// bookings.
+func (ms *Missions) Hash(id int32) string {
+	return Hash(ms.Digests[id])
+}
+
+// Hash returns the hash of a mission from the digests of its rows,
+// independently of their order.
+func Hash(digests [][]byte) string {
+	ds := append([][]byte(nil), digests...)
+	sort.Slice(ds, func(i, j int) bool {
+		return bytes.Compare(ds[i], ds[j]) < 0
+	})
+	h := sha256.New()
+	for _, d := range ds {
+		h.Write(d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Book matches bookings with the accepted missions.
+// The digests of the matched bookings are added to the digests of their
+// mission, so missions are modified when their bookings change.
+func (ms *Missions) Book(bks []Booking) []Unmatched {
+	var recs []Record
+	for id, legs := range ms.Legs {
+		if !ms.Accepted[id] {
+			continue
+		}
+		recs = append(recs, legs...)
+	}
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].ID < recs[j].ID
+	})
+
+	matched, unmatched := Match(bks, recs)
+	for id, bks := range matched {
+		for _, b := range bks {
+			ms.Digests[id] = append(ms.Digests[id], b.Digest())
+		}
+	}
+	ms.Bookings = matched
+	return unmatched
+}
+
+// transport checks the transport mode of a row can be determined.
+// Rows of the "Autres" kind matched by a rule with a distance condition
+// are checked once their distance is known, by Process.
+func (p *Pipeline) transport(rec Record) *Error {
+	if p.TransID(rec) != eco.Unknown {
+		return nil
+	}
+	if rec.Transport.ID == idAutres && p.opts.Rules.possible(rec) {
+		return nil
+	}
+	return p.badTransport(rec)
+}
+
+func (p *Pipeline) badTransport(rec Record) *Error {
+	err := fmt.Errorf("unknown transport mode %q", rec.Transport.Label)
+	if rec.Transport.ID == idAutres {
+		err = fmt.Errorf("no transport fixup nor rule for %q (comment=%q)", rec.Transport.Label, rec.Comment)
+	}
+	return &Error{
+		ID:    rec.ID,
+		Kind:  BadTransport,
+		Field: "transport_id",
+		Value: strconv.Itoa(int(rec.Transport.ID)),
+		Err:   err,
+	}
+}
+
+// fail reports an error of a mission.
+func (p *Pipeline) fail(e *Error) *Error {
+	log.Printf("INVALID %v", e)
+	p.report.Add(e)
+	return e
+}
+
+// Report returns the report of the errors of the missions.
+func (p *Pipeline) Report() *Report {
+	return p.report
+}
+
+// TransID returns the transport mode of a row.
+func (p *Pipeline) TransID(rec Record) eco.TransID {
+	var id eco.TransID
+	switch tid := rec.Transport.ID; tid {
+	case idAvion:
+		id = eco.Plane
+	case idBus:
+		id = eco.Bus
+	case idPassager:
+		// free. cost already reported on somebody else
+		id = eco.Passenger
+	case idTrain:
+		id = eco.Train
+	case idVoitureAdm, idVoitureLoc, idVoiturePers:
+		id = eco.Car
+	case idAutres:
+		id, _ = p.others(rec, -1)
+	}
+
+	return id
+}
+
+// Decide returns the transport mode of a row with the provided round-trip
+// distance, in kilometers (negative if unknown).
+// For rows of the "Autres" kind, Decide also returns how the transport
+// mode was inferred: from a fixup, a rule or the default transport mode.
+func (p *Pipeline) Decide(rec Record, km float64) (eco.TransID, string) {
+	if rec.Transport.ID != idAutres {
+		return p.TransID(rec), ""
+	}
+	return p.others(rec, km)
+}
+
+// others returns the transport mode of a row of the "Autres" kind:
+// explicit fixups take precedence over rules, and rules over the default
+// transport mode.
+func (p *Pipeline) others(rec Record, km float64) (eco.TransID, string) {
+	if tid, ok := p.tids[rec.ID]; ok {
+		return tid, "fixup"
+	}
+	if tid, why := p.opts.Rules.Match(rec, km); tid != eco.Unknown {
+		return tid, why
+	}
+	if p.opts.Others != eco.Unknown {
+		return p.opts.Others, "default"
+	}
+	return eco.Unknown, ""
+}
+
+// Choose returns the leg of a multi-legs mission with the most emitting
+// transport mode.
+func (p *Pipeline) Choose(ms []Record) Record {
+	if len(ms) == 1 {
+		return ms[0]
+	}
+
+	if p.opts.Verbose {
+		log.Printf("=== missions %d === (n=%d)", ms[0].ID, len(ms))
+		for _, m := range ms {
+			log.Printf("transport=%s, destination=%s", m.Transport.Label, m.Destination)
+		}
+	}
+
+	costs := make([]eco.TransID, len(ms))
+	for i, m := range ms {
+		costs[i] = p.TransID(m)
+	}
+	switch {
+	case reflect.DeepEqual(costs, []eco.TransID{eco.Train, eco.Bus}):
+		return ms[0]
+	case reflect.DeepEqual(costs, []eco.TransID{eco.Bus, eco.Train}):
+		return ms[1]
+	}
+
+	var (
+		cost = p.TransID(ms[0])
+		j    = 0
+	)
+	for i := range costs {
+		if !eco.CostLess(costs[i], cost) {
+			cost = costs[i]
+			j = i
+		}
+	}
+	return ms[j]
+}
+
+// Process converts a row of the source database into an eco mission,
+// enriched with its bookings.
+// Errors are reported as *Error.
+func (p *Pipeline) Process(raw Record, bks []Booking) (eco.Mission, error) {
+	var (
+		fix   = p.dests[raw.ID]
+		stops []eco.Location
+	)
+	switch {
+	case fix.Lat != nil && fix.Lng != nil:
+		dest := eco.Location{Name: raw.Destination, Lat: *fix.Lat, Lng: *fix.Lng}
+		if ss, err := p.Destination(raw); err == nil {
+			dest.Name = ss[0].City
+			dest.Addr.City = ss[0].City
+			dest.Addr.Country = ss[0].Country
+			if c := ss[0].Country; c != "" {
+				// without a country code, the country is taken from the
+				// last component of the name.
+				dest.Name += ", " + c
+				if loc, err := p.locate(c); err == nil {
+					dest.Addr.CountryCode = loc.Addr.CountryCode
+				}
+			}
+		}
+		stops = []eco.Location{dest}
+	default:
+		ss, err := p.Destination(raw)
+		if err != nil {
+			return eco.Mission{}, err
+		}
+
+		stops = make([]eco.Location, len(ss))
+		for i, s := range ss {
+			stops[i], err = p.locate(s.query())
+			if err != nil {
+				return eco.Mission{}, &Error{ID: raw.ID, Kind: BadGeocode, Field: "destination", Value: s.query(), Err: err}
+			}
+		}
+	}
+
+	start := p.opts.Start
+	m := eco.Mission{
+		ID:      raw.ID,
+		Date:    raw.Outbound.Date.UTC(),
+		Inbound: raw.Inbound.Date.UTC(),
+		Start:   start,
+		Dest:    farthest(start, stops),
+		Dist:    itinerary(start, stops),
+		Group:   raw.Group,
+	}
+	if m.Dist == 0 {
+		// probably an intra-muros mission
+		// add an ad-hoc estimation of 5km
+		m.Dist = 5000
+	}
+
+	if len(stops) > 1 {
+		m.Legs = legs(m, stops)
+	}
+
+	if len(bks) > 0 {
+		err := p.book(&m, bks)
+		if err != nil {
+			return m, &Error{ID: raw.ID, Kind: BadBooking, Err: err}
+		}
+	}
+
+	if fix.Km > 0 {
+		m.Dist = 1000 * fix.Km
+	}
+
+	m.Trans, m.TransReason = p.Decide(raw, m.Dist/1000)
+	if m.Trans == eco.Unknown {
+		return m, p.badTransport(raw)
+	}
+	if len(bks) == 0 {
+		for i := range m.Legs {
+			m.Legs[i].Trans = m.Trans
+		}
+	}
+	if p.opts.Verbose && m.TransReason != "" {
+		log.Printf("mission %d: transport=%v (%s)", m.ID, m.Trans, m.TransReason)
+	}
+
+	// do not upload missions eco-srv would reject.
+	err := m.Validate()
+	if err != nil {
+		return m, &Error{ID: raw.ID, Kind: BadMission, Err: err}
+	}
+
+	return m, nil
+}
+
+// Destination returns the stops of a mission, from its destination fixup
+// or its destination field (see ParseDestination).
+func (p *Pipeline) Destination(raw Record) ([]Stop, error) {
+	stops, err := ParseDestination(p.dest(raw))
+	if err != nil {
+		return nil, &Error{ID: raw.ID, Kind: BadDestination, Field: "destination", Value: raw.Destination, Err: err}
+	}
+	return stops, nil
+}
+
+// farthest returns the stop farthest from the start of a mission.
+func farthest(start eco.Location, stops []eco.Location) eco.Location {
+	var (
+		dest = stops[0]
+		dist = geo.Haversine(point(start), point(dest))
+	)
+	for _, s := range stops[1:] {
+		if d := geo.Haversine(point(start), point(s)); d > dist {
+			dest, dist = s, d
+		}
+	}
+	return dest
+}
+
+// itinerary returns the distance of the round trip from the start of a
+// mission through all its stops, in order.
+func itinerary(start eco.Location, stops []eco.Location) float64 {
+	var (
+		dist = 0.0
+		prev = start
+	)
+	for _, s := range stops {
+		dist += geo.Haversine(point(prev), point(s))
+		prev = s
+	}
+	return dist + geo.Haversine(point(prev), point(start))
+}
+
+// legs returns the journeys of the round trip of a multi-stop mission.
+// Only the dates of the first and last journeys are known.
+func legs(m eco.Mission, stops []eco.Location) []eco.Leg {
+	path := append(append([]eco.Location{m.Start}, stops...), m.Start)
+	legs := make([]eco.Leg, len(path)-1)
+	for i := range legs {
+		legs[i] = eco.Leg{
+			Start: path[i],
+			Dest:  path[i+1],
+			Dist:  geo.Haversine(point(path[i]), point(path[i+1])),
+		}
+	}
+	legs[0].Date = m.Date
+	legs[len(legs)-1].Date = m.Inbound
+	return legs
+}
+
+// Revise processes the new content of a registered or modified mission,
+// from its legs, and records its revision.
+// Rejected missions are ignored.
+// Errors are reported, and the mission skipped.
+func (p *Pipeline) Revise(rev eco.Revision, legs []Record, bks []Booking) error {
+	if len(legs) == 0 {
+		return p.fail(&Error{ID: rev.ID, Kind: BadRecord, Err: fmt.Errorf("no valid row")})
+	}
+	raw := p.Choose(legs)
+	if !raw.Accepted() {
+		return nil
+	}
+
+	if p.opts.Verbose {
+		log.Printf(
+			"id=%d transport=%v, date=%s dest=%v (%v)",
+			raw.ID,
+			raw.Transport.Label,
+			raw.Outbound.Date.Format(defaultJourneyLayout),
+			raw.Destination,
+			rev.Status,
+		)
+	}
+
+	p.report.Processed++
+	m, err := p.Process(raw, bks)
+	if err != nil {
+		var e *Error
+		if !errors.As(err, &e) {
+			e = &Error{ID: rev.ID, Kind: BadRecord, Err: err}
+		}
+		return p.fail(e)
+	}
+	log.Printf("%v", m)
+
+	rev.Mission = &m
+	p.revs = append(p.revs, rev)
+	p.n++
+	return nil
+}
+
+// Add records a revision that does not change the content of a mission.
+func (p *Pipeline) Add(rev eco.Revision) {
+	p.revs = append(p.revs, rev)
+}
+
+// Revisions returns the recorded revisions.
+func (p *Pipeline) Revisions() []eco.Revision {
+	return p.revs
+}
+
+// Flush writes the recorded revisions to the sink.
+// Revisions rejected by the sink are reported as errors of their mission.
+func (p *Pipeline) Flush() error {
+	if len(p.revs) == 0 {
+		return nil
+	}
+	n := len(p.revs)
+	err := p.sink.Write(p.revs)
+	if rej := new(RejectedError); errors.As(err, &rej) {
+		for _, r := range rej.Rejected {
+			p.fail(&Error{ID: r.ID, Kind: BadUpload, Err: errors.New(r.Reason)})
+		}
+		n -= len(rej.Rejected)
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not write revisions: %w", err)
+	}
+	log.Printf("uploaded %d/%d revision(s) (%d mission(s))", n, len(p.revs), p.n)
+	p.revs = p.revs[:0]
+	p.n = 0
+	return nil
+}
+
+func (p *Pipeline) dest(m Record) string {
+	if fix, ok := p.dests[m.ID]; ok && fix.Dest != nil {
+		return strings.Join(fix.Dest, "///")
+	}
+
+	return m.Destination
+}
+
+// locate returns the location corresponding to the provided query.
+func (p *Pipeline) locate(query string) (eco.Location, error) {
+	if loc, ok := p.places[query]; ok {
+		return loc, nil
+	}
+
+	locs, err := p.osm.Search(query)
+	if err != nil {
+		return eco.Location{}, fmt.Errorf("could not find location for %q: %w", query, err)
+	}
+	if len(locs) == 0 {
+		return eco.Location{}, fmt.Errorf("could not find location for %q", query)
+	}
+	if p.opts.Verbose {
+		log.Printf("location: %#v", locs)
+	}
+
+	loc := locs[0]
+	lat, err := strconv.ParseFloat(loc.Lat, 64)
+	if err != nil {
+		return eco.Location{}, fmt.Errorf("could not parse lattitude: %w", err)
+	}
+	lng, err := strconv.ParseFloat(loc.Lng, 64)
+	if err != nil {
+		return eco.Location{}, fmt.Errorf("could not parse longitude: %w", err)
+	}
+
+	o := eco.Location{
+		Name: loc.DisplayName,
+		Lat:  lat,
+		Lng:  lng,
+		Addr: eco.Address{
+			City:        loc.Address.Locality(),
+			State:       loc.Address.State,
+			Country:     loc.Address.Country,
+			CountryCode: strings.ToUpper(loc.Address.CountryCode),
+		},
+	}
+	p.places[query] = o
+	return o, nil
+}
+
+// book enriches a mission with its booked journeys: the distance of the
+// mission becomes the total distance of its legs.
+func (p *Pipeline) book(m *eco.Mission, bks []Booking) error {
+	m.Legs = make([]eco.Leg, 0, len(bks))
+	dist := 0.0
+	for _, b := range bks {
+		beg, err := p.locate(b.Origin)
+		if err != nil {
+			return fmt.Errorf("could not find origin of booking %v: %w", b, err)
+		}
+		end, err := p.locate(b.Dest)
+		if err != nil {
+			return fmt.Errorf("could not find destination of booking %v: %w", b, err)
+		}
+		leg := eco.Leg{
+			Date:  b.Date.UTC(),
+			Start: beg,
+			Dest:  end,
+			Dist:  geo.Haversine(point(beg), point(end)),
+			Trans: b.Mode,
+			Class: b.Class,
+		}
+		dist += leg.Dist
+		m.Legs = append(m.Legs, leg)
+	}
+	if dist > 0 {
+		m.Dist = dist
+	}
+	return nil
+}
@@ -0,0 +1,574 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// records is an in-memory source of missions.
+type records []Record
+
+func (rs *records) Next() (Record, error) {
+	if len(*rs) == 0 {
+		return Record{}, io.EOF
+	}
+	rec := (*rs)[0]
+	*rs = (*rs)[1:]
+	return rec, nil
+}
+
+func (rs *records) Close() error { return nil }
+
+// record returns a row of the source database.
+func record(id, tid int32, valid int16, dest, out, in string) Record {
+	rec := Record{
+		ID:          id,
+		Date:        date("2019-09-01"),
+		Org:         "CNRS",
+		Group:       "ATLAS",
+		Departure:   "Clermont-Ferrand",
+		Destination: dest,
+		Valid:       valid,
+		Cost:        -1,
+	}
+	rec.Transport.ID = tid
+	rec.Outbound.Date = date(out)
+	rec.Inbound.Date = date(in)
+	rec.Residence.Return = -1
+	return rec
+}
+
+func testRecords() *records {
+	return &records{
+		record(1, idTrain, 1, "France///Lyon///France", "2019-10-02", "2019-10-04"),
+		record(1, idBus, 1, "France///Lyon///France", "2019-10-02", "2019-10-04"),
+		record(2, idAutres, 1, "France///Lyon///France", "2019-11-02", "2019-11-03"),
+		record(3, idAutres, 1, "France///Lyon///France", "2019-12-02", "2019-12-03"),
+		record(4, idAvion, 4, "Chine///Pékin///Chine", "2020-01-02", "2020-01-10"),
+	}
+}
+
+// newTestPipeline returns a pipeline that does not need to geocode
+// missions to Lyon.
+func newTestPipeline(sink Sink, opts Options) *Pipeline {
+	p := NewPipeline(sink, opts)
+	p.places["Lyon,France"] = eco.Location{Name: "Lyon", Lat: 45.7578137, Lng: 4.8320114}
+	return p
+}
+
+func TestPipelineRead(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		others eco.TransID
+		legs   map[int32]int
+		failed map[int32]bool
+		trans  map[int32]eco.TransID
+	}{
+		{
+			name:   "reject",
+			legs:   map[int32]int{1: 2, 2: 1},
+			failed: map[int32]bool{3: true},
+			trans:  map[int32]eco.TransID{1: eco.Train, 2: eco.Plane},
+		},
+		{
+			name:   "others",
+			others: eco.Car,
+			legs:   map[int32]int{1: 2, 2: 1, 3: 1},
+			failed: map[int32]bool{},
+			trans:  map[int32]eco.TransID{1: eco.Train, 2: eco.Plane, 3: eco.Car},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPipeline(nil, Options{
+				Fixups: Fixups{TIDs: []TIDFixup{{ID: 2, TID: "plane"}}},
+				Others: tc.others,
+			})
+			ms, err := p.Read(testRecords())
+			if err != nil {
+				t.Fatalf("could not read source: %+v", err)
+			}
+
+			if got, want := len(ms.Digests), 4; got != want {
+				t.Fatalf("invalid number of missions: got=%d, want=%d", got, want)
+			}
+			legs := make(map[int32]int)
+			for id, vs := range ms.Legs {
+				legs[id] = len(vs)
+			}
+			if !reflect.DeepEqual(legs, tc.legs) {
+				t.Fatalf("invalid legs: got=%v, want=%v", legs, tc.legs)
+			}
+			if !reflect.DeepEqual(ms.Failed, tc.failed) {
+				t.Fatalf("invalid failed missions: got=%v, want=%v", ms.Failed, tc.failed)
+			}
+			if ms.Accepted[4] {
+				t.Fatalf("rejected mission 4 was accepted")
+			}
+			if got, want := ms.Transports[4], idAvion; got != want {
+				t.Fatalf("invalid transport of mission 4: got=%d, want=%d", got, want)
+			}
+
+			for id, want := range tc.trans {
+				if got := p.TransID(p.Choose(ms.Legs[id])); got != want {
+					t.Fatalf("invalid transport mode for mission %d: got=%v, want=%v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHashOrder(t *testing.T) {
+	var (
+		a = record(1, idTrain, 1, "France///Paris///France", "2019-10-02", "2019-10-04")
+		b = record(1, idBus, 1, "France///Paris///France", "2019-10-02", "2019-10-04")
+	)
+	h1 := Hash([][]byte{a.Digest(), b.Digest()})
+	h2 := Hash([][]byte{b.Digest(), a.Digest()})
+	if h1 != h2 {
+		t.Fatalf("hash depends on the order of rows")
+	}
+	if h1 == Hash([][]byte{a.Digest()}) {
+		t.Fatalf("hash does not depend on the rows")
+	}
+}
+
+func TestMissionsBook(t *testing.T) {
+	read := func() *Missions {
+		ms, err := newTestPipeline(nil, Options{}).Read(&records{
+			record(1, idAvion, 1, "Japon///Tokyo///Japon", "2019-10-02", "2019-10-09"),
+			record(2, idTrain, 1, "France///Lyon///France", "2019-11-02", "2019-11-02"),
+			record(3, idTrain, 4, "France///Lyon///France", "2019-11-02", "2019-11-02"),
+		})
+		if err != nil {
+			t.Fatalf("could not read source: %+v", err)
+		}
+		return ms
+	}
+
+	bks := []Booking{
+		{Ref: "A1", Date: date("2019-10-02"), Origin: "Paris CDG", Dest: "Tokyo Haneda", Mode: eco.Plane, Class: "business", Fare: -1},
+		{Ref: "T1", Date: date("2019-11-02"), Origin: "Clermont-Ferrand", Dest: "Lyon Part-Dieu", Mode: eco.Train, Fare: -1},
+		{Ref: "T2", Date: date("2020-01-02"), Origin: "Clermont-Ferrand", Dest: "Lyon Part-Dieu", Mode: eco.Train, Fare: -1},
+	}
+
+	var (
+		ref = read()
+		ms  = read()
+	)
+	unmatched := ms.Book(bks)
+	if got, want := len(unmatched), 1; got != want {
+		t.Fatalf("invalid number of unmatched bookings: got=%d, want=%d", got, want)
+	}
+
+	// mission 3 was rejected: T1 only matches mission 2.
+	if got, want := len(ms.Bookings[2]), 1; got != want {
+		t.Fatalf("invalid number of bookings for mission 2: got=%d, want=%d", got, want)
+	}
+	for _, id := range []int32{1, 2} {
+		if ms.Hash(id) == ref.Hash(id) {
+			t.Fatalf("hash of mission %d does not depend on its bookings", id)
+		}
+	}
+	if ms.Hash(3) != ref.Hash(3) {
+		t.Fatalf("hash of mission 3 depends on unrelated bookings")
+	}
+}
+
+// process processes the missions of the test records with the provided
+// sink.
+func process(t *testing.T, sink Sink) {
+	t.Helper()
+
+	p := newTestPipeline(sink, Options{Others: eco.Car})
+	ms, err := p.Read(testRecords())
+	if err != nil {
+		t.Fatalf("could not read source: %+v", err)
+	}
+	for _, id := range []int32{1, 2, 3} {
+		rev := eco.Revision{ID: id, Status: eco.Registered, Hash: ms.Hash(id)}
+		err = p.Revise(rev, ms.Legs[id], nil)
+		if err != nil {
+			t.Fatalf("could not revise mission %d: %+v", id, err)
+		}
+	}
+	p.Add(eco.Revision{ID: 4, Status: eco.Rejected})
+
+	if got, want := len(p.Revisions()), 4; got != want {
+		t.Fatalf("invalid number of revisions: got=%d, want=%d", got, want)
+	}
+	m := p.Revisions()[0].Mission
+	if m == nil || m.Trans != eco.Train || m.Dest.Name != "Lyon" || m.Start != Clermont {
+		t.Fatalf("invalid mission 1: %+v", m)
+	}
+
+	err = p.Flush()
+	if err != nil {
+		t.Fatalf("could not flush revisions: %+v", err)
+	}
+	if got := len(p.Revisions()); got != 0 {
+		t.Fatalf("revisions were not flushed: %d", got)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var (
+		revs    []eco.Revision
+		batches = make(map[string]eco.BatchResult)
+		fail    = 1 // number of failures before accepting a batch
+		sent    []string
+		reqs    = 0 // number of received requests
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs++
+		if r.Method != http.MethodPost || r.URL.Path != "/api/batch" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer s3cr3t"; got != want {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		var b eco.Batch
+		err := json.NewDecoder(r.Body).Decode(&b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sent = append(sent, b.ID)
+
+		res, ok := batches[b.ID]
+		switch {
+		case ok:
+			res.Replayed = true
+		default:
+			res = eco.BatchResult{ID: b.ID}
+			for _, rev := range b.Revisions {
+				if rev.Status == eco.Rejected {
+					res.Rejected = append(res.Rejected, eco.Rejection{ID: rev.ID, Reason: "no such mission"})
+					continue
+				}
+				res.Accepted = append(res.Accepted, rev.ID)
+				revs = append(revs, rev)
+			}
+			batches[b.ID] = res
+		}
+		if fail > 0 {
+			// batch applied, but its result is lost.
+			fail--
+			http.Error(w, "boom", http.StatusBadGateway)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	sink := HTTPSink{Addr: srv.URL, Token: "s3cr3t", MaxRevisions: 2, Retries: 1}
+	p := newTestPipeline(sink, Options{Others: eco.Car})
+	for _, id := range []int32{1, 2, 3} {
+		p.Add(eco.Revision{ID: id, Status: eco.Registered, Hash: "h"})
+	}
+	p.Add(eco.Revision{ID: 4, Status: eco.Rejected})
+
+	err := p.Flush()
+	if err != nil {
+		t.Fatalf("could not flush revisions: %+v", err)
+	}
+
+	if got, want := len(revs), 3; got != want {
+		t.Fatalf("invalid number of applied revisions: got=%d, want=%d", got, want)
+	}
+	for i, rev := range revs {
+		if rev.ID != int32(i+1) {
+			t.Fatalf("invalid revision %d: %+v", i, rev)
+		}
+	}
+	if got, want := len(batches), 2; got != want {
+		t.Fatalf("invalid number of batches: got=%d, want=%d", got, want)
+	}
+	if got, want := len(sent), 3; got != want || sent[0] != sent[1] || sent[1] == sent[2] {
+		t.Fatalf("invalid sent batches: %q", sent)
+	}
+
+	r := p.Report()
+	if got, want := len(r.Errors), 1; got != want {
+		t.Fatalf("invalid number of errors: got=%d, want=%d", got, want)
+	}
+	if e := r.Errors[0]; e.ID != 4 || e.Kind != BadUpload || e.Err.Error() != "no such mission" {
+		t.Fatalf("invalid error: %+v", e)
+	}
+
+	// the same revisions written again (e.g. a mission cancelled, restored
+	// and cancelled again) are uploaded in a new batch.
+	err = sink.Write(revs[:2])
+	if err != nil {
+		t.Fatalf("could not upload revisions again: %+v", err)
+	}
+	if got := sent[len(sent)-1]; got == sent[0] {
+		t.Fatalf("revisions written again were sent with the ID of their first batch: %q", got)
+	}
+	if got, want := len(revs), 5; got != want {
+		t.Fatalf("invalid number of applied revisions: got=%d, want=%d", got, want)
+	}
+
+	// client errors are not retried.
+	n := reqs
+	err = HTTPSink{Addr: srv.URL, Retries: 3}.Write(revs)
+	if err == nil {
+		t.Fatalf("expected an error without token")
+	}
+	if got, want := reqs-n, 1; got != want {
+		t.Fatalf("invalid number of requests: got=%d, want=%d", got, want)
+	}
+}
+
+func TestHTTPSinkChunks(t *testing.T) {
+	revs := make([]eco.Revision, 10)
+	for i := range revs {
+		revs[i] = eco.Revision{ID: int32(i + 1), Status: eco.Registered, Hash: strings.Repeat("x", 100)}
+	}
+
+	for _, tc := range []struct {
+		sink HTTPSink
+		want []int
+	}{
+		{HTTPSink{}, []int{10}},
+		{HTTPSink{MaxRevisions: 3}, []int{3, 3, 3, 1}},
+		{HTTPSink{MaxBytes: 400}, []int{2, 2, 2, 2, 2}},
+		{HTTPSink{MaxRevisions: 1, MaxBytes: 400}, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{HTTPSink{MaxBytes: 10}, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{HTTPSink{MaxRevisions: 3, MaxBytes: 10, Single: true}, []int{10}},
+	} {
+		chunks, err := tc.sink.chunks(revs)
+		if err != nil {
+			t.Fatalf("could not split revisions: %+v", err)
+		}
+		got := make([]int, len(chunks))
+		for i, c := range chunks {
+			got[i] = len(c)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("invalid chunks (%+v): got=%v, want=%v", tc.sink, got, tc.want)
+		}
+	}
+}
+
+func TestBoltSink(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "eco.db"), 0644, nil)
+	if err != nil {
+		t.Fatalf("could not create db: %+v", err)
+	}
+	defer db.Close()
+
+	sink, err := NewBoltSink(db, "eco-mig")
+	if err != nil {
+		t.Fatalf("could not create sink: %+v", err)
+	}
+
+	// mission 4 was stored before being rejected.
+	m4 := eco.Mission{
+		ID: 4, Date: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		Start: Clermont, Dest: eco.Location{Name: "Pékin", Lat: 39.9, Lng: 116.4},
+		Dist: 8500e3, Trans: eco.Plane,
+	}
+	err = sink.Write([]eco.Revision{{ID: 4, Status: eco.Registered, Mission: &m4}})
+	if err != nil {
+		t.Fatalf("could not store mission 4: %+v", err)
+	}
+
+	// corrections are re-applied to the stored missions.
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return store.SaveCorrection(tx, 2, store.Correction{Patch: map[string]interface{}{"transport_id": eco.Train}})
+	})
+	if err != nil {
+		t.Fatalf("could not store correction: %+v", err)
+	}
+
+	process(t, sink)
+
+	last, err := sink.LastID()
+	if err != nil {
+		t.Fatalf("could not retrieve last ID: %+v", err)
+	}
+	if got, want := last, int32(3); got != want {
+		t.Fatalf("invalid last ID: got=%d, want=%d", got, want)
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, tc := range []struct {
+			id    int32
+			trans eco.TransID
+		}{
+			{2, eco.Train},
+			{3, eco.Car},
+		} {
+			m, err := store.LoadMission(tx, tc.id)
+			if err != nil {
+				return err
+			}
+			if m.Trans != tc.trans {
+				t.Fatalf("invalid mission %d: %+v", tc.id, m)
+			}
+		}
+
+		lc, _, err := store.LoadLifecycle(tx, 4)
+		if err != nil {
+			return err
+		}
+		if lc.Status != eco.Rejected || lc.Mission == nil || lc.Mission.ID != 4 {
+			t.Fatalf("invalid lifecycle of mission 4: %+v", lc)
+		}
+		as, err := store.LoadAudit(tx, 4)
+		if err != nil {
+			return err
+		}
+		if len(as) != 1 || as[0].User != "eco-mig" || as[0].Action != "rejected" {
+			t.Fatalf("invalid audit trail of mission 4: %+v", as)
+		}
+
+		if store.Stale(tx) {
+			t.Fatalf("stale aggregates")
+		}
+		if store.Version(tx) == 0 {
+			t.Fatalf("dataset version was not bumped")
+		}
+		vs, err := store.TripMissions(tx)
+		if err != nil {
+			return err
+		}
+		if got, want := len(vs), 3; got != want {
+			t.Fatalf("invalid number of aggregated missions: got=%d, want=%d", got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not read db: %+v", err)
+	}
+
+	// invalid missions are rejected, the other ones are stored.
+	m5 := m4
+	m5.ID = 5
+	err = sink.Write([]eco.Revision{
+		{ID: 5, Status: eco.Registered, Mission: &m5},
+		{ID: 6, Status: eco.Registered, Mission: &eco.Mission{ID: 6}},
+	})
+	var rerr *RejectedError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected a rejection error, got: %+v", err)
+	}
+	if len(rerr.Rejected) != 1 || rerr.Rejected[0].ID != 6 || len(rerr.Rejected[0].Fields) == 0 {
+		t.Fatalf("invalid rejections: %+v", rerr.Rejected)
+	}
+	last, err = sink.LastID()
+	if err != nil {
+		t.Fatalf("could not retrieve last ID: %+v", err)
+	}
+	if got, want := last, int32(5); got != want {
+		t.Fatalf("invalid last ID: got=%d, want=%d", got, want)
+	}
+}
+
+func TestReport(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "missions.csv")
+	err := os.WriteFile(fname, []byte(`id,destination,transport_id,outbound_date,inbound_date,valid
+1,France///Lyon///France,4,2019-10-02,2019-10-04,1
+2,France///Lyon///France,4,02/10/2019,2019-10-04,1
+3,France///Lyon///France,99,2019-10-02,2019-10-04,1
+4,France//////France,4,2019-10-02,2019-10-04,1
+5,France///Lyon///France,99,2019-10-02,2019-10-04,4
+6,France/// ///France,4,2019-10-02,2019-10-04,1
+7,France///Lyon///France,4,1890-10-02,1890-10-04,1
+`), 0644)
+	if err != nil {
+		t.Fatalf("could not create source: %+v", err)
+	}
+
+	src, err := Open(fname, Mapping{})
+	if err != nil {
+		t.Fatalf("could not open source: %+v", err)
+	}
+	defer src.Close()
+
+	p := newTestPipeline(nil, Options{})
+	ms, err := p.Read(src)
+	if err != nil {
+		t.Fatalf("could not read source: %+v", err)
+	}
+	if got, want := ms.Failed, map[int32]bool{2: true, 3: true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid failed missions: got=%v, want=%v", got, want)
+	}
+
+	for _, id := range []int32{1, 4, 6, 7} {
+		_ = p.Revise(eco.Revision{ID: id, Status: eco.Registered}, ms.Legs[id], nil)
+	}
+	if got, want := len(p.Revisions()), 1; got != want {
+		t.Fatalf("invalid number of revisions: got=%d, want=%d", got, want)
+	}
+
+	r := p.Report()
+	if r.Missions != 7 || r.Processed != 4 || r.Failed != 5 {
+		t.Fatalf("invalid report: missions=%d, processed=%d, failed=%d", r.Missions, r.Processed, r.Failed)
+	}
+
+	out := new(bytes.Buffer)
+	err = r.WriteJSON(out)
+	if err != nil {
+		t.Fatalf("could not write report: %+v", err)
+	}
+	var got struct {
+		Kinds  map[Kind]int `json:"kinds"`
+		Errors []struct {
+			ID    int32  `json:"id"`
+			Row   int    `json:"row"`
+			Kind  Kind   `json:"kind"`
+			Field string `json:"field"`
+			Value string `json:"value"`
+		} `json:"errors"`
+	}
+	err = json.Unmarshal(out.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("could not decode report: %+v", err)
+	}
+	if want := map[Kind]int{BadRecord: 1, BadTransport: 1, BadDestination: 2, BadMission: 1}; !reflect.DeepEqual(got.Kinds, want) {
+		t.Fatalf("invalid kinds: got=%v, want=%v", got.Kinds, want)
+	}
+	if e := got.Errors[0]; e.ID != 2 || e.Row != 3 || e.Kind != BadRecord || e.Field != "outbound_date" || e.Value != "02/10/2019" {
+		t.Fatalf("invalid error: %+v", e)
+	}
+	if e := got.Errors[len(got.Errors)-1]; e.ID != 7 || e.Kind != BadMission {
+		t.Fatalf("invalid error: %+v", e)
+	}
+
+	for _, tc := range []struct {
+		th  Thresholds
+		err bool
+	}{
+		{Thresholds{MaxFailed: 0}, true},
+		{Thresholds{MaxFailed: 5}, false},
+		{Thresholds{MaxFailed: -1}, false},
+		{Thresholds{MaxFailed: -1, MaxRate: 0.5}, true},
+		{Thresholds{MaxFailed: -1, MaxRate: 0.8}, false},
+	} {
+		err := r.Check(tc.th)
+		if (err != nil) != tc.err {
+			t.Fatalf("invalid check for %+v: err=%v", tc.th, err)
+		}
+	}
+}
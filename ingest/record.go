@@ -0,0 +1,78 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ingest reads missions from travel-management databases and
+// exports.
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+// Record is a mission, as stored in a travel-management database.
+//
+// A mission with multiple legs is described by multiple records with the
+// same ID.
+type Record struct {
+	ID          int32
+	Date        time.Time // when was the mission drafted
+	Org         string    // funding organization
+	Group       string    // group funding the mission
+	Departure   string
+	Destination string // "country///city///country" triplet
+	Object      string
+	Type        int16
+	Transport   struct {
+		Name  string
+		ID    int32
+		Label string
+	}
+	Outbound  Journey
+	Inbound   Journey
+	Comment   string
+	Valid     int16   // validation status
+	Cost      float64 // -1 if unknown
+	Residence struct {
+		Familiale int8
+		Return    int64 // -1 if unknown
+	}
+	Housing   string
+	Traveller string // name of the traveller, if known
+}
+
+type Journey struct {
+	Date  time.Time
+	Start string // Hour of departure
+	Stop  string // Hour of arrival
+}
+
+// Digest returns the digest of the content of the record.
+func (rec Record) Digest() []byte {
+	h := sha256.New()
+	for _, v := range []string{
+		rec.Org, rec.Group,
+		rec.Departure, rec.Destination, rec.Object,
+		rec.Transport.Name, rec.Transport.Label,
+		rec.Outbound.Start, rec.Outbound.Stop,
+		rec.Inbound.Start, rec.Inbound.Stop,
+		rec.Comment, rec.Housing,
+	} {
+		fmt.Fprintf(h, "%d:%s;", len(v), v)
+	}
+	fmt.Fprintf(h, "%d;%d;%d;%d;%d;%d;%v;",
+		rec.ID, rec.Type, rec.Transport.ID, rec.Valid,
+		rec.Residence.Familiale, rec.Residence.Return, rec.Cost,
+	)
+	for _, t := range []time.Time{rec.Date, rec.Outbound.Date, rec.Inbound.Date} {
+		fmt.Fprintf(h, "%d;", t.Unix())
+	}
+	if rec.Traveller != "" {
+		// only when known, so the digests of sources without travellers
+		// do not depend on this field.
+		fmt.Fprintf(h, "%d:%s;", len(rec.Traveller), rec.Traveller)
+	}
+	return h.Sum(nil)
+}
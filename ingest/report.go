@@ -0,0 +1,151 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Kind is the kind of error of a mission.
+type Kind string
+
+// Kinds of mission errors.
+const (
+	BadRecord      Kind = "record"      // unparsable row (bad date, number, ...)
+	BadTransport   Kind = "transport"   // unknown transport mode
+	BadDestination Kind = "destination" // missing or malformed destination
+	BadGeocode     Kind = "geocode"     // location not found
+	BadBooking     Kind = "booking"     // bookings could not be processed
+	BadMission     Kind = "validation"  // processed mission failed validation
+	BadUpload      Kind = "upload"      // revision rejected by eco-srv
+)
+
+// Error is an error of a single mission.
+// Missions with errors are skipped, the other missions are processed.
+type Error struct {
+	ID    int32  // mission ID, 0 if unknown
+	Row   int    // row of the source, 0 if unknown
+	Kind  Kind   // kind of error
+	Field string // faulty field, if any
+	Value string // faulty value, if any
+	Err   error
+}
+
+func (e *Error) Error() string {
+	o := new(strings.Builder)
+	switch e.ID {
+	case 0:
+		o.WriteString("mission")
+	default:
+		fmt.Fprintf(o, "mission %d", e.ID)
+	}
+	if e.Row > 0 {
+		fmt.Fprintf(o, " (row %d)", e.Row)
+	}
+	fmt.Fprintf(o, ": %s", e.Kind)
+	if e.Field != "" {
+		fmt.Fprintf(o, " %s=%q", e.Field, e.Value)
+	}
+	fmt.Fprintf(o, ": %v", e.Err)
+	return o.String()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID    int32  `json:"id,omitempty"`
+		Row   int    `json:"row,omitempty"`
+		Kind  Kind   `json:"kind"`
+		Field string `json:"field,omitempty"`
+		Value string `json:"value,omitempty"`
+		Err   string `json:"error"`
+	}{e.ID, e.Row, e.Kind, e.Field, e.Value, e.Err.Error()})
+}
+
+// Report is the report of a pipeline run.
+type Report struct {
+	Missions  int          `json:"missions"`  // number of missions in the source
+	Processed int          `json:"processed"` // number of (re)processed missions
+	Failed    int          `json:"failed"`    // number of missions with errors
+	Kinds     map[Kind]int `json:"kinds"`     // number of errors per kind
+	Errors    []*Error     `json:"errors"`
+
+	UnusedTIDs  []int32 `json:"unused_tid_fixups,omitempty"`  // transport fixups of no "Autres" mission
+	UnusedDests []int32 `json:"unused_dest_fixups,omitempty"` // destination fixups of no mission
+
+	failed map[int32]bool
+}
+
+func newReport() *Report {
+	return &Report{
+		Kinds:  make(map[Kind]int),
+		Errors: []*Error{},
+		failed: make(map[int32]bool),
+	}
+}
+
+// Add adds an error to the report.
+func (r *Report) Add(e *Error) {
+	r.Errors = append(r.Errors, e)
+	r.Kinds[e.Kind]++
+	if e.ID == 0 || !r.failed[e.ID] {
+		r.Failed++
+	}
+	if e.ID != 0 {
+		r.failed[e.ID] = true
+	}
+}
+
+// WriteJSON writes the report as JSON, with the errors sorted by mission.
+func (r *Report) WriteJSON(w io.Writer) error {
+	sort.SliceStable(r.Errors, func(i, j int) bool {
+		return r.Errors[i].ID < r.Errors[j].ID
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Summary writes a human readable summary of the report.
+func (r *Report) Summary(w io.Writer) {
+	kinds := make([]string, 0, len(r.Kinds))
+	for k := range r.Kinds {
+		kinds = append(kinds, string(k))
+	}
+	sort.Strings(kinds)
+
+	fmt.Fprintf(w, "missions: %d, processed: %d, failed: %d\n", r.Missions, r.Processed, r.Failed)
+	for _, k := range kinds {
+		fmt.Fprintf(w, "  %-12s %d\n", k+":", r.Kinds[Kind(k)])
+	}
+	if n := len(r.UnusedTIDs) + len(r.UnusedDests); n > 0 {
+		fmt.Fprintf(w, "unused fixups: %d (transport: %v, destination: %v)\n", n, r.UnusedTIDs, r.UnusedDests)
+	}
+}
+
+// Thresholds are the tolerated numbers of missions with errors.
+type Thresholds struct {
+	MaxFailed int     // maximum number of failed missions (negative: no limit)
+	MaxRate   float64 // maximum fraction of failed missions (0: no limit)
+}
+
+// Check returns an error if the report exceeds the thresholds.
+func (r *Report) Check(th Thresholds) error {
+	if th.MaxFailed >= 0 && r.Failed > th.MaxFailed {
+		return fmt.Errorf("too many failed missions: %d (max=%d)", r.Failed, th.MaxFailed)
+	}
+	if th.MaxRate > 0 && r.Missions > 0 {
+		rate := float64(r.Failed) / float64(r.Missions)
+		if rate > th.MaxRate {
+			return fmt.Errorf("too many failed missions: %.1f%% (max=%.1f%%)", 100*rate, 100*th.MaxRate)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/sbinet-lpc/eco"
+)
+
+// Rule infers the transport mode of missions of the "Autres" kind.
+//
+// A rule matches a mission when all its conditions hold: its comment
+// matches Comment, the name or the label of its transport matches Label
+// and its round-trip distance is within [MinKm, MaxKm).
+// Empty conditions always hold.
+type Rule struct {
+	Name    string  `json:"name"`
+	Comment string  `json:"comment,omitempty"` // regexp matched against the comment of the mission
+	Label   string  `json:"label,omitempty"`   // regexp matched against the name or label of the transport
+	MinKm   float64 `json:"min_km,omitempty"`  // minimum round-trip distance, in kilometers
+	MaxKm   float64 `json:"max_km,omitempty"`  // maximum round-trip distance, in kilometers (0: no limit)
+	TID     string  `json:"tid"`               // transport mode (e.g. "train", "car")
+
+	tid     eco.TransID
+	comment *regexp.Regexp
+	label   *regexp.Regexp
+}
+
+// Rules are transport rules, applied in order: the first matching rule
+// decides the transport mode of a mission.
+type Rules []Rule
+
+// LoadRules loads and compiles the transport rules of a JSON file.
+func LoadRules(fname string) (Rules, error) {
+	raw, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not load transport rules: %w", err)
+	}
+
+	var rules Rules
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode transport rules %q: %w", fname, err)
+	}
+
+	err = rules.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Compile validates the rules and compiles their regular expressions.
+func (rules Rules) Compile() error {
+	var errs []string
+	bad := func(i int, r Rule, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("rule #%d (%q): %s", i, r.Name, fmt.Sprintf(format, args...)))
+	}
+
+	seen := make(map[string]bool, len(rules))
+	for i := range rules {
+		r := &rules[i]
+		if r.Name == "" {
+			bad(i, *r, "missing name")
+		}
+		if seen[r.Name] {
+			bad(i, *r, "duplicate name")
+		}
+		seen[r.Name] = true
+
+		var err error
+		r.tid, err = eco.ParseTransID(r.TID)
+		if err != nil || r.tid == eco.Unknown {
+			bad(i, *r, "invalid transport mode %q", r.TID)
+		}
+
+		r.comment, r.label = nil, nil
+		if r.Comment != "" {
+			r.comment, err = regexp.Compile(r.Comment)
+			if err != nil {
+				bad(i, *r, "invalid comment regexp: %v", err)
+			}
+		}
+		if r.Label != "" {
+			r.label, err = regexp.Compile(r.Label)
+			if err != nil {
+				bad(i, *r, "invalid label regexp: %v", err)
+			}
+		}
+
+		switch {
+		case math.IsNaN(r.MinKm) || math.IsInf(r.MinKm, 0) || r.MinKm < 0:
+			bad(i, *r, "invalid minimum distance %v", r.MinKm)
+		case math.IsNaN(r.MaxKm) || math.IsInf(r.MaxKm, 0) || r.MaxKm < 0:
+			bad(i, *r, "invalid maximum distance %v", r.MaxKm)
+		case r.MaxKm > 0 && r.MaxKm <= r.MinKm:
+			bad(i, *r, "empty distance range [%v, %v)", r.MinKm, r.MaxKm)
+		}
+
+		if r.Comment == "" && r.Label == "" && r.MinKm == 0 && r.MaxKm == 0 {
+			bad(i, *r, "no condition")
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid transport rules:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// distance returns whether the rule has a distance condition.
+func (r Rule) distance() bool {
+	return r.MinKm > 0 || r.MaxKm > 0
+}
+
+// Match returns whether the rule matches a row with the provided
+// round-trip distance, in kilometers, and why.
+// Distance conditions hold when the distance is negative (unknown).
+func (r Rule) Match(rec Record, km float64) (string, bool) {
+	var why []string
+	if r.comment != nil {
+		if !r.comment.MatchString(rec.Comment) {
+			return "", false
+		}
+		why = append(why, fmt.Sprintf("comment=%q", rec.Comment))
+	}
+	if r.label != nil {
+		switch {
+		case r.label.MatchString(rec.Transport.Label):
+			why = append(why, fmt.Sprintf("label=%q", rec.Transport.Label))
+		case r.label.MatchString(rec.Transport.Name):
+			why = append(why, fmt.Sprintf("name=%q", rec.Transport.Name))
+		default:
+			return "", false
+		}
+	}
+	if r.distance() && km >= 0 {
+		if km < r.MinKm || (r.MaxKm > 0 && km >= r.MaxKm) {
+			return "", false
+		}
+		why = append(why, fmt.Sprintf("dist=%.0fkm", km))
+	}
+	return fmt.Sprintf("rule %q (%s)", r.Name, strings.Join(why, ", ")), true
+}
+
+// Match returns the transport mode decided by the first rule matching a
+// row with the provided round-trip distance, in kilometers, and why.
+// Rules with a distance condition are skipped when the distance is
+// negative (unknown).
+func (rules Rules) Match(rec Record, km float64) (eco.TransID, string) {
+	for _, r := range rules {
+		if km < 0 && r.distance() {
+			continue
+		}
+		if why, ok := r.Match(rec, km); ok {
+			return r.tid, why
+		}
+	}
+	return eco.Unknown, ""
+}
+
+// possible returns whether a rule could match a row, once its distance is
+// known.
+func (rules Rules) possible(rec Record) bool {
+	for _, r := range rules {
+		if _, ok := r.Match(rec, -1); ok {
+			return true
+		}
+	}
+	return false
+}
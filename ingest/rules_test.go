@@ -0,0 +1,121 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sbinet-lpc/eco"
+)
+
+func TestLoadRules(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		json string
+		err  string
+	}{
+		{
+			name: "ok",
+			json: `[{"name": "tgv", "comment": "(?i)\\btgv\\b", "tid": "train"}, {"name": "short", "max_km": 50, "tid": "car"}]`,
+		},
+		{name: "unknown-field", json: `[{"name": "tgv", "regexp": "tgv", "tid": "train"}]`, err: "unknown field"},
+		{name: "no-name", json: `[{"comment": "tgv", "tid": "train"}]`, err: "missing name"},
+		{name: "dup-name", json: `[{"name": "a", "comment": "x", "tid": "train"}, {"name": "a", "comment": "y", "tid": "car"}]`, err: "duplicate name"},
+		{name: "bad-tid", json: `[{"name": "a", "comment": "x", "tid": "rocket"}]`, err: "invalid transport mode"},
+		{name: "bad-regexp", json: `[{"name": "a", "comment": "(", "tid": "train"}]`, err: "invalid comment regexp"},
+		{name: "bad-range", json: `[{"name": "a", "min_km": 100, "max_km": 50, "tid": "train"}]`, err: "empty distance range"},
+		{name: "no-condition", json: `[{"name": "a", "tid": "train"}]`, err: "no condition"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "rules.json")
+			err := os.WriteFile(fname, []byte(tc.json), 0644)
+			if err != nil {
+				t.Fatalf("could not create rules: %+v", err)
+			}
+			_, err = LoadRules(fname)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("could not load rules: %+v", err)
+			case tc.err != "" && err == nil:
+				t.Fatalf("expected an error")
+			case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+				t.Fatalf("invalid error: got=%q, want=%q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestRulesPipeline(t *testing.T) {
+	rules := Rules{
+		{Name: "tgv", Comment: `(?i)\btgv\b`, TID: "train"},
+		{Name: "ferry", Label: `(?i)ferry|bateau`, TID: "bus"},
+		{Name: "short", MaxKm: 50, TID: "car"},
+	}
+	err := rules.Compile()
+	if err != nil {
+		t.Fatalf("could not compile rules: %+v", err)
+	}
+
+	autres := func(id int32, comment, label string) Record {
+		rec := record(id, idAutres, 1, "France///Lyon///France", "2019-10-02", "2019-10-04")
+		rec.Comment = comment
+		rec.Transport.Label = label
+		return rec
+	}
+
+	p := newTestPipeline(nil, Options{
+		Fixups: Fixups{TIDs: []TIDFixup{{ID: 1, TID: "plane"}}},
+		Rules:  rules,
+	})
+	p.places["Cournon,France"] = eco.Location{Name: "Cournon", Lat: 45.7409, Lng: 3.1967}
+
+	short := autres(5, "", "Autres")
+	short.Destination = "France///Cournon///France"
+
+	ms, err := p.Read(&records{
+		autres(1, "aller en TGV", "Autres"),
+		autres(2, "aller en TGV", "Autres"),
+		autres(3, "", "Bateau"),
+		autres(4, "", "Autres"),
+		short,
+	})
+	if err != nil {
+		t.Fatalf("could not read source: %+v", err)
+	}
+	// missions 4 and 5 may be matched by the "short" rule, once their
+	// distance is known.
+	if len(ms.Failed) != 0 {
+		t.Fatalf("invalid failed missions: %v", ms.Failed)
+	}
+
+	for _, tc := range []struct {
+		id    int32
+		trans eco.TransID
+		why   string
+	}{
+		{1, eco.Plane, "fixup"},
+		{2, eco.Train, `rule "tgv" (comment="aller en TGV")`},
+		{3, eco.Bus, `rule "ferry" (label="Bateau")`},
+		{5, eco.Car, `rule "short" (dist=20km)`},
+	} {
+		m, err := p.Process(p.Choose(ms.Legs[tc.id]), nil)
+		if err != nil {
+			t.Fatalf("could not process mission %d: %+v", tc.id, err)
+		}
+		if m.Trans != tc.trans || m.TransReason != tc.why {
+			t.Fatalf("invalid transport of mission %d: got=%v (%s), want=%v (%s)", tc.id, m.Trans, m.TransReason, tc.trans, tc.why)
+		}
+	}
+
+	_, err = p.Process(p.Choose(ms.Legs[4]), nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != BadTransport {
+		t.Fatalf("invalid error for mission 4: %+v", err)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"github.com/sbinet-lpc/eco/store"
+	"go.etcd.io/bbolt"
+)
+
+// Sink stores the revisions of missions.
+type Sink interface {
+	Write(revs []eco.Revision) error
+}
+
+// HTTPSink uploads revisions to the batch API of eco-srv.
+//
+// Revisions are uploaded in batches of bounded size, each identified by
+// the SHA-256 hash of its revisions and of a random nonce drawn for each
+// call to Write: eco-srv applies a batch at most once, so a batch can be
+// safely sent again after a network or server error, while the same
+// revisions written again later are applied again.
+type HTTPSink struct {
+	Addr   string       // address of eco-srv
+	Token  string       // API token, if any
+	Client *http.Client // default: http.DefaultClient
+
+	MaxRevisions int  // maximum number of revisions per batch (default: 500)
+	MaxBytes     int  // maximum size of a batch, in bytes (default: 1 MiB)
+	Retries      int  // number of retries of a batch upload failed with a network or server error
+	Single       bool // upload all the revisions in a single batch, applied atomically by eco-srv
+}
+
+// RejectedError is returned by sinks when some revisions were rejected.
+// The other revisions were stored.
+type RejectedError struct {
+	Rejected []eco.Rejection
+}
+
+func (e *RejectedError) Error() string {
+	ids := make([]string, len(e.Rejected))
+	for i, r := range e.Rejected {
+		ids[i] = strconv.Itoa(int(r.ID))
+	}
+	return fmt.Sprintf("%d revision(s) rejected (missions %s)", len(e.Rejected), strings.Join(ids, ", "))
+}
+
+func (sink HTTPSink) Write(revs []eco.Revision) error {
+	url := URL(sink.Addr, "/api/batch")
+
+	chunks, err := sink.chunks(revs)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return fmt.Errorf("could not generate batch nonce: %w", err)
+	}
+
+	var rejected []eco.Rejection
+	for i, chunk := range chunks {
+		id, err := batchID(nonce, chunk)
+		if err != nil {
+			return err
+		}
+		b := eco.Batch{
+			ID:        id,
+			Revisions: chunk,
+		}
+		var (
+			res   eco.BatchResult
+			retry bool
+		)
+		for try := 0; ; try++ {
+			res, retry, err = sink.post(url, b)
+			if err == nil || !retry || try >= sink.Retries {
+				break
+			}
+			log.Printf("could not upload batch %q (retry %d/%d): %+v", b.ID, try+1, sink.Retries, err)
+		}
+		if err != nil {
+			return fmt.Errorf("could not upload batch %q (%d/%d), previous batches were stored: %w", b.ID, i+1, len(chunks), err)
+		}
+		log.Printf("batch %q (%d/%d): accepted=%d, rejected=%d, replayed=%v",
+			res.ID, i+1, len(chunks), len(res.Accepted), len(res.Rejected), res.Replayed,
+		)
+		rejected = append(rejected, res.Rejected...)
+	}
+
+	if len(rejected) > 0 {
+		return &RejectedError{Rejected: rejected}
+	}
+	return nil
+}
+
+// batchID returns the ID of a batch of revisions, the SHA-256 hash of the
+// nonce of the upload and of the JSON encoding of the revisions.
+func batchID(nonce []byte, revs []eco.Revision) (string, error) {
+	raw, err := json.Marshal(revs)
+	if err != nil {
+		return "", fmt.Errorf("could not encode batch to JSON: %w", err)
+	}
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(raw)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// chunks splits revisions into batches of bounded size.
+func (sink HTTPSink) chunks(revs []eco.Revision) ([][]eco.Revision, error) {
+	if sink.Single {
+		if len(revs) == 0 {
+			return nil, nil
+		}
+		return [][]eco.Revision{revs}, nil
+	}
+
+	var (
+		maxN = sink.MaxRevisions
+		maxB = sink.MaxBytes
+	)
+	if maxN <= 0 {
+		maxN = 500
+	}
+	if maxB <= 0 {
+		maxB = 1 << 20
+	}
+
+	var (
+		chunks [][]eco.Revision
+		beg    = 0
+		size   = 0
+	)
+	for i, rev := range revs {
+		raw, err := json.Marshal(rev)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode revision of mission %d to JSON: %w", rev.ID, err)
+		}
+		n := len(raw) + 1
+		if i > beg && (i-beg >= maxN || size+n > maxB) {
+			chunks = append(chunks, revs[beg:i])
+			beg, size = i, 0
+		}
+		size += n
+	}
+	if beg < len(revs) {
+		chunks = append(chunks, revs[beg:])
+	}
+	return chunks, nil
+}
+
+// post uploads a batch of revisions.
+// It reports whether a failed upload can be retried, after a network or
+// server error.
+func (sink HTTPSink) post(url string, b eco.Batch) (eco.BatchResult, bool, error) {
+	var res eco.BatchResult
+
+	body := new(bytes.Buffer)
+	err := json.NewEncoder(body).Encode(b)
+	if err != nil {
+		return res, false, fmt.Errorf("could not encode batch to JSON: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return res, false, fmt.Errorf("could not create POST request to eco-srv: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sink.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sink.Token)
+	}
+
+	cli := sink.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return res, true, fmt.Errorf("could not send POST request to eco-srv: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return res, resp.StatusCode >= 500, fmt.Errorf("received an invalid status from eco-srv: %s (code=%d)",
+			resp.Status, resp.StatusCode,
+		)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return res, false, fmt.Errorf("could not decode batch result: %w", err)
+	}
+	if res.ID != b.ID {
+		return res, false, fmt.Errorf("received the result of batch %q instead of %q", res.ID, b.ID)
+	}
+	return res, false, nil
+}
+
+// BoltSink stores missions directly in an eco-srv database.
+//
+// Revisions are applied like the batches uploaded to eco-srv, in a single
+// transaction: missions are validated, their corrections re-applied and
+// their lifecycle, audit trail and aggregates updated.
+type BoltSink struct {
+	db   *bbolt.DB
+	user string // user recorded in the audit trail
+}
+
+// NewBoltSink returns a sink writing to the provided database on behalf of
+// the provided user, creating its buckets and migrating its missions if
+// needed.
+func NewBoltSink(db *bbolt.DB, user string) (*BoltSink, error) {
+	err := db.Update(store.Setup)
+	if err != nil {
+		return nil, fmt.Errorf("could not setup eco db: %w", err)
+	}
+	return &BoltSink{db: db, user: user}, nil
+}
+
+// LastID returns the largest ID of the stored missions.
+func (sink *BoltSink) LastID() (int32, error) {
+	var lastID int32
+	err := sink.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		lastID, err = store.LastID(tx)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not find last mission id: %w", err)
+	}
+	return lastID, nil
+}
+
+func (sink *BoltSink) Write(revs []eco.Revision) error {
+	var rejected []eco.Rejection
+	err := sink.db.Update(func(tx *bbolt.Tx) error {
+		now := time.Now().UTC()
+		_, rejs, err := store.Apply(tx, revs, sink.user, now)
+		if err != nil {
+			return err
+		}
+		rejected = rejs
+		return store.Touch(tx, now)
+	})
+	if err != nil {
+		return fmt.Errorf("could not update eco db: %w", err)
+	}
+	if len(rejected) > 0 {
+		return &RejectedError{Rejected: rejected}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// MissionSource is a source of mission records.
+type MissionSource interface {
+	// Next returns the next record of the source, or io.EOF once all the
+	// records have been read.
+	// Records that can not be decoded are reported with an *Error: the
+	// following records can still be read.
+	Next() (Record, error)
+
+	// Close releases the resources held by the source.
+	Close() error
+}
+
+// Open opens a file of mission records.
+// The format of the file is inferred from its extension:
+//   - .csv: comma-separated values, with a header line,
+//   - .xlsx: Excel spreadsheet, with a header row (first sheet only),
+//   - .jsonl, .ndjson: JSON Lines, one JSON object per record.
+func Open(fname string, m Mapping) (MissionSource, error) {
+	err := m.validate(fields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(fname)); ext {
+	case ".csv", ".xlsx":
+		return openTable(fname, m, fields, required)
+	case ".jsonl", ".ndjson":
+		return openJSONL(fname, m)
+	default:
+		return nil, fmt.Errorf("unknown format for missions file %q", fname)
+	}
+}
+
+// ReadAll reads all the records of a source.
+func ReadAll(src MissionSource) ([]Record, error) {
+	var recs []Record
+	for {
+		rec, err := src.Next()
+		if err != nil {
+			if err == io.EOF {
+				return recs, nil
+			}
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// Credentials are the credentials of a MySQL source database.
+type Credentials struct {
+	User  string `json:"user"`
+	Pwd   string `json:"password"`
+	Host  string `json:"host"`
+	DB    string `json:"db"`
+	Table string `json:"table"` // overrides the table of the mapping, if any
+}
+
+// ReadCredentials reads the credentials of a MySQL database from a JSON file.
+func ReadCredentials(fname string) (Credentials, error) {
+	var v Credentials
+	f, err := os.Open(fname)
+	if err != nil {
+		return v, fmt.Errorf("could not open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&v)
+	if err != nil {
+		return v, fmt.Errorf("could not decode credentials file content: %w", err)
+	}
+
+	return v, nil
+}
+
+// DSN returns the data source name of the MySQL database.
+func (c Credentials) DSN() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:3306)/%s", c.User, c.Pwd, c.Host, c.DB)
+}
+
+// OpenSource opens a source of missions: a CSV, XLSX or JSON Lines file if
+// fname is not empty, or the MySQL database of the credentials file creds
+// otherwise, read with pages of up to page missions.
+// The columns of the source are mapped to the fields of the missions with
+// the provided mapping file, if any. The LPC mapping is used by default for
+// MySQL databases.
+func OpenSource(fname, mapping, creds string, page int) (MissionSource, error) {
+	var (
+		m   Mapping
+		err error
+	)
+	if mapping != "" {
+		m, err = LoadMapping(mapping)
+		if err != nil {
+			return nil, fmt.Errorf("could not load mapping: %w", err)
+		}
+	}
+
+	if fname != "" {
+		return Open(fname, m)
+	}
+
+	if mapping == "" {
+		m = LPC
+	}
+
+	c, err := ReadCredentials(creds)
+	if err != nil {
+		return nil, err
+	}
+	if c.Table != "" {
+		m.Table = c.Table
+	}
+
+	db, err := sql.Open("mysql", c.DSN())
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not ping db: %w", err)
+	}
+
+	src, err := NewSQL(db, m, page)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return dbSource{src, db}, nil
+}
+
+// dbSource is a source that owns its database.
+type dbSource struct {
+	MissionSource
+	db *sql.DB
+}
+
+func (src dbSource) Close() error {
+	err := src.MissionSource.Close()
+	if e := src.db.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sqlSource streams the missions of a SQL table, one page of missions at
+// a time. Pages are delimited by mission IDs so the rows of a multi-legs
+// mission are never split across pages.
+type sqlSource struct {
+	db   *sql.DB
+	m    Mapping
+	page int
+
+	queryPage string // IDs of the missions of the next page
+	queryRows string // rows of the missions of a page
+
+	last int64
+	done bool
+	recs []result
+}
+
+// result is a decoded row.
+type result struct {
+	rec Record
+	err error
+}
+
+// NewSQL returns a source reading the missions of the table of the mapping,
+// with pages of up to page missions.
+// The mission ID column of the mapping must be given by name.
+//
+// Closing the source does not close the database.
+func NewSQL(db *sql.DB, m Mapping, page int) (MissionSource, error) {
+	if page <= 0 {
+		return nil, fmt.Errorf("invalid page size %d", page)
+	}
+	err := m.validate(fields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping: %w", err)
+	}
+	if m.Table == "" {
+		return nil, fmt.Errorf("invalid mapping: no table")
+	}
+	id := m.column("id")
+	if strings.HasPrefix(id, "#") {
+		return nil, fmt.Errorf("invalid mapping: mission id column must be named (got %q)", id)
+	}
+
+	return &sqlSource{
+		db:   db,
+		m:    m,
+		page: page,
+		queryPage: fmt.Sprintf(
+			"select distinct %[2]s from %[1]s where %[2]s > ? order by %[2]s limit ?",
+			m.Table, id,
+		),
+		queryRows: fmt.Sprintf(
+			"select * from %[1]s where %[2]s > ? and %[2]s <= ? order by %[2]s",
+			m.Table, id,
+		),
+		last: -1,
+	}, nil
+}
+
+func (src *sqlSource) Next() (Record, error) {
+	for len(src.recs) == 0 {
+		if src.done {
+			return Record{}, io.EOF
+		}
+		err := src.fetch()
+		if err != nil {
+			return Record{}, err
+		}
+	}
+	res := src.recs[0]
+	src.recs = src.recs[1:]
+	return res.rec, res.err
+}
+
+func (src *sqlSource) Close() error {
+	src.done = true
+	src.recs = nil
+	return nil
+}
+
+// fetch reads the next page of missions.
+func (src *sqlSource) fetch() error {
+	ids, err := src.pageIDs()
+	if err != nil {
+		return fmt.Errorf("could not select page after mission %d: %w", src.last, err)
+	}
+	if len(ids) < src.page {
+		src.done = true
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	next := ids[len(ids)-1]
+	err = src.read(src.last, next)
+	if err != nil {
+		return fmt.Errorf("could not read missions (%d, %d]: %w", src.last, next, err)
+	}
+	src.last = next
+	return nil
+}
+
+func (src *sqlSource) pageIDs() ([]int64, error) {
+	rows, err := src.db.Query(src.queryPage, src.last, src.page)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan mission id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// read reads the rows of the missions with IDs in the (beg, end] range.
+func (src *sqlSource) read(beg, end int64) error {
+	rows, err := src.db.Query(src.queryRows, beg, end)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("could not retrieve columns: %w", err)
+	}
+	idx, err := src.m.index(cols, fields, required)
+	if err != nil {
+		return fmt.Errorf("could not map columns: %w", err)
+	}
+
+	var (
+		raw  = make([]sql.RawBytes, len(cols))
+		ptrs = make([]interface{}, len(cols))
+		row  = make([]string, len(cols))
+	)
+	for i := range raw {
+		ptrs[i] = &raw[i]
+	}
+
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return fmt.Errorf("could not scan row: %w", err)
+		}
+		for i, v := range raw {
+			row[i] = string(v)
+		}
+		rec, err := src.m.decode(idx, row)
+		src.recs = append(src.recs, result{rec, err})
+	}
+	return rows.Err()
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tableSource reads missions from the rows of a spreadsheet.
+// The first non-empty row holds the names of the columns.
+type tableSource struct {
+	m     Mapping
+	idx   map[string]int
+	next  func() ([]string, error) // next row, or io.EOF
+	close func() error
+	row   int
+}
+
+func newTable(m Mapping, fields []string, required map[string]bool, next func() ([]string, error), close func() error) (*tableSource, error) {
+	src := &tableSource{m: m, next: next, close: close}
+	hdr, err := src.line()
+	if err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("no header")
+		}
+		return nil, fmt.Errorf("could not read header: %w", err)
+	}
+	if len(hdr) > 0 {
+		hdr[0] = strings.TrimPrefix(hdr[0], "\ufeff") // UTF-8 byte order mark
+	}
+
+	src.idx, err = m.index(hdr, fields, required)
+	if err != nil {
+		return nil, fmt.Errorf("could not map columns: %w", err)
+	}
+	return src, nil
+}
+
+// line returns the next non-empty row.
+func (src *tableSource) line() ([]string, error) {
+	for {
+		row, err := src.next()
+		if err != nil {
+			return nil, err
+		}
+		src.row++
+		for _, v := range row {
+			if strings.TrimSpace(v) != "" {
+				return row, nil
+			}
+		}
+	}
+}
+
+func (src *tableSource) Next() (Record, error) {
+	row, err := src.line()
+	if err != nil {
+		if err == io.EOF {
+			return Record{}, err
+		}
+		return Record{}, fmt.Errorf("could not read row %d: %w", src.row, err)
+	}
+	rec, err := src.m.decode(src.idx, row)
+	if e, ok := err.(*Error); ok {
+		e.Row = src.row
+	}
+	return rec, err
+}
+
+func (src *tableSource) Close() error {
+	if src.close == nil {
+		return nil
+	}
+	return src.close()
+}
+
+// openTable opens a CSV or XLSX file, with the columns of the provided
+// fields.
+func openTable(fname string, m Mapping, fields []string, required map[string]bool) (*tableSource, error) {
+	switch ext := strings.ToLower(filepath.Ext(fname)); ext {
+	case ".csv":
+		return openCSV(fname, m, fields, required)
+	case ".xlsx":
+		return openXLSX(fname, m, fields, required)
+	default:
+		return nil, fmt.Errorf("unknown format for spreadsheet %q", fname)
+	}
+}
+
+func openCSV(fname string, m Mapping, fields []string, required map[string]bool) (*tableSource, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not open CSV file: %w", err)
+	}
+
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	if m.Comma != "" {
+		cr.Comma = []rune(m.Comma)[0]
+	}
+
+	src, err := newTable(m, fields, required, cr.Read, f.Close)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read CSV file %q: %w", fname, err)
+	}
+	return src, nil
+}
+
+func openXLSX(fname string, m Mapping, fields []string, required map[string]bool) (*tableSource, error) {
+	rows, err := readXLSX(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not read XLSX file %q: %w", fname, err)
+	}
+
+	next := func() ([]string, error) {
+		if len(rows) == 0 {
+			return nil, io.EOF
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, nil
+	}
+
+	src, err := newTable(m, fields, required, next, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not read XLSX file %q: %w", fname, err)
+	}
+	return src, nil
+}
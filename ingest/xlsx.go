@@ -0,0 +1,199 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ingest // import "github.com/sbinet-lpc/eco/ingest"
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Minimal reader of Office Open XML spreadsheets: only the values of the
+// cells of the first sheet are read, formatting and formulas are ignored.
+
+type xlsxText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"` // rich text runs
+}
+
+func (txt xlsxText) String() string {
+	if len(txt.R) == 0 {
+		return txt.T
+	}
+	var o strings.Builder
+	for _, r := range txt.R {
+		o.WriteString(r.T)
+	}
+	return o.String()
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRels struct {
+	Rels []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX returns the rows of the first sheet of a spreadsheet.
+func readXLSX(fname string) ([][]string, error) {
+	z, err := zip.OpenReader(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not open spreadsheet: %w", err)
+	}
+	defer z.Close()
+
+	files := make(map[string]*zip.File, len(z.File))
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+
+	var sst xlsxStrings
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		err = xlsxDecode(f, &sst)
+		if err != nil {
+			return nil, fmt.Errorf("could not read shared strings: %w", err)
+		}
+	}
+
+	name, err := xlsxFirstSheet(files)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("could not find sheet %q", name)
+	}
+
+	var sheet xlsxSheet
+	err = xlsxDecode(f, &sheet)
+	if err != nil {
+		return nil, fmt.Errorf("could not read sheet %q: %w", name, err)
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	for _, r := range sheet.Rows {
+		var row []string
+		for i, c := range r.Cells {
+			col := i
+			if c.Ref != "" {
+				col, err = xlsxColumn(c.Ref)
+				if err != nil {
+					return nil, err
+				}
+			}
+			var v string
+			switch c.Type {
+			case "s":
+				j, err := strconv.Atoi(strings.TrimSpace(c.Value))
+				if err != nil || j < 0 || j >= len(sst.Items) {
+					return nil, fmt.Errorf("invalid shared string index %q in cell %q", c.Value, c.Ref)
+				}
+				v = sst.Items[j].String()
+			case "inlineStr":
+				v = c.Inline.String()
+			default:
+				v = c.Value
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+			row[col] = v
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// xlsxFirstSheet returns the name of the file holding the first sheet of a
+// workbook.
+func xlsxFirstSheet(files map[string]*zip.File) (string, error) {
+	const def = "xl/worksheets/sheet1.xml"
+
+	wf, ok := files["xl/workbook.xml"]
+	if !ok {
+		return def, nil
+	}
+	var wb xlsxWorkbook
+	err := xlsxDecode(wf, &wb)
+	if err != nil {
+		return "", fmt.Errorf("could not read workbook: %w", err)
+	}
+	if len(wb.Sheets) == 0 {
+		return "", fmt.Errorf("no sheet in workbook")
+	}
+
+	rf, ok := files["xl/_rels/workbook.xml.rels"]
+	if !ok {
+		return def, nil
+	}
+	var rels xlsxRels
+	err = xlsxDecode(rf, &rels)
+	if err != nil {
+		return "", fmt.Errorf("could not read workbook relationships: %w", err)
+	}
+	for _, rel := range rels.Rels {
+		if rel.ID != wb.Sheets[0].RID {
+			continue
+		}
+		if strings.HasPrefix(rel.Target, "/") {
+			return strings.TrimPrefix(rel.Target, "/"), nil
+		}
+		return path.Join("xl", rel.Target), nil
+	}
+	return def, nil
+}
+
+func xlsxDecode(f *zip.File, ptr interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return xml.NewDecoder(r).Decode(ptr)
+}
+
+// xlsxColumn returns the 0-based column index of a cell reference (e.g. "AB12").
+func xlsxColumn(ref string) (int, error) {
+	col := 0
+	n := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		col = col*26 + int(c-'A'+1)
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	return col - 1, nil
+}
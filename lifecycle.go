@@ -0,0 +1,134 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eco // import "github.com/sbinet-lpc/eco"
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Status is the lifecycle status of a mission in its source database.
+type Status byte
+
+// List of mission statuses.
+const (
+	Registered Status = iota // mission registered in the source database
+	Modified                 // mission modified after its registration
+	Cancelled                // mission removed from the source database
+	Rejected                 // mission rejected by its manager or funder
+)
+
+func (st Status) String() string {
+	switch st {
+	case Registered:
+		return "registered"
+	case Modified:
+		return "modified"
+	case Cancelled:
+		return "cancelled"
+	case Rejected:
+		return "rejected"
+	}
+	return fmt.Sprintf("Status(%d)", int(st))
+}
+
+// ParseStatus returns the status corresponding to the provided name.
+func ParseStatus(name string) (Status, error) {
+	for _, st := range []Status{Registered, Modified, Cancelled, Rejected} {
+		if st.String() == name {
+			return st, nil
+		}
+	}
+	return Registered, fmt.Errorf("eco: unknown mission status %q", name)
+}
+
+// Active returns whether missions with that status are part of the stats.
+func (st Status) Active() bool {
+	return st == Registered || st == Modified
+}
+
+func (st Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(st.String())
+}
+
+func (st *Status) UnmarshalJSON(p []byte) error {
+	var name string
+	err := json.Unmarshal(p, &name)
+	if err != nil {
+		return fmt.Errorf("eco: could not unmarshal mission status: %w", err)
+	}
+	*st, err = ParseStatus(name)
+	return err
+}
+
+// Revision is a change of a mission in its source database.
+//
+// Registered and modified revisions carry the new content of the mission,
+// or no content to only record the hash of an already stored mission.
+// Cancelled and rejected revisions remove the mission from the stats.
+type Revision struct {
+	ID      int32    `json:"id"`
+	Status  Status   `json:"status"`
+	Hash    string   `json:"hash"` // hash of the mission content in the source database
+	Mission *Mission `json:"mission,omitempty"`
+}
+
+// Batch is a batch of revisions uploaded to eco-srv.
+//
+// Batches are identified by an ID generated by the client: a batch is
+// applied at most once, uploading it again returns the result of its first
+// upload.
+type Batch struct {
+	ID        string     `json:"id"`
+	Revisions []Revision `json:"revisions"`
+}
+
+// BatchResult is the result of the upload of a batch of revisions.
+type BatchResult struct {
+	ID       string      `json:"id"`
+	Date     time.Time   `json:"date"`     // date of the application of the batch
+	Replayed bool        `json:"replayed"` // whether the batch was already applied
+	Accepted []int32     `json:"accepted"` // IDs of the applied revisions
+	Rejected []Rejection `json:"rejected"`
+}
+
+// Rejection is a revision rejected by eco-srv.
+type Rejection struct {
+	ID     int32        `json:"id"`
+	Reason string       `json:"reason"`
+	Fields []FieldError `json:"fields,omitempty"` // invalid fields of the mission, if any
+}
+
+// Lifecycle is the lifecycle of a mission.
+type Lifecycle struct {
+	ID      int32        `json:"id"`
+	Status  Status       `json:"status"`
+	Hash    string       `json:"hash"` // hash of the mission content in the source database
+	Date    time.Time    `json:"date"` // date of the last status transition
+	Mission *Mission     `json:"mission,omitempty"`
+	History []Transition `json:"history"`
+
+	// Corrections made in eco-srv, which take precedence over the
+	// source database.
+	Corrected []string `json:"corrected,omitempty"` // corrected fields of the mission
+	Deleted   bool     `json:"deleted,omitempty"`   // whether the mission was deleted
+}
+
+// Transition is a status transition of a mission.
+type Transition struct {
+	Date time.Time `json:"date"`
+	From Status    `json:"from"`
+	To   Status    `json:"to"`
+}
+
+// Avoided returns whether the mission was cancelled or rejected while it
+// was still planned, i.e. whether its emissions were avoided.
+func (lc Lifecycle) Avoided() bool {
+	if lc.Status.Active() || lc.Mission == nil {
+		return false
+	}
+	return lc.Mission.Planned(lc.Date)
+}
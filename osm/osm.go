@@ -34,6 +34,9 @@ type Place struct {
 // Address gives (optional) additional informations about a Place.
 type Address struct {
 	City          string `json:"city"`
+	Town          string `json:"town"`
+	Village       string `json:"village"`
+	Municipality  string `json:"municipality"`
 	StateDistrict string `json:"state_district"`
 	State         string `json:"state"`
 	Postcode      string `json:"postcode"`
@@ -41,6 +44,17 @@ type Address struct {
 	CountryCode   string `json:"country_code"`
 }
 
+// Locality returns the city, town, village or municipality of the address,
+// whichever is the most precise.
+func (addr Address) Locality() string {
+	for _, v := range []string{addr.City, addr.Town, addr.Village, addr.Municipality} {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 // Search queries the OpenStreetMap Nominatim service for a given place, using
 // the default client.
 func Search(query string) ([]Place, error) {
@@ -105,7 +119,7 @@ func (c *Client) Search(query string) ([]Place, error) {
 	var places []Place
 	err = json.NewDecoder(resp.Body).Decode(&places)
 	if err != nil {
-		return nil, fmt.Errorf("could not decode JSON reply from %q: %w", req, err)
+		return nil, fmt.Errorf("could not decode JSON reply from %q: %w", req.URL, err)
 	}
 
 	return places, nil
@@ -0,0 +1,75 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eco // import "github.com/sbinet-lpc/eco"
+
+import "strings"
+
+// List of continents.
+const (
+	Africa       = "Africa"
+	Antarctica   = "Antarctica"
+	Asia         = "Asia"
+	Europe       = "Europe"
+	NorthAmerica = "North America"
+	Oceania      = "Oceania"
+	SouthAmerica = "South America"
+)
+
+// continents maps ISO 3166-1 alpha-2 country codes to continents.
+var continents = func() map[string]string {
+	db := make(map[string]string)
+	for continent, codes := range map[string]string{
+		Africa: "AO BF BI BJ BW CD CF CG CI CM CV DJ DZ EG EH ER ET GA GH GM GN GQ GW " +
+			"KE KM LR LS LY MA MG ML MR MU MW MZ NA NE NG RE RW SC SD SH SL SN SO SS " +
+			"ST SZ TD TG TN TZ UG YT ZA ZM ZW",
+		Antarctica: "AQ BV GS HM TF",
+		Asia: "AE AF AM AZ BD BH BN BT CC CN CX CY GE HK ID IL IN IO IQ IR JO JP KG " +
+			"KH KP KR KW KZ LA LB LK MM MN MO MV MY NP OM PH PK PS QA SA SG SY TH TJ " +
+			"TL TM TR TW UZ VN YE",
+		Europe: "AD AL AT AX BA BE BG BY CH CZ DE DK EE ES FI FO FR GB GG GI GR HR HU " +
+			"IE IM IS IT JE LI LT LU LV MC MD ME MK MT NL NO PL PT RO RS RU SE SI SJ " +
+			"SK SM UA VA XK",
+		NorthAmerica: "AG AI AW BB BL BM BQ BS BZ CA CR CU CW DM DO GD GL GP GT HN HT JM " +
+			"KN KY LC MF MQ MS MX NI PA PM PR SV SX TC TT US VC VG VI",
+		Oceania: "AS AU CK FJ FM GU KI MH MP NC NF NR NU NZ PF PG PN PW SB TK TO TV " +
+			"UM VU WF WS",
+		SouthAmerica: "AR BO BR CL CO EC FK GF GY PE PY SR UY VE",
+	} {
+		for _, code := range strings.Fields(codes) {
+			db[code] = continent
+		}
+	}
+	return db
+}()
+
+// ContinentOf returns the continent of the country with the provided
+// ISO 3166-1 alpha-2 code, or an empty string if the code is unknown.
+func ContinentOf(code string) string {
+	return continents[strings.ToUpper(code)]
+}
+
+// Place returns the city, country and continent of a location.
+//
+// The country is the ISO 3166-1 alpha-2 code of the structured address
+// of the location.
+// For locations without a structured address, the city and country are
+// derived from the first and last components of the location name and
+// the continent is empty.
+func (loc Location) Place() (city, country, continent string) {
+	if code := loc.Addr.CountryCode; code != "" {
+		country = strings.ToUpper(code)
+		city = loc.Addr.City
+		if city == "" {
+			city = strings.TrimSpace(strings.Split(loc.Name, ",")[0])
+		}
+		return city, country, ContinentOf(country)
+	}
+
+	toks := strings.Split(loc.Name, ",")
+	for i, tok := range toks {
+		toks[i] = strings.TrimSpace(tok)
+	}
+	return toks[0], toks[len(toks)-1], ""
+}
@@ -5,41 +5,52 @@
 package eco // import "github.com/sbinet-lpc/eco"
 
 import (
-	"strings"
+	"math/rand"
 	"time"
 )
 
+// Summary aggregates missions as of a reference time.
+//
+// Missions that are over at the reference time are executed missions,
+// the others (including missions in progress) are planned missions.
 type Summary struct {
-	Start     time.Time      `json:"start"`
-	Stop      time.Time      `json:"stop"`
-	Countries map[string]int `json:"countries"`
-	Cities    map[string]int `json:"cities"`
-	All       Stats          `json:"all_missions"`
-	Planned   Stats          `json:"planned_missions"`
-	Executed  Stats          `json:"executed_missions"`
+	Now        time.Time        `json:"now"`        // reference time of the summary
+	Start      time.Time        `json:"start"`      // outbound date of the first executed mission
+	Stop       time.Time        `json:"stop"`       // outbound date of the last executed mission
+	Countries  map[string]Tally `json:"countries"`  // per ISO 3166-1 alpha-2 country code
+	Continents map[string]Tally `json:"continents"` // per continent
+	Cities     map[string]Tally `json:"cities"`     // per "city, country"
+	All        Stats            `json:"all_missions"`
+	Planned    Stats            `json:"planned_missions"`
+	Executed   Stats            `json:"executed_missions"`
+	Avoided    Stats            `json:"avoided_missions"` // planned missions later cancelled or rejected
 }
 
-func NewSummary() *Summary {
+// NewSummary returns a new summary of missions as of the provided
+// reference time.
+func NewSummary(now time.Time) *Summary {
 	return &Summary{
-		Countries: make(map[string]int),
-		Cities:    make(map[string]int),
-		All:       NewStats(),
-		Planned:   NewStats(),
-		Executed:  NewStats(),
+		Now:        now.UTC(),
+		Countries:  make(map[string]Tally),
+		Continents: make(map[string]Tally),
+		Cities:     make(map[string]Tally),
+		All:        NewStats(),
+		Planned:    NewStats(),
+		Executed:   NewStats(),
+		Avoided:    NewStats(),
 	}
 }
 
 func (summ *Summary) Add(m Mission) {
-	now := time.Now().UTC()
-	if now.After(m.Date) && (summ.Start.After(m.Date) || summ.Start.IsZero()) {
+	planned := m.Planned(summ.Now)
+	if !planned && (summ.Start.After(m.Date) || summ.Start.IsZero()) {
 		summ.Start = m.Date
 	}
-	if now.After(m.Date) && (summ.Stop.Before(m.Date) || summ.Stop.IsZero()) {
+	if !planned && (summ.Stop.Before(m.Date) || summ.Stop.IsZero()) {
 		summ.Stop = m.Date
 	}
 
 	summ.All.Add(m)
-	planned := now.Before(m.Date)
 	switch {
 	case planned:
 		summ.Planned.Add(m)
@@ -47,24 +58,46 @@ func (summ *Summary) Add(m Mission) {
 		summ.Executed.Add(m)
 	}
 
-	toks := strings.Split(m.Dest.Name, ",")
-	for i, tok := range toks {
-		toks[i] = strings.TrimSpace(tok)
+	city, country, continent := m.Dest.Place()
+	summ.Cities[city+", "+country] = summ.Cities[city+", "+country].add(m)
+	summ.Countries[country] = summ.Countries[country].add(m)
+	if continent != "" {
+		summ.Continents[continent] = summ.Continents[continent].add(m)
 	}
-	summ.Cities[toks[0]]++
-	summ.Countries[toks[len(toks)-1]]++
+}
+
+// Avoid adds a planned mission that was later cancelled or rejected.
+// Avoided missions are not part of the other aggregates.
+func (summ *Summary) Avoid(m Mission) {
+	summ.Avoided.Add(m)
+}
+
+// Tally aggregates the missions to a given place.
+type Tally struct {
+	N    int     `json:"missions"`
+	Dist float64 `json:"dist"` // in kilometers
+	CO2e float64 `json:"co2e"` // in kgCO2e
+}
+
+func (t Tally) add(m Mission) Tally {
+	t.N++
+	t.Dist += m.Dist / 1000
+	t.CO2e += CostOf(m.Trans, m.Dist)
+	return t
 }
 
 type Stats struct {
 	N        int               `json:"missions"`
 	TransIDs map[TransID]int   `json:"trans_ids"`
 	Dists    map[TransID]int64 `json:"dists"`
+	CO2e     Emissions         `json:"co2e"`
 }
 
 func NewStats() Stats {
 	return Stats{
 		TransIDs: make(map[TransID]int),
 		Dists:    make(map[TransID]int64),
+		CO2e:     EmissionsOf(nil),
 	}
 }
 
@@ -72,4 +105,25 @@ func (stats *Stats) Add(m Mission) {
 	stats.N++
 	stats.TransIDs[m.Trans]++
 	stats.Dists[m.Trans] += int64(m.Dist) / 1000 // to kilometers
+	stats.CO2e = stats.Emissions()
+}
+
+// Emissions returns the CO2e emissions of the missions, with their
+// uncertainties propagated analytically.
+func (stats Stats) Emissions() Emissions {
+	return EmissionsOf(stats.meters())
+}
+
+// Simulate returns the CO2e emissions of the missions, with their
+// uncertainties propagated with n Monte Carlo samples drawn from rnd.
+func (stats Stats) Simulate(n int, rnd *rand.Rand) Emissions {
+	return SimulateEmissions(stats.meters(), n, rnd)
+}
+
+func (stats Stats) meters() map[TransID]float64 {
+	o := make(map[TransID]float64, len(stats.Dists))
+	for tid, km := range stats.Dists {
+		o[tid] = float64(km) * 1000
+	}
+	return o
 }
@@ -0,0 +1,394 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store // import "github.com/sbinet-lpc/eco/store"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"go.etcd.io/bbolt"
+)
+
+// Materialised aggregates of the eco bucket.
+//
+// Missions are aggregated per outbound date, inbound date and transport
+// mode, so the planned/executed classification can still be performed at
+// query time, for any reference time.
+// Missions are also aggregated per outbound date, inbound date, transport
+// mode, distance (in kilometers) and group, so forecasts, plots and
+// budgets can be computed without scanning the eco bucket.
+// Destinations are aggregated per city, per country and per continent.
+//
+// Aggregates are updated in the same transaction as the missions, and
+// each modification of the eco bucket bumps the dataset version, which
+// is used by eco-srv to derive ETags and to invalidate cached responses.
+var (
+	BucketAggr = []byte("aggregates")
+
+	keyVersion = []byte("version")
+	keyLayout  = []byte("layout")
+
+	prefixTrip      = []byte("d/")
+	prefixGroup     = []byte("g/")
+	prefixCity      = []byte("c/")
+	prefixCountry   = []byte("k/")
+	prefixContinent = []byte("n/")
+)
+
+const timefmt = "20060102T150405"
+
+// aggrLayout is the current version of the layout of the aggregates.
+// Aggregates with another layout are rebuilt from the eco bucket.
+const aggrLayout = 3
+
+// Counter aggregates a set of missions.
+type Counter struct {
+	N    int64   // number of missions
+	Km   int64   // sum of truncated distances, in kilometers
+	Dist float64 // sum of distances, in meters
+	CO2e float64 // sum of CO2e emissions, in kgCO2e
+}
+
+func (c Counter) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 32)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(c.N))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(c.Km))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(c.Dist))
+	binary.LittleEndian.PutUint64(buf[24:], math.Float64bits(c.CO2e))
+	return buf, nil
+}
+
+func (c *Counter) UnmarshalBinary(buf []byte) error {
+	if len(buf) != 32 {
+		return fmt.Errorf("invalid counter size %d", len(buf))
+	}
+	c.N = int64(binary.LittleEndian.Uint64(buf[0:]))
+	c.Km = int64(binary.LittleEndian.Uint64(buf[8:]))
+	c.Dist = math.Float64frombits(binary.LittleEndian.Uint64(buf[16:]))
+	c.CO2e = math.Float64frombits(binary.LittleEndian.Uint64(buf[24:]))
+	return nil
+}
+
+// tripKey returns the key of the aggregate of the missions with the
+// provided outbound date, end date and transport mode.
+func tripKey(date, end time.Time, tid eco.TransID) []byte {
+	key := make([]byte, 0, len(prefixTrip)+2*len(timefmt)+3)
+	key = append(key, prefixTrip...)
+	key = append(key, date.UTC().Format(timefmt)...)
+	key = append(key, '/')
+	key = append(key, end.UTC().Format(timefmt)...)
+	key = append(key, '/', byte(tid))
+	return key
+}
+
+func parseTripKey(key []byte) (date, end time.Time, tid eco.TransID, err error) {
+	key = key[len(prefixTrip):]
+	if len(key) != 2*len(timefmt)+3 {
+		return date, end, tid, fmt.Errorf("invalid aggregate key %q", key)
+	}
+	date, err = time.Parse(timefmt, string(key[:len(timefmt)]))
+	if err != nil {
+		return date, end, tid, fmt.Errorf("invalid aggregate key %q: %w", key, err)
+	}
+	end, err = time.Parse(timefmt, string(key[len(timefmt)+1:2*len(timefmt)+1]))
+	if err != nil {
+		return date, end, tid, fmt.Errorf("invalid aggregate key %q: %w", key, err)
+	}
+	return date, end, eco.TransID(key[len(key)-1]), nil
+}
+
+// groupKey returns the key of the aggregate of the missions with the
+// provided outbound date, end date, transport mode, distance and group.
+func groupKey(date, end time.Time, tid eco.TransID, km int64, group string) []byte {
+	key := make([]byte, 0, len(prefixGroup)+2*len(timefmt)+14+len(group))
+	key = append(key, prefixGroup...)
+	key = append(key, tripKey(date, end, tid)[len(prefixTrip):]...)
+	key = append(key, fmt.Sprintf("/%08d/", km)...)
+	key = append(key, group...)
+	return key
+}
+
+func parseGroupKey(key []byte) (date, end time.Time, tid eco.TransID, group string, err error) {
+	const n = 2*len(timefmt) + 3
+	key = key[len(prefixGroup):]
+	if len(key) < n+10 || key[n] != '/' || key[n+9] != '/' {
+		return date, end, tid, group, fmt.Errorf("invalid aggregate key %q", key)
+	}
+	date, end, tid, err = parseTripKey(append(append([]byte(nil), prefixTrip...), key[:n]...))
+	if err != nil {
+		return date, end, tid, group, err
+	}
+	return date, end, tid, string(key[n+10:]), nil
+}
+
+// aggregate adds (sign=+1) or removes (sign=-1) a mission from the aggregates.
+func aggregate(tx *bbolt.Tx, m eco.Mission, sign int64) error {
+	bkt := tx.Bucket(BucketAggr)
+	if bkt == nil {
+		return fmt.Errorf("could not find %q bucket", BucketAggr)
+	}
+
+	var (
+		one  = Counter{N: 1, Km: int64(m.Dist) / 1000, Dist: m.Dist, CO2e: eco.CostOf(m.Trans, m.Dist)}
+		keys = [][]byte{
+			tripKey(m.Date, m.End(), m.Trans),
+			groupKey(m.Date, m.End(), m.Trans, one.Km, m.Group),
+		}
+		key = func(prefix []byte, name string) []byte {
+			return append(append([]byte(nil), prefix...), name...)
+		}
+	)
+
+	city, country, continent := m.Dest.Place()
+	keys = append(keys,
+		key(prefixCity, city+", "+country),
+		key(prefixCountry, country),
+	)
+	if continent != "" {
+		keys = append(keys, key(prefixContinent, continent))
+	}
+
+	for _, k := range keys {
+		var cnt Counter
+		if raw := bkt.Get(k); raw != nil {
+			err := cnt.UnmarshalBinary(raw)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal aggregate %q: %w", k, err)
+			}
+		}
+		cnt.N += sign * one.N
+		cnt.Km += sign * one.Km
+		cnt.Dist += float64(sign) * one.Dist
+		cnt.CO2e += float64(sign) * one.CO2e
+
+		if cnt.N <= 0 {
+			err := bkt.Delete(k)
+			if err != nil {
+				return fmt.Errorf("could not delete aggregate %q: %w", k, err)
+			}
+			continue
+		}
+
+		raw, _ := cnt.MarshalBinary()
+		err := bkt.Put(k, raw)
+		if err != nil {
+			return fmt.Errorf("could not store aggregate %q: %w", k, err)
+		}
+	}
+
+	return BumpVersion(tx)
+}
+
+// RebuildAggregates recomputes all the aggregates from the eco bucket.
+func RebuildAggregates(tx *bbolt.Tx) error {
+	if tx.Bucket(BucketAggr) != nil {
+		err := tx.DeleteBucket(BucketAggr)
+		if err != nil {
+			return fmt.Errorf("could not delete %q bucket: %w", BucketAggr, err)
+		}
+	}
+	bkt, err := tx.CreateBucket(BucketAggr)
+	if err != nil {
+		return fmt.Errorf("could not create %q bucket: %w", BucketAggr, err)
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, aggrLayout)
+	err = bkt.Put(keyLayout, buf)
+	if err != nil {
+		return fmt.Errorf("could not store aggregates layout: %w", err)
+	}
+
+	return tx.Bucket(BucketEco).ForEach(func(k, v []byte) error {
+		var m eco.Mission
+		err := m.UnmarshalBinary(v)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal mission: %w", err)
+		}
+		return aggregate(tx, m, +1)
+	})
+}
+
+// Stale returns whether the aggregates are missing or have an outdated layout.
+func Stale(tx *bbolt.Tx) bool {
+	bkt := tx.Bucket(BucketAggr)
+	if bkt == nil {
+		return true
+	}
+	raw := bkt.Get(keyLayout)
+	return len(raw) != 8 || binary.LittleEndian.Uint64(raw) != aggrLayout
+}
+
+// BumpVersion increments the version of the dataset.
+func BumpVersion(tx *bbolt.Tx) error {
+	bkt := tx.Bucket(BucketUpdate)
+	if bkt == nil {
+		return fmt.Errorf("could not find %q bucket", BucketUpdate)
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, Version(tx)+1)
+	return bkt.Put(keyVersion, buf)
+}
+
+// Version returns the version of the dataset.
+func Version(tx *bbolt.Tx) uint64 {
+	raw := tx.Bucket(BucketUpdate).Get(keyVersion)
+	if len(raw) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(raw)
+}
+
+// Summary builds the summary of all the missions as they stood at the
+// provided reference time.
+//
+// The summary is built from the aggregates, unless the eco db was modified
+// after the reference time: it is then built from the history of the
+// missions.
+func Summary(tx *bbolt.Tx, now time.Time) (*eco.Summary, error) {
+	bkt := tx.Bucket(BucketAggr)
+	if bkt == nil {
+		return nil, fmt.Errorf("could not find %q bucket", BucketAggr)
+	}
+
+	past, err := changed(tx, now)
+	if err != nil {
+		return nil, err
+	}
+	if past {
+		return history(tx, now)
+	}
+
+	var (
+		summ = eco.NewSummary(now)
+		add  = func(st *eco.Stats, tid eco.TransID, cnt Counter) {
+			st.N += int(cnt.N)
+			st.TransIDs[tid] += int(cnt.N)
+			st.Dists[tid] += cnt.Km
+		}
+	)
+
+	err = Trips(tx, func(date, end time.Time, tid eco.TransID, cnt Counter) error {
+		planned := now.Before(end)
+		if !planned && (summ.Start.After(date) || summ.Start.IsZero()) {
+			summ.Start = date
+		}
+		if !planned && (summ.Stop.Before(date) || summ.Stop.IsZero()) {
+			summ.Stop = date
+		}
+
+		add(&summ.All, tid, cnt)
+		switch {
+		case planned:
+			add(&summ.Planned, tid, cnt)
+		default:
+			add(&summ.Executed, tid, cnt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = avoided(tx, summ)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range []*eco.Stats{&summ.All, &summ.Planned, &summ.Executed, &summ.Avoided} {
+		st.CO2e = st.Emissions()
+	}
+
+	for _, v := range []struct {
+		prefix []byte
+		dst    map[string]eco.Tally
+	}{
+		{prefixCity, summ.Cities},
+		{prefixCountry, summ.Countries},
+		{prefixContinent, summ.Continents},
+	} {
+		c := bkt.Cursor()
+		for k, raw := c.Seek(v.prefix); k != nil && bytes.HasPrefix(k, v.prefix); k, raw = c.Next() {
+			var cnt Counter
+			err := cnt.UnmarshalBinary(raw)
+			if err != nil {
+				return nil, fmt.Errorf("could not unmarshal aggregate %q: %w", k, err)
+			}
+			v.dst[string(k[len(v.prefix):])] = eco.Tally{
+				N:    int(cnt.N),
+				Dist: cnt.Dist / 1000,
+				CO2e: cnt.CO2e,
+			}
+		}
+	}
+
+	return summ, nil
+}
+
+// Trips iterates over the per-trip aggregates, in chronological order of
+// their outbound dates.
+func Trips(tx *bbolt.Tx, f func(date, end time.Time, tid eco.TransID, cnt Counter) error) error {
+	bkt := tx.Bucket(BucketAggr)
+	if bkt == nil {
+		return fmt.Errorf("could not find %q bucket", BucketAggr)
+	}
+
+	c := bkt.Cursor()
+	for k, raw := c.Seek(prefixTrip); k != nil && bytes.HasPrefix(k, prefixTrip); k, raw = c.Next() {
+		date, end, tid, err := parseTripKey(k)
+		if err != nil {
+			return err
+		}
+		var cnt Counter
+		err = cnt.UnmarshalBinary(raw)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal aggregate %q: %w", k, err)
+		}
+		err = f(date, end, tid, cnt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TripMissions returns the missions of the dataset, as reconstructed from
+// the per-group aggregates: only their dates, transport mode, distance and
+// group are set.
+// Missions sharing the same aggregate are given its average distance.
+func TripMissions(tx *bbolt.Tx) ([]eco.Mission, error) {
+	bkt := tx.Bucket(BucketAggr)
+	if bkt == nil {
+		return nil, fmt.Errorf("could not find %q bucket", BucketAggr)
+	}
+
+	var (
+		ms = make([]eco.Mission, 0)
+		c  = bkt.Cursor()
+	)
+	for k, raw := c.Seek(prefixGroup); k != nil && bytes.HasPrefix(k, prefixGroup); k, raw = c.Next() {
+		date, end, tid, group, err := parseGroupKey(k)
+		if err != nil {
+			return nil, err
+		}
+		var cnt Counter
+		err = cnt.UnmarshalBinary(raw)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal aggregate %q: %w", k, err)
+		}
+		m := eco.Mission{
+			Date:    date,
+			Inbound: end,
+			Dist:    cnt.Dist / float64(cnt.N),
+			Trans:   tid,
+			Group:   group,
+		}
+		for i := int64(0); i < cnt.N; i++ {
+			ms = append(ms, m)
+		}
+	}
+	return ms, nil
+}
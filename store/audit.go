@@ -0,0 +1,145 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store // import "github.com/sbinet-lpc/eco/store"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"go.etcd.io/bbolt"
+)
+
+// Audit describes a manual modification of a stored mission.
+type Audit struct {
+	ID     int32        `json:"id"`
+	Action string       `json:"action"` // "patch", "delete" or a lifecycle status ("modified", "cancelled", ...)
+	User   string       `json:"user"`
+	Date   time.Time    `json:"date"`
+	Reason string       `json:"reason"`
+	Prev   *eco.Mission `json:"prev,omitempty"`
+	Next   *eco.Mission `json:"next,omitempty"`
+}
+
+// Correction is the manual correction applied to a mission.
+//
+// Corrections are re-applied each time a mission with the same ID is
+// (re-)uploaded to the eco db.
+type Correction struct {
+	Patch   map[string]interface{} `json:"patch,omitempty"`
+	Deleted bool                   `json:"deleted,omitempty"`
+}
+
+// Apply applies the patch of the correction to a mission.
+func (c Correction) Apply(m eco.Mission) (eco.Mission, error) {
+	if len(c.Patch) == 0 {
+		return m, nil
+	}
+	raw, err := json.Marshal(c.Patch)
+	if err != nil {
+		return m, fmt.Errorf("could not marshal patch: %w", err)
+	}
+	id := m.ID
+	err = json.Unmarshal(raw, &m)
+	if err != nil {
+		return m, fmt.Errorf("could not apply patch: %w", err)
+	}
+	m.ID = id
+	return m, nil
+}
+
+// Corrected applies the stored correction of a mission, if any, and
+// validates the corrected mission.
+// It returns false if the mission was deleted by a correction.
+func Corrected(tx *bbolt.Tx, m eco.Mission) (eco.Mission, bool, error) {
+	c, _, err := LoadCorrection(tx, m.ID)
+	if err != nil {
+		return m, false, err
+	}
+	if c.Deleted {
+		return m, false, nil
+	}
+	m, err = c.Apply(m)
+	if err != nil {
+		return m, false, fmt.Errorf("could not apply correction to mission %d: %w", m.ID, err)
+	}
+	return m, true, m.Validate()
+}
+
+func LoadCorrection(tx *bbolt.Tx, id int32) (Correction, bool, error) {
+	var c Correction
+	bkt := tx.Bucket(BucketCorrections)
+	if bkt == nil {
+		return c, false, fmt.Errorf("could not find %q bucket", BucketCorrections)
+	}
+	raw := bkt.Get(MissionKey(id))
+	if raw == nil {
+		return c, false, nil
+	}
+	err := json.Unmarshal(raw, &c)
+	if err != nil {
+		return c, false, fmt.Errorf("could not unmarshal correction for mission %d: %w", id, err)
+	}
+	return c, true, nil
+}
+
+func SaveCorrection(tx *bbolt.Tx, id int32, c Correction) error {
+	bkt := tx.Bucket(BucketCorrections)
+	if bkt == nil {
+		return fmt.Errorf("could not find %q bucket", BucketCorrections)
+	}
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("could not marshal correction for mission %d: %w", id, err)
+	}
+	return bkt.Put(MissionKey(id), raw)
+}
+
+// AddAudit appends an entry to the audit trail.
+// Entries are keyed by mission ID and sequence number so all entries
+// for a given mission are contiguous and chronologically ordered.
+func AddAudit(tx *bbolt.Tx, a Audit) error {
+	bkt := tx.Bucket(BucketAudit)
+	if bkt == nil {
+		return fmt.Errorf("could not find %q bucket", BucketAudit)
+	}
+	seq, err := bkt.NextSequence()
+	if err != nil {
+		return fmt.Errorf("could not generate audit sequence: %w", err)
+	}
+	key := make([]byte, 4+8)
+	copy(key, MissionKey(a.ID))
+	binary.BigEndian.PutUint64(key[4:], seq)
+
+	raw, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("could not marshal audit entry: %w", err)
+	}
+	return bkt.Put(key, raw)
+}
+
+// LoadAudit returns the audit trail of a mission.
+func LoadAudit(tx *bbolt.Tx, id int32) ([]Audit, error) {
+	bkt := tx.Bucket(BucketAudit)
+	if bkt == nil {
+		return nil, fmt.Errorf("could not find %q bucket", BucketAudit)
+	}
+	var (
+		as     = make([]Audit, 0)
+		prefix = MissionKey(id)
+		c      = bkt.Cursor()
+	)
+	for k, v := c.Seek(prefix); k != nil && string(k[:4]) == string(prefix); k, v = c.Next() {
+		var a Audit
+		err := json.Unmarshal(v, &a)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal audit entry: %w", err)
+		}
+		as = append(as, a)
+	}
+	return as, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store // import "github.com/sbinet-lpc/eco/store"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"go.etcd.io/bbolt"
+)
+
+// History of the eco bucket.
+//
+// The aggregates only describe the missions as they stand now. The
+// missions as they stood at a past time are reconstructed from their
+// lifecycle, whose transitions date their registration, cancellation and
+// restoration, and from their audit trail, whose entries keep their
+// content before each modification.
+//
+// Missions stored before their lifecycle was recorded have no known
+// registration date: they are assumed to be registered at the latest at
+// their outbound date, and before the first recorded change of the eco db.
+
+// changed returns whether the eco db was modified after the provided time.
+func changed(tx *bbolt.Tx, since time.Time) (bool, error) {
+	last, ok, err := LastUpdate(tx)
+	if err != nil {
+		return false, err
+	}
+	if ok && last.After(since) {
+		return true, nil
+	}
+
+	lcs, err := lifecycles(tx)
+	if err != nil {
+		return false, err
+	}
+	for _, lc := range lcs {
+		if lc.Date.After(since) {
+			return true, nil
+		}
+	}
+
+	as, err := audits(tx)
+	if err != nil {
+		return false, err
+	}
+	for _, trail := range as {
+		if n := len(trail); n > 0 && trail[n-1].Date.After(since) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// history builds the summary of the missions as they stood at the
+// reference time, from their lifecycle and audit trail.
+func history(tx *bbolt.Tx, now time.Time) (*eco.Summary, error) {
+	last, hasLast, err := LastUpdate(tx)
+	if err != nil {
+		return nil, err
+	}
+	lcs, err := lifecycles(tx)
+	if err != nil {
+		return nil, err
+	}
+	as, err := audits(tx)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := Missions(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		stored = make(map[int32]*eco.Mission, len(ms))
+		ids    = make([]int32, 0, len(ms))
+		seen   = make(map[int32]bool, len(ms))
+		add    = func(id int32) {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	)
+	for i := range ms {
+		stored[ms[i].ID] = &ms[i]
+		add(ms[i].ID)
+	}
+	for id := range lcs {
+		add(id)
+	}
+	for id := range as {
+		add(id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	summ := eco.NewSummary(now)
+	for _, id := range ids {
+		var (
+			trail = as[id]
+			hist  = lcs[id].History
+			// content returns the content of the mission right before
+			// its first modification matching the provided predicate.
+			content = func(after func(date time.Time) bool) *eco.Mission {
+				for _, a := range trail {
+					if after(a.Date) {
+						return a.Prev
+					}
+				}
+				return stored[id]
+			}
+			i = sort.Search(len(hist), func(i int) bool {
+				return hist[i].Date.After(now)
+			})
+		)
+
+		switch {
+		case i > 0 && !hist[i-1].To.Active():
+			// cancelled or rejected by then.
+			tr := hist[i-1]
+			if !tr.From.Active() {
+				continue
+			}
+			m := content(func(date time.Time) bool { return !date.Before(tr.Date) })
+			if m != nil && m.Planned(tr.Date) {
+				summ.Avoid(*m)
+			}
+			continue
+		case i == 0 && len(hist) > 0 && registration(hist[0], trail):
+			// registered afterwards.
+			continue
+		}
+
+		m := content(func(date time.Time) bool { return date.After(now) })
+		if m == nil {
+			continue
+		}
+		if i == 0 {
+			// unknown registration date.
+			reg := m.Date
+			if len(hist) > 0 && hist[0].Date.Before(reg) {
+				reg = hist[0].Date
+			}
+			if len(trail) > 0 && trail[0].Date.Before(reg) {
+				reg = trail[0].Date
+			}
+			if hasLast && last.Before(reg) {
+				reg = last
+			}
+			if now.Before(reg) {
+				continue
+			}
+		}
+		summ.Add(*m)
+	}
+
+	return summ, nil
+}
+
+// registration returns whether a transition registered a new mission,
+// i.e. a mission that was not stored before: the registration of an
+// already stored mission is recorded in its audit trail.
+func registration(tr eco.Transition, trail []Audit) bool {
+	if tr.From != eco.Registered || !tr.To.Active() {
+		return false
+	}
+	for _, a := range trail {
+		if a.Date.Equal(tr.Date) && a.Prev != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// lifecycles returns the recorded lifecycles, keyed by mission ID.
+func lifecycles(tx *bbolt.Tx) (map[int32]eco.Lifecycle, error) {
+	lcs := make(map[int32]eco.Lifecycle)
+	err := tx.Bucket(BucketLifecycle).ForEach(func(k, v []byte) error {
+		var lc eco.Lifecycle
+		err := json.Unmarshal(v, &lc)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal lifecycle: %w", err)
+		}
+		lcs[int32(binary.LittleEndian.Uint32(k))] = lc
+		return nil
+	})
+	return lcs, err
+}
+
+// audits returns the audit trails, keyed by mission ID.
+func audits(tx *bbolt.Tx) (map[int32][]Audit, error) {
+	as := make(map[int32][]Audit)
+	err := tx.Bucket(BucketAudit).ForEach(func(k, v []byte) error {
+		var a Audit
+		err := json.Unmarshal(v, &a)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal audit entry: %w", err)
+		}
+		id := int32(binary.LittleEndian.Uint32(k[:4]))
+		as[id] = append(as[id], a)
+		return nil
+	})
+	return as, err
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store // import "github.com/sbinet-lpc/eco/store"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"go.etcd.io/bbolt"
+)
+
+// BucketLifecycle stores the lifecycle of missions, keyed by mission ID.
+//
+// Cancelled and rejected missions are removed from the eco bucket: their
+// lifecycle keeps their last content, so their emissions can be reported
+// as avoided emissions.
+var BucketLifecycle = []byte("lifecycle")
+
+func LoadLifecycle(tx *bbolt.Tx, id int32) (eco.Lifecycle, bool, error) {
+	lc := eco.Lifecycle{ID: id, Status: eco.Registered}
+	bkt := tx.Bucket(BucketLifecycle)
+	if bkt == nil {
+		return lc, false, fmt.Errorf("could not find %q bucket", BucketLifecycle)
+	}
+	raw := bkt.Get(MissionKey(id))
+	if raw == nil {
+		return lc, false, nil
+	}
+	err := json.Unmarshal(raw, &lc)
+	if err != nil {
+		return lc, false, fmt.Errorf("could not unmarshal lifecycle of mission %d: %w", id, err)
+	}
+	return lc, true, nil
+}
+
+func SaveLifecycle(tx *bbolt.Tx, lc eco.Lifecycle) error {
+	bkt := tx.Bucket(BucketLifecycle)
+	if bkt == nil {
+		return fmt.Errorf("could not find %q bucket", BucketLifecycle)
+	}
+	raw, err := json.Marshal(lc)
+	if err != nil {
+		return fmt.Errorf("could not marshal lifecycle of mission %d: %w", lc.ID, err)
+	}
+	return bkt.Put(MissionKey(lc.ID), raw)
+}
+
+// Lifecycles returns the lifecycle of all the known missions, sorted by ID.
+//
+// Stored or corrected missions without a recorded lifecycle are registered
+// missions with an unknown hash.
+func Lifecycles(tx *bbolt.Tx) ([]eco.Lifecycle, error) {
+	var (
+		lcs = make([]eco.Lifecycle, 0)
+		ids = make(map[int32]int)
+		get = func(k []byte) *eco.Lifecycle {
+			id := int32(binary.LittleEndian.Uint32(k))
+			i, ok := ids[id]
+			if !ok {
+				i = len(lcs)
+				ids[id] = i
+				lcs = append(lcs, eco.Lifecycle{ID: id, Status: eco.Registered})
+			}
+			return &lcs[i]
+		}
+	)
+	err := tx.Bucket(BucketLifecycle).ForEach(func(k, v []byte) error {
+		lc := get(k)
+		err := json.Unmarshal(v, lc)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal lifecycle: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket(BucketEco).ForEach(func(k, v []byte) error {
+		get(k)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket(BucketCorrections).ForEach(func(k, v []byte) error {
+		var c Correction
+		err := json.Unmarshal(v, &c)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal correction: %w", err)
+		}
+		lc := get(k)
+		lc.Deleted = c.Deleted
+		lc.Corrected = make([]string, 0, len(c.Patch))
+		for name := range c.Patch {
+			lc.Corrected = append(lc.Corrected, name)
+		}
+		sort.Strings(lc.Corrected)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(lcs, func(i, j int) bool {
+		return lcs[i].ID < lcs[j].ID
+	})
+	return lcs, nil
+}
+
+// Check returns why a revision can not be applied, if it can not.
+func Check(tx *bbolt.Tx, rev eco.Revision) error {
+	if rev.ID <= 0 {
+		return fmt.Errorf("invalid mission ID %d", rev.ID)
+	}
+	if rev.Mission != nil && rev.Mission.ID != 0 && rev.Mission.ID != rev.ID {
+		return fmt.Errorf("mission ID %d differs from revision ID %d", rev.Mission.ID, rev.ID)
+	}
+	if rev.Mission != nil {
+		m := *rev.Mission
+		m.ID = rev.ID
+		err := m.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if !rev.Status.Active() || rev.Mission != nil {
+		return nil
+	}
+
+	lc, ok, err := LoadLifecycle(tx, rev.ID)
+	if err != nil {
+		return err
+	}
+	if !ok && tx.Bucket(BucketEco).Get(MissionKey(rev.ID)) == nil {
+		return fmt.Errorf("could not register unknown mission %d without its content", rev.ID)
+	}
+	if !lc.Status.Active() {
+		return fmt.Errorf("could not restore %v mission %d without its content", lc.Status, rev.ID)
+	}
+	return nil
+}
+
+// Revise applies a revision of a mission from its source database.
+func Revise(tx *bbolt.Tx, rev eco.Revision, user string, now time.Time) error {
+	lc, _, err := LoadLifecycle(tx, rev.ID)
+	if err != nil {
+		return err
+	}
+
+	prev, err := LoadMission(tx, rev.ID)
+	if err != nil && !errors.Is(err, ErrNoMission) {
+		return err
+	}
+	stored := err == nil
+
+	var (
+		from = lc.Status
+		next *eco.Mission
+	)
+	switch {
+	case rev.Status.Active() && rev.Mission != nil:
+		m := *rev.Mission
+		m.ID = rev.ID
+		m, ok, err := Corrected(tx, m)
+		if err != nil {
+			return err
+		}
+		if ok {
+			err = SaveMission(tx, m)
+			if err != nil {
+				return err
+			}
+			next = &m
+		}
+		lc.Mission = nil
+
+	case rev.Status.Active():
+		if !from.Active() {
+			return fmt.Errorf("could not restore %v mission %d without its content", from, rev.ID)
+		}
+		if rev.Hash != "" {
+			lc.Hash = rev.Hash
+		}
+		return SaveLifecycle(tx, lc)
+
+	case !from.Active():
+		// already removed from the stats.
+
+	case stored:
+		err = DeleteMission(tx, rev.ID)
+		if err != nil {
+			return err
+		}
+		lc.Mission = &prev
+	}
+
+	if rev.Hash != "" {
+		lc.Hash = rev.Hash
+	}
+	lc.Status = rev.Status
+	lc.Date = now
+	lc.History = append(lc.History, eco.Transition{Date: now, From: from, To: rev.Status})
+
+	err = SaveLifecycle(tx, lc)
+	if err != nil {
+		return err
+	}
+
+	// avoided emissions depend on the lifecycle of missions.
+	err = BumpVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	if !stored && (rev.Status == eco.Registered || next == nil) {
+		// new mission, or mission neither stored before nor after the
+		// revision (e.g. deleted by a correction): nothing to audit.
+		return nil
+	}
+	a := Audit{
+		ID:     rev.ID,
+		Action: rev.Status.String(),
+		User:   user,
+		Date:   now,
+		Reason: "source database",
+		Next:   next,
+	}
+	if stored {
+		a.Prev = &prev
+	}
+	return AddAudit(tx, a)
+}
+
+// Apply checks and applies a list of revisions, in the provided
+// transaction. It returns the IDs of the applied revisions and the
+// rejected ones.
+//
+// Invalid revisions, including revisions whose corrected mission is
+// invalid, are rejected without modifying the db.
+func Apply(tx *bbolt.Tx, revs []eco.Revision, user string, now time.Time) ([]int32, []eco.Rejection, error) {
+	var (
+		accepted = make([]int32, 0, len(revs))
+		rejected = make([]eco.Rejection, 0)
+		reject   = func(rev eco.Revision, err error) {
+			rej := eco.Rejection{ID: rev.ID, Reason: err.Error()}
+			var verr *eco.ValidationError
+			if errors.As(err, &verr) {
+				rej.Fields = verr.Fields
+			}
+			rejected = append(rejected, rej)
+		}
+	)
+	for _, rev := range revs {
+		err := Check(tx, rev)
+		if err != nil {
+			reject(rev, err)
+			continue
+		}
+		err = Revise(tx, rev, user, now)
+		var verr *eco.ValidationError
+		switch {
+		case errors.As(err, &verr):
+			// corrected mission is invalid: nothing was written.
+			reject(rev, err)
+			continue
+		case err != nil:
+			return nil, nil, fmt.Errorf("could not revise mission %d: %w", rev.ID, err)
+		}
+		accepted = append(accepted, rev.ID)
+	}
+	return accepted, rejected, nil
+}
+
+// avoided adds the missions cancelled or rejected while still planned,
+// as of the reference time of the summary, to its avoided missions.
+func avoided(tx *bbolt.Tx, summ *eco.Summary) error {
+	return tx.Bucket(BucketLifecycle).ForEach(func(k, v []byte) error {
+		var lc eco.Lifecycle
+		err := json.Unmarshal(v, &lc)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal lifecycle: %w", err)
+		}
+		if lc.Avoided() && !lc.Date.After(summ.Now) {
+			summ.Avoid(*lc.Mission)
+		}
+		return nil
+	})
+}
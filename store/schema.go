@@ -0,0 +1,257 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store // import "github.com/sbinet-lpc/eco/store"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"go.etcd.io/bbolt"
+)
+
+// keySchema stores the version of the binary layout of the missions
+// stored in the eco bucket.
+var keySchema = []byte("schema")
+
+// legacyDecoders decode missions stored with previous layouts of the eco
+// bucket. legacyDecoders[i] decodes missions stored with version i.
+var legacyDecoders = []func(raw []byte) (eco.Mission, error){
+	unmarshalMissionV0, // v0: no eco.Mission.Group
+	unmarshalMissionV1, // v1: no eco.Location.Addr
+	unmarshalMissionV2, // v2: no eco.Mission.Inbound
+	unmarshalMissionV3, // v3: no eco.Mission.Legs
+	unmarshalMissionV4, // v4: no eco.Mission.TransReason
+}
+
+// schemaVersion is the current version of the eco bucket layout.
+const schemaVersion = eco.BinaryVersion
+
+// Migrate converts the eco bucket to the current schema version.
+func Migrate(tx *bbolt.Tx) error {
+	bkt := tx.Bucket(BucketUpdate)
+	v := uint64(0)
+	if raw := bkt.Get(keySchema); len(raw) == 8 {
+		v = binary.LittleEndian.Uint64(raw)
+	}
+	if v > schemaVersion {
+		return fmt.Errorf("eco db schema version %d is newer than supported version %d", v, schemaVersion)
+	}
+
+	if v < schemaVersion {
+		err := remarshal(tx, legacyDecoders[v])
+		if err != nil {
+			return fmt.Errorf("could not migrate eco db from schema v%d: %w", v, err)
+		}
+
+		// aggregates may depend on the new fields.
+		if tx.Bucket(BucketAggr) != nil {
+			err = RebuildAggregates(tx)
+			if err != nil {
+				return fmt.Errorf("could not rebuild aggregates: %w", err)
+			}
+		}
+	}
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, schemaVersion)
+	return bkt.Put(keySchema, buf)
+}
+
+// remarshal decodes all the missions with the provided legacy decoder
+// and stores them back with the current layout.
+func remarshal(tx *bbolt.Tx, unmarshal func(raw []byte) (eco.Mission, error)) error {
+	bkt := tx.Bucket(BucketEco)
+
+	var ms []eco.Mission
+	err := bkt.ForEach(func(k, v []byte) error {
+		m, err := unmarshal(v)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal legacy mission: %w", err)
+		}
+		ms = append(ms, m)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		buf, err := m.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("could not marshal mission %v: %w", m, err)
+		}
+		err = bkt.Put(MissionKey(m.ID), buf)
+		if err != nil {
+			return fmt.Errorf("could not store mission %v: %w", m, err)
+		}
+	}
+	return nil
+}
+
+// legacy is a decoder for legacy binary layouts.
+type legacy struct {
+	data []byte
+	err  error
+}
+
+func (dec *legacy) next(n int) []byte {
+	if dec.err != nil {
+		return make([]byte, n)
+	}
+	if len(dec.data) < n {
+		dec.err = fmt.Errorf("short buffer (got=%d, want=%d)", len(dec.data), n)
+		return make([]byte, n)
+	}
+	v := dec.data[:n]
+	dec.data = dec.data[n:]
+	return v
+}
+
+func (dec *legacy) u32() uint32  { return binary.LittleEndian.Uint32(dec.next(4)) }
+func (dec *legacy) u64() uint64  { return binary.LittleEndian.Uint64(dec.next(8)) }
+func (dec *legacy) f64() float64 { return math.Float64frombits(dec.u64()) }
+func (dec *legacy) u8() byte     { return dec.next(1)[0] }
+func (dec *legacy) bytes() []byte {
+	n := dec.u64()
+	if dec.err == nil && uint64(len(dec.data)) < n {
+		dec.err = fmt.Errorf("short buffer (got=%d, want=%d)", len(dec.data), n)
+		return nil
+	}
+	return dec.next(int(n))
+}
+
+func (dec *legacy) time() time.Time {
+	var t time.Time
+	raw := dec.bytes()
+	if dec.err == nil {
+		dec.err = t.UnmarshalBinary(raw)
+	}
+	return t
+}
+
+func (dec *legacy) str() string { return string(dec.bytes()) }
+
+func (dec *legacy) locationV0() eco.Location {
+	sub := legacy{data: dec.bytes()}
+	loc := eco.Location{
+		Name: sub.str(),
+		Lat:  sub.f64(),
+		Lng:  sub.f64(),
+	}
+	if dec.err == nil {
+		dec.err = sub.err
+	}
+	return loc
+}
+
+// unmarshalMissionV0 decodes a mission stored with the v0 layout.
+func unmarshalMissionV0(raw []byte) (eco.Mission, error) {
+	dec := legacy{data: raw}
+	m := eco.Mission{
+		ID:    int32(dec.u32()),
+		Date:  dec.time(),
+		Start: dec.locationV0(),
+		Dest:  dec.locationV0(),
+		Dist:  dec.f64(),
+		Trans: eco.TransID(dec.u8()),
+	}
+	return m, dec.err
+}
+
+func (dec *legacy) locationV1() eco.Location {
+	sub := legacy{data: dec.bytes()}
+	loc := eco.Location{
+		Name: sub.str(),
+		Lat:  sub.f64(),
+		Lng:  sub.f64(),
+	}
+	addr := legacy{data: sub.bytes()}
+	loc.Addr = eco.Address{
+		City:        addr.str(),
+		State:       addr.str(),
+		Country:     addr.str(),
+		CountryCode: addr.str(),
+	}
+	for _, err := range []error{sub.err, addr.err} {
+		if dec.err == nil {
+			dec.err = err
+		}
+	}
+	return loc
+}
+
+// unmarshalMissionV1 decodes a mission stored with the v1 layout.
+func unmarshalMissionV1(raw []byte) (eco.Mission, error) {
+	dec := legacy{data: raw}
+	m := eco.Mission{
+		ID:    int32(dec.u32()),
+		Date:  dec.time(),
+		Start: dec.locationV0(),
+		Dest:  dec.locationV0(),
+		Dist:  dec.f64(),
+		Trans: eco.TransID(dec.u8()),
+		Group: dec.str(),
+	}
+	return m, dec.err
+}
+
+// unmarshalMissionV2 decodes a mission stored with the v2 layout.
+func unmarshalMissionV2(raw []byte) (eco.Mission, error) {
+	dec := legacy{data: raw}
+	m := eco.Mission{
+		ID:    int32(dec.u32()),
+		Date:  dec.time(),
+		Start: dec.locationV1(),
+		Dest:  dec.locationV1(),
+		Dist:  dec.f64(),
+		Trans: eco.TransID(dec.u8()),
+		Group: dec.str(),
+	}
+	return m, dec.err
+}
+
+// unmarshalMissionV3 decodes a mission stored with the v3 layout.
+func unmarshalMissionV3(raw []byte) (eco.Mission, error) {
+	dec := legacy{data: raw}
+	m := eco.Mission{
+		ID:      int32(dec.u32()),
+		Date:    dec.time(),
+		Inbound: dec.time(),
+		Start:   dec.locationV1(),
+		Dest:    dec.locationV1(),
+		Dist:    dec.f64(),
+		Trans:   eco.TransID(dec.u8()),
+		Group:   dec.str(),
+	}
+	return m, dec.err
+}
+
+// unmarshalMissionV4 decodes a mission stored with the v4 layout.
+func unmarshalMissionV4(raw []byte) (eco.Mission, error) {
+	dec := legacy{data: raw}
+	m := eco.Mission{
+		ID:      int32(dec.u32()),
+		Date:    dec.time(),
+		Inbound: dec.time(),
+		Start:   dec.locationV1(),
+		Dest:    dec.locationV1(),
+		Dist:    dec.f64(),
+		Trans:   eco.TransID(dec.u8()),
+		Group:   dec.str(),
+	}
+	n := dec.u64()
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		var leg eco.Leg
+		raw := dec.bytes()
+		if dec.err == nil {
+			dec.err = leg.UnmarshalBinary(raw)
+		}
+		m.Legs = append(m.Legs, leg)
+	}
+	return m, dec.err
+}
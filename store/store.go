@@ -0,0 +1,208 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package store stores missions in an eco db, the bbolt database served
+// by eco-srv.
+//
+// All the writers of an eco db go through this package, so the missions,
+// their aggregates, corrections, lifecycle and audit trail are updated
+// consistently, in the transaction of each write.
+package store // import "github.com/sbinet-lpc/eco/store"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"go.etcd.io/bbolt"
+)
+
+// Buckets of an eco db.
+var (
+	BucketUpdate      = []byte("last-update") // time of the last update and versions of the db
+	BucketEco         = []byte("eco")         // missions, keyed by mission ID
+	BucketOSM         = []byte("osm")
+	BucketAudit       = []byte("audit")
+	BucketCorrections = []byte("corrections")
+)
+
+// ErrNoMission is returned when a mission is not stored.
+var ErrNoMission = errors.New("store: no such mission")
+
+// Setup creates the buckets of an eco db, migrates its missions to the
+// current binary layout and rebuilds its aggregates if needed.
+func Setup(tx *bbolt.Tx) error {
+	for _, name := range [][]byte{
+		BucketUpdate,
+		BucketEco,
+		BucketOSM,
+		BucketAudit,
+		BucketCorrections,
+		BucketLifecycle,
+	} {
+		bkt, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return fmt.Errorf("could not create %q bucket: %w", name, err)
+		}
+		if bkt == nil {
+			return fmt.Errorf("could not create %q bucket", name)
+		}
+	}
+
+	err := Migrate(tx)
+	if err != nil {
+		return err
+	}
+
+	if Stale(tx) {
+		err := RebuildAggregates(tx)
+		if err != nil {
+			return fmt.Errorf("could not build aggregates: %w", err)
+		}
+	}
+	return nil
+}
+
+// MissionKey returns the key of a mission in the buckets keyed by mission ID.
+func MissionKey(id int32) []byte {
+	key := make([]byte, 4)
+	binary.LittleEndian.PutUint32(key, uint32(id))
+	return key
+}
+
+func LoadMission(tx *bbolt.Tx, id int32) (eco.Mission, error) {
+	var m eco.Mission
+	bkt := tx.Bucket(BucketEco)
+	if bkt == nil {
+		return m, fmt.Errorf("could not find %q bucket", BucketEco)
+	}
+	raw := bkt.Get(MissionKey(id))
+	if raw == nil {
+		return m, ErrNoMission
+	}
+	err := m.UnmarshalBinary(raw)
+	if err != nil {
+		return m, fmt.Errorf("could not unmarshal mission %d: %w", id, err)
+	}
+	return m, nil
+}
+
+// SaveMission stores a mission and updates the aggregates accordingly.
+func SaveMission(tx *bbolt.Tx, m eco.Mission) error {
+	err := DeleteMission(tx, m.ID)
+	if err != nil && !errors.Is(err, ErrNoMission) {
+		return err
+	}
+
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("could not marshal mission %v: %w", m, err)
+	}
+	err = tx.Bucket(BucketEco).Put(MissionKey(m.ID), buf)
+	if err != nil {
+		return fmt.Errorf("could not store mission %v: %w", m, err)
+	}
+
+	return aggregate(tx, m, +1)
+}
+
+// DeleteMission removes a mission and updates the aggregates accordingly.
+func DeleteMission(tx *bbolt.Tx, id int32) error {
+	prev, err := LoadMission(tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(BucketEco).Delete(MissionKey(id))
+	if err != nil {
+		return fmt.Errorf("could not delete mission %d: %w", id, err)
+	}
+
+	return aggregate(tx, prev, -1)
+}
+
+// Missions returns all the stored missions, sorted by ID.
+func Missions(tx *bbolt.Tx) ([]eco.Mission, error) {
+	bkt := tx.Bucket(BucketEco)
+	if bkt == nil {
+		return nil, fmt.Errorf("could not find bucket %q", BucketEco)
+	}
+
+	ms := make([]eco.Mission, 0, bkt.Stats().KeyN)
+	err := bkt.ForEach(func(k, v []byte) error {
+		var m eco.Mission
+		err := m.UnmarshalBinary(v)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal mission: %w", err)
+		}
+		ms = append(ms, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].ID < ms[j].ID
+	})
+	return ms, nil
+}
+
+// LastID returns the largest ID of the stored missions.
+func LastID(tx *bbolt.Tx) (int32, error) {
+	bkt := tx.Bucket(BucketEco)
+	if bkt == nil {
+		return 0, fmt.Errorf("could not find %q bucket", BucketEco)
+	}
+	var last int32
+	err := bkt.ForEach(func(k, v []byte) error {
+		id := int32(binary.LittleEndian.Uint32(k))
+		if id > last {
+			last = id
+		}
+		return nil
+	})
+	return last, err
+}
+
+// LastUpdate returns the time of the last update of the eco db, if any.
+func LastUpdate(tx *bbolt.Tx) (time.Time, bool, error) {
+	var last time.Time
+	bkt := tx.Bucket(BucketUpdate)
+	if bkt == nil {
+		return last, false, fmt.Errorf("could not find %q bucket", BucketUpdate)
+	}
+	raw := bkt.Get(BucketUpdate)
+	if raw == nil {
+		return last, false, nil
+	}
+	err := last.UnmarshalBinary(raw)
+	if err != nil {
+		return last, false, fmt.Errorf("could not unmarshal last-update: %w", err)
+	}
+	return last, true, nil
+}
+
+// Touch records the time of the last update of the eco db, in the
+// transaction of the update.
+func Touch(tx *bbolt.Tx, now time.Time) error {
+	bkt := tx.Bucket(BucketUpdate)
+	if bkt == nil {
+		return fmt.Errorf("could not access %q bucket", BucketUpdate)
+	}
+
+	raw, err := now.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("could not marshal last-update: %w", err)
+	}
+
+	err = bkt.Put(BucketUpdate, raw)
+	if err != nil {
+		return fmt.Errorf("could not store last-update: %w", err)
+	}
+	return nil
+}
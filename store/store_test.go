@@ -0,0 +1,401 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sbinet-lpc/eco"
+	"go.etcd.io/bbolt"
+)
+
+func testMissions() []eco.Mission {
+	date := time.Date(2019, 10, 2, 0, 0, 0, 0, time.UTC)
+	return []eco.Mission{
+		{
+			ID: 1, Date: date,
+			Dest:  eco.Location{Name: "Paris, France", Lat: 48.8566101, Lng: 2.3514992},
+			Dist:  692000,
+			Trans: eco.Train,
+		},
+		{
+			ID: 2, Date: date.AddDate(0, 1, 0),
+			Dest:  eco.Location{Name: "Genève, Suisse", Lat: 46.2334715, Lng: 6.0555674},
+			Dist:  470000,
+			Trans: eco.Car,
+		},
+	}
+}
+
+func newTestDB(t *testing.T) *bbolt.DB {
+	t.Helper()
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "eco.db"), 0644, nil)
+	if err != nil {
+		t.Fatalf("could not open eco db: %+v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Update(Setup)
+	if err != nil {
+		t.Fatalf("could not setup eco db: %+v", err)
+	}
+	return db
+}
+
+func TestSetup(t *testing.T) {
+	db := newTestDB(t)
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, m := range testMissions() {
+			err := SaveMission(tx, m)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not store missions: %+v", err)
+	}
+
+	// stale aggregates are rebuilt when the eco db is set up.
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(BucketAggr).Delete(keyLayout)
+	})
+	if err != nil {
+		t.Fatalf("could not reset aggregates layout: %+v", err)
+	}
+	err = db.Update(Setup)
+	if err != nil {
+		t.Fatalf("could not re-setup eco db: %+v", err)
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		if Stale(tx) {
+			return fmt.Errorf("aggregates not rebuilt")
+		}
+		vs, err := TripMissions(tx)
+		if err != nil {
+			return err
+		}
+		if got, want := len(vs), len(testMissions()); got != want {
+			return fmt.Errorf("invalid number of missions: got=%d, want=%d", got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("invalid rebuilt aggregates: %+v", err)
+	}
+}
+
+// marshalLegacy encodes a mission with a legacy layout of the eco bucket.
+func marshalLegacy(t *testing.T, m eco.Mission, version int) []byte {
+	t.Helper()
+
+	var (
+		u64 = func(buf []byte, v uint64) []byte { return binary.LittleEndian.AppendUint64(buf, v) }
+		str = func(buf, v []byte) []byte { return append(u64(buf, uint64(len(v))), v...) }
+		loc = func(buf []byte, loc eco.Location) []byte {
+			sub := str(nil, []byte(loc.Name))
+			sub = u64(sub, math.Float64bits(loc.Lat))
+			sub = u64(sub, math.Float64bits(loc.Lng))
+			if version >= 2 {
+				var addr []byte
+				for _, v := range []string{loc.Addr.City, loc.Addr.State, loc.Addr.Country, loc.Addr.CountryCode} {
+					addr = str(addr, []byte(v))
+				}
+				sub = str(sub, addr)
+			}
+			return str(buf, sub)
+		}
+	)
+
+	date, err := m.Date.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not marshal date: %+v", err)
+	}
+
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(m.ID))
+	buf = str(buf, date)
+	if version >= 3 {
+		inbound, err := m.Inbound.MarshalBinary()
+		if err != nil {
+			t.Fatalf("could not marshal inbound date: %+v", err)
+		}
+		buf = str(buf, inbound)
+	}
+	buf = loc(buf, m.Start)
+	buf = loc(buf, m.Dest)
+	buf = u64(buf, math.Float64bits(m.Dist))
+	buf = append(buf, byte(m.Trans))
+	if version >= 1 {
+		buf = str(buf, []byte(m.Group))
+	}
+	if version >= 4 {
+		buf = u64(buf, uint64(len(m.Legs)))
+		for i := range m.Legs {
+			leg, err := m.Legs[i].MarshalBinary()
+			if err != nil {
+				t.Fatalf("could not marshal leg: %+v", err)
+			}
+			buf = str(buf, leg)
+		}
+	}
+	return buf
+}
+
+func TestMigrate(t *testing.T) {
+	if got, want := len(legacyDecoders), schemaVersion; got != want {
+		t.Fatalf("invalid number of legacy decoders: got=%d, want=%d", got, want)
+	}
+
+	for version := range legacyDecoders {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "eco.db")
+			db, err := bbolt.Open(fname, 0644, nil)
+			if err != nil {
+				t.Fatalf("could not open eco db: %+v", err)
+			}
+
+			want := testMissions()
+			if version >= 1 {
+				want[0].Group = "ATLAS"
+			}
+			if version >= 2 {
+				want[0].Dest.Addr = eco.Address{City: "Paris", Country: "France", CountryCode: "FR"}
+			}
+			if version >= 4 {
+				want[0].Legs = []eco.Leg{{Date: want[0].Date, Dist: 500e3, Trans: eco.Train, Class: "second"}}
+			}
+			err = db.Update(func(tx *bbolt.Tx) error {
+				for _, name := range [][]byte{BucketUpdate, BucketEco} {
+					_, err := tx.CreateBucket(name)
+					if err != nil {
+						return err
+					}
+				}
+				if version > 0 {
+					buf := binary.LittleEndian.AppendUint64(nil, uint64(version))
+					err := tx.Bucket(BucketUpdate).Put(keySchema, buf)
+					if err != nil {
+						return err
+					}
+				}
+				for _, m := range want {
+					err := tx.Bucket(BucketEco).Put(MissionKey(m.ID), marshalLegacy(t, m, version))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("could not create v%d db: %+v", version, err)
+			}
+
+			defer db.Close()
+
+			err = db.Update(Setup)
+			if err != nil {
+				t.Fatalf("could not migrate eco db: %+v", err)
+			}
+
+			var got []eco.Mission
+			err = db.View(func(tx *bbolt.Tx) error {
+				got, err = Missions(tx)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("could not read missions: %+v", err)
+			}
+			for i := range got {
+				if len(got[i].Legs) == 0 {
+					got[i].Legs = nil
+				}
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("invalid migrated missions:\ngot= %v\nwant=%v", got, want)
+			}
+
+			err = db.Update(Setup)
+			if err != nil {
+				t.Fatalf("could not re-open eco db: %+v", err)
+			}
+		})
+	}
+}
+
+func TestSummaryAsOf(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		ms     = testMissions()
+		legacy = eco.Mission{
+			ID: 10, Date: time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC),
+			Dest:  eco.Location{Name: "Paris, France", Lat: 48.8566101, Lng: 2.3514992},
+			Dist:  692000,
+			Trans: eco.Train,
+		}
+		m2 = ms[1]
+		m3 = eco.Mission{
+			ID: 3, Date: time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC),
+			Dest:  eco.Location{Name: "Genève, Suisse", Lat: 46.2334715, Lng: 6.0555674},
+			Dist:  470000,
+			Trans: eco.Train,
+		}
+		m1 = ms[0]
+	)
+	m2.Dist *= 2
+	m1.Trans = eco.Car
+
+	type step struct {
+		date time.Time
+		f    func(tx *bbolt.Tx, now time.Time) error
+	}
+	revise := func(revs ...eco.Revision) func(tx *bbolt.Tx, now time.Time) error {
+		return func(tx *bbolt.Tx, now time.Time) error {
+			_, rejs, err := Apply(tx, revs, "eco-ingest", now)
+			if err != nil {
+				return err
+			}
+			if len(rejs) != 0 {
+				return fmt.Errorf("rejected revisions: %+v", rejs)
+			}
+			return Touch(tx, now)
+		}
+	}
+	steps := []step{
+		{
+			// mission stored before lifecycles were recorded.
+			date: time.Date(2019, 8, 15, 0, 0, 0, 0, time.UTC),
+			f: func(tx *bbolt.Tx, now time.Time) error {
+				return SaveMission(tx, legacy)
+			},
+		},
+		{
+			date: time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC),
+			f: revise(
+				eco.Revision{ID: 1, Status: eco.Registered, Mission: &ms[0]},
+				eco.Revision{ID: 2, Status: eco.Registered, Mission: &ms[1]},
+			),
+		},
+		{
+			date: time.Date(2019, 10, 15, 0, 0, 0, 0, time.UTC),
+			f: revise(
+				eco.Revision{ID: 2, Status: eco.Modified, Mission: &m2},
+				eco.Revision{ID: 3, Status: eco.Registered, Mission: &m3},
+			),
+		},
+		{
+			date: time.Date(2019, 10, 20, 0, 0, 0, 0, time.UTC),
+			f:    revise(eco.Revision{ID: 2, Status: eco.Cancelled}),
+		},
+		{
+			// manual correction of an executed mission.
+			date: time.Date(2019, 11, 10, 0, 0, 0, 0, time.UTC),
+			f: func(tx *bbolt.Tx, now time.Time) error {
+				err := SaveCorrection(tx, 1, Correction{Patch: map[string]interface{}{"transport_id": eco.Car}})
+				if err != nil {
+					return err
+				}
+				err = SaveMission(tx, m1)
+				if err != nil {
+					return err
+				}
+				return AddAudit(tx, Audit{
+					ID: 1, Action: "patch", User: "admin", Date: now,
+					Prev: &ms[0], Next: &m1,
+				})
+			},
+		},
+		{
+			date: time.Date(2019, 11, 20, 0, 0, 0, 0, time.UTC),
+			f:    revise(eco.Revision{ID: 2, Status: eco.Registered, Mission: &ms[1]}),
+		},
+		{
+			date: time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC),
+			f: revise(
+				eco.Revision{ID: 3, Status: eco.Rejected},
+				eco.Revision{ID: 10, Status: eco.Cancelled},
+			),
+		},
+	}
+
+	// summaries built from the data as it stood at each step.
+	want := make([]*eco.Summary, len(steps))
+	for i, s := range steps {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			err := s.f(tx, s.date)
+			if err != nil {
+				return err
+			}
+			want[i], err = Summary(tx, s.date)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("could not apply step %d: %+v", i, err)
+		}
+	}
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		for i, s := range steps {
+			past, err := changed(tx, s.date)
+			if err != nil {
+				return err
+			}
+			if got, want := past, i < len(steps)-1; got != want {
+				return fmt.Errorf("step %d: invalid changed: got=%v, want=%v", i, got, want)
+			}
+			got, err := Summary(tx, s.date)
+			if err != nil {
+				return err
+			}
+			if !sameSummary(got, want[i]) {
+				return fmt.Errorf("step %d: invalid summary as of %v:\ngot= %+v\nwant=%+v", i, s.date, *got, *want[i])
+			}
+		}
+
+		summ, err := Summary(tx, time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			return err
+		}
+		if got, want := summ.All.N+summ.Avoided.N, 0; got != want {
+			return fmt.Errorf("invalid number of missions before registration: got=%d, want=%d", got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+// sameSummary compares two summaries, up to the rounding errors of the
+// place tallies accumulated by the aggregates.
+func sameSummary(a, b *eco.Summary) bool {
+	tallies := func(a, b map[string]eco.Tally) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for k, ta := range a {
+			tb, ok := b[k]
+			if !ok || ta.N != tb.N || math.Abs(ta.Dist-tb.Dist) > 1e-6 || math.Abs(ta.CO2e-tb.CO2e) > 1e-6 {
+				return false
+			}
+		}
+		return true
+	}
+	if !tallies(a.Cities, b.Cities) || !tallies(a.Countries, b.Countries) || !tallies(a.Continents, b.Continents) {
+		return false
+	}
+	aa, bb := *a, *b
+	aa.Cities, aa.Countries, aa.Continents = nil, nil, nil
+	bb.Cities, bb.Countries, bb.Continents = nil, nil, nil
+	return reflect.DeepEqual(aa, bb)
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eco // import "github.com/sbinet-lpc/eco"
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// DistUncertainty is the relative half-width of the 95% confidence
+// interval of the estimated distance of missions.
+//
+// Distances are estimated from the start and destination of missions,
+// not from the actual itineraries: the resulting bias is the same for
+// all the missions of a transportation mode.
+var DistUncertainty = 0.1
+
+// z95 is the quantile of the normal distribution for a 95% two-sided
+// confidence interval.
+const z95 = 1.959963984540054
+
+// Estimate is an estimated quantity with its uncertainty.
+type Estimate struct {
+	Value float64 `json:"value"` // central value
+	Err   float64 `json:"err"`   // standard uncertainty
+	Low   float64 `json:"low"`   // lower edge of the 95% confidence interval
+	High  float64 `json:"high"`  // upper edge of the 95% confidence interval
+}
+
+// Emissions are estimated CO2e emissions, in kgCO2e.
+type Emissions struct {
+	Modes map[TransID]Estimate `json:"modes"`
+	Total Estimate             `json:"total"`
+}
+
+// relErrs returns the relative standard uncertainties of the emission
+// factor and of the distance of a transportation mode.
+func relErrs(tid TransID) (fact, dist float64) {
+	return Factors[tid].Uncertainty / z95, DistUncertainty / z95
+}
+
+// EmissionsOf returns the CO2e emissions of the provided distances (in
+// meters) per transportation mode, with their uncertainties propagated
+// analytically.
+//
+// The uncertainties of the emission factor and of the distance of a mode
+// are independent, and fully correlated among the missions of that mode.
+// The uncertainties of different modes are independent.
+// Confidence intervals are normal intervals, truncated at zero.
+func EmissionsOf(dists map[TransID]float64) Emissions {
+	o := Emissions{Modes: make(map[TransID]Estimate, len(dists))}
+	v2 := 0.0
+	for tid, dist := range dists {
+		var (
+			v      = CostOf(tid, dist)
+			rf, rd = relErrs(tid)
+			err    = v * math.Sqrt(rf*rf+rd*rd)
+		)
+		o.Modes[tid] = newEstimate(v, err)
+		o.Total.Value += v
+		v2 += err * err
+	}
+	o.Total = newEstimate(o.Total.Value, math.Sqrt(v2))
+	return o
+}
+
+func newEstimate(v, err float64) Estimate {
+	return Estimate{
+		Value: v,
+		Err:   err,
+		Low:   math.Max(0, v-z95*err),
+		High:  v + z95*err,
+	}
+}
+
+// SimulateEmissions returns the CO2e emissions of the provided distances
+// (in meters) per transportation mode, with their uncertainties propagated
+// with n Monte Carlo samples drawn from rnd.
+//
+// The emission factor and distance of each mode are drawn from log-normal
+// distributions, with the same correlations as EmissionsOf.
+// Confidence intervals are the 2.5% and 97.5% quantiles of the samples.
+func SimulateEmissions(dists map[TransID]float64, n int, rnd *rand.Rand) Emissions {
+	o := Emissions{Modes: make(map[TransID]Estimate, len(dists))}
+	if n <= 0 {
+		n = 1
+	}
+
+	tids := make([]TransID, 0, len(dists))
+	for tid := range dists {
+		tids = append(tids, tid)
+	}
+	sort.Slice(tids, func(i, j int) bool { return tids[i] < tids[j] })
+
+	var (
+		total   = make([]float64, n)
+		samples = make([]float64, n)
+	)
+	for _, tid := range tids {
+		var (
+			v      = CostOf(tid, dists[tid])
+			rf, rd = relErrs(tid)
+		)
+		for i := range samples {
+			samples[i] = v * lognormal(rnd, rf) * lognormal(rnd, rd)
+			total[i] += samples[i]
+		}
+		o.Modes[tid] = quantiles(v, samples)
+		o.Total.Value += v
+	}
+	o.Total = quantiles(o.Total.Value, total)
+	return o
+}
+
+// lognormal returns a sample of the log-normal distribution with mean 1
+// and standard deviation rel.
+func lognormal(rnd *rand.Rand, rel float64) float64 {
+	if rel <= 0 {
+		return 1
+	}
+	s2 := math.Log1p(rel * rel)
+	return math.Exp(rnd.NormFloat64()*math.Sqrt(s2) - s2/2)
+}
+
+// quantiles returns the estimate of a quantity with central value v from
+// its samples.
+// quantiles sorts the samples in place.
+func quantiles(v float64, samples []float64) Estimate {
+	sort.Float64s(samples)
+	var (
+		n    = len(samples)
+		mean = 0.0
+		std  = 0.0
+	)
+	for _, x := range samples {
+		mean += x
+	}
+	mean /= float64(n)
+	for _, x := range samples {
+		std += (x - mean) * (x - mean)
+	}
+	if n > 1 {
+		std = math.Sqrt(std / float64(n-1))
+	}
+	return Estimate{
+		Value: v,
+		Err:   std,
+		Low:   samples[int(0.025*float64(n-1)+0.5)],
+		High:  samples[int(0.975*float64(n-1)+0.5)],
+	}
+}
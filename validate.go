@@ -0,0 +1,118 @@
+// Copyright 2019 The lpc-eco Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eco // import "github.com/sbinet-lpc/eco"
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Range of the years of valid mission dates.
+const (
+	minYear = 1970
+	maxYear = 2100
+)
+
+// FieldError is an invalid field of a mission.
+type FieldError struct {
+	Field  string `json:"field"` // JSON path of the field (e.g. "dest.lat", "legs[1].dist")
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s=%s: %s", e.Field, e.Value, e.Reason)
+}
+
+// ValidationError lists the invalid fields of a mission.
+type ValidationError struct {
+	ID     int32        `json:"id"`
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		fields[i] = f.Error()
+	}
+	return fmt.Sprintf("eco: invalid mission %d: %s", e.ID, strings.Join(fields, ", "))
+}
+
+// Validate checks the fields of the mission, and returns a
+// *ValidationError listing the invalid ones, if any.
+//
+// A valid mission has a positive ID, an outbound date within [1970, 2100],
+// finite and non-negative distances, known transport modes and locations
+// with valid coordinates.
+// Unknown (zero) inbound dates and dates of legs are valid.
+func (m Mission) Validate() error {
+	var v validator
+	if m.ID <= 0 {
+		v.add("id", m.ID, "not a positive ID")
+	}
+	v.date("date", m.Date, false)
+	v.date("inbound", m.Inbound, true)
+	v.location("start", m.Start)
+	v.location("dest", m.Dest)
+	v.dist("dist", m.Dist)
+	v.trans("transport_id", m.Trans)
+	for i, leg := range m.Legs {
+		name := fmt.Sprintf("legs[%d]", i)
+		v.date(name+".date", leg.Date, true)
+		v.location(name+".start", leg.Start)
+		v.location(name+".dest", leg.Dest)
+		v.dist(name+".dist", leg.Dist)
+		v.trans(name+".transport_id", leg.Trans)
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &ValidationError{ID: m.ID, Fields: v.errs}
+}
+
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) add(field string, value interface{}, reason string) {
+	v.errs = append(v.errs, FieldError{
+		Field:  field,
+		Value:  fmt.Sprintf("%v", value),
+		Reason: reason,
+	})
+}
+
+func (v *validator) date(field string, t time.Time, optional bool) {
+	if optional && t.IsZero() {
+		return
+	}
+	if y := t.Year(); y < minYear || y > maxYear {
+		v.add(field, t.Format(time.RFC3339), fmt.Sprintf("year not within [%d, %d]", minYear, maxYear))
+	}
+}
+
+func (v *validator) location(field string, loc Location) {
+	if math.IsNaN(loc.Lat) || loc.Lat < -90 || loc.Lat > +90 {
+		v.add(field+".lat", loc.Lat, "latitude not within [-90, 90]")
+	}
+	if math.IsNaN(loc.Lng) || loc.Lng < -180 || loc.Lng > +180 {
+		v.add(field+".lng", loc.Lng, "longitude not within [-180, 180]")
+	}
+}
+
+func (v *validator) dist(field string, dist float64) {
+	if math.IsNaN(dist) || math.IsInf(dist, 0) || dist < 0 {
+		v.add(field, dist, "not a finite non-negative distance")
+	}
+}
+
+func (v *validator) trans(field string, tid TransID) {
+	if tid == Unknown || tid > Plane {
+		v.add(field, int(tid), "unknown transport ID")
+	}
+}